@@ -1,193 +1,238 @@
-package main
+// Package client is a TFTP client, for programs that fetch files from or
+// send files to a TFTP server without shelling out to the tftp command.
+package client
 
 import (
-	"bufio"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"os"
-	"strings"
+	"strconv"
+	"time"
 
 	"github.com/ryanslade/tftp/common"
 )
 
-const (
-	expectedArgFormat = "client put|get host:port filename"
-)
-
-type mode string
-
-const (
-	modeGet mode = "get"
-	modePut mode = "put"
-)
-
-type clientState struct {
-	mode     mode
-	filename string
-	address  string
+// A Client transfers files with the TFTP server at Addr. Other than Addr
+// its zero value is ready to use, talking to the server directly and
+// waiting on it for as long as ctx allows.
+type Client struct {
+	// Addr is the server's host:port.
+	Addr string
+	// Transport opens the socket of each transfer. If nil datagrams are
+	// sent directly, see ParseRelay for tunnelling them instead.
+	Transport Transport
+	// Tracer, if set, records every packet sent and received.
+	Tracer *common.Tracer
+	// Timeout, if non-zero, is how long to wait for the server to be
+	// heard from, resends included, before giving up on it.
+	Timeout time.Duration
+	// Retransmission is how a packet is resent while the server's reply is
+	// overdue, DefaultRetransmission if its Timeout is zero. A negative
+	// Timeout turns resending off.
+	Retransmission common.Retransmission
 }
 
-// TODO: Maybe default to port 69?
-func parseArgs(args []string) (clientState, error) {
-	state := clientState{}
-	if len(args) != 4 {
-		return clientState{}, fmt.Errorf("Too few arguments")
-	}
-	switch mode(strings.ToLower(args[1])) {
-	case modeGet:
-		state.mode = modeGet
-	case modePut:
-		state.mode = modePut
-	default:
-		return clientState{}, fmt.Errorf("Unknown mode")
-	}
-
-	host, port, err := net.SplitHostPort(args[2])
+// DefaultRetransmission resends a packet after a second without a reply, up
+// to five times.
+var DefaultRetransmission = common.Retransmission{Timeout: time.Second, Retries: 5}
+
+// Get downloads the file remote from the server, writing it to w. If w has
+// a Flush method it is flushed before the last block is acknowledged. An
+// ERROR from the server, such as File not found, is returned as a
+// *common.Error. Once ctx is done the transfer is abandoned, returning its
+// cause.
+func (c *Client) Get(ctx context.Context, remote string, w io.Writer) (common.TransferStats, error) {
+	conn, serverAddr, closeConn, err := c.open(ctx)
 	if err != nil {
-		return clientState{}, fmt.Errorf("Error parsing host or port: %v", err)
+		return common.TransferStats{}, err
 	}
-	if host == "" {
-		return clientState{}, fmt.Errorf("Host can't be blank")
-	}
-	if port == "" {
-		return clientState{}, fmt.Errorf("Port can't be blank")
-	}
-	state.address = args[2]
-	state.filename = args[3]
-
-	return state, nil
-}
+	defer closeConn()
 
-func getAddrAndConn(address string) (net.Addr, net.PacketConn, error) {
-	// Create conn and remoteAddr
-	serverAddr, err := net.ResolveUDPAddr("udp", address)
-	if err != nil {
-		return nil, nil, fmt.Errorf("Error resolving address: %v", err)
+	rrq := common.RequestPacket{
+		OpCode:   common.OpRRQ,
+		Filename: remote,
+		Mode:     common.ModeOctet,
 	}
-
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: 0,
-	})
-	if err != nil {
-		return nil, nil, fmt.Errorf("Error setting up connection: %v", err)
+	request := rrq.ToBytes()
+	if _, err := conn.WriteTo(request, serverAddr); err != nil {
+		return common.TransferStats{}, fmt.Errorf("Error sending RRQ packet: %v", err)
 	}
 
-	return serverAddr, conn, nil
+	// The loop latches onto the port the first block comes from, the
+	// server's transfer ID, rather than serverAddr's well-known port
+	opts := common.LoopOptions{Context: ctx, Retransmission: c.retransmission(), Request: request}
+	stats, err := common.WriteFileLoopOptions(w, conn, serverAddr, opts)
+	return stats, transferError(ctx, err)
 }
 
-// handle reading a local file and sending it to the server
-func handlePut(filename, address string) error {
-	f, err := os.Open(filename)
-	if err != nil {
-		return fmt.Errorf("Error opening file: %v", err)
-	}
-	defer f.Close()
-
-	br := bufio.NewReader(f)
-
-	serverAddr, conn, err := getAddrAndConn(address)
+// Put uploads the content of r to the server as remote. size, unless it is
+// negative, is sent as the tsize option (RFC 2349) so the server can refuse
+// an upload it has no room for before any of it is sent. An ERROR from the
+// server is returned as a *common.Error. Once ctx is done the transfer is
+// abandoned, returning its cause.
+func (c *Client) Put(ctx context.Context, remote string, r io.Reader, size int64) (common.TransferStats, error) {
+	conn, serverAddr, closeConn, err := c.open(ctx)
 	if err != nil {
-		return err
+		return common.TransferStats{}, err
 	}
-	defer conn.Close()
+	defer closeConn()
 
-	// Send WRQ packet
 	wrq := common.RequestPacket{
 		OpCode:   common.OpWRQ,
-		Filename: filename,
-		Mode:     "octet",
+		Filename: remote,
+		Mode:     common.ModeOctet,
 	}
-
-	_, err = conn.WriteTo(wrq.ToBytes(), serverAddr)
-	if err != nil {
-		return fmt.Errorf("Error sending WRQ packet: %v", err)
+	if size >= 0 {
+		wrq.Options = map[string]string{"tsize": strconv.FormatInt(size, 10)}
+	}
+	request := wrq.ToBytes()
+	if _, err := conn.WriteTo(request, serverAddr); err != nil {
+		return common.TransferStats{}, fmt.Errorf("Error sending WRQ packet: %v", err)
 	}
 
-	// Get the ACK
-	ackBuf := make([]byte, 4)
-	_, remoteAddr, err := conn.ReadFrom(ackBuf)
+	// Get the ACK, or the OACK of a server that understood tsize
+	rt := c.retransmission()
+	ackBuf := make([]byte, common.MaxPacketSize)
+	n, remoteAddr, resent, err := readReply(conn, serverAddr, request, rt, ackBuf)
 	if err != nil {
-		return fmt.Errorf("Error reading ACK packet: %v", err)
+		return common.TransferStats{}, transferError(ctx, fmt.Errorf("Error reading ACK packet: %v", err))
 	}
-	_, err = common.ParseAckPacket(ackBuf)
-	if err != nil {
-		return fmt.Errorf("Error parsing ACK packet: %v", err)
+	if op, err := common.GetOpCode(ackBuf[:n]); err == nil && op == common.OpERROR {
+		peerErr, err := common.ParseErrorPacket(ackBuf[:n])
+		if err != nil {
+			return common.TransferStats{}, err
+		}
+		return common.TransferStats{}, peerErr
+	}
+	if _, err := common.ParseOACKPacket(ackBuf[:n]); err != nil {
+		if _, err := common.ParseAckPacket(ackBuf[:n]); err != nil {
+			return common.TransferStats{}, fmt.Errorf("Error parsing ACK packet: %v: %s", err, common.DumpPacket(ackBuf[:n]))
+		}
 	}
 
-	common.ReadFileLoop(br, conn, remoteAddr, common.BlockSize)
-
-	return nil
+	stats, err := common.ReadFileLoopOptions(r, conn, remoteAddr, common.BlockSize, common.LoopOptions{Context: ctx, Retransmission: rt})
+	stats.Retransmits += resent
+	return stats, transferError(ctx, err)
 }
 
-func handleGet(filename string, address string) error {
-	serverAddr, conn, err := getAddrAndConn(address)
-	if err != nil {
-		return err
+// readReply reads the server's answer to request, sent to serverAddr,
+// resending it according to rt while the answer is overdue and reporting how
+// many times it did. The server answers from a new port, its transfer ID,
+// which the rest of the transfer sticks to, so only the host has to match.
+// Packets from other hosts are refused with ERROR 5.
+func readReply(conn net.PacketConn, serverAddr net.Addr, request []byte, rt common.Retransmission, b []byte) (n int, from net.Addr, resent int, err error) {
+	wait := rt.Timeout
+	for {
+		if rt.Timeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(wait))
+		}
+		n, from, err = conn.ReadFrom(b)
+		if err != nil && rt.Timeout > 0 && errors.Is(err, os.ErrDeadlineExceeded) && resent < rt.Retries {
+			if _, err := conn.WriteTo(request, serverAddr); err != nil {
+				return 0, nil, resent, fmt.Errorf("Error retransmitting: %v", err)
+			}
+			resent++
+			if wait < rt.MaxTimeout {
+				wait = min(2*wait, rt.MaxTimeout)
+			}
+			continue
+		}
+		if err != nil {
+			return 0, nil, resent, err
+		}
+		if common.HostOf(from) == common.HostOf(serverAddr) {
+			return n, from, resent, nil
+		}
+		common.SendError(common.ErrUnknownTransferID, "Unknown transfer ID", conn, from)
 	}
-	defer conn.Close()
+}
 
-	rrq := common.RequestPacket{
-		OpCode:   common.OpRRQ,
-		Filename: filename,
-		Mode:     "octet",
+// retransmission returns how the client resends packets.
+func (c *Client) retransmission() common.Retransmission {
+	switch {
+	case c.Retransmission.Timeout == 0:
+		return DefaultRetransmission
+	case c.Retransmission.Timeout < 0:
+		return common.Retransmission{}
 	}
+	return c.Retransmission
+}
 
-	_, err = conn.WriteTo(rrq.ToBytes(), serverAddr)
+// open resolves the server's address and opens the socket for a transfer,
+// returning a function closing it. The socket is closed early once ctx is
+// done, so that a read waiting on the server gives up.
+func (c *Client) open(ctx context.Context) (net.PacketConn, net.Addr, func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, nil, context.Cause(ctx)
+	}
+	serverAddr, err := net.ResolveUDPAddr("udp", c.Addr)
 	if err != nil {
-		return fmt.Errorf("Error sending RRQ packet: %v", err)
+		return nil, nil, nil, fmt.Errorf("Error resolving address: %v", err)
 	}
 
-	f, err := os.Create(filename)
+	t := c.Transport
+	if t == nil {
+		t = directTransport{}
+	}
+	if c.Tracer != nil {
+		t = tracedTransport(t, c.Tracer)
+	}
+	conn, err := t.ListenPacket()
 	if err != nil {
-		return fmt.Errorf("Error creating file: %v", err)
+		return nil, nil, nil, fmt.Errorf("Error setting up connection: %v", err)
+	}
+	if c.Timeout > 0 {
+		conn = &deadlineConn{PacketConn: conn, timeout: c.Timeout, heard: time.Now()}
 	}
-	defer f.Close()
-
-	bw := bufio.NewWriter(f)
-	defer bw.Flush()
-
-	var n int
-	tid := uint16(1)
-	packet := make([]byte, common.MaxPacketSize)
-	for {
-		// Always use the serverAddr returned as it changes after the first packet.
-		n, serverAddr, err = common.WriteFile(bw, conn, serverAddr, packet, tid)
-		if err != nil {
-			return err
-		}
 
-		if n < 4+common.BlockSize {
-			break
-		}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return conn, serverAddr, func() {
+		stop()
+		conn.Close()
+	}, nil
+}
 
-		tid++
+// transferError returns why a transfer failed with err, which is ctx's
+// cause if it ended the transfer.
+func transferError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return context.Cause(ctx)
 	}
-
-	return nil
+	return err
 }
 
-func handleState(s clientState) {
-	switch s.mode {
-	case modePut:
-		if err := handlePut(s.filename, s.address); err != nil {
-			log.Printf("Error performing put: %v", err)
-		}
+// deadlineConn fails reads once the server hasn't been heard from for
+// timeout, letting the client give up on a dead server. Earlier deadlines,
+// set to resend a packet, still apply.
+type deadlineConn struct {
+	net.PacketConn
+	timeout time.Duration
+	// heard is when the last packet arrived, or the conn was opened.
+	heard    time.Time
+	deadline time.Time
+}
 
-	case modeGet:
-		if err := handleGet(s.filename, s.address); err != nil {
-			log.Printf("Error performing get: %v", err)
-		}
-	}
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return nil
 }
 
-func main() {
-	state, err := parseArgs(os.Args)
-	if err != nil {
-		fmt.Println(err)
-		fmt.Println("Expected", expectedArgFormat)
-		return
-	}
-	handleState(state)
+func (c *deadlineConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	giveUp := c.heard.Add(c.timeout)
+	deadline := giveUp
+	if !c.deadline.IsZero() && c.deadline.Before(giveUp) {
+		deadline = c.deadline
+	}
+	c.PacketConn.SetReadDeadline(deadline)
+	n, from, err := c.PacketConn.ReadFrom(b)
+	if err == nil {
+		c.heard = time.Now()
+	} else if errors.Is(err, os.ErrDeadlineExceeded) && !time.Now().Before(giveUp) {
+		// Not a deadline error, which would be taken as time to resend
+		return 0, nil, fmt.Errorf("No reply from the server for %v", c.timeout)
+	}
+	return n, from, err
 }
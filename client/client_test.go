@@ -1,107 +1,307 @@
-package main
+package client
 
 import (
-	"reflect"
-	"strings"
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+	"github.com/ryanslade/tftp/server"
 )
 
-func TestParseArgs(t *testing.T) {
+// startServer serves root on a loopback port, returning its address.
+func startServer(t *testing.T, root string) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server.Server{Root: root, Logger: slog.New(slog.DiscardHandler)}
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+	return conn.LocalAddr().String()
+}
+
+func TestClientPutGet(t *testing.T) {
+	root := t.TempDir()
+	c := &Client{Addr: startServer(t, root), Timeout: 2 * time.Second}
+	ctx := context.Background()
+
 	testCases := []struct {
-		args        string
-		shouldError bool
-		expected    clientState
+		name string
+		size int
+		// tsize is sent if true
+		known bool
+	}{
+		{name: "empty", size: 0, known: true},
+		{name: "block", size: 512, known: true},
+		{name: "kernel", size: 5000, known: true},
+		{name: "streamed", size: 1500},
+	}
+
+	for i, tc := range testCases {
+		content := bytes.Repeat([]byte{byte(i + 1)}, tc.size)
+		size := int64(-1)
+		if tc.known {
+			size = int64(tc.size)
+		}
+		if _, err := c.Put(ctx, tc.name, bytes.NewReader(content), size); err != nil {
+			t.Errorf("Error putting %s: %v (%d)", tc.name, err, i)
+			continue
+		}
+
+		// The server may still be closing the file
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			got, err := os.ReadFile(filepath.Join(root, tc.name))
+			if err == nil && bytes.Equal(got, content) || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		var buf bytes.Buffer
+		stats, err := c.Get(ctx, tc.name, &buf)
+		if err != nil {
+			t.Errorf("Error getting %s: %v (%d)", tc.name, err, i)
+			continue
+		}
+		if !bytes.Equal(buf.Bytes(), content) || stats.Bytes != int64(tc.size) {
+			t.Errorf("Expected %d bytes back, got %d, %v (%d)", tc.size, buf.Len(), stats, i)
+		}
+	}
+}
+
+func TestClientServerError(t *testing.T) {
+	c := &Client{Addr: startServer(t, t.TempDir()), Timeout: 2 * time.Second}
+	ctx := context.Background()
+
+	testCases := []struct {
+		transfer func() error
+		code     common.ErrorCode
 	}{
-		// Valid put
-		{
-			args:        "client put blah:1234 somefile.txt",
-			shouldError: false,
-			expected: clientState{
-				mode:     modePut,
-				filename: "somefile.txt",
-				address:  "blah:1234",
-			},
-		},
-		{
-			args:        "client PUT blah:1234 somefile.txt",
-			shouldError: false,
-			expected: clientState{
-				mode:     modePut,
-				filename: "somefile.txt",
-				address:  "blah:1234",
-			},
-		},
-		// Valid get
 		{
-			args:        "client get blah:1234 somefile.txt",
-			shouldError: false,
-			expected: clientState{
-				mode:     modeGet,
-				filename: "somefile.txt",
-				address:  "blah:1234",
+			transfer: func() error {
+				_, err := c.Get(ctx, "missing", &bytes.Buffer{})
+				return err
 			},
+			code: common.ErrFileNotFound,
 		},
 		{
-			args:        "client GET blah:1234 somefile.txt",
-			shouldError: false,
-			expected: clientState{
-				mode:     modeGet,
-				filename: "somefile.txt",
-				address:  "blah:1234",
+			transfer: func() error {
+				_, err := c.Put(ctx, "../outside", bytes.NewReader(nil), 0)
+				return err
 			},
-		},
-		// Not enough args
-		{
-			args:        "client get blah:1234",
-			shouldError: true,
-			expected:    clientState{},
-		},
-		// Unknown command
-		{
-			args:        "client abc blah:1234 somefile.txt",
-			shouldError: true,
-			expected:    clientState{},
-		},
-		// Invalid host/port
-		{
-			args:        "client put blah::1234 somefile.txt",
-			shouldError: true,
-			expected:    clientState{},
-		},
-		{
-			args:        "client put :1234 somefile.txt",
-			shouldError: true,
-			expected:    clientState{},
-		},
-		{
-			args:        "client put blah: somefile.txt",
-			shouldError: true,
-			expected:    clientState{},
-		},
-		{
-			args:        "client put blah somefile.txt",
-			shouldError: true,
-			expected:    clientState{},
+			code: common.ErrAccessViolation,
 		},
 	}
 
 	for i, tc := range testCases {
-		args := strings.Fields(tc.args)
-		cs, err := parseArgs(args)
-		if tc.shouldError && err == nil {
-			t.Errorf("Expected an error, didn't get one (%d)", i)
-			continue
+		err := tc.transfer()
+		var peerErr *common.Error
+		if !errors.As(err, &peerErr) || peerErr.Code != tc.code {
+			t.Errorf("Expected ERROR %d from the server, got %v (%d)", tc.code, err, i)
 		}
-		if !tc.shouldError && err != nil {
-			t.Errorf("Didn't expect an error: %v (%d)", err, i)
-			continue
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	// A server that never answers
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &Client{Addr: conn.LocalAddr().String()}
+
+	cause := errors.New("Shutting down")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(50*time.Millisecond, func() { cancel(cause) })
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Get(ctx, "kernel", &bytes.Buffer{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != cause {
+			t.Errorf("Expected %v, got %v", cause, err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected cancelling to end the transfer")
+	}
+
+	if _, err := c.Put(ctx, "kernel", &bytes.Buffer{}, 0); err != cause {
+		t.Errorf("Expected %v, got %v", cause, err)
+	}
+}
+
+// fakeServer answers the first request on a loopback port from a new port,
+// as a TFTP server does, running serve on that transfer socket. It returns
+// the listening address.
+func fakeServer(t *testing.T, serve func(conn net.PacketConn, client net.Addr)) string {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		buf := make([]byte, common.MaxPacketSize)
+		_, client, err := listener.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		serve(conn, client)
+	}()
+	return listener.LocalAddr().String()
+}
+
+// expectError reads from conn, returning the code of the ERROR received.
+func expectError(t *testing.T, conn net.PacketConn) common.ErrorCode {
+	buf := make([]byte, common.MaxPacketSize)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Error(err)
+		return 0
+	}
+	peerErr, err := common.ParseErrorPacket(buf[:n])
+	if err != nil {
+		t.Errorf("Expected an ERROR, got %s", common.DumpPacket(buf[:n]))
+		return 0
+	}
+	return peerErr.Code
+}
+
+func TestClientGetTransferID(t *testing.T) {
+	rogue, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rogue.Close()
+
+	first := bytes.Repeat([]byte("a"), common.BlockSize)
+	rogueCode := make(chan common.ErrorCode, 1)
+	addr := fakeServer(t, func(conn net.PacketConn, client net.Addr) {
+		buf := make([]byte, common.MaxPacketSize)
+		conn.WriteTo(append([]byte{0, byte(common.OpDATA), 0, 1}, first...), client)
+		conn.ReadFrom(buf)
+		// Another port pretending to carry on the transfer is refused
+		rogue.WriteTo([]byte{0, byte(common.OpDATA), 0, 2, 'x'}, client)
+		rogueCode <- expectError(t, rogue)
+		conn.WriteTo([]byte{0, byte(common.OpDATA), 0, 2, 'b'}, client)
+		conn.ReadFrom(buf)
+	})
+
+	var buf bytes.Buffer
+	c := &Client{Addr: addr, Timeout: 2 * time.Second}
+	if _, err := c.Get(context.Background(), "kernel", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if expected := string(first) + "b"; buf.String() != expected {
+		t.Errorf("Expected %d bytes ending in b, got %d ending in %q", len(expected), buf.Len(), buf.Bytes()[buf.Len()-1:])
+	}
+	if code := <-rogueCode; code != common.ErrUnknownTransferID {
+		t.Errorf("Expected the rogue port to get ERROR %d, got %d", common.ErrUnknownTransferID, code)
+	}
+}
+
+func TestClientPutTransferID(t *testing.T) {
+	// Loopback answers on all of 127/8 on Linux, elsewhere this may fail
+	rogue, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Can't listen on a second loopback address: %v", err)
+	}
+	defer rogue.Close()
+
+	received := make(chan []byte, 1)
+	rogueCode := make(chan common.ErrorCode, 1)
+	addr := fakeServer(t, func(conn net.PacketConn, client net.Addr) {
+		// Another host answering first is refused
+		rogue.WriteTo(common.CreateAckPacket(0), client)
+		rogueCode <- expectError(t, rogue)
+		conn.WriteTo(common.CreateAckPacket(0), client)
+		buf := make([]byte, common.MaxPacketSize)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		received <- append([]byte(nil), buf[4:n]...)
+		conn.WriteTo(common.CreateAckPacket(1), client)
+	})
+
+	c := &Client{Addr: addr, Timeout: 2 * time.Second}
+	if _, err := c.Put(context.Background(), "config.txt", bytes.NewReader([]byte("hostname sw1")), -1); err != nil {
+		t.Fatal(err)
+	}
+	if got := string(<-received); got != "hostname sw1" {
+		t.Errorf("Expected %q to be sent to the transfer port, got %q", "hostname sw1", got)
+	}
+	if code := <-rogueCode; code != common.ErrUnknownTransferID {
+		t.Errorf("Expected the rogue host to get ERROR %d, got %d", common.ErrUnknownTransferID, code)
+	}
+}
+
+// lossyConn drops every third packet written, starting with the first.
+type lossyConn struct {
+	net.PacketConn
+	writes int
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.writes++
+	if c.writes%3 == 1 {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestClientRetransmits(t *testing.T) {
+	c := &Client{
+		Addr: startServer(t, t.TempDir()),
+		Transport: TransportFunc(func() (net.PacketConn, error) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			return &lossyConn{PacketConn: conn}, err
+		}),
+		Timeout:        2 * time.Second,
+		Retransmission: common.Retransmission{Timeout: 20 * time.Millisecond, Retries: 5},
+	}
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("k"), 5000)
+	stats, err := c.Put(ctx, "kernel", bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Retransmits == 0 {
+		t.Errorf("Expected the upload to resend lost packets, got %+v", stats)
+	}
+
+	// The server may still be closing the file
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		var buf bytes.Buffer
+		stats, err := c.Get(ctx, "kernel", &buf)
+		if err == nil && bytes.Equal(buf.Bytes(), content) {
+			if stats.Retransmits == 0 {
+				t.Errorf("Expected the download to resend lost packets, got %+v", stats)
+			}
+			break
 		}
-		if !reflect.DeepEqual(cs, tc.expected) {
-			t.Errorf("Case %d failed", i)
-			t.Error("Got")
-			t.Errorf("%+v", cs)
-			t.Error("Expected")
-			t.Errorf("%+v", tc.expected)
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d bytes back, got %d, %v", len(content), buf.Len(), err)
 		}
+		time.Sleep(10 * time.Millisecond)
 	}
 }
@@ -0,0 +1,339 @@
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// A Transport opens the packet connection used to talk to the server. The
+// default transport sends datagrams directly; relay transports tunnel them
+// through a jump host.
+type Transport interface {
+	ListenPacket() (net.PacketConn, error)
+}
+
+// TransportFunc allows a plain function, for example one returning a
+// caller-supplied relay conn, to be used as a Transport.
+type TransportFunc func() (net.PacketConn, error)
+
+func (f TransportFunc) ListenPacket() (net.PacketConn, error) {
+	return f()
+}
+
+// tracedTransport traces every packet on the conns opened by t.
+func tracedTransport(t Transport, tracer *common.Tracer) Transport {
+	return TransportFunc(func() (net.PacketConn, error) {
+		conn, err := t.ListenPacket()
+		if err != nil {
+			return nil, err
+		}
+		return tracer.Conn(conn), nil
+	})
+}
+
+type directTransport struct{}
+
+func (directTransport) ListenPacket() (net.PacketConn, error) {
+	// A nil address binds the dual-stack wildcard, so IPv4 and IPv6
+	// servers can both be reached
+	return net.ListenUDP("udp", nil)
+}
+
+// ParseRelay returns the transport described by relay. An empty string means
+// talk to the server directly, otherwise relay must be a URL of the form
+// socks5://[user:password@]host:port.
+func ParseRelay(relay string) (Transport, error) {
+	if relay == "" {
+		return directTransport{}, nil
+	}
+	u, err := url.Parse(relay)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing relay: %v", err)
+	}
+	switch u.Scheme {
+	case "socks5":
+	default:
+		return nil, fmt.Errorf("Unsupported relay scheme: %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("Relay host can't be blank")
+	}
+	t := socks5Transport{proxy: u.Host}
+	if u.User != nil {
+		t.username = u.User.Username()
+		t.password, _ = u.User.Password()
+	}
+	return t, nil
+}
+
+const (
+	socks5Version = 5
+
+	socks5AuthNone     = 0
+	socks5AuthPassword = 2
+
+	socks5CmdUDPAssociate = 3
+
+	socks5AddrIPv4   = 1
+	socks5AddrDomain = 3
+	socks5AddrIPv6   = 4
+
+	socks5HandshakeTimeout = 10 * time.Second
+)
+
+// socks5Transport reaches the server through a SOCKS5 proxy using
+// UDP ASSOCIATE (RFC 1928).
+type socks5Transport struct {
+	proxy    string
+	username string
+	password string
+}
+
+func (t socks5Transport) ListenPacket() (net.PacketConn, error) {
+	ctrl, err := net.DialTimeout("tcp", t.proxy, socks5HandshakeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("Error connecting to relay: %v", err)
+	}
+	ctrl.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	relayAddr, err := t.associate(ctrl)
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+	ctrl.SetDeadline(time.Time{})
+
+	// A relay bound to the wildcard address is reachable on the proxy's IP
+	if relayAddr.IP.IsUnspecified() {
+		relayAddr.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		ctrl.Close()
+		return nil, fmt.Errorf("Error setting up connection: %v", err)
+	}
+
+	return &socks5PacketConn{
+		PacketConn: conn,
+		ctrl:       ctrl,
+		relay:      relayAddr,
+	}, nil
+}
+
+// associate performs method negotiation and the UDP ASSOCIATE request on the
+// control connection, returning the address of the proxy's UDP relay.
+func (t socks5Transport) associate(ctrl net.Conn) (*net.UDPAddr, error) {
+	method := byte(socks5AuthNone)
+	if t.username != "" {
+		method = socks5AuthPassword
+	}
+	if _, err := ctrl.Write([]byte{socks5Version, 1, method}); err != nil {
+		return nil, fmt.Errorf("Error writing relay greeting: %v", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return nil, fmt.Errorf("Error reading relay greeting: %v", err)
+	}
+	if reply[0] != socks5Version || reply[1] != method {
+		return nil, fmt.Errorf("Relay refused authentication method %d", method)
+	}
+
+	if method == socks5AuthPassword {
+		if err := t.authenticate(ctrl); err != nil {
+			return nil, err
+		}
+	}
+
+	req := []byte{socks5Version, socks5CmdUDPAssociate, 0}
+	req = appendSocks5Addr(req, &net.UDPAddr{IP: net.IPv4zero})
+	if _, err := ctrl.Write(req); err != nil {
+		return nil, fmt.Errorf("Error writing UDP ASSOCIATE request: %v", err)
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(ctrl, header); err != nil {
+		return nil, fmt.Errorf("Error reading UDP ASSOCIATE reply: %v", err)
+	}
+	if header[1] != 0 {
+		return nil, fmt.Errorf("Relay rejected UDP ASSOCIATE, reply code: %d", header[1])
+	}
+	return readSocks5Addr(ctrl)
+}
+
+// authenticate performs username/password authentication (RFC 1929).
+func (t socks5Transport) authenticate(ctrl net.Conn) error {
+	if len(t.username) > 255 || len(t.password) > 255 {
+		return fmt.Errorf("Relay username or password too long")
+	}
+	req := []byte{1, byte(len(t.username))}
+	req = append(req, t.username...)
+	req = append(req, byte(len(t.password)))
+	req = append(req, t.password...)
+	if _, err := ctrl.Write(req); err != nil {
+		return fmt.Errorf("Error writing relay credentials: %v", err)
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil {
+		return fmt.Errorf("Error reading relay authentication reply: %v", err)
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("Relay authentication failed")
+	}
+	return nil
+}
+
+// socks5PacketConn wraps every datagram in the SOCKS5 UDP request header and
+// sends it via the relay. The association lasts as long as ctrl stays open.
+type socks5PacketConn struct {
+	net.PacketConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+
+	// A relay may name the sender by domain rather than IP. The last one
+	// resolved is kept, a transfer only having the one peer, so the lookup
+	// isn't repeated for every datagram.
+	mu           sync.Mutex
+	resolvedName string
+	resolved     *net.UDPAddr
+}
+
+func (c *socks5PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	//  2 bytes   1 byte   1 byte    variable    2 bytes   variable
+	//  ------------------------------------------------------------
+	// |  RSV   |  FRAG  |  ATYP  |  DST.ADDR  | DST.PORT |   DATA   |
+	//  ------------------------------------------------------------
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("Unsupported address type: %T", addr)
+	}
+	packet := appendSocks5Addr([]byte{0, 0, 0}, udpAddr)
+	packet = append(packet, b...)
+	if _, err := c.PacketConn.WriteTo(packet, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *socks5PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, len(b)+3+1+1+255+2)
+	for {
+		n, from, err := c.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		// Only the relay may talk to us
+		if udpFrom, ok := from.(*net.UDPAddr); !ok || !udpFrom.IP.Equal(c.relay.IP) || udpFrom.Port != c.relay.Port {
+			continue
+		}
+		addr, payload, err := c.parse(buf[:n])
+		if err != nil {
+			continue
+		}
+		return copy(b, payload), addr, nil
+	}
+}
+
+// parse is parseSocks5Datagram, reusing the last domain resolved.
+func (c *socks5PacketConn) parse(packet []byte) (*net.UDPAddr, []byte, error) {
+	if len(packet) < 5 || packet[2] != 0 || packet[3] != socks5AddrDomain {
+		return parseSocks5Datagram(packet)
+	}
+	// RSV, FRAG, ATYP, the name's length, the name and the port
+	end := 5 + int(packet[4]) + 2
+	if end > len(packet) {
+		return parseSocks5Datagram(packet)
+	}
+	name := string(packet[3:end])
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.resolved != nil && name == c.resolvedName {
+		return c.resolved, packet[end:], nil
+	}
+	addr, payload, err := parseSocks5Datagram(packet)
+	if err != nil {
+		return nil, nil, err
+	}
+	c.resolvedName, c.resolved = name, addr
+	return addr, payload, nil
+}
+
+func (c *socks5PacketConn) Close() error {
+	c.ctrl.Close()
+	return c.PacketConn.Close()
+}
+
+func parseSocks5Datagram(packet []byte) (*net.UDPAddr, []byte, error) {
+	if len(packet) < 4 {
+		return nil, nil, fmt.Errorf("Relay datagram too small")
+	}
+	if packet[2] != 0 {
+		return nil, nil, fmt.Errorf("Fragmented relay datagrams are not supported")
+	}
+	r := bytes.NewReader(packet[3:])
+	addr, err := readSocks5Addr(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, packet[len(packet)-r.Len():], nil
+}
+
+func appendSocks5Addr(b []byte, addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, socks5AddrIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AddrIPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return binary.BigEndian.AppendUint16(b, uint16(addr.Port))
+}
+
+func readSocks5Addr(r io.Reader) (*net.UDPAddr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return nil, fmt.Errorf("Error reading address type: %v", err)
+	}
+
+	var host []byte
+	switch atyp[0] {
+	case socks5AddrIPv4:
+		host = make([]byte, net.IPv4len)
+	case socks5AddrIPv6:
+		host = make([]byte, net.IPv6len)
+	case socks5AddrDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return nil, fmt.Errorf("Error reading address length: %v", err)
+		}
+		host = make([]byte, length[0])
+	default:
+		return nil, fmt.Errorf("Unknown address type: %d", atyp[0])
+	}
+	if _, err := io.ReadFull(r, host); err != nil {
+		return nil, fmt.Errorf("Error reading address: %v", err)
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, fmt.Errorf("Error reading port: %v", err)
+	}
+	portNum := int(binary.BigEndian.Uint16(port))
+
+	if atyp[0] == socks5AddrDomain {
+		return net.ResolveUDPAddr("udp", net.JoinHostPort(string(host), strconv.Itoa(portNum)))
+	}
+	return &net.UDPAddr{IP: net.IP(host), Port: portNum}, nil
+}
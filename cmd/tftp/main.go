@@ -0,0 +1,245 @@
+// Command tftp is a TFTP client.
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/ryanslade/tftp/client"
+	"github.com/ryanslade/tftp/common"
+)
+
+const (
+	expectedArgFormat = "tftp [-relay socks5://[user:pass@]host:port] [-state file] [-trace file] put|get host:port[,host:port...] filename"
+)
+
+// Exit statuses, telling a request the server refused apart from other
+// failures
+const (
+	exitFailure     = 1
+	exitUsage       = 2
+	exitServerError = 3
+)
+
+type mode string
+
+const (
+	modeGet mode = "get"
+	modePut mode = "put"
+)
+
+type clientState struct {
+	mode     mode
+	filename string
+	address  string
+	relay    string
+	// statePath is where mirror health is remembered when address lists
+	// more than one server.
+	statePath string
+	// trace names a file to write an NDJSON event for every packet to, -
+	// for stdout.
+	trace string
+}
+
+// TODO: Maybe default to port 69?
+func parseArgs(args []string) (clientState, error) {
+	state := clientState{}
+	if len(args) == 0 {
+		return clientState{}, fmt.Errorf("Too few arguments")
+	}
+
+	flags := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	flags.SetOutput(ioutil.Discard)
+	flags.StringVar(&state.relay, "relay", "", "Relay to tunnel packets through")
+	flags.StringVar(&state.statePath, "state", "", "File remembering mirror health, defaults to the user cache directory")
+	flags.StringVar(&state.trace, "trace", "", "Write an NDJSON event for every packet to this file, - for stdout")
+	if err := flags.Parse(args[1:]); err != nil {
+		return clientState{}, err
+	}
+	if _, err := client.ParseRelay(state.relay); err != nil {
+		return clientState{}, err
+	}
+
+	args = flags.Args()
+	if len(args) < 3 {
+		return clientState{}, fmt.Errorf("Too few arguments")
+	}
+	if len(args) > 3 {
+		return clientState{}, fmt.Errorf("Too many arguments")
+	}
+	switch mode(strings.ToLower(args[0])) {
+	case modeGet:
+		state.mode = modeGet
+	case modePut:
+		state.mode = modePut
+	default:
+		return clientState{}, fmt.Errorf("Unknown mode")
+	}
+
+	for _, address := range strings.Split(args[1], ",") {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return clientState{}, fmt.Errorf("Error parsing host or port: %v", err)
+		}
+		if host == "" {
+			return clientState{}, fmt.Errorf("Host can't be blank")
+		}
+		if port == "" {
+			return clientState{}, fmt.Errorf("Port can't be blank")
+		}
+	}
+	state.address = args[1]
+	state.filename = args[2]
+
+	return state, nil
+}
+
+// handle reading a local file and sending it to the server
+func handlePut(filename string, c *client.Client) (common.TransferStats, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return common.TransferStats{}, fmt.Errorf("Error opening file: %v", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return common.TransferStats{}, fmt.Errorf("Error opening file: %v", err)
+	}
+
+	stats, err := c.Put(context.Background(), filename, bufio.NewReader(f), info.Size())
+	if err != nil {
+		return stats, err
+	}
+	fmt.Printf("Sent %s: %v\n", filename, stats)
+	return stats, nil
+}
+
+func handleGet(filename string, c *client.Client) (common.TransferStats, error) {
+	f, err := os.Create(filename)
+	if err != nil {
+		return common.TransferStats{}, fmt.Errorf("Error creating file: %v", err)
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(f)
+
+	stats, err := c.Get(context.Background(), filename, bw)
+	if err != nil {
+		// The server gave up or went away, don't leave a truncated copy
+		// behind
+		f.Close()
+		os.Remove(filename)
+		return stats, err
+	}
+	if err := bw.Flush(); err != nil {
+		return stats, fmt.Errorf("Error writing file: %v", err)
+	}
+	fmt.Printf("Received %s: %v\n", filename, stats)
+	return stats, nil
+}
+
+// errorMessage describes why a transfer failed, giving the code and message
+// of an ERROR sent by the server.
+func errorMessage(err error) string {
+	var peerErr *common.Error
+	if errors.As(err, &peerErr) {
+		return fmt.Sprintf("Server error %d (%v): %s", peerErr.Code, peerErr.Code, peerErr.Message)
+	}
+	return err.Error()
+}
+
+// exitStatus returns the status to exit with after a transfer failed with
+// err.
+func exitStatus(err error) int {
+	var peerErr *common.Error
+	if errors.As(err, &peerErr) {
+		return exitServerError
+	}
+	return exitFailure
+}
+
+// handleState performs the transfer described by s, returning the status to
+// exit with.
+func handleState(s clientState) int {
+	t, err := client.ParseRelay(s.relay)
+	if err != nil {
+		log.Println(err)
+		return exitUsage
+	}
+	c := &client.Client{Transport: t}
+
+	if s.trace != "" {
+		w := os.Stdout
+		if s.trace != "-" {
+			w, err = os.OpenFile(s.trace, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				log.Printf("Error opening trace file: %v", err)
+				return exitFailure
+			}
+			defer w.Close()
+		}
+		c.Tracer = common.NewTracer(w)
+	}
+
+	transfer := handleGet
+	if s.mode == modePut {
+		transfer = handlePut
+	}
+
+	addresses := strings.Split(s.address, ",")
+	if len(addresses) == 1 {
+		c.Addr = s.address
+		if _, err := transfer(s.filename, c); err != nil {
+			log.Printf("Error performing %s: %s", s.mode, errorMessage(err))
+			return exitStatus(err)
+		}
+		return 0
+	}
+
+	// Several mirrors, try the healthiest first and remember how each did
+	statePath := s.statePath
+	if statePath == "" {
+		statePath = defaultStatePath()
+	}
+	scores, err := loadMirrorScores(statePath)
+	if err != nil {
+		log.Println(err)
+		scores, _ = loadMirrorScores("")
+	}
+	// Move on from an unreachable mirror without waiting out every resend
+	c.Timeout = mirrorTimeout
+	status := 0
+	for _, address := range scores.order(addresses) {
+		c.Addr = address
+		stats, err := transfer(s.filename, c)
+		scores.record(address, stats, err)
+		if err == nil {
+			status = 0
+			break
+		}
+		log.Printf("Error performing %s with %s: %s", s.mode, address, errorMessage(err))
+		status = exitStatus(err)
+	}
+	if err := scores.save(); err != nil {
+		log.Printf("Error saving mirror state: %v", err)
+	}
+	return status
+}
+
+func main() {
+	state, err := parseArgs(os.Args)
+	if err != nil {
+		fmt.Println(err)
+		fmt.Println("Expected", expectedArgFormat)
+		os.Exit(exitUsage)
+	}
+	os.Exit(handleState(state))
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestParseArgs(t *testing.T) {
+	testCases := []struct {
+		args        string
+		shouldError bool
+		expected    clientState
+	}{
+		// Valid put
+		{
+			args:        "client put blah:1234 somefile.txt",
+			shouldError: false,
+			expected: clientState{
+				mode:     modePut,
+				filename: "somefile.txt",
+				address:  "blah:1234",
+			},
+		},
+		{
+			args:        "client PUT blah:1234 somefile.txt",
+			shouldError: false,
+			expected: clientState{
+				mode:     modePut,
+				filename: "somefile.txt",
+				address:  "blah:1234",
+			},
+		},
+		// Valid get
+		{
+			args:        "client get blah:1234 somefile.txt",
+			shouldError: false,
+			expected: clientState{
+				mode:     modeGet,
+				filename: "somefile.txt",
+				address:  "blah:1234",
+			},
+		},
+		{
+			args:        "client GET blah:1234 somefile.txt",
+			shouldError: false,
+			expected: clientState{
+				mode:     modeGet,
+				filename: "somefile.txt",
+				address:  "blah:1234",
+			},
+		},
+		// Relay
+		{
+			args:        "client -relay socks5://jump:1080 get blah:1234 somefile.txt",
+			shouldError: false,
+			expected: clientState{
+				mode:     modeGet,
+				filename: "somefile.txt",
+				address:  "blah:1234",
+				relay:    "socks5://jump:1080",
+			},
+		},
+		{
+			args:        "client -relay http://jump:1080 get blah:1234 somefile.txt",
+			shouldError: true,
+			expected:    clientState{},
+		},
+		// Mirrors
+		{
+			args:        "client -state /tmp/mirrors.json get a:69,b:69 somefile.txt",
+			shouldError: false,
+			expected: clientState{
+				mode:      modeGet,
+				filename:  "somefile.txt",
+				address:   "a:69,b:69",
+				statePath: "/tmp/mirrors.json",
+			},
+		},
+		{
+			args:        "client get a:69,b somefile.txt",
+			shouldError: true,
+			expected:    clientState{},
+		},
+		// Not enough args
+		{
+			args:        "client get blah:1234",
+			shouldError: true,
+			expected:    clientState{},
+		},
+		// Too many args
+		{
+			args:        "client get blah:1234 somefile.txt extra",
+			shouldError: true,
+			expected:    clientState{},
+		},
+		// Unknown command
+		{
+			args:        "client abc blah:1234 somefile.txt",
+			shouldError: true,
+			expected:    clientState{},
+		},
+		// Invalid host/port
+		{
+			args:        "client put blah::1234 somefile.txt",
+			shouldError: true,
+			expected:    clientState{},
+		},
+		{
+			args:        "client put :1234 somefile.txt",
+			shouldError: true,
+			expected:    clientState{},
+		},
+		{
+			args:        "client put blah: somefile.txt",
+			shouldError: true,
+			expected:    clientState{},
+		},
+		{
+			args:        "client put blah somefile.txt",
+			shouldError: true,
+			expected:    clientState{},
+		},
+	}
+
+	for i, tc := range testCases {
+		args := strings.Fields(tc.args)
+		cs, err := parseArgs(args)
+		if tc.shouldError && err == nil {
+			t.Errorf("Expected an error, didn't get one (%d)", i)
+			continue
+		}
+		if !tc.shouldError && err != nil {
+			t.Errorf("Didn't expect an error: %v (%d)", err, i)
+			continue
+		}
+		if !reflect.DeepEqual(cs, tc.expected) {
+			t.Errorf("Case %d failed", i)
+			t.Error("Got")
+			t.Errorf("%+v", cs)
+			t.Error("Expected")
+			t.Errorf("%+v", tc.expected)
+		}
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	testCases := []struct {
+		err      error
+		expected string
+		status   int
+	}{
+		{
+			err:      &common.Error{Code: common.ErrFileNotFound, Message: "File not found"},
+			expected: "Server error 1 (File not found): File not found",
+			status:   exitServerError,
+		},
+		{
+			err:      fmt.Errorf("Error reading data: %w", &common.Error{Code: common.ErrAccessViolation, Message: "Denied"}),
+			expected: "Server error 2 (Access violation): Denied",
+			status:   exitServerError,
+		},
+		{
+			err:      errors.New("Error reading data: i/o timeout"),
+			expected: "Error reading data: i/o timeout",
+			status:   exitFailure,
+		},
+	}
+
+	for i, tc := range testCases {
+		if got := errorMessage(tc.err); got != tc.expected {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+		if got := exitStatus(tc.err); got != tc.status {
+			t.Errorf("Expected status %d, got %d (%d)", tc.status, got, i)
+		}
+	}
+}
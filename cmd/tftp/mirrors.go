@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+const (
+	// mirrorDecay is how much weight older results keep each time a new
+	// result is recorded, so the scores track recent behaviour.
+	mirrorDecay = 0.8
+	// mirrorFailurePenalty scales a mirror's round trip time by its recent
+	// failure rate.
+	mirrorFailurePenalty = 4
+	// mirrorTimeout is how long to wait for a mirror before moving on to
+	// the next one.
+	mirrorTimeout = 5 * time.Second
+)
+
+// mirrorHealth is what the client remembers about one server.
+type mirrorHealth struct {
+	// Successes and Failures are decayed counts of recent transfers.
+	Successes float64 `json:"successes"`
+	Failures  float64 `json:"failures"`
+	// RTT is a moving average of the time per block, which in lock step
+	// TFTP is roughly the round trip time to the mirror.
+	RTT     time.Duration `json:"rtt"`
+	Updated time.Time     `json:"updated"`
+}
+
+// score is lower for better mirrors.
+func (h *mirrorHealth) score() float64 {
+	failureRate := h.Failures / (h.Successes + h.Failures)
+	rtt := h.RTT
+	if rtt == 0 {
+		// Only failures so far
+		rtt = time.Second
+	}
+	return float64(rtt) * (1 + mirrorFailurePenalty*failureRate)
+}
+
+// mirrorScores holds the health of every mirror the client has used,
+// persisted in a small JSON state file between runs.
+type mirrorScores struct {
+	path    string
+	Mirrors map[string]*mirrorHealth `json:"mirrors"`
+}
+
+// defaultStatePath returns where mirror scores are kept when -state isn't
+// given, or the empty string if there is no suitable location.
+func defaultStatePath() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "tftp", "mirrors.json")
+}
+
+// loadMirrorScores reads the state file at path. A missing file, or an empty
+// path, gives empty scores.
+func loadMirrorScores(path string) (*mirrorScores, error) {
+	scores := &mirrorScores{path: path, Mirrors: make(map[string]*mirrorHealth)}
+	if path == "" {
+		return scores, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return scores, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error reading mirror state: %v", err)
+	}
+	if err := json.Unmarshal(data, scores); err != nil {
+		return nil, fmt.Errorf("Error parsing mirror state %s: %v", path, err)
+	}
+	if scores.Mirrors == nil {
+		scores.Mirrors = make(map[string]*mirrorHealth)
+	}
+	return scores, nil
+}
+
+// order returns addresses sorted best first. Mirrors with no history are
+// tried before known ones so they get a chance to prove themselves, and ties
+// keep the order they were given in.
+func (m *mirrorScores) order(addresses []string) []string {
+	ordered := append([]string(nil), addresses...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		hi, hj := m.Mirrors[ordered[i]], m.Mirrors[ordered[j]]
+		if hi == nil || hj == nil {
+			return hi == nil && hj != nil
+		}
+		return hi.score() < hj.score()
+	})
+	return ordered
+}
+
+// record updates address's health with the outcome of a transfer.
+func (m *mirrorScores) record(address string, stats common.TransferStats, err error) {
+	h := m.Mirrors[address]
+	if h == nil {
+		h = &mirrorHealth{}
+		m.Mirrors[address] = h
+	}
+	h.Successes *= mirrorDecay
+	h.Failures *= mirrorDecay
+	h.Updated = time.Now()
+
+	if err != nil {
+		h.Failures++
+		return
+	}
+	h.Successes++
+	if stats.Blocks > 0 {
+		rtt := stats.Duration / time.Duration(stats.Blocks)
+		if h.RTT == 0 {
+			h.RTT = rtt
+		} else {
+			h.RTT = time.Duration(mirrorDecay*float64(h.RTT) + (1-mirrorDecay)*float64(rtt))
+		}
+	}
+}
+
+// save writes the scores back to the state file, replacing it atomically so
+// concurrent clients never see a torn file.
+func (m *mirrorScores) save() error {
+	if m.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return fmt.Errorf("Error creating mirror state directory: %v", err)
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(m.path), ".mirrors-*")
+	if err != nil {
+		return fmt.Errorf("Error writing mirror state: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing mirror state: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error writing mirror state: %v", err)
+	}
+	return os.Rename(tmp.Name(), m.path)
+}
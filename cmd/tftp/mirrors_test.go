@@ -0,0 +1,60 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func transferTaking(perBlock time.Duration) common.TransferStats {
+	return common.TransferStats{Blocks: 10, Duration: 10 * perBlock}
+}
+
+func TestMirrorOrder(t *testing.T) {
+	scores, err := loadMirrorScores("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores.record("slow:69", transferTaking(50*time.Millisecond), nil)
+	scores.record("fast:69", transferTaking(5*time.Millisecond), nil)
+	scores.record("flaky:69", transferTaking(2*time.Millisecond), nil)
+	scores.record("flaky:69", common.TransferStats{}, errors.New("timeout"))
+	scores.record("flaky:69", common.TransferStats{}, errors.New("timeout"))
+
+	got := scores.order([]string{"slow:69", "flaky:69", "fast:69", "new:69", "other:69"})
+	expected := []string{"new:69", "other:69", "fast:69", "flaky:69", "slow:69"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
+
+func TestMirrorScoresPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "mirrors.json")
+
+	scores, err := loadMirrorScores(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scores.record("a:69", transferTaking(20*time.Millisecond), nil)
+	scores.record("b:69", transferTaking(2*time.Millisecond), nil)
+	if err := scores.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadMirrorScores(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := loaded.order([]string{"a:69", "b:69"})
+	expected := []string{"b:69", "a:69"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+	if loaded.Mirrors["a:69"].RTT != 20*time.Millisecond {
+		t.Errorf("Expected RTT to persist, got %v", loaded.Mirrors["a:69"].RTT)
+	}
+}
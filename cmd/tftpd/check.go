@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// checkInstance reports every problem with in's configuration that would
+// stop the daemon starting, beyond those newInstance already refused:
+// fields the server rejects, a missing root, and addresses it can't listen
+// on because they are in use or need privileges. in's listeners are opened
+// and closed again, as is the admin API's.
+func checkInstance(in *instance) error {
+	errs := []error{in.s.Check()}
+	if !inetd {
+		conns, err := in.s.Listen()
+		errs = append(errs, err)
+		for _, c := range conns {
+			c.Close()
+		}
+	}
+	if adminAddr != "" {
+		if adminTokenFile == "" {
+			errs = append(errs, errors.New("-admin-addr requires -admin-token-file"))
+		} else if _, err := os.ReadFile(adminTokenFile); err != nil {
+			errs = append(errs, fmt.Errorf("Error reading admin token: %v", err))
+		}
+		l, err := net.Listen("tcp", adminAddr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Error listening for the admin API: %v", err))
+		} else {
+			l.Close()
+		}
+	}
+	return errors.Join(errs...)
+}
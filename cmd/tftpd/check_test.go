@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ryanslade/tftp/server"
+)
+
+func TestCheckInstance(t *testing.T) {
+	busy, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer busy.Close()
+	dir := t.TempDir()
+
+	testCases := []struct {
+		s        *server.Server
+		expected string
+	}{
+		{s: &server.Server{Addr: "127.0.0.1:0", Root: dir}},
+		{s: &server.Server{Addr: busy.LocalAddr().String(), Root: dir}, expected: "Error listening"},
+		{s: &server.Server{Addr: "127.0.0.1:0", Root: dir + "/missing"}, expected: "doesn't exist"},
+	}
+
+	for i, tc := range testCases {
+		err := checkInstance(&instance{s: tc.s})
+		if tc.expected == "" && err != nil || tc.expected != "" && (err == nil || !strings.Contains(err.Error(), tc.expected)) {
+			t.Errorf("Expected %q, got %v (%d)", tc.expected, err, i)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// checkChrootUser refuses -chroot without -user for a process running as
+// root, euid 0, which can break out of a chroot.
+func checkChrootUser(euid int) error {
+	if euid == 0 && runAs == "" {
+		return fmt.Errorf("-chroot needs -user when running as root, which can escape the chroot")
+	}
+	return nil
+}
+
+// prepareChroot points the flags at the paths they will have once chrooted
+// into -root, returning its absolute path. The working directory becomes
+// the root, which stays the working directory after the chroot, so root and
+// upload root are given relative to it and work on both sides, such as for
+// -preload. The files named by other flags are opened before the chroot, so
+// they are made absolute instead.
+func prepareChroot() (string, error) {
+	dir := root
+	if dir == "" {
+		dir = "."
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	uploads := ""
+	if uploadRoot != "" {
+		abs, err := filepath.Abs(uploadRoot)
+		if err != nil {
+			return "", err
+		}
+		uploads, err = filepath.Rel(dir, abs)
+		if err != nil || uploads == ".." || strings.HasPrefix(uploads, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("-upload-root must be inside -root with -chroot")
+		}
+	}
+
+	for _, f := range []*string{&configFile, &remapFile, &adminTokenFile, &accessLog, &history, &trace} {
+		if *f == "" || *f == "-" {
+			continue
+		}
+		if *f, err = filepath.Abs(*f); err != nil {
+			return "", err
+		}
+	}
+	if templates != "" {
+		specs := strings.Split(templates, ",")
+		for i, spec := range specs {
+			pattern, file, ok := strings.Cut(spec, "=")
+			if !ok {
+				continue
+			}
+			if file, err = filepath.Abs(file); err != nil {
+				return "", err
+			}
+			specs[i] = pattern + "=" + file
+		}
+		templates = strings.Join(specs, ",")
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		return "", fmt.Errorf("Error changing to -root: %v", err)
+	}
+	root, uploadRoot = ".", uploads
+	return dir, nil
+}
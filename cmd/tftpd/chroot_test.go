@@ -0,0 +1,87 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPrepareChroot(t *testing.T) {
+	start := t.TempDir()
+	dir := filepath.Join(start, "srv")
+	if err := os.MkdirAll(filepath.Join(dir, "uploads"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		root, uploadRoot, accessLog, templates string
+
+		expectedUploadRoot, expectedAccessLog, expectedTemplates string
+		shouldError                                              bool
+	}{
+		{root: "srv", accessLog: "access.log", expectedAccessLog: filepath.Join(start, "access.log")},
+		{root: dir, accessLog: "-", expectedAccessLog: "-"},
+		{root: "srv", uploadRoot: "srv/uploads", expectedUploadRoot: "uploads"},
+		{
+			root:              "srv",
+			templates:         "pxelinux.cfg/*=host.tmpl,menu=/etc/menu.tmpl",
+			expectedTemplates: "pxelinux.cfg/*=" + filepath.Join(start, "host.tmpl") + ",menu=/etc/menu.tmpl",
+		},
+		{root: "srv", uploadRoot: start, shouldError: true},
+		{root: "srv/uploads", uploadRoot: "srv", shouldError: true},
+	}
+
+	saved := []string{root, uploadRoot, accessLog, templates}
+	t.Cleanup(func() { root, uploadRoot, accessLog, templates = saved[0], saved[1], saved[2], saved[3] })
+	for i, tc := range testCases {
+		t.Chdir(start)
+		root, uploadRoot, accessLog, templates = tc.root, tc.uploadRoot, tc.accessLog, tc.templates
+		got, err := prepareChroot()
+		if tc.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error (%d)", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		wd, _ := os.Getwd()
+		if got != dir || wd != dir {
+			t.Errorf("Expected to be in %s, got %s and working directory %s (%d)", dir, got, wd, i)
+		}
+		if root != "." || uploadRoot != tc.expectedUploadRoot {
+			t.Errorf("Expected roots %q and %q, got %q and %q (%d)", ".", tc.expectedUploadRoot, root, uploadRoot, i)
+		}
+		if accessLog != tc.expectedAccessLog {
+			t.Errorf("Expected -access-log %q, got %q (%d)", tc.expectedAccessLog, accessLog, i)
+		}
+		if templates != tc.expectedTemplates {
+			t.Errorf("Expected -template %q, got %q (%d)", tc.expectedTemplates, templates, i)
+		}
+	}
+}
+
+func TestCheckChrootUser(t *testing.T) {
+	testCases := []struct {
+		euid        int
+		runAs       string
+		shouldError bool
+	}{
+		{euid: 0, shouldError: true},
+		{euid: 0, runAs: "tftp"},
+		{euid: 1000},
+		// Windows has no user IDs
+		{euid: -1},
+	}
+
+	saved := runAs
+	t.Cleanup(func() { runAs = saved })
+	for i, tc := range testCases {
+		runAs = tc.runAs
+		if err := checkChrootUser(tc.euid); (err != nil) != tc.shouldError {
+			t.Errorf("Expected error %v, got %v (%d)", tc.shouldError, err, i)
+		}
+	}
+}
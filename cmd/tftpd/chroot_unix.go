@@ -0,0 +1,35 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/ryanslade/tftp/server"
+)
+
+// enterChroot makes the working directory, -root after prepareChroot, the
+// root directory.
+func enterChroot() error {
+	if err := syscall.Chroot("."); err != nil {
+		return fmt.Errorf("Error chrooting: %v", err)
+	}
+	return os.Chdir("/")
+}
+
+// dropPrivileges switches to owner's user and group, leaving no
+// supplementary groups. The change applies to every thread.
+func dropPrivileges(owner *server.FileOwner) error {
+	if err := syscall.Setgroups(nil); err != nil {
+		return fmt.Errorf("Error dropping supplementary groups: %v", err)
+	}
+	if err := syscall.Setgid(owner.GID); err != nil {
+		return fmt.Errorf("Error switching group: %v", err)
+	}
+	if err := syscall.Setuid(owner.UID); err != nil {
+		return fmt.Errorf("Error switching user: %v", err)
+	}
+	return nil
+}
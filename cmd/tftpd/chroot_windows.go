@@ -0,0 +1,15 @@
+package main
+
+import (
+	"errors"
+
+	"github.com/ryanslade/tftp/server"
+)
+
+func enterChroot() error {
+	return errors.New("-chroot isn't supported on Windows")
+}
+
+func dropPrivileges(owner *server.FileOwner) error {
+	return errors.New("-user isn't supported on Windows")
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var errUnterminatedArray = errors.New("Unterminated array")
+
+// loadConfig reads the config file at path and applies it to the command
+// line flags, leaving those in explicit alone.
+func loadConfig(path string, explicit map[string]bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("Error opening config: %v", err)
+	}
+	defer f.Close()
+	values, err := parseConfig(f)
+	if err != nil {
+		return fmt.Errorf("Error parsing %s: %v", path, err)
+	}
+	if err := applyConfig(flag.CommandLine, values, explicit); err != nil {
+		return fmt.Errorf("Error in %s: %v", path, err)
+	}
+	return nil
+}
+
+// parseConfig parses a config file, a flat TOML document whose keys are the
+// names of command line flags:
+//
+//	# Serve netboot images
+//	root = "/srv/tftp"
+//	max-transfers = 200
+//	idle-timeout = "10s"
+//	allow = ["10.0.0.0/8", "192.168.0.0/16"]
+//
+// Underscores in keys stand for dashes. Values are returned in the form the
+// flag takes, with arrays joined by commas. Tables aren't supported.
+func parseConfig(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || text[0] == '#' {
+			continue
+		}
+		if text[0] == '[' {
+			return nil, fmt.Errorf("Line %d: tables aren't supported", line)
+		}
+		key, raw, ok := strings.Cut(text, "=")
+		if !ok {
+			return nil, fmt.Errorf("Line %d: expected key = value", line)
+		}
+		key = strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		if key == "" {
+			return nil, fmt.Errorf("Line %d: missing key", line)
+		}
+		if _, ok := values[key]; ok {
+			return nil, fmt.Errorf("Line %d: %s set twice", line, key)
+		}
+
+		start := line
+		value, err := parseConfigValue(raw)
+		// Arrays may span lines
+		for err == errUnterminatedArray && scanner.Scan() {
+			line++
+			raw += "\n" + scanner.Text()
+			value, err = parseConfigValue(raw)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Line %d: %v", start, err)
+		}
+		values[key] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// parseConfigValue parses the value of a key, which must be all that is left
+// on the line apart from a comment.
+func parseConfigValue(s string) (string, error) {
+	value, rest, err := scanConfigValue(s, false)
+	if err != nil {
+		return "", err
+	}
+	if rest = skipConfigSpace(rest); rest != "" {
+		return "", fmt.Errorf("Unexpected %q after value", rest)
+	}
+	return value, nil
+}
+
+// scanConfigValue parses the value at the start of s, returning it and what
+// follows it.
+func scanConfigValue(s string, inArray bool) (value, rest string, err error) {
+	s = strings.TrimLeft(s, " \t\r\n")
+	if s == "" {
+		return "", "", fmt.Errorf("Missing value")
+	}
+	switch s[0] {
+	case '"':
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return "", "", fmt.Errorf("Unterminated string")
+		}
+		value, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return "", "", fmt.Errorf("Invalid string %s", s[:end+1])
+		}
+		return value, s[end+1:], nil
+	case '\'':
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("Unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	case '[':
+		if inArray {
+			return "", "", fmt.Errorf("Nested arrays aren't supported")
+		}
+		var items []string
+		s = s[1:]
+		for {
+			s = skipConfigSpace(s)
+			if s == "" {
+				return "", "", errUnterminatedArray
+			}
+			if s[0] == ']' {
+				return strings.Join(items, ","), s[1:], nil
+			}
+			item, rest, err := scanConfigValue(s, true)
+			if err != nil {
+				return "", "", err
+			}
+			items = append(items, item)
+			s = skipConfigSpace(rest)
+			switch {
+			case s == "":
+				return "", "", errUnterminatedArray
+			case s[0] == ',':
+				s = s[1:]
+			case s[0] != ']':
+				return "", "", fmt.Errorf("Expected , or ] in array, got %q", s)
+			}
+		}
+	}
+	// Numbers, booleans and, unlike TOML, bare durations such as 30s
+	end := strings.IndexAny(s, " \t\r\n,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	return s[:end], s[end:], nil
+}
+
+// skipConfigSpace skips whitespace and comments.
+func skipConfigSpace(s string) string {
+	for {
+		s = strings.TrimLeft(s, " \t\r\n")
+		if !strings.HasPrefix(s, "#") {
+			return s
+		}
+		end := strings.IndexByte(s, '\n')
+		if end < 0 {
+			return ""
+		}
+		s = s[end:]
+	}
+}
+
+// applyConfig sets every flag of fs not in explicit to its value in values,
+// or back to its default if it isn't there, so options removed from the
+// file are reset on reload.
+func applyConfig(fs *flag.FlagSet, values map[string]string, explicit map[string]bool) error {
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("Unknown option %q", name)
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" {
+			return
+		}
+		value, ok := values[f.Name]
+		if !ok {
+			value = f.DefValue
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("Invalid %s %q: %v", f.Name, value, setErr)
+		}
+	})
+	return err
+}
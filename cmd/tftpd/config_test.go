@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	testCases := []struct {
+		config      string
+		expected    map[string]string
+		shouldError bool
+	}{
+		{
+			config: `# Netboot
+root = "/srv/tftp"   # served files
+max_transfers = 200
+upload-only = true
+idle-timeout = 10s
+statsd-prefix = 'tftp.'
+allow = ["10.0.0.0/8", "192.168.0.0/16"]
+deny = [
+	"10.0.0.1", # the router
+	"10.0.0.2",
+]
+`,
+			expected: map[string]string{
+				"root":          "/srv/tftp",
+				"max-transfers": "200",
+				"upload-only":   "true",
+				"idle-timeout":  "10s",
+				"statsd-prefix": "tftp.",
+				"allow":         "10.0.0.0/8,192.168.0.0/16",
+				"deny":          "10.0.0.1,10.0.0.2",
+			},
+		},
+		{config: `webhook = "http://a/\"q\""`, expected: map[string]string{"webhook": `http://a/"q"`}},
+		{config: "[server]\nroot = \"/srv\"", shouldError: true},
+		{config: "root", shouldError: true},
+		{config: "root = \"/srv", shouldError: true},
+		{config: "root = \"/srv\" extra", shouldError: true},
+		{config: "root = \"/a\"\nroot = \"/b\"", shouldError: true},
+		{config: "allow = [\"10.0.0.0/8\"", shouldError: true},
+		{config: "allow = [[\"10.0.0.0/8\"]]", shouldError: true},
+	}
+
+	for i, tc := range testCases {
+		values, err := parseConfig(strings.NewReader(tc.config))
+		if tc.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error, got %v (%d)", values, i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		if !reflect.DeepEqual(values, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, values, i)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	fs := flag.NewFlagSet("tftpd", flag.ContinueOnError)
+	root := fs.String("root", "", "")
+	port := fs.Int("port", 69, "")
+	uploadOnly := fs.Bool("upload-only", false, "")
+	fs.String("config", "", "")
+	if err := fs.Parse([]string{"-port", "6969"}); err != nil {
+		t.Fatal(err)
+	}
+	explicit := map[string]bool{"port": true}
+
+	if err := applyConfig(fs, map[string]string{"root": "/srv", "port": "69", "upload-only": "true"}, explicit); err != nil {
+		t.Fatal(err)
+	}
+	if *root != "/srv" || *port != 6969 || !*uploadOnly {
+		t.Errorf("Expected the file to set all but the command line flags, got %q, %d, %v", *root, *port, *uploadOnly)
+	}
+
+	// Options dropped from the file go back to their defaults
+	if err := applyConfig(fs, map[string]string{"root": "/tftpboot"}, explicit); err != nil {
+		t.Fatal(err)
+	}
+	if *root != "/tftpboot" || *uploadOnly {
+		t.Errorf("Expected upload-only to be reset, got %q, %v", *root, *uploadOnly)
+	}
+
+	for i, values := range []map[string]string{
+		{"bogus": "1"},
+		{"config": "other.toml"},
+		{"port": "69", "upload-only": "maybe"},
+	} {
+		if err := applyConfig(fs, values, explicit); err == nil {
+			t.Errorf("Expected an error for %v (%d)", values, i)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ryanslade/tftp/server"
+)
+
+// runHistory implements "tftpd history", printing the transfers recorded by
+// -history that match the filters in args.
+func runHistory(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	path := fs.String("history", "", "History file to read, as written by tftpd -history")
+	var q server.HistoryQuery
+	fs.StringVar(&q.Client, "client", "", "Only show transfers with this client IP, or IP:port")
+	fs.StringVar(&q.File, "file", "", "Only show transfers of this file")
+	fs.StringVar(&q.Op, "op", "", "Only show RRQ or WRQ transfers")
+	fs.StringVar(&q.Outcome, "outcome", "", "Only show transfers with this outcome: ok, aborted, failed or rejected")
+	since := fs.Duration("since", 0, "Only show transfers finished within this long, e.g. 24h")
+	fs.Parse(args)
+	if *path == "" {
+		return errors.New("-history is required")
+	}
+	if *since > 0 {
+		q.Since = time.Now().Add(-*since)
+	}
+
+	f, err := os.Open(*path)
+	if err != nil {
+		return fmt.Errorf("Error opening history: %v", err)
+	}
+	defer f.Close()
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tCLIENT\tOP\tFILE\tBYTES\tDURATION\tOUTCOME\tERROR")
+	err = server.ReadHistory(f, q, func(r server.HistoryRecord) error {
+		_, err := fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%v\t%s\t%s\n",
+			r.Time.Local().Format(time.RFC3339), r.Client, r.Op, r.File, r.Bytes,
+			r.Duration.Round(time.Millisecond), r.Outcome, r.Error)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Error reading %s: %v", *path, err)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history.jsonl")
+	history := `{"time":"2024-01-01T10:00:00Z","client":"10.1.2.3:1000","op":"RRQ","file":"kernel","bytes":1000,"outcome":"ok"}
+{"time":"2024-01-01T11:00:00Z","client":"10.1.2.4:1000","op":"RRQ","file":"kernel","outcome":"failed","error":"File not found"}
+{"time":"2024-01-01T12:00:00Z","client":"10.1.2.3:1001","op":"WRQ","file":"switch.cfg","bytes":600,"outcome":"ok"}
+`
+	if err := os.WriteFile(path, []byte(history), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		args  []string
+		files []string
+	}{
+		{args: nil, files: []string{"kernel", "kernel", "switch.cfg"}},
+		{args: []string{"-client", "10.1.2.3"}, files: []string{"kernel", "switch.cfg"}},
+		{args: []string{"-outcome", "failed"}, files: []string{"kernel"}},
+		{args: []string{"-since", "1h"}},
+	}
+
+	for i, tc := range testCases {
+		var out bytes.Buffer
+		if err := runHistory(append([]string{"-history", path}, tc.args...), &out); err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		if !strings.HasPrefix(lines[0], "TIME") {
+			t.Errorf("Expected a header, got %q (%d)", lines[0], i)
+		}
+		if len(lines)-1 != len(tc.files) {
+			t.Errorf("Expected %d transfers, got %q (%d)", len(tc.files), out.String(), i)
+			continue
+		}
+		for j, file := range tc.files {
+			if fields := strings.Fields(lines[j+1]); len(fields) < 4 || fields[3] != file {
+				t.Errorf("Expected %s, got %q (%d)", file, lines[j+1], i)
+			}
+		}
+	}
+
+	if err := runHistory(nil, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error without -history")
+	}
+}
@@ -0,0 +1,880 @@
+// Command tftpd is a standalone TFTP server.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+	"github.com/ryanslade/tftp/server"
+)
+
+// Flags
+var (
+	configFile        string
+	port              int
+	listen            string
+	transparent       bool
+	listeners         int
+	singlePort        bool
+	dscp              int
+	readBuffer        int
+	workers           int
+	duplicateWindow   time.Duration
+	writeBuffer       int
+	inetd             bool
+	sandboxed         bool
+	chrooted          bool
+	runAs             string
+	checkConfig       bool
+	grace             time.Duration
+	idleTimeout       time.Duration
+	maxDuration       time.Duration
+	retransmitTimeout time.Duration
+	retries           int
+	maxBlockTimeout   time.Duration
+	maxTransfers      int
+	queueTimeout      time.Duration
+	priorities        string
+	requestRate       float64
+	requestRatePerIP  float64
+	requestBurst      int
+	rejectLimited     bool
+	maxBandwidth      int64
+	clientBandwidth   int64
+	transferBandwidth int64
+	clientQuota       int64
+	quotaWindow       time.Duration
+	allow             string
+	deny              string
+	dropDenied        bool
+	denyFiles         string
+	fileMetrics       bool
+	fileMetricGroups  string
+	errorMessages     string
+	hideErrorDetails  bool
+	octetOnly         bool
+	dropBogons        bool
+	allowHidden       bool
+	noSymlinks        bool
+	keepPartial       bool
+	resumable         bool
+	logLevel          string
+	accessLog         string
+	resolveHostnames  bool
+	history           string
+	logFormat         string
+	summaryInterval   time.Duration
+	trace             string
+	statsdAddr        string
+	statsdPrefix      string
+	statsdTags        string
+	adminAddr         string
+	webhooks          string
+	webhookEvents     string
+	adminTokenFile    string
+	root              string
+	uploadRoot        string
+	uploadOnly        bool
+	honeypot          bool
+	honeypotError     string
+	overwrite         string
+	concurrentUploads string
+	createDirs        bool
+	uploadValidator   string
+	validatorTimeout  time.Duration
+	uploadPerm        string
+	uploadOwner       string
+	minFreeSpace      int64
+	s3Endpoint        string
+	s3Bucket          string
+	s3Prefix          string
+	s3Region          string
+	cacheSize         int64
+	coalesceReads     int64
+	openFiles         int
+	cacheTTL          time.Duration
+	preload           string
+	remapFile         string
+	templates         string
+	pxe               bool
+	pxeFallback       string
+	checksums         bool
+)
+
+func init() {
+	flag.StringVar(&configFile, "config", "", "TOML file setting any of these flags by name, reread on SIGHUP. Flags given on the command line take precedence")
+	flag.IntVar(&port, "port", 69, "Port to listen on")
+	flag.StringVar(&listen, "listen", "", "Address to listen on, as host:port or a bare IP using -port, defaults to every interface")
+	flag.BoolVar(&transparent, "transparent", false, "Accept requests redirected by a TPROXY rule and reply from their original destination (Linux only)")
+	flag.IntVar(&listeners, "listeners", 1, "Number of SO_REUSEPORT sockets to read requests from, spreading bursts across cores (Linux only)")
+	flag.BoolVar(&singlePort, "single-port", false, "Send and receive all transfer traffic on the listening port, for clients behind NAT or firewalls only allowing it")
+	flag.IntVar(&dscp, "dscp", 0, "DSCP value, 0 to 63, to mark outgoing packets with, e.g. 8 for CS1")
+	flag.DurationVar(&duplicateWindow, "duplicate-window", 5*time.Second, "How long retransmitted requests are ignored while their transfer runs, 0 to serve every copy")
+	flag.IntVar(&workers, "workers", 0, "Goroutines per listener checking and parsing requests, defaults to the number of CPUs")
+	flag.IntVar(&readBuffer, "rcvbuf", 0, "Size in bytes of the kernel receive buffer of each socket, 0 for the system default. Raise it if requests are dropped during boot storms")
+	flag.IntVar(&writeBuffer, "sndbuf", 0, "Size in bytes of the kernel send buffer of each socket, 0 for the system default")
+	flag.BoolVar(&inetd, "inetd", false, "Serve the single request waiting on the socket inherited as stdin and exit, for use from inetd with wait")
+	flag.DurationVar(&grace, "grace", 30*time.Second, "How long to let active transfers finish on SIGINT or SIGTERM")
+	flag.DurationVar(&idleTimeout, "idle-timeout", 30*time.Second, "Abandon a transfer when nothing is heard from the client for this long, 0 to wait forever")
+	flag.DurationVar(&maxDuration, "max-duration", 0, "Abandon a transfer, sending the client an ERROR, once it has run for this long, 0 for no limit")
+	flag.DurationVar(&retransmitTimeout, "timeout", time.Second, "How long to wait for the client's reply before resending the last packet, 0 to never resend")
+	flag.IntVar(&retries, "retries", 5, "How many times to resend a packet before abandoning the transfer")
+	flag.DurationVar(&maxBlockTimeout, "max-block-timeout", 10*time.Second, "Upper bound on the wait for a reply, which doubles with each resend of the same packet")
+	flag.IntVar(&maxTransfers, "max-transfers", 0, "Maximum number of concurrent transfers, 0 for no limit")
+	flag.DurationVar(&queueTimeout, "queue-timeout", 0, "How long a request waits for a free transfer slot before being refused")
+	flag.StringVar(&priorities, "priorities", "", "Comma separated pattern=priority pairs, with priority low, normal or high, e.g. vmlinuz*=high,wallpapers/*=low. Higher priorities get freed -max-transfers slots and shared bandwidth first")
+	flag.Float64Var(&requestRate, "request-rate", 0, "Maximum requests per second accepted from all clients, 0 for no limit")
+	flag.Float64Var(&requestRatePerIP, "request-rate-per-ip", 0, "Maximum requests per second accepted from each client IP, 0 for no limit")
+	flag.IntVar(&requestBurst, "request-burst", 1, "How many requests may arrive at once before -request-rate limits apply")
+	flag.BoolVar(&rejectLimited, "reject-rate-limited", false, "Answer rate limited requests with an ERROR rather than dropping them")
+	flag.Int64Var(&maxBandwidth, "max-bandwidth", 0, "Maximum bytes per second sent by all transfers together, 0 for no limit")
+	flag.Int64Var(&clientBandwidth, "client-bandwidth", 0, "Maximum bytes per second sent to each client IP, 0 for no limit")
+	flag.Int64Var(&transferBandwidth, "transfer-bandwidth", 0, "Maximum bytes per second sent by each transfer, 0 for no limit")
+	flag.Int64Var(&clientQuota, "client-quota", 0, "Maximum bytes sent to and received from each client IP per -client-quota-window, 0 for no limit")
+	flag.DurationVar(&quotaWindow, "client-quota-window", time.Hour, "Sliding window -client-quota applies over")
+	flag.StringVar(&allow, "allow", "", "Comma separated CIDRs or IPs allowed to make requests, defaults to everyone")
+	flag.StringVar(&deny, "deny", "", "Comma separated CIDRs or IPs refused, taking precedence over -allow")
+	flag.BoolVar(&dropDenied, "drop-denied", false, "Drop requests refused by -allow or -deny without replying")
+	flag.BoolVar(&dropBogons, "drop-bogons", false, "Drop requests from private, loopback, link local and reserved addresses, for servers facing the internet")
+	flag.StringVar(&errorMessages, "error-messages", "", "Comma separated code=text pairs replacing the text of ERROR packets sent to clients, e.g. 1=No such image")
+	flag.BoolVar(&hideErrorDetails, "hide-error-details", false, "Send \"Internal error\" to clients in place of the text of unexpected errors")
+	flag.BoolVar(&octetOnly, "octet-only", false, "Refuse netascii and mail mode requests, serving only byte for byte octet transfers")
+	flag.StringVar(&denyFiles, "deny-files", "", "Comma separated patterns of files never served or accepted, e.g. *.key,secrets/*")
+	flag.BoolVar(&allowHidden, "allow-hidden", false, "Serve and accept files whose name or directory starts with a dot, refused by default")
+	flag.BoolVar(&noSymlinks, "no-symlinks", false, "Refuse paths through symlinks, even ones pointing inside the root. Symlinks leading outside it are always refused")
+	flag.BoolVar(&keepPartial, "keep-partial", false, "Keep what arrived of failed uploads with a .partial suffix rather than deleting it")
+	flag.BoolVar(&resumable, "resumable-uploads", false, "Let clients resume interrupted uploads from a byte offset with the nonstandard offset option. Implies -keep-partial")
+	flag.StringVar(&root, "root", "", "Directory to serve files from and store uploads in, defaults to the working directory")
+	flag.StringVar(&uploadRoot, "upload-root", "", "Directory to store uploads in, defaults to -root")
+	flag.BoolVar(&uploadOnly, "upload-only", false, "Accept uploads but refuse all read requests")
+	flag.BoolVar(&honeypot, "honeypot", false, "Serve nothing, logging every request in full and refusing it with -honeypot-error, to spot rogue PXE clients and scanners")
+	flag.StringVar(&honeypotError, "honeypot-error", "", "The code=text ERROR -honeypot refuses requests with, e.g. 2=Access violation, defaults to 1=File not found")
+	flag.StringVar(&overwrite, "overwrite", "allow", "What to do when an upload names an existing file: allow, reject or version")
+	flag.StringVar(&concurrentUploads, "concurrent-uploads", "reject", "What to do with an upload of a file another client is still uploading: reject, wait or allow")
+	flag.BoolVar(&createDirs, "mkdir", false, "Create missing parent directories of uploads")
+	flag.StringVar(&uploadPerm, "upload-perm", "", "Octal mode for uploaded files, e.g. 0640, instead of 0666 less the umask")
+	flag.StringVar(&uploadOwner, "upload-owner", "", "User and optionally group for uploaded files, as user[:group]")
+	flag.Int64Var(&minFreeSpace, "min-free-space", 0, "Refuse uploads with Disk full while the upload root's file system has fewer bytes than this free, counting the size clients announce, 0 for no check")
+	flag.StringVar(&uploadValidator, "upload-validator", "", "Command run on each completed upload with its path appended, rejecting the upload unless it exits with status 0")
+	flag.DurationVar(&validatorTimeout, "upload-validator-timeout", 10*time.Second, "How long -upload-validator may run before the upload is rejected")
+	flag.StringVar(&s3Bucket, "s3-bucket", "", "Serve reads from this S3 bucket instead of -root, with credentials from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	flag.StringVar(&s3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "Base URL of the S3 compatible store")
+	flag.StringVar(&s3Prefix, "s3-prefix", "", "Prefix of the objects served from -s3-bucket, e.g. tftp/")
+	flag.StringVar(&s3Region, "s3-region", "us-east-1", "Region used to sign S3 requests")
+	flag.Int64Var(&cacheSize, "cache-size", 0, "Cache up to this many bytes of served files in memory, 0 for no cache")
+	flag.Int64Var(&coalesceReads, "coalesce-reads", 0, "Read files up to this many bytes once for all the downloads of them running at the same time, 0 to read per download")
+	flag.IntVar(&openFiles, "open-files", 0, "Keep this many of the most recently downloaded files open, saving an open and close per download, 0 for none")
+	flag.DurationVar(&cacheTTL, "cache-ttl", 0, "How long a cached file is served before it is read again, 0 to keep it until evicted. Uploads aren't seen by readers until then")
+	flag.StringVar(&preload, "preload", "", "Comma separated files or patterns, e.g. images/*.img, to read into the -cache-size cache at startup")
+	flag.StringVar(&remapFile, "remap", "", "File of tftpd-hpa style rules rewriting requested filenames")
+	flag.StringVar(&templates, "template", "", "Comma separated pattern=file pairs rendering the Go template in file for reads matching pattern, e.g. pxelinux.cfg/01-*=host.tmpl")
+	flag.BoolVar(&pxe, "pxe", false, "Log the MAC and IP from pxelinux.cfg lookups with every request from the client")
+	flag.StringVar(&pxeFallback, "pxe-fallback", "", "Serve this file in place of missing pxelinux.cfg hex IP configs, implies -pxe")
+	flag.BoolVar(&checksums, "checksums", false, "Serve the digest of name for missing name.sha256 and name.md5 files")
+	flag.StringVar(&logLevel, "log-level", "info", "Minimum level to log: debug, info, warn or error")
+	flag.StringVar(&logFormat, "log-format", "text", "Format of the log and access log: text or json")
+	flag.DurationVar(&summaryInterval, "summary-interval", 0, "Log a summary of transfers, bytes, peak concurrency and dropped requests this often, e.g. 15m, 0 for none")
+	flag.StringVar(&accessLog, "access-log", "", "Write a record of every transfer to this file, - for stdout")
+	flag.BoolVar(&resolveHostnames, "resolve-hostnames", false, "Log the client's hostname, found by reverse DNS, with its transfers")
+	flag.StringVar(&history, "history", "", "Append a JSON record of every transfer to this file, for querying with tftpd history")
+	flag.StringVar(&statsdAddr, "statsd", "", "Send transfer metrics to the StatsD server at this host:port")
+	flag.StringVar(&statsdPrefix, "statsd-prefix", "tftp.", "Prefix for StatsD metric names")
+	flag.StringVar(&statsdTags, "statsd-tags", "", "Comma separated DogStatsD tags added to every metric, e.g. env:prod")
+	flag.StringVar(&webhooks, "webhook", "", "Comma separated URLs to POST transfer events to as JSON")
+	flag.StringVar(&webhookEvents, "webhook-events", "", "Comma separated events to send to -webhook: start, success and failure, defaults to all")
+	flag.StringVar(&adminAddr, "admin-addr", "", "Serve the HTTP admin API on this address, e.g. 127.0.0.1:8069")
+	flag.StringVar(&adminTokenFile, "admin-token-file", "", "File holding the bearer token required by the admin API")
+	flag.BoolVar(&fileMetrics, "file-metrics", false, "Count the downloads of each file in the admin API's /vars")
+	flag.StringVar(&fileMetricGroups, "file-metric-groups", "", "Comma separated patterns of files counted together by -file-metrics, e.g. pxelinux.cfg/*,images/*.iso")
+	flag.StringVar(&trace, "trace", "", "Write an NDJSON event for every packet to this file, - for stdout")
+	flag.BoolVar(&sandboxed, "sandbox", false, "Once started, confine tftpd to its root, upload root, logs and config with Landlock, and deny it syscalls it never needs, such as execve and mount, with a seccomp denylist. Linux only, and needs a tftpd built with CGO_ENABLED=0")
+	flag.BoolVar(&chrooted, "chroot", false, "Once listening, chroot into -root, which must hold -upload-root. Needs -user when run as root. Other files named by flags are opened beforehand. Disables reloads")
+	flag.StringVar(&runAs, "user", "", "Once listening, and chrooted with -chroot, switch to this user[:group], e.g. tftp or tftp:tftp. Disables reloads")
+	flag.BoolVar(&checkConfig, "check-config", false, "Check the config file and flags, that -root exists and that the ports are free, then exit, non-zero with the problems found if any")
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		if err := runHistory(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	flag.Parse()
+	// Flags given on the command line take precedence over the config file
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if configFile != "" {
+		if err := loadConfig(configFile, explicit); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var owner *server.FileOwner
+	if runAs != "" {
+		if transparent {
+			log.Fatal("-user can't be combined with -transparent, which needs privileges for every transfer")
+		}
+		var err error
+		if owner, err = parseOwner(runAs); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if sandboxed && uploadValidator != "" {
+		log.Fatal("-sandbox can't be combined with -upload-validator, which runs commands")
+	}
+	var chrootDir string
+	if chrooted {
+		if uploadValidator != "" {
+			log.Fatal("-chroot can't be combined with -upload-validator, which runs commands")
+		}
+		if err := checkChrootUser(os.Geteuid()); err != nil {
+			log.Fatal(err)
+		}
+		var err error
+		if chrootDir, err = prepareChroot(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	in, err := newInstance()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if checkConfig {
+		err := checkInstance(in)
+		in.close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Println("Configuration OK")
+		return
+	}
+
+	// The admin API serves whichever server is current after reloads
+	var adminToken string
+	var adminHandler atomic.Value
+	if adminAddr != "" {
+		if adminTokenFile == "" {
+			log.Fatal("-admin-addr requires -admin-token-file")
+		}
+		token, err := os.ReadFile(adminTokenFile)
+		if err != nil {
+			log.Fatalf("Error reading admin token: %v", err)
+		}
+		adminToken = strings.TrimSpace(string(token))
+		adminHandler.Store(in.s.AdminHandler(adminToken))
+		admin := &http.Server{Addr: adminAddr, Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			adminHandler.Load().(http.Handler).ServeHTTP(w, r)
+		})}
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				in.logger.Error("Admin API failed", "err", err)
+			}
+		}()
+		defer admin.Close()
+	}
+
+	// Privileges are given up once listening, as binding port 69 needs them
+	if chrooted || owner != nil {
+		if !inetd {
+			if in.listeners, err = in.s.Listen(); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if chrooted {
+			if err := enterChroot(); err != nil {
+				log.Fatal(err)
+			}
+			in.logger.Info("Chrooted", "root", chrootDir)
+		}
+		if owner != nil {
+			if err := dropPrivileges(owner); err != nil {
+				log.Fatal(err)
+			}
+			in.logger.Info("Dropped privileges", "uid", owner.UID, "gid", owner.GID)
+		}
+	}
+
+	if sandboxed {
+		if err := sandbox(sandboxPaths()); err != nil {
+			log.Fatal(err)
+		}
+		in.logger.Info("Sandboxed")
+	}
+	in.start()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	statsSigs := make(chan os.Signal, 1)
+	if len(statsSignals) > 0 {
+		signal.Notify(statsSigs, statsSignals...)
+	}
+
+	for {
+		select {
+		case err := <-in.errc:
+			if inetd && err == nil {
+				in.close()
+				return
+			}
+			// The admin API drains the server by shutting it down
+			if !errors.Is(err, server.ErrServerClosed) {
+				in.logger.Error("Server failed", "err", err)
+				os.Exit(1)
+			}
+			in.logger.Info("Draining")
+		case <-statsSigs:
+			in.s.LogStats()
+			continue
+		case sig := <-sigs:
+			if sig == syscall.SIGHUP {
+				if configFile == "" || inetd {
+					in.logger.Info("Ignoring SIGHUP, there is no config file to reload")
+					continue
+				}
+				if chrooted || owner != nil {
+					in.logger.Info("Ignoring SIGHUP, reloads can't rebind or reopen files after -chroot or -user")
+					continue
+				}
+				next, err := reload(in, explicit)
+				if err != nil {
+					in.logger.Error("Reload failed, keeping the current configuration", "err", err)
+					continue
+				}
+				in = next
+				if adminHandler.Load() != nil {
+					adminHandler.Store(in.s.AdminHandler(adminToken))
+				}
+				in.logger.Info("Reloaded configuration", "config", configFile)
+				continue
+			}
+			in.logger.Info("Shutting down", "signal", sig.String())
+		}
+		break
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := in.s.Shutdown(ctx); err != nil {
+		in.logger.Warn("Transfers didn't finish within the grace period", "grace", grace)
+	}
+	in.close()
+}
+
+// instance is a server built from the flags, along with the files and
+// connections it uses.
+type instance struct {
+	s      *server.Server
+	logger *slog.Logger
+	errc   chan error
+
+	// listeners are bound before start when privileges are given up
+	listeners []net.PacketConn
+	closers   []io.Closer
+}
+
+// newInstance builds a server from the flags.
+func newInstance() (in *instance, err error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return nil, fmt.Errorf("Invalid -log-level %q", logLevel)
+	}
+	if logFormat != "text" && logFormat != "json" {
+		return nil, fmt.Errorf("Invalid -log-format %q", logFormat)
+	}
+	logger := slog.New(newLogHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+
+	in = &instance{logger: logger, errc: make(chan error, 1)}
+	// Error returns clear in, so close the files opened so far through a
+	// copy
+	opened := in
+	defer func() {
+		if err != nil {
+			opened.close()
+		}
+	}()
+
+	overwritePolicy, err := server.ParseOverwritePolicy(overwrite)
+	if err != nil {
+		return nil, err
+	}
+	conflictPolicy, err := server.ParseUploadConflictPolicy(concurrentUploads)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &server.Server{
+		Addr:                   listenAddr(listen, port),
+		Transparent:            transparent,
+		ReusePort:              listeners,
+		SinglePort:             singlePort,
+		DSCP:                   dscp,
+		HandshakeWorkers:       workers,
+		DuplicateWindow:        duplicateWindow,
+		ReadBuffer:             readBuffer,
+		WriteBuffer:            writeBuffer,
+		IdleTimeout:            idleTimeout,
+		MaxTransferDuration:    maxDuration,
+		RetransmitTimeout:      retransmitTimeout,
+		Retries:                retries,
+		MaxBlockTimeout:        maxBlockTimeout,
+		MaxConcurrentTransfers: maxTransfers,
+		TransferQueueTimeout:   queueTimeout,
+		RequestRate:            requestRate,
+		RequestRatePerIP:       requestRatePerIP,
+		RequestBurst:           requestBurst,
+		RejectRateLimited:      rejectLimited,
+		MaxBandwidth:           maxBandwidth,
+		MaxClientBandwidth:     clientBandwidth,
+		MaxTransferBandwidth:   transferBandwidth,
+		ClientQuota:            clientQuota,
+		ClientQuotaWindow:      quotaWindow,
+		Root:                   root,
+		UploadRoot:             uploadRoot,
+		MinFreeSpace:           minFreeSpace,
+		UploadOnly:             uploadOnly,
+		Honeypot:               honeypot,
+		Overwrite:              overwritePolicy,
+		ConcurrentUploads:      conflictPolicy,
+		CoalesceReads:          coalesceReads,
+		OpenFiles:              openFiles,
+		CreateDirs:             createDirs,
+		DropDenied:             dropDenied,
+		DropBogons:             dropBogons,
+		AllowHidden:            allowHidden,
+		NoSymlinks:             noSymlinks,
+		KeepPartialUploads:     keepPartial,
+		ResumableUploads:       resumable,
+		HideErrorDetails:       hideErrorDetails,
+		OctetOnly:              octetOnly,
+		ResolveHostnames:       resolveHostnames,
+		FileMetrics:            fileMetrics,
+		Logger:                 logger,
+		SummaryInterval:        summaryInterval,
+	}
+
+	if duplicateWindow == 0 {
+		// Zero means the default to the server
+		s.DuplicateWindow = -1
+	}
+
+	if denyFiles != "" {
+		s.DenyFiles = strings.Split(denyFiles, ",")
+	}
+	if fileMetricGroups != "" {
+		s.FileMetricPatterns = strings.Split(fileMetricGroups, ",")
+	}
+
+	if s.Priorities, err = parsePriorities(priorities); err != nil {
+		return nil, err
+	}
+	if s.ErrorMessages, err = parseErrorMessages(errorMessages); err != nil {
+		return nil, err
+	}
+	if honeypotError != "" {
+		messages, err := parseErrorMessages(honeypotError)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) != 1 || strings.Contains(honeypotError, ",") {
+			return nil, fmt.Errorf("Invalid -honeypot-error %q, expected a single code=text", honeypotError)
+		}
+		for code, message := range messages {
+			s.HoneypotError = &common.Error{Code: code, Message: message}
+		}
+	}
+	if s.Allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if s.Deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+
+	if remapFile != "" {
+		f, err := os.Open(remapFile)
+		if err != nil {
+			return nil, err
+		}
+		rules, err := server.ParseRemapRules(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		s.Remap = rules
+	}
+
+	if pxe || pxeFallback != "" {
+		p := &server.PXELinux{Fallback: pxeFallback}
+		s.Filters = append(s.Filters, p.Filter)
+		s.Middleware = append(s.Middleware, p.Middleware)
+	}
+	if checksums {
+		sums := &server.Checksums{}
+		s.Middleware = append(s.Middleware, sums.Middleware)
+	}
+
+	var readBackend server.Backend
+	if s3Bucket != "" {
+		readBackend = &server.S3Backend{
+			Endpoint:     s3Endpoint,
+			Bucket:       s3Bucket,
+			Prefix:       s3Prefix,
+			Region:       s3Region,
+			AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}
+	}
+	// The disk as served without a cache or -template in front of it
+	var rootBackend server.Backend = server.Dir(root)
+	if noSymlinks {
+		rootBackend = server.Dir(root).NoSymlinks()
+	}
+	if cacheSize > 0 {
+		if readBackend == nil {
+			readBackend = rootBackend
+		}
+		cache := server.NewCachedBackend(readBackend, cacheSize)
+		cache.TTL = cacheTTL
+		readBackend = cache
+		if preload != "" {
+			n, err := cache.Preload(strings.Split(preload, ",")...)
+			if err != nil {
+				return nil, err
+			}
+			logger.Info("Preloaded files", "files", n, "bytes", cache.Stats().Bytes)
+		}
+		// Pick up files replaced on disk without waiting for -cache-ttl
+		if s3Bucket == "" {
+			w, err := cache.Watch()
+			if err != nil {
+				logger.Warn("Cached files are served until they expire, not as soon as they change", "err", err)
+			} else {
+				in.closers = append(in.closers, w)
+			}
+		}
+	} else if preload != "" {
+		return nil, fmt.Errorf("-preload requires -cache-size")
+	}
+	if readBackend != nil {
+		s.ReadHandler = server.BackendHandler{Backend: readBackend}
+	}
+
+	if templates != "" {
+		mux := server.NewServeMux()
+		for _, spec := range strings.Split(templates, ",") {
+			pattern, file, ok := strings.Cut(spec, "=")
+			if !ok {
+				return nil, fmt.Errorf("Invalid -template %q, expected pattern=file", spec)
+			}
+			t, err := template.ParseFiles(file)
+			if err != nil {
+				return nil, err
+			}
+			mux.HandleRead(pattern, server.TemplateHandler(t))
+		}
+		fallback := s.ReadHandler
+		if fallback == nil {
+			fallback = server.BackendHandler{Backend: rootBackend}
+		}
+		mux.HandleRead("/", fallback)
+		s.ReadHandler = mux
+	}
+	// These only wrap reads straight from -root
+	if s.ReadHandler != nil {
+		if coalesceReads > 0 {
+			return nil, fmt.Errorf("-coalesce-reads can't be combined with -cache-size, -s3-bucket or -template")
+		}
+		if openFiles > 0 {
+			return nil, fmt.Errorf("-open-files can't be combined with -cache-size, -s3-bucket or -template")
+		}
+	}
+
+	if uploadPerm != "" {
+		perm, err := strconv.ParseUint(uploadPerm, 8, 32)
+		if err != nil || perm > 0777 {
+			return nil, fmt.Errorf("Invalid -upload-perm %q", uploadPerm)
+		}
+		s.UploadPerm = os.FileMode(perm)
+	}
+	if uploadOwner != "" {
+		owner, err := parseOwner(uploadOwner)
+		if err != nil {
+			return nil, err
+		}
+		s.UploadOwner = owner
+	}
+
+	if accessLog != "" {
+		w, err := openLog(accessLog)
+		if err != nil {
+			return nil, err
+		}
+		in.closers = append(in.closers, w)
+		s.AccessLog = slog.New(newLogHandler(w, nil))
+	}
+	if history != "" {
+		w, err := openLog(history)
+		if err != nil {
+			return nil, err
+		}
+		in.closers = append(in.closers, w)
+		s.History = w
+	}
+	if trace != "" {
+		w, err := openLog(trace)
+		if err != nil {
+			return nil, err
+		}
+		in.closers = append(in.closers, w)
+		s.Tracer = common.NewTracer(w)
+	}
+	if statsdAddr != "" {
+		var tags []string
+		if statsdTags != "" {
+			tags = strings.Split(statsdTags, ",")
+		}
+		statsd, err := server.DialStatsD(statsdAddr, statsdPrefix, tags...)
+		if err != nil {
+			return nil, err
+		}
+		in.closers = append(in.closers, statsd)
+		s.StatsD = statsd
+	}
+
+	if webhooks != "" {
+		var events []string
+		if webhookEvents != "" {
+			events = strings.Split(webhookEvents, ",")
+			for _, e := range events {
+				if e != server.WebhookStart && e != server.WebhookSuccess && e != server.WebhookFailure {
+					return nil, fmt.Errorf("Invalid -webhook-events %q", e)
+				}
+			}
+		}
+		for _, url := range strings.Split(webhooks, ",") {
+			s.Webhooks = append(s.Webhooks, &server.Webhook{URL: url, Events: events})
+		}
+	}
+
+	if command := strings.Fields(uploadValidator); len(command) > 0 {
+		s.UploadValidators = []server.UploadValidator{
+			server.CommandValidator{Command: command, Timeout: validatorTimeout},
+		}
+	}
+
+	in.s = s
+	return in, nil
+}
+
+// start serves requests in the background, sending the result to in.errc.
+func (in *instance) start() {
+	slog.SetDefault(in.logger)
+	if inetd {
+		conn, err := net.FilePacketConn(os.Stdin)
+		if err != nil {
+			in.errc <- fmt.Errorf("Error using stdin as the inetd socket: %v", err)
+			return
+		}
+		go func() { in.errc <- in.s.ServeOne(conn) }()
+		return
+	}
+	if in.listeners != nil {
+		go func() { in.errc <- in.s.ServeListeners(in.listeners) }()
+		return
+	}
+	go func() { in.errc <- in.s.ListenAndServe() }()
+}
+
+// close closes the files and connections used by in's server.
+func (in *instance) close() {
+	for _, c := range in.closers {
+		c.Close()
+	}
+}
+
+// reload rereads the config file and replaces in with a server built from
+// it, taking over in's transfer slots, quotas, upload locks and bandwidth
+// limits. in stops accepting requests first so the new server can bind the
+// same address, and its active transfers are given the grace period to
+// finish. In single port mode in's listener carries its transfers, so the
+// new server only starts once they are done.
+func reload(in *instance, explicit map[string]bool) (*instance, error) {
+	if err := loadConfig(configFile, explicit); err != nil {
+		return nil, err
+	}
+	next, err := newInstance()
+	if err != nil {
+		return nil, err
+	}
+	// Transfers still draining count against the new server's limits
+	next.s.TakeOver(in.s)
+	ctx, cancel := context.WithTimeout(context.Background(), grace)
+	go func() {
+		defer cancel()
+		if err := in.s.Shutdown(ctx); err != nil {
+			in.logger.Warn("Transfers didn't finish within the grace period", "grace", grace)
+		}
+		in.close()
+	}()
+	if err := <-in.errc; !errors.Is(err, server.ErrServerClosed) {
+		in.logger.Error("Server failed", "err", err)
+	}
+	next.start()
+	return next, nil
+}
+
+// listenAddr returns the address to listen on given the -listen and -port
+// flags.
+func listenAddr(listen string, port int) string {
+	if _, err := netip.ParseAddr(listen); err == nil || listen == "" {
+		return net.JoinHostPort(listen, strconv.Itoa(port))
+	}
+	return listen
+}
+
+// newLogHandler returns a handler writing to w in the -log-format format.
+func newLogHandler(w io.Writer, opts *slog.HandlerOptions) slog.Handler {
+	if logFormat == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// openLog opens a file named by a flag such as -trace for appending, with -
+// meaning stdout.
+func openLog(name string) (io.WriteCloser, error) {
+	if name == "-" {
+		// Left open when the server using it is replaced on reload
+		return nopCloser{os.Stdout}, nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening %s: %v", name, err)
+	}
+	return f, nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// parseOwner resolves a user[:group] flag, accepting names or numeric IDs.
+// Without a group the user's primary group is used.
+func parseOwner(spec string) (*server.FileOwner, error) {
+	userName, groupName, hasGroup := strings.Cut(spec, ":")
+	u, err := user.Lookup(userName)
+	if err != nil {
+		if u, err = user.LookupId(userName); err != nil {
+			return nil, fmt.Errorf("Unknown user %q", userName)
+		}
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, fmt.Errorf("User %q has no numeric ID", userName)
+	}
+	gidString := u.Gid
+	if hasGroup {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			if g, err = user.LookupGroupId(groupName); err != nil {
+				return nil, fmt.Errorf("Unknown group %q", groupName)
+			}
+		}
+		gidString = g.Gid
+	}
+	gid, err := strconv.Atoi(gidString)
+	if err != nil {
+		return nil, fmt.Errorf("Group %q has no numeric ID", groupName)
+	}
+	return &server.FileOwner{UID: uid, GID: gid}, nil
+}
+
+// parseErrorMessages parses a comma separated list of code=text pairs.
+func parseErrorMessages(list string) (map[common.ErrorCode]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	messages := make(map[common.ErrorCode]string)
+	for _, field := range strings.Split(list, ",") {
+		codeText, message, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid error message %q, expected code=text", field)
+		}
+		code, err := strconv.ParseUint(strings.TrimSpace(codeText), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid error code %q", codeText)
+		}
+		messages[common.ErrorCode(code)] = message
+	}
+	return messages, nil
+}
+
+// parsePriorities parses a comma separated list of pattern=priority pairs.
+func parsePriorities(list string) ([]server.PriorityRule, error) {
+	if list == "" {
+		return nil, nil
+	}
+	var rules []server.PriorityRule
+	for _, field := range strings.Split(list, ",") {
+		pattern, name, ok := strings.Cut(field, "=")
+		if !ok {
+			return nil, fmt.Errorf("Invalid priority %q, expected pattern=priority", field)
+		}
+		p, err := server.ParsePriority(strings.TrimSpace(name))
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, server.PriorityRule{Pattern: pattern, Priority: p})
+	}
+	return rules, nil
+}
+
+// parsePrefixes parses a comma separated list of CIDRs, where a bare IP
+// stands for just that address.
+func parsePrefixes(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !strings.Contains(field, "/") {
+			ip, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid address %q: %v", field, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q: %v", field, err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
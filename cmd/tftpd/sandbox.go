@@ -0,0 +1,56 @@
+package main
+
+import "strings"
+
+// sandboxSystemPaths are read by the standard library once sandboxed: the
+// resolver's configuration, for -resolve-hostnames and webhooks, and CA
+// certificates, for S3 and HTTPS webhooks.
+var sandboxSystemPaths = []string{
+	"/etc/resolv.conf",
+	"/etc/hosts",
+	"/etc/nsswitch.conf",
+	"/etc/ssl",
+	"/etc/pki",
+	"/etc/ca-certificates",
+	"/usr/share/ca-certificates",
+	"/usr/local/share/certs",
+}
+
+// sandboxPaths returns the files and directories the daemon reads and
+// writes once running, as configured by the flags. Those read include the
+// config file and the files it names, so reloads keep working as long as
+// they don't name new ones.
+func sandboxPaths() (read, write []string) {
+	dir := func(d string) string {
+		if d == "" {
+			return "."
+		}
+		return d
+	}
+	read = append(read, sandboxSystemPaths...)
+	read = append(read, dir(root))
+	for _, f := range []string{configFile, remapFile, adminTokenFile} {
+		if f != "" {
+			read = append(read, f)
+		}
+	}
+	if templates != "" {
+		for _, spec := range strings.Split(templates, ",") {
+			if _, file, ok := strings.Cut(spec, "="); ok {
+				read = append(read, file)
+			}
+		}
+	}
+
+	uploads := uploadRoot
+	if uploads == "" {
+		uploads = root
+	}
+	write = append(write, dir(uploads))
+	for _, f := range []string{accessLog, history, trace} {
+		if f != "" && f != "-" {
+			write = append(write, f)
+		}
+	}
+	return read, write
+}
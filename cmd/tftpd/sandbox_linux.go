@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+// From linux/landlock.h.
+const (
+	sysLandlockCreateRuleset = 444
+	sysLandlockAddRule       = 445
+	sysLandlockRestrictSelf  = 446
+
+	landlockCreateRulesetVersion = 1
+	landlockRulePathBeneath      = 1
+
+	accessExecute    = 1 << 0
+	accessWriteFile  = 1 << 1
+	accessReadFile   = 1 << 2
+	accessReadDir    = 1 << 3
+	accessRemoveDir  = 1 << 4
+	accessRemoveFile = 1 << 5
+	accessMakeDir    = 1 << 7
+	accessMakeReg    = 1 << 8
+	accessRefer      = 1 << 13
+	accessTruncate   = 1 << 14
+
+	// accessABI1 are all the rights known to the first Landlock ABI
+	accessABI1 = 1<<13 - 1
+	// fileAccess are the rights that apply to files, rather than the
+	// directories holding them.
+	fileAccess = accessExecute | accessWriteFile | accessReadFile | accessTruncate
+
+	readAccess  = accessReadFile | accessReadDir
+	writeAccess = readAccess | accessWriteFile | accessRemoveDir | accessRemoveFile |
+		accessMakeDir | accessMakeReg | accessRefer | accessTruncate
+)
+
+// From linux/seccomp.h, linux/filter.h and friends.
+const (
+	prSetNoNewPrivs = 38
+	// oPath is O_PATH, missing from package syscall
+	oPath = 0x200000
+
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTsync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+
+	bpfLoadAbs = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJumpEq  = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJumpGE  = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfReturn  = 0x06 // BPF_RET | BPF_K
+)
+
+// sandbox confines the process to reading the files and directories in read
+// and writing those in write, with Landlock, and denies it the syscalls in
+// deniedSyscalls, with seccomp, so an exploit of the packet parsing can't
+// reach the rest of the system. Every thread is restricted, which Go only
+// supports in binaries built without cgo. Missing paths are skipped.
+//
+// The seccomp filter is a denylist hardening the process, not an allowlist
+// confining it: any syscall not listed, including those added by newer
+// kernels, is still allowed. The syscalls the Go runtime, resolver and
+// inotify make vary between Go and kernel versions, and an allowlist
+// missing one would crash the server after an upgrade. Landlock is what
+// confines the files it can reach.
+func sandbox(read, write []string) error {
+	abi, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return fmt.Errorf("Landlock isn't available: %v", errno)
+	}
+	handled := uint64(accessABI1)
+	if abi >= 2 {
+		handled |= accessRefer
+	}
+	if abi >= 3 {
+		handled |= accessTruncate
+	}
+	var attr [8]byte
+	binary.NativeEndian.PutUint64(attr[:], handled)
+	ruleset, _, errno := syscall.Syscall(sysLandlockCreateRuleset, uintptr(unsafe.Pointer(&attr[0])), uintptr(len(attr)), 0)
+	if errno != 0 {
+		return os.NewSyscallError("landlock_create_ruleset", errno)
+	}
+	defer syscall.Close(int(ruleset))
+
+	for _, p := range read {
+		if err := addLandlockRule(int(ruleset), p, readAccess&handled); err != nil {
+			return err
+		}
+	}
+	for _, p := range write {
+		if err := addLandlockRule(int(ruleset), p, writeAccess&handled); err != nil {
+			return err
+		}
+	}
+
+	// Required by both, and keeps exec'd setuid programs from escaping
+	if _, _, errno := syscall.AllThreadsSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return errors.New("Sandboxing needs a tftpd built with CGO_ENABLED=0, so every thread can be restricted")
+		}
+		return os.NewSyscallError("prctl", errno)
+	}
+	if _, _, errno := syscall.AllThreadsSyscall(sysLandlockRestrictSelf, ruleset, 0, 0); errno != 0 {
+		return os.NewSyscallError("landlock_restrict_self", errno)
+	}
+	return restrictSyscalls()
+}
+
+// addLandlockRule allows access beneath path, or to it if it is a file.
+func addLandlockRule(ruleset int, path string, access uint64) error {
+	fd, err := syscall.Open(path, oPath|syscall.O_CLOEXEC, 0)
+	if errors.Is(err, syscall.ENOENT) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error opening %s for the sandbox: %v", path, err)
+	}
+	defer syscall.Close(fd)
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("Error opening %s for the sandbox: %v", path, err)
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		access &= fileAccess
+	}
+
+	// struct landlock_path_beneath_attr is packed
+	var attr [12]byte
+	binary.NativeEndian.PutUint64(attr[:], access)
+	binary.NativeEndian.PutUint32(attr[8:], uint32(fd))
+	if _, _, errno := syscall.Syscall6(sysLandlockAddRule, uintptr(ruleset), landlockRulePathBeneath, uintptr(unsafe.Pointer(&attr[0])), 0, 0, 0); errno != 0 {
+		return fmt.Errorf("Error adding %s to the sandbox: %v", path, errno)
+	}
+	return nil
+}
+
+// sockFilter and sockFprog are struct sock_filter and struct sock_fprog.
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// restrictSyscalls makes deniedSyscalls fail with EPERM in every thread,
+// along with any syscall made through another architecture's calling
+// convention. Every other syscall is allowed. It does nothing where
+// deniedSyscalls isn't known.
+func restrictSyscalls() error {
+	if len(deniedSyscalls) == 0 {
+		return nil
+	}
+	deny := uint32(seccompRetErrno | uint32(syscall.EPERM))
+	prog := []sockFilter{
+		// seccomp_data.arch
+		{code: bpfLoadAbs, k: 4},
+		{code: bpfJumpEq, jt: 1, k: auditArch},
+		{code: bpfReturn, k: deny},
+		// seccomp_data.nr
+		{code: bpfLoadAbs, k: 0},
+	}
+	if syscallNumberLimit > 0 {
+		prog = append(prog,
+			sockFilter{code: bpfJumpGE, jf: 1, k: syscallNumberLimit},
+			sockFilter{code: bpfReturn, k: deny},
+		)
+	}
+	for i, nr := range deniedSyscalls {
+		// Jump past the rest and the allow to the deny
+		prog = append(prog, sockFilter{code: bpfJumpEq, jt: uint8(len(deniedSyscalls) - i), k: nr})
+	}
+	prog = append(prog,
+		sockFilter{code: bpfReturn, k: seccompRetAllow},
+		sockFilter{code: bpfReturn, k: deny},
+	)
+
+	fprog := sockFprog{len: uint16(len(prog)), filter: &prog[0]}
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	r, _, errno := syscall.Syscall(sysSeccomp, seccompSetModeFilter, seccompFilterFlagTsync, uintptr(unsafe.Pointer(&fprog)))
+	runtime.KeepAlive(prog)
+	if errno != 0 {
+		return os.NewSyscallError("seccomp", errno)
+	}
+	if r != 0 {
+		return fmt.Errorf("Error restricting syscalls, thread %d couldn't be synchronized", r)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// sandboxTestEnv names the directory a test process re-run by TestSandbox
+// sandboxes itself in.
+const sandboxTestEnv = "TFTPD_SANDBOX_TEST_DIR"
+
+func TestSandbox(t *testing.T) {
+	if dir := os.Getenv(sandboxTestEnv); dir != "" {
+		runSandboxed(dir)
+		os.Exit(0)
+	}
+
+	dir := t.TempDir()
+	for _, d := range []string{"ro", "rw"} {
+		if err := os.Mkdir(filepath.Join(dir, d), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, f := range []string{"ro/kernel", "outside"} {
+		if err := os.WriteFile(filepath.Join(dir, f), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Sandboxing can't be undone, so it happens in a process of its own
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSandbox$")
+	cmd.Env = append(os.Environ(), sandboxTestEnv+"="+dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%v: %s", err, out)
+	}
+	if msg, ok := strings.CutPrefix(string(out), "error: "); ok {
+		t.Skipf("Can't sandbox: %s", msg)
+	}
+
+	expected := []string{
+		"read ro: ok",
+		"write ro: denied",
+		"write rw: ok",
+		"rename rw: ok",
+		"read outside: denied",
+		"exec: denied",
+		"unshare: denied",
+	}
+	if got := strings.Split(strings.TrimSpace(string(out)), "\n"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+// runSandboxed sandboxes the process to read dir/ro and write dir/rw, then
+// reports which operations it can still do.
+func runSandboxed(dir string) {
+	ro, rw := filepath.Join(dir, "ro"), filepath.Join(dir, "rw")
+	if err := sandbox([]string{ro}, []string{rw}); err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	checks := []struct {
+		name string
+		f    func() error
+	}{
+		{"read ro", func() error { _, err := os.ReadFile(filepath.Join(ro, "kernel")); return err }},
+		{"write ro", func() error { return os.WriteFile(filepath.Join(ro, "new"), nil, 0644) }},
+		{"write rw", func() error { return os.WriteFile(filepath.Join(rw, "new"), nil, 0644) }},
+		{"rename rw", func() error { return os.Rename(filepath.Join(rw, "new"), filepath.Join(rw, "renamed")) }},
+		{"read outside", func() error { _, err := os.ReadFile(filepath.Join(dir, "outside")); return err }},
+		{"exec", func() error { return exec.Command(os.Args[0], "-test.run=^$").Run() }},
+		{"unshare", func() error { return syscall.Unshare(syscall.CLONE_NEWUSER) }},
+	}
+	for _, c := range checks {
+		result := "ok"
+		if err := c.f(); err != nil {
+			result = "denied"
+		}
+		fmt.Printf("%s: %s\n", c.name, result)
+	}
+}
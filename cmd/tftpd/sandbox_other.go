@@ -0,0 +1,9 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+func sandbox(read, write []string) error {
+	return errors.New("Sandboxing is only supported on Linux")
+}
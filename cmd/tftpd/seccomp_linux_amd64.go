@@ -0,0 +1,45 @@
+package main
+
+const (
+	sysSeccomp = 317
+	// auditArch is AUDIT_ARCH_X86_64
+	auditArch = 0xc000003e
+	// syscallNumberLimit is __X32_SYSCALL_BIT, x32 syscalls would bypass
+	// the filter's numbers
+	syscallNumberLimit = 0x40000000
+)
+
+// deniedSyscalls are the syscalls a TFTP server never needs, which would
+// help an exploit take over or escape the host. Those not listed are
+// allowed, see sandbox.
+var deniedSyscalls = []uint32{
+	59,  // execve
+	322, // execveat
+	101, // ptrace
+	310, // process_vm_readv
+	311, // process_vm_writev
+	165, // mount
+	166, // umount2
+	155, // pivot_root
+	161, // chroot
+	167, // swapon
+	168, // swapoff
+	169, // reboot
+	246, // kexec_load
+	320, // kexec_file_load
+	175, // init_module
+	313, // finit_module
+	176, // delete_module
+	321, // bpf
+	298, // perf_event_open
+	248, // add_key
+	249, // request_key
+	250, // keyctl
+	308, // setns
+	272, // unshare
+	323, // userfaultfd
+	304, // open_by_handle_at
+	163, // acct
+	172, // iopl
+	173, // ioperm
+}
@@ -0,0 +1,41 @@
+package main
+
+const (
+	sysSeccomp = 277
+	// auditArch is AUDIT_ARCH_AARCH64
+	auditArch          = 0xc00000b7
+	syscallNumberLimit = 0
+)
+
+// deniedSyscalls are the syscalls a TFTP server never needs, which would
+// help an exploit take over or escape the host. Those not listed are
+// allowed, see sandbox.
+var deniedSyscalls = []uint32{
+	221, // execve
+	281, // execveat
+	117, // ptrace
+	270, // process_vm_readv
+	271, // process_vm_writev
+	40,  // mount
+	39,  // umount2
+	41,  // pivot_root
+	51,  // chroot
+	224, // swapon
+	225, // swapoff
+	142, // reboot
+	104, // kexec_load
+	294, // kexec_file_load
+	105, // init_module
+	273, // finit_module
+	106, // delete_module
+	280, // bpf
+	241, // perf_event_open
+	217, // add_key
+	218, // request_key
+	219, // keyctl
+	268, // setns
+	97,  // unshare
+	282, // userfaultfd
+	265, // open_by_handle_at
+	89,  // acct
+}
@@ -0,0 +1,13 @@
+//go:build linux && !amd64 && !arm64
+
+package main
+
+// Syscalls are only restricted on amd64 and arm64, elsewhere the sandbox is
+// Landlock alone.
+const (
+	sysSeccomp         = 0
+	auditArch          = 0
+	syscallNumberLimit = 0
+)
+
+var deniedSyscalls []uint32
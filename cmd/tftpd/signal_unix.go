@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statsSignals make the server log a snapshot of its state.
+var statsSignals = []os.Signal{syscall.SIGUSR1}
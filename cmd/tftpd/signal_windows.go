@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// statsSignals make the server log a snapshot of its state. Windows has no
+// SIGUSR1.
+var statsSignals []os.Signal
@@ -2,10 +2,14 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
+	"sort"
+	"strings"
+	"time"
 )
 
 const (
@@ -21,6 +25,8 @@ const (
 	OpDATA  OpCode = 3
 	OpACK   OpCode = 4
 	OpERROR OpCode = 5
+	// OpOACK acknowledges the options of a request, see RFC 2347.
+	OpOACK OpCode = 6
 )
 
 var OpCodeNames = map[OpCode]string{
@@ -29,16 +35,62 @@ var OpCodeNames = map[OpCode]string{
 	OpDATA:  "DATA",
 	OpACK:   "ACK",
 	OpERROR: "ERROR",
+	OpOACK:  "OACK",
 }
 
 func (o OpCode) String() string {
 	return OpCodeNames[o]
 }
 
+// ErrorCode is the code carried in an ERROR packet, see RFC 1350.
+type ErrorCode uint16
+
+const (
+	ErrNotDefined        ErrorCode = 0
+	ErrFileNotFound      ErrorCode = 1
+	ErrAccessViolation   ErrorCode = 2
+	ErrDiskFull          ErrorCode = 3
+	ErrIllegalOperation  ErrorCode = 4
+	ErrUnknownTransferID ErrorCode = 5
+	ErrFileExists        ErrorCode = 6
+	ErrNoSuchUser        ErrorCode = 7
+)
+
+// Error is an ERROR packet received from the peer. A transfer loop returns
+// it unwrapped so callers can tell a peer abort from a local failure.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("Peer sent error %d: %s", e.Code, e.Message)
+}
+
+// Transfer modes, as normalized by ParseRequestPacket.
+const (
+	ModeNetASCII = "netascii"
+	ModeOctet    = "octet"
+	ModeMail     = "mail"
+)
+
+// ValidMode reports whether mode is one of the modes defined by RFC 1350. It
+// expects a mode already normalized by ParseRequestPacket.
+func ValidMode(mode string) bool {
+	switch mode {
+	case ModeNetASCII, ModeOctet, ModeMail:
+		return true
+	}
+	return false
+}
+
 type RequestPacket struct {
 	OpCode   OpCode
 	Filename string
 	Mode     string
+	// Options holds the options appended to the request (RFC 2347), keyed
+	// by lower case name. It is nil if there were none.
+	Options map[string]string
 }
 
 //  2 bytes     2 bytes      n bytes
@@ -100,35 +152,107 @@ func ParseRequestPacket(packet []byte) (*RequestPacket, error) {
 	// Remove trailing 0
 	mode = mode[:len(mode)-1]
 
+	// Options follow as name/value pairs. A name without a value is
+	// ignored, as is anything not terminated.
+	var options map[string]string
+	for {
+		name, err := reader.ReadBytes(byte(0))
+		if err != nil {
+			break
+		}
+		value, err := reader.ReadBytes(byte(0))
+		if err != nil {
+			break
+		}
+		if options == nil {
+			options = make(map[string]string)
+		}
+		// Option names are case insensitive too
+		options[strings.ToLower(string(name[:len(name)-1]))] = string(value[:len(value)-1])
+	}
+
 	return &RequestPacket{
-		OpCode:   opcode,
-		Mode:     string(mode),
+		OpCode: opcode,
+		// Modes are case insensitive, normalize once here
+		Mode:     strings.ToLower(string(mode)),
 		Filename: string(filename),
+		Options:  options,
 	}, nil
 }
 
 func (p RequestPacket) ToBytes() []byte {
-	buf := make([]byte, 2+len(p.Filename)+1+len(p.Mode)+1)
+	buf := make([]byte, 2, 2+len(p.Filename)+1+len(p.Mode)+1)
 	binary.BigEndian.PutUint16(buf, uint16(p.OpCode))
-	copy(buf[2:], p.Filename)
-	copy(buf[2+len(p.Filename)+1:], p.Mode)
+	buf = append(buf, p.Filename...)
+	buf = append(buf, 0)
+	buf = append(buf, p.Mode...)
+	buf = append(buf, 0)
+	return appendOptions(buf, p.Options)
+}
+
+// appendOptions appends options to buf as zero terminated name/value pairs,
+// sorted by name.
+func appendOptions(buf []byte, options map[string]string) []byte {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		buf = append(buf, name...)
+		buf = append(buf, 0)
+		buf = append(buf, options[name]...)
+		buf = append(buf, 0)
+	}
 	return buf
 }
 
+// creates an option acknowledgement packet with the following structure:
+//
+// 2 bytes   string   1 byte   string   1 byte
+// ------------------------------------------------
+// | Opcode |  opt1  |   0   |  value1 |   0   | ...
+// ------------------------------------------------
+func CreateOACKPacket(options map[string]string) []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, uint16(OpOACK))
+	return appendOptions(buf, options)
+}
+
+// ParseOACKPacket returns the options acknowledged by an OACK packet.
+func ParseOACKPacket(packet []byte) (map[string]string, error) {
+	opcode, err := GetOpCode(packet)
+	if err != nil {
+		return nil, err
+	}
+	if opcode != OpOACK {
+		return nil, fmt.Errorf("Expected OACK packet, got %v", opcode)
+	}
+	fields := bytes.Split(packet[2:], []byte{0})
+	if len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+		return nil, fmt.Errorf("Malformed OACK packet")
+	}
+	options := make(map[string]string)
+	for i := 0; i+1 < len(fields); i += 2 {
+		options[strings.ToLower(string(fields[i]))] = string(fields[i+1])
+	}
+	return options, nil
+}
+
 // GetOpCode will attempt to parse the OpCode from the packet passed in
 func GetOpCode(packet []byte) (OpCode, error) {
 	if len(packet) < 2 {
 		return OpERROR, fmt.Errorf("Packet too small to get opcode")
 	}
 	opcode := OpCode(binary.BigEndian.Uint16(packet))
-	if opcode > 5 {
+	if opcode > 6 {
 		return OpERROR, fmt.Errorf("Unknown opcode: %d", opcode)
 	}
 	return opcode, nil
 }
 
-func SendError(code uint16, message string, conn net.PacketConn, remoteAddress net.Addr) error {
-	errPacket := CreateErrorPacket(0, message)
+func SendError(code ErrorCode, message string, conn net.PacketConn, remoteAddress net.Addr) error {
+	errPacket := CreateErrorPacket(code, message)
 	_, err := conn.WriteTo(errPacket, remoteAddress)
 	if err != nil {
 		return fmt.Errorf("Error writing error packet: %v", err)
@@ -155,112 +279,343 @@ func CreateAckPacket(tid uint16) []byte {
 // -----------------------------------------
 // | Opcode |  ErrorCode |   ErrMsg   |   0  |
 // -----------------------------------------
-func CreateErrorPacket(code uint16, message string) []byte {
+func CreateErrorPacket(code ErrorCode, message string) []byte {
 	buf := make([]byte, 2+2+len(message)+1)
-	binary.BigEndian.PutUint16(buf, uint16(OpERROR)) // 2 bytes
-	binary.BigEndian.PutUint16(buf[2:], code)        // 2 bytes
+	binary.BigEndian.PutUint16(buf, uint16(OpERROR))  // 2 bytes
+	binary.BigEndian.PutUint16(buf[2:], uint16(code)) // 2 bytes
 	copy(buf[4:], []byte(message))
 	buf[len(buf)-1] = byte(0)
 	return buf
 }
 
-func WriteFile(w io.Writer, conn net.PacketConn, remoteAddress net.Addr, packet []byte, tid uint16) (int, net.Addr, error) {
-	// Read data packet
-	n, replyAddr, err := conn.ReadFrom(packet)
+// ParseErrorPacket parses an ERROR packet. A missing terminating zero is
+// tolerated since the message is only informational.
+func ParseErrorPacket(packet []byte) (*Error, error) {
+	op, err := GetOpCode(packet)
 	if err != nil {
-		return n, replyAddr, fmt.Errorf("Error reading packet: %v", err)
+		return nil, fmt.Errorf("Error getting opcode: %v", err)
 	}
-
-	opcode, err := GetOpCode(packet)
-	if err != nil {
-		return n, replyAddr, fmt.Errorf("Error getting opcode: %v", err)
+	if op != OpERROR {
+		return nil, fmt.Errorf("Expected ERROR packet, got OpCode: %d", op)
 	}
-	if opcode != OpDATA {
-		return n, replyAddr, fmt.Errorf("Expected DATA packet, got %v\n", opcode)
+	if len(packet) < 4 {
+		return nil, fmt.Errorf("ERROR packet too small")
 	}
-
-	packetTID := binary.BigEndian.Uint16(packet[2:4])
-	if packetTID != tid {
-		SendError(5, "Unknown transfer id", conn, remoteAddress)
-		return n, replyAddr, fmt.Errorf("Expected TID %d, got %d\n", tid, packetTID)
+	message := packet[4:]
+	if i := bytes.IndexByte(message, 0); i >= 0 {
+		message = message[:i]
 	}
+	return &Error{
+		Code:    ErrorCode(binary.BigEndian.Uint16(packet[2:])),
+		Message: string(message),
+	}, nil
+}
 
-	// Write data to disk
-	_, err = w.Write(packet[4:n])
+// LoopOptions tunes a transfer loop beyond RFC 1350.
+type LoopOptions struct {
+	Retransmission
+	// OACK, if set, is the option acknowledgement the request was answered
+	// with (RFC 2347).
+	OACK []byte
+	// Request, if set, is the RRQ a client's download began with, which is
+	// what is resent until the first block arrives.
+	Request []byte
+	// Rollover is the block number following 65535, which is 0 unless the
+	// client negotiated otherwise. Large images need more blocks than that.
+	Rollover uint16
+	// Context, if set, ends the transfer once done, with the peer sent an
+	// ERROR carrying the text of its cause. It is checked between packets,
+	// so cancelling a transfer waiting on its peer also takes closing conn.
+	Context context.Context
+	// OnRetransmit, if set, is called with every packet sent again, whether
+	// the peer's reply was late or the peer repeated itself.
+	OnRetransmit func(packet []byte)
+}
+
+// cancelled returns why the loop's context ended, if it has, telling the
+// peer at to.
+func (o LoopOptions) cancelled(conn net.PacketConn, to net.Addr) error {
+	if o.Context == nil {
+		return nil
+	}
+	err := context.Cause(o.Context)
 	if err != nil {
-		return n, replyAddr, fmt.Errorf("Error writing: %v", err)
+		SendError(ErrNotDefined, err.Error(), conn, to)
 	}
+	return err
+}
 
-	ack := CreateAckPacket(tid)
-	_, err = conn.WriteTo(ack, replyAddr)
-	if err != nil {
-		return n, replyAddr, fmt.Errorf("Error writing ACK packet: %v", err)
+// next returns the block number following tid.
+func (o LoopOptions) next(tid uint16) uint16 {
+	if tid == 65535 {
+		return o.Rollover
 	}
+	return tid + 1
+}
+
+// WriteFileLoop receives DATA packets from conn, writing their payload to w and
+// acknowledging each one, until a short block marks the end of the transfer.
+// The initial ACK (for WRQ) or RRQ is assumed to have been sent already.
+//
+// If w has a Flush method it is flushed before the final block is
+// acknowledged. When writing fails the peer is sent an ERROR, Disk full if
+// the disk or quota is full.
+//
+// Packets from anywhere but remoteAddress, the peer's transfer ID, are
+// answered with ERROR 5.
+func WriteFileLoop(w io.Writer, conn net.PacketConn, remoteAddress net.Addr) (stats TransferStats, err error) {
+	return WriteFileLoopRetransmit(w, conn, remoteAddress, Retransmission{})
+}
 
-	return n, replyAddr, nil
+// WriteFileLoopRetransmit is WriteFileLoop resending the last ACK whenever
+// the next block is late, according to rt. Until the first block arrives
+// that is the ACK of block 0 answering a WRQ, so clients should use
+// WriteFileLoopOptions with the RRQ as opts.Request.
+func WriteFileLoopRetransmit(w io.Writer, conn net.PacketConn, remoteAddress net.Addr, rt Retransmission) (stats TransferStats, err error) {
+	return WriteFileLoopOptions(w, conn, remoteAddress, LoopOptions{Retransmission: rt})
 }
 
-func WriteFileLoop(w io.Writer, conn net.PacketConn, remoteAddress net.Addr) error {
-	// Assume we have already sent the initial ACK packet
-	tid := uint16(0)
+// WriteFileLoopOptions is WriteFileLoopRetransmit tuned by opts. If the WRQ
+// was answered with opts.OACK rather than the ACK of block 0, that is what
+// is resent until the first block arrives, as is a client's opts.Request.
+//
+// With opts.Request set remoteAddress is the server's request port, and the
+// first block may arrive from a different port on its host, since a server
+// answers from a new transfer ID. The loop then sticks to that address and
+// answers packets from anywhere else with ERROR 5.
+func WriteFileLoopOptions(w io.Writer, conn net.PacketConn, remoteAddress net.Addr, opts LoopOptions) (stats TransferStats, err error) {
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
+
+	reply := opts.OACK
+	if opts.Request != nil {
+		reply = opts.Request
+	}
+	if reply == nil {
+		reply = CreateAckPacket(0)
+	}
+	// A server knows the client's transfer ID from its request
+	var peer net.Addr
+	if opts.Request == nil {
+		peer = remoteAddress
+	}
+	tid, prev := uint16(1), uint16(0)
 	packet := make([]byte, MaxPacketSize)
+	resend := newResender(opts.Retransmission, conn, &stats)
+	resend.onResend = opts.OnRetransmit
+	resend.sent(reply, remoteAddress)
 	for {
-		tid++
+		to := peer
+		if to == nil {
+			to = remoteAddress
+		}
+		if err := opts.cancelled(conn, to); err != nil {
+			return stats, err
+		}
+
+		// Read data packet
+		n, replyAddr, err := resend.read(packet)
+		if err != nil {
+			return stats, fmt.Errorf("Error reading packet: %v", err)
+		}
+
+		if peer == nil && HostOf(replyAddr) == HostOf(remoteAddress) {
+			peer = replyAddr
+		}
+		if peer == nil || !sameAddr(replyAddr, peer) {
+			stats.addViolation(replyAddr, ViolationWrongTID)
+			SendError(ErrUnknownTransferID, "Unknown transfer ID", conn, replyAddr)
+			continue
+		}
+
+		if n < 4 {
+			stats.addViolation(peer, ViolationShortPacket)
+			SendError(ErrIllegalOperation, "Packet too small", conn, peer)
+			return stats, fmt.Errorf("Packet too small: %s", DumpPacket(packet[:n]))
+		}
+
+		opcode, err := GetOpCode(packet[:n])
+		if err == nil && opcode == OpERROR {
+			peerErr, err := ParseErrorPacket(packet[:n])
+			if err != nil {
+				return stats, err
+			}
+			return stats, peerErr
+		}
+		if err != nil || opcode != OpDATA {
+			stats.addViolation(peer, ViolationBadOpcode)
+			SendError(ErrIllegalOperation, "Expected DATA packet", conn, peer)
+			return stats, fmt.Errorf("Expected DATA packet, got %s", DumpPacket(packet[:n]))
+		}
+
+		packetTID := binary.BigEndian.Uint16(packet[2:4])
+		if packetTID == prev {
+			// Our ACK was lost and the peer resent the previous block
+			stats.Duplicates++
+			ack := CreateAckPacket(packetTID)
+			if _, err := conn.WriteTo(ack, peer); err != nil {
+				return stats, fmt.Errorf("Error writing ACK packet: %v", err)
+			}
+			stats.Retransmits++
+			if opts.OnRetransmit != nil {
+				opts.OnRetransmit(ack)
+			}
+			continue
+		}
+		if packetTID != tid {
+			stats.addViolation(peer, ViolationBadBlock)
+			SendError(ErrIllegalOperation, "Unexpected block number", conn, peer)
+			return stats, fmt.Errorf("Expected TID %d, got %s", tid, DumpPacket(packet[:n]))
+		}
 
-		n, _, err := WriteFile(w, conn, remoteAddress, packet, tid)
+		// Write data to disk
+		_, err = w.Write(packet[4:n])
+		last := n < 4+BlockSize
+		if f, ok := w.(flusher); ok && err == nil && last {
+			// Make sure everything is stored before acknowledging the end
+			err = f.Flush()
+		}
 		if err != nil {
-			return err
+			code, message := writeError(err)
+			SendError(code, message, conn, peer)
+			return stats, fmt.Errorf("Error writing: %v", err)
 		}
+		stats.Bytes += int64(n - 4)
+		stats.Blocks++
 
-		if n < 4+BlockSize {
-			return nil
+		ack := CreateAckPacket(tid)
+		_, err = conn.WriteTo(ack, peer)
+		if err != nil {
+			return stats, fmt.Errorf("Error writing ACK packet: %v", err)
 		}
+		resend.sent(ack, peer)
+
+		if last {
+			return stats, nil
+		}
+		tid, prev = opts.next(tid), tid
 	}
 }
 
+// flusher is implemented by buffered writers such as bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
 // ReadFileLoop will read from r in blockSize chunks, sending each chunk to through conn
 // to remoteAddr. After each send it will wait for an ACK packet. It will loop until
-// EOF on r.
-func ReadFileLoop(r io.Reader, conn net.PacketConn, remoteAddr net.Addr, blockSize int) (int, error) {
+// EOF on r, finishing with a short (possibly empty) block.
+func ReadFileLoop(r io.Reader, conn net.PacketConn, remoteAddr net.Addr, blockSize int) (stats TransferStats, err error) {
+	return ReadFileLoopRetransmit(r, conn, remoteAddr, blockSize, Retransmission{})
+}
+
+// ReadFileLoopRetransmit is ReadFileLoop resending each DATA packet whenever
+// its ACK is late, according to rt.
+func ReadFileLoopRetransmit(r io.Reader, conn net.PacketConn, remoteAddr net.Addr, blockSize int, rt Retransmission) (stats TransferStats, err error) {
+	return ReadFileLoopOptions(r, conn, remoteAddr, blockSize, LoopOptions{Retransmission: rt})
+}
+
+// ReadFileLoopOptions is ReadFileLoopRetransmit tuned by opts. If the RRQ
+// was answered with opts.OACK, the loop waits for its ACK of block 0,
+// resending it as needed, before sending the first block.
+func ReadFileLoopOptions(r io.Reader, conn net.PacketConn, remoteAddr net.Addr, blockSize int, opts LoopOptions) (stats TransferStats, err error) {
+	start := time.Now()
+	defer func() { stats.Duration = time.Since(start) }()
+
 	var tid uint16
-	var bytesRead int
 
 	buffer := make([]byte, blockSize)
-	ackBuf := make([]byte, 4)
+	ackBuf := make([]byte, MaxPacketSize)
+	resend := newResender(opts.Retransmission, conn, &stats)
+	resend.onResend = opts.OnRetransmit
+	if opts.OACK != nil {
+		resend.sent(opts.OACK, remoteAddr)
+		if err := waitForAck(resend, remoteAddr, ackBuf, 0, 0, &stats); err != nil {
+			return stats, err
+		}
+	}
 	for {
-		tid++
-
-		n, err := r.Read(buffer)
-		if err == io.EOF {
-			// We're done
-			break
+		if err := opts.cancelled(conn, remoteAddr); err != nil {
+			return stats, err
 		}
-		if err != nil {
-			return bytesRead, fmt.Errorf("Error reading data: %v", err)
+		prev := tid
+		tid = opts.next(tid)
+
+		n, err := io.ReadFull(r, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return stats, fmt.Errorf("Error reading data: %v", err)
 		}
-		bytesRead += n
 
 		packet := createDataPacket(tid, buffer[:n])
-		n, err = conn.WriteTo(packet, remoteAddr)
+		_, err = conn.WriteTo(packet, remoteAddr)
 		if err != nil {
-			return bytesRead, fmt.Errorf("Error writing data packet: %v", err)
+			return stats, fmt.Errorf("Error writing data packet: %v", err)
+		}
+		stats.Bytes += int64(n)
+		stats.Blocks++
+		resend.sent(packet, remoteAddr)
+
+		if err := waitForAck(resend, remoteAddr, ackBuf, tid, prev, &stats); err != nil {
+			return stats, err
 		}
 
-		// Read ack
-		i, _, err := conn.ReadFrom(ackBuf)
+		if n < blockSize {
+			// We're done
+			return stats, nil
+		}
+	}
+}
+
+// waitForAck reads packets until the ACK for block tid arrives. Duplicate ACKs
+// for the previous block, prev, are counted and ignored rather than
+// answered, which would otherwise cause every later block to be sent twice.
+func waitForAck(resend *resender, remoteAddr net.Addr, ackBuf []byte, tid, prev uint16, stats *TransferStats) error {
+	conn := resend.conn
+	for {
+		i, from, err := resend.read(ackBuf)
 		if err != nil {
-			return bytesRead, fmt.Errorf("Error reading ACK packet: %v", err)
+			return fmt.Errorf("Error reading ACK packet: %v", err)
+		}
+		if !sameAddr(from, remoteAddr) {
+			stats.addViolation(from, ViolationWrongTID)
+			SendError(ErrUnknownTransferID, "Unknown transfer ID", conn, from)
+			continue
+		}
+
+		op, err := GetOpCode(ackBuf[:i])
+		if err == nil && op == OpERROR {
+			peerErr, err := ParseErrorPacket(ackBuf[:i])
+			if err != nil {
+				return err
+			}
+			return peerErr
+		}
+		if i < 4 {
+			stats.addViolation(from, ViolationShortPacket)
+			SendError(ErrIllegalOperation, "Packet too small", conn, from)
+			return fmt.Errorf("Expected 4 bytes read for ACK packet, got %s", DumpPacket(ackBuf[:i]))
+		}
+		if err != nil || op != OpACK {
+			stats.addViolation(from, ViolationBadOpcode)
+			SendError(ErrIllegalOperation, "Expected ACK packet", conn, from)
+			return fmt.Errorf("Expected ACK packet, got %s", DumpPacket(ackBuf[:i]))
 		}
 		if i != 4 {
-			return bytesRead, fmt.Errorf("Expected 4 bytes read for ACK packet, got %d", i)
+			stats.addViolation(from, ViolationMalformed)
+			SendError(ErrIllegalOperation, "Malformed ACK packet", conn, from)
+			return fmt.Errorf("Expected 4 bytes read for ACK packet, got %s", DumpPacket(ackBuf[:i]))
 		}
-		ackTid, err := ParseAckPacket(ackBuf)
-		if err != nil {
-			return bytesRead, fmt.Errorf("Error parsing ACK packet: %v", err)
+
+		ackTid := binary.BigEndian.Uint16(ackBuf[2:4])
+		if ackTid == prev && ackTid != tid {
+			stats.Duplicates++
+			continue
 		}
 		if ackTid != tid {
-			return bytesRead, fmt.Errorf("ACK tid: %d, does not match expected: %d", ackTid, tid)
+			stats.addViolation(from, ViolationBadBlock)
+			SendError(ErrIllegalOperation, "Unexpected block number", conn, from)
+			return fmt.Errorf("ACK tid: %d, does not match expected: %d (%s)", ackTid, tid, DumpPacket(ackBuf[:i]))
 		}
+		return nil
 	}
-	return bytesRead, nil
 }
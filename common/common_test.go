@@ -1,8 +1,17 @@
 package common
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
 	"reflect"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestCreateAckPacket(t *testing.T) {
@@ -29,6 +38,31 @@ func TestCreateAckPacket(t *testing.T) {
 	}
 }
 
+func TestParseOACKPacket(t *testing.T) {
+	testCases := []struct {
+		packet      []byte
+		expected    map[string]string
+		shouldError bool
+	}{
+		{packet: CreateOACKPacket(map[string]string{"offset": "1024", "tsize": "0"}), expected: map[string]string{"offset": "1024", "tsize": "0"}},
+		{packet: []byte{0, 6}, expected: map[string]string{}},
+		{packet: []byte{0, 6, 'O', 'f', 'f', 's', 'e', 't', 0, '1', 0}, expected: map[string]string{"offset": "1"}},
+		{packet: []byte{0, 6, 'a', 0}, shouldError: true},
+		{packet: []byte{0, 6, 'a', 0, '1'}, shouldError: true},
+		{packet: CreateAckPacket(0), shouldError: true},
+	}
+
+	for i, tc := range testCases {
+		options, err := ParseOACKPacket(tc.packet)
+		if tc.shouldError != (err != nil) {
+			t.Errorf("Expected error %v, got %v (%d)", tc.shouldError, err, i)
+		}
+		if !reflect.DeepEqual(options, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, options, i)
+		}
+	}
+}
+
 func TestCreateErrorPacket(t *testing.T) {
 	p := CreateErrorPacket(2, "Hello")
 	expected := []byte{0, 5, 0, 2, 72, 101, 108, 108, 111, 0}
@@ -40,6 +74,230 @@ func TestCreateErrorPacket(t *testing.T) {
 	}
 }
 
+func TestParseErrorPacket(t *testing.T) {
+	testCases := []struct {
+		packet      []byte
+		expected    *Error
+		shouldError bool
+	}{
+		{
+			packet:   CreateErrorPacket(ErrFileNotFound, "File not found"),
+			expected: &Error{Code: ErrFileNotFound, Message: "File not found"},
+		},
+		// Missing terminator
+		{
+			packet:   []byte{0, 5, 0, 3, 'F', 'u', 'l', 'l'},
+			expected: &Error{Code: ErrDiskFull, Message: "Full"},
+		},
+		// Not an ERROR packet
+		{
+			packet:      CreateAckPacket(1),
+			shouldError: true,
+		},
+		// Too small
+		{
+			packet:      []byte{0, 5, 0},
+			shouldError: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		e, err := ParseErrorPacket(tc.packet)
+		if tc.shouldError && err == nil {
+			t.Errorf("Expected error, didn't get one (%d)", i)
+			continue
+		}
+		if !tc.shouldError && err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		if !reflect.DeepEqual(e, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, e, i)
+		}
+	}
+}
+
+func loopbackPair(t *testing.T) (net.PacketConn, net.PacketConn) {
+	a, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	a.SetDeadline(deadline)
+	b.SetDeadline(deadline)
+	return a, b
+}
+
+func TestReadFileLoopPeerAbort(t *testing.T) {
+	sender, peer := loopbackPair(t)
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		peer.ReadFrom(buf)
+		peer.WriteTo(CreateErrorPacket(ErrDiskFull, "No space"), sender.LocalAddr())
+	}()
+
+	data := bytes.NewReader(make([]byte, BlockSize*3))
+	_, err := ReadFileLoop(data, sender, peer.LocalAddr(), BlockSize)
+	peerErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if peerErr.Code != ErrDiskFull || peerErr.Message != "No space" {
+		t.Errorf("Unexpected peer error: %v", peerErr)
+	}
+}
+
+func TestWriteFileLoopPeerAbort(t *testing.T) {
+	receiver, peer := loopbackPair(t)
+
+	go func() {
+		peer.WriteTo(createDataPacket(1, make([]byte, BlockSize)), receiver.LocalAddr())
+		buf := make([]byte, MaxPacketSize)
+		peer.ReadFrom(buf)
+		peer.WriteTo(CreateErrorPacket(ErrNotDefined, "Cancelled"), receiver.LocalAddr())
+	}()
+
+	var w bytes.Buffer
+	_, err := WriteFileLoop(&w, receiver, peer.LocalAddr())
+	if _, ok := err.(*Error); !ok {
+		t.Fatalf("Expected *Error, got %v", err)
+	}
+	if w.Len() != BlockSize {
+		t.Errorf("Expected %d bytes written before abort, got %d", BlockSize, w.Len())
+	}
+}
+
+// failingWriter fails every write with err.
+type failingWriter struct {
+	err error
+}
+
+func (f failingWriter) Write(p []byte) (int, error) {
+	return 0, f.err
+}
+
+func TestWriteFileLoopWriteError(t *testing.T) {
+	diskFull := &os.PathError{Op: "write", Path: "/srv/tftp/upload", Err: syscall.ENOSPC}
+	testCases := []struct {
+		w        io.Writer
+		expected *Error
+	}{
+		{w: failingWriter{diskFull}, expected: &Error{Code: ErrDiskFull, Message: "Disk full or allocation exceeded"}},
+		{w: failingWriter{syscall.EDQUOT}, expected: &Error{Code: ErrDiskFull, Message: "Disk full or allocation exceeded"}},
+		{w: failingWriter{io.ErrClosedPipe}, expected: &Error{Code: ErrNotDefined, Message: "Error writing file"}},
+		// Buffered data is flushed, and any failure reported, before the
+		// final ACK
+		{w: bufio.NewWriter(failingWriter{diskFull}), expected: &Error{Code: ErrDiskFull, Message: "Disk full or allocation exceeded"}},
+	}
+
+	for i, tc := range testCases {
+		receiver, peer := loopbackPair(t)
+		peer.WriteTo(createDataPacket(1, []byte("short")), receiver.LocalAddr())
+
+		if _, err := WriteFileLoop(tc.w, receiver, peer.LocalAddr()); err == nil {
+			t.Errorf("Expected an error (%d)", i)
+			continue
+		}
+		buf := make([]byte, MaxPacketSize)
+		n, _, err := peer.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ParseErrorPacket(buf[:n])
+		if err != nil {
+			t.Errorf("Expected an ERROR packet, got %s (%d)", DumpPacket(buf[:n]), i)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestTransferStats(t *testing.T) {
+	testCases := []struct {
+		size   int64
+		blocks int64
+	}{
+		{size: 0, blocks: 1},
+		{size: 100, blocks: 1},
+		// A block aligned file ends with an empty block
+		{size: BlockSize * 2, blocks: 3},
+		{size: BlockSize*2 + 10, blocks: 3},
+	}
+
+	for i, tc := range testCases {
+		sender, receiver := loopbackPair(t)
+		data := bytes.Repeat([]byte{'x'}, int(tc.size))
+
+		type result struct {
+			stats TransferStats
+			err   error
+		}
+		done := make(chan result)
+		var w bytes.Buffer
+		go func() {
+			stats, err := WriteFileLoop(&w, receiver, sender.LocalAddr())
+			done <- result{stats, err}
+		}()
+
+		sent, err := ReadFileLoop(bytes.NewReader(data), sender, receiver.LocalAddr(), BlockSize)
+		if err != nil {
+			t.Fatalf("%v (%d)", err, i)
+		}
+		received := <-done
+		if received.err != nil {
+			t.Fatalf("%v (%d)", received.err, i)
+		}
+
+		for _, stats := range []TransferStats{sent, received.stats} {
+			if stats.Bytes != tc.size || stats.Blocks != tc.blocks {
+				t.Errorf("Expected %d bytes in %d blocks, got %v (%d)", tc.size, tc.blocks, stats, i)
+			}
+		}
+		if !bytes.Equal(w.Bytes(), data) {
+			t.Errorf("Received data does not match (%d)", i)
+		}
+	}
+}
+
+func TestDuplicatesCounted(t *testing.T) {
+	receiver, peer := loopbackPair(t)
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		block := createDataPacket(1, make([]byte, BlockSize))
+		peer.WriteTo(block, receiver.LocalAddr())
+		peer.ReadFrom(buf)
+		// Pretend the ACK was lost
+		peer.WriteTo(block, receiver.LocalAddr())
+		peer.ReadFrom(buf)
+		peer.WriteTo(createDataPacket(2, nil), receiver.LocalAddr())
+		peer.ReadFrom(buf)
+	}()
+
+	var w bytes.Buffer
+	stats, err := WriteFileLoop(&w, receiver, peer.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Duplicates != 1 || stats.Retransmits != 1 {
+		t.Errorf("Expected 1 duplicate and 1 retransmit, got %v", stats)
+	}
+	if w.Len() != BlockSize {
+		t.Errorf("Expected duplicate block to be written once, got %d bytes", w.Len())
+	}
+}
+
 func BenchmarkCreateErrorPacket(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		packet := CreateErrorPacket(1, "Error")
@@ -94,6 +352,16 @@ func TestRequestPacketToBytes(t *testing.T) {
 				Mode:     "B",
 			},
 		},
+		// Options, sorted by name
+		{
+			expectedBytes: []byte{0, 2, 'f', 0, 'o', 0, 'b', 0, '2', 0, 't', 0, '1', 0},
+			packet: RequestPacket{
+				OpCode:   OpWRQ,
+				Filename: "f",
+				Mode:     "o",
+				Options:  map[string]string{"t": "1", "b": "2"},
+			},
+		},
 	}
 
 	for i, tc := range testCases {
@@ -132,7 +400,7 @@ func TestParseRequestPacket(t *testing.T) {
 			expectedPacket: &RequestPacket{
 				OpCode:   OpRRQ,
 				Filename: "Hello",
-				Mode:     "Mode",
+				Mode:     "mode",
 			},
 			shouldError: false,
 		},
@@ -142,7 +410,39 @@ func TestParseRequestPacket(t *testing.T) {
 			expectedPacket: &RequestPacket{
 				OpCode:   OpWRQ,
 				Filename: "B",
-				Mode:     "B",
+				Mode:     "b",
+			},
+			shouldError: false,
+		},
+		// Mode is normalized to lower case
+		{
+			packet: []byte{0, 1, 'f', 0, 'O', 'c', 't', 'E', 'T', 0},
+			expectedPacket: &RequestPacket{
+				OpCode:   OpRRQ,
+				Filename: "f",
+				Mode:     ModeOctet,
+			},
+			shouldError: false,
+		},
+		// Options, with names normalized to lower case
+		{
+			packet: []byte{0, 2, 'f', 0, 'o', 0, 'T', 'S', 'i', 'z', 'e', 0, '9', '0', 0},
+			expectedPacket: &RequestPacket{
+				OpCode:   OpWRQ,
+				Filename: "f",
+				Mode:     "o",
+				Options:  map[string]string{"tsize": "90"},
+			},
+			shouldError: false,
+		},
+		// An option missing its value is ignored
+		{
+			packet: []byte{0, 2, 'f', 0, 'o', 0, 'a', 0, '1', 0, 'b', 0},
+			expectedPacket: &RequestPacket{
+				OpCode:   OpWRQ,
+				Filename: "f",
+				Mode:     "o",
+				Options:  map[string]string{"a": "1"},
 			},
 			shouldError: false,
 		},
@@ -183,3 +483,31 @@ func TestParseRequestPacket(t *testing.T) {
 		}
 	}
 }
+
+func TestLoopContext(t *testing.T) {
+	cancelled := errors.New("Transfer cancelled")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	cancel(cancelled)
+
+	sender, peer := loopbackPair(t)
+	data := bytes.NewReader(make([]byte, BlockSize*3))
+	stats, err := ReadFileLoopOptions(data, sender, peer.LocalAddr(), BlockSize, LoopOptions{Context: ctx})
+	if err != cancelled {
+		t.Errorf("Expected %v, got %v", cancelled, err)
+	}
+	if stats.Blocks != 0 {
+		t.Errorf("Expected no blocks sent, got %d", stats.Blocks)
+	}
+	buf := make([]byte, MaxPacketSize)
+	n, _, err := peer.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ParseErrorPacket(buf[:n])
+	if err != nil {
+		t.Fatalf("Expected an ERROR packet, got %s", DumpPacket(buf[:n]))
+	}
+	if expected := (&Error{Code: ErrNotDefined, Message: "Transfer cancelled"}); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected %v, got %v", expected, got)
+	}
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// maxDumpPayload is how many bytes of a DATA payload DumpPacket shows.
+const maxDumpPayload = 16
+
+var errorCodeNames = map[ErrorCode]string{
+	ErrNotDefined:        "Not defined",
+	ErrFileNotFound:      "File not found",
+	ErrAccessViolation:   "Access violation",
+	ErrDiskFull:          "Disk full",
+	ErrIllegalOperation:  "Illegal TFTP operation",
+	ErrUnknownTransferID: "Unknown transfer ID",
+	ErrFileExists:        "File already exists",
+	ErrNoSuchUser:        "No such user",
+}
+
+func (c ErrorCode) String() string {
+	if name, ok := errorCodeNames[c]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown error %d", uint16(c))
+}
+
+// DumpPacket renders packet in a human readable form for debug logs, for
+// example:
+//
+//	RRQ filename="pxelinux.0" mode="octet" "tsize"="0"
+//	DATA block=3 len=512 data=7f454c46020101000000000000000000...
+//	ERROR code=1 (File not found) message="File not found"
+//
+// Anything that can't be decoded is shown as hex.
+func DumpPacket(packet []byte) string {
+	opcode, err := GetOpCode(packet)
+	if err != nil {
+		return "INVALID " + truncatedHex(packet)
+	}
+
+	body := packet[2:]
+	switch opcode {
+	case OpRRQ, OpWRQ:
+		fields := bytes.Split(body, []byte{0})
+		// A well formed request ends with a zero, leaving an empty last field
+		if len(fields) < 3 || len(fields[len(fields)-1]) != 0 {
+			return fmt.Sprintf("%v (malformed) %s", opcode, truncatedHex(body))
+		}
+		fields = fields[:len(fields)-1]
+		out := fmt.Sprintf("%v filename=%q mode=%q", opcode, fields[0], fields[1])
+		for i := 2; i+1 < len(fields); i += 2 {
+			out += fmt.Sprintf(" %q=%q", fields[i], fields[i+1])
+		}
+		if len(fields)%2 != 0 {
+			out += fmt.Sprintf(" %q=<missing>", fields[len(fields)-1])
+		}
+		return out
+	case OpDATA:
+		if len(body) < 2 {
+			return fmt.Sprintf("DATA (short) %s", truncatedHex(body))
+		}
+		return fmt.Sprintf("DATA block=%d len=%d data=%s", binary.BigEndian.Uint16(body), len(body)-2, truncatedHex(body[2:]))
+	case OpACK:
+		if len(body) < 2 {
+			return fmt.Sprintf("ACK (short) %s", truncatedHex(body))
+		}
+		out := fmt.Sprintf("ACK block=%d", binary.BigEndian.Uint16(body))
+		if len(body) > 2 {
+			out += fmt.Sprintf(" trailing=%s", truncatedHex(body[2:]))
+		}
+		return out
+	case OpOACK:
+		fields := bytes.Split(body, []byte{0})
+		if len(fields)%2 != 1 || len(fields[len(fields)-1]) != 0 {
+			return fmt.Sprintf("OACK (malformed) %s", truncatedHex(body))
+		}
+		out := "OACK"
+		for i := 0; i+1 < len(fields); i += 2 {
+			out += fmt.Sprintf(" %q=%q", fields[i], fields[i+1])
+		}
+		return out
+	case OpERROR:
+		e, err := ParseErrorPacket(packet)
+		if err != nil {
+			return fmt.Sprintf("ERROR (short) %s", truncatedHex(body))
+		}
+		return fmt.Sprintf("ERROR code=%d (%v) message=%q", e.Code, e.Code, e.Message)
+	}
+	return fmt.Sprintf("%v %s", opcode, truncatedHex(body))
+}
+
+func truncatedHex(b []byte) string {
+	if len(b) <= maxDumpPayload {
+		return hex.EncodeToString(b)
+	}
+	return hex.EncodeToString(b[:maxDumpPayload]) + "..."
+}
@@ -0,0 +1,70 @@
+package common
+
+import "testing"
+
+func TestDumpPacket(t *testing.T) {
+	testCases := []struct {
+		packet   []byte
+		expected string
+	}{
+		{
+			packet:   RequestPacket{OpCode: OpRRQ, Filename: "pxelinux.0", Mode: "octet"}.ToBytes(),
+			expected: `RRQ filename="pxelinux.0" mode="octet"`,
+		},
+		{
+			packet:   []byte("\x00\x02up.bin\x00octet\x00tsize\x00512\x00blksize\x001428\x00"),
+			expected: `WRQ filename="up.bin" mode="octet" "tsize"="512" "blksize"="1428"`,
+		},
+		{
+			// Options can't forge log lines
+			packet:   []byte("\x00\x01boot\x00octet\x00x\nlevel=ERROR\x00\x1b[2J\x00"),
+			expected: `RRQ filename="boot" mode="octet" "x\nlevel=ERROR"="\x1b[2J"`,
+		},
+		{
+			packet:   []byte{0, 1, 'a', 'b'},
+			expected: "RRQ (malformed) 6162",
+		},
+		{
+			packet:   createDataPacket(3, []byte{1, 2, 3}),
+			expected: "DATA block=3 len=3 data=010203",
+		},
+		{
+			packet:   createDataPacket(4, make([]byte, 20)),
+			expected: "DATA block=4 len=20 data=00000000000000000000000000000000...",
+		},
+		{
+			packet:   CreateAckPacket(9),
+			expected: "ACK block=9",
+		},
+		{
+			packet:   []byte{0, 4, 0},
+			expected: "ACK (short) 00",
+		},
+		{
+			packet:   CreateOACKPacket(map[string]string{"offset": "1024"}),
+			expected: `OACK "offset"="1024"`,
+		},
+		{
+			packet:   []byte{0, 6, 'a'},
+			expected: "OACK (malformed) 61",
+		},
+		{
+			packet:   CreateErrorPacket(ErrFileNotFound, "File not found"),
+			expected: `ERROR code=1 (File not found) message="File not found"`,
+		},
+		{
+			packet:   []byte{0, 99, 1},
+			expected: "INVALID 006301",
+		},
+		{
+			packet:   nil,
+			expected: "INVALID ",
+		},
+	}
+
+	for i, tc := range testCases {
+		if got := DumpPacket(tc.packet); got != tc.expected {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+	}
+}
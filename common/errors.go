@@ -0,0 +1,23 @@
+package common
+
+import (
+	"errors"
+	"syscall"
+)
+
+// IsDiskFull reports whether err means the disk or the user's quota is full.
+func IsDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// writeError returns the ERROR packet to send the peer when storing its data
+// fails.
+func writeError(err error) (ErrorCode, string) {
+	if e, ok := err.(*Error); ok {
+		return e.Code, e.Message
+	}
+	if IsDiskFull(err) {
+		return ErrDiskFull, "Disk full or allocation exceeded"
+	}
+	return ErrNotDefined, "Error writing file"
+}
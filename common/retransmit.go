@@ -0,0 +1,79 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// Retransmission controls resending the last packet of a transfer when the
+// peer's reply is late, as RFC 1350 expects of both sides. The zero value
+// never resends, leaving it to conn's own deadlines to give up.
+type Retransmission struct {
+	// Timeout is how long to wait for a reply before resending. Zero turns
+	// retransmission off.
+	Timeout time.Duration
+	// Retries is how many times a packet is resent before the transfer is
+	// abandoned.
+	Retries int
+	// MaxTimeout caps the wait, which doubles after every resend of the
+	// same packet. If zero the wait stays at Timeout.
+	MaxTimeout time.Duration
+}
+
+// resender remembers the last packet sent so it can be sent again while the
+// peer's reply is overdue.
+type resender struct {
+	Retransmission
+	conn     net.PacketConn
+	stats    *TransferStats
+	onResend func(packet []byte)
+
+	packet []byte
+	to     net.Addr
+	tries  int
+	wait   time.Duration
+}
+
+func newResender(rt Retransmission, conn net.PacketConn, stats *TransferStats) *resender {
+	return &resender{Retransmission: rt, conn: conn, stats: stats}
+}
+
+// sent records packet as the one to resend, starting its waits afresh.
+func (r *resender) sent(packet []byte, to net.Addr) {
+	r.packet = packet
+	r.to = to
+	r.tries = 0
+	r.wait = r.Timeout
+}
+
+// read reads the next packet from conn, resending the last packet each time
+// the wait for one runs out.
+func (r *resender) read(b []byte) (int, net.Addr, error) {
+	for {
+		if r.Timeout > 0 {
+			r.conn.SetReadDeadline(time.Now().Add(r.wait))
+		}
+		n, from, err := r.conn.ReadFrom(b)
+		if err == nil || r.Timeout <= 0 || r.packet == nil || !errors.Is(err, os.ErrDeadlineExceeded) {
+			return n, from, err
+		}
+		if r.tries >= r.Retries {
+			return 0, nil, fmt.Errorf("No reply after %d retransmits: %w", r.tries, err)
+		}
+		if _, err := r.conn.WriteTo(r.packet, r.to); err != nil {
+			return 0, nil, fmt.Errorf("Error retransmitting: %v", err)
+		}
+		r.tries++
+		r.stats.Retransmits++
+		if r.onResend != nil {
+			r.onResend(r.packet)
+		}
+		// Back off, up to MaxTimeout
+		if r.wait < r.MaxTimeout {
+			r.wait = min(2*r.wait, r.MaxTimeout)
+		}
+	}
+}
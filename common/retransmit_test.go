@@ -0,0 +1,113 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadFileLoopRetransmits(t *testing.T) {
+	sender, peer := loopbackPair(t)
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		// Drop the first copy of each DATA packet and ACK the resend
+		for block := uint16(1); block <= 2; block++ {
+			peer.ReadFrom(buf)
+			peer.ReadFrom(buf)
+			peer.WriteTo(CreateAckPacket(block), sender.LocalAddr())
+		}
+	}()
+
+	var resent []uint16
+	opts := LoopOptions{
+		Retransmission: Retransmission{Timeout: 20 * time.Millisecond, Retries: 3},
+		OnRetransmit: func(packet []byte) {
+			resent = append(resent, binary.BigEndian.Uint16(packet[2:4]))
+		},
+	}
+	stats, err := ReadFileLoopOptions(bytes.NewReader(make([]byte, BlockSize)), sender, peer.LocalAddr(), BlockSize, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Retransmits != 2 {
+		t.Errorf("Expected 2 retransmits, got %d", stats.Retransmits)
+	}
+	if !reflect.DeepEqual(resent, []uint16{1, 2}) {
+		t.Errorf("Expected blocks 1 and 2 to be resent, got %v", resent)
+	}
+}
+
+func TestWriteFileLoopRetransmits(t *testing.T) {
+	receiver, peer := loopbackPair(t)
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		peer.WriteTo(createDataPacket(1, nil), receiver.LocalAddr())
+		peer.ReadFrom(buf)
+	}()
+
+	rt := Retransmission{Timeout: 20 * time.Millisecond, Retries: 3}
+	var w bytes.Buffer
+	stats, err := WriteFileLoopRetransmit(&w, receiver, peer.LocalAddr(), rt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Retransmits != 0 {
+		t.Errorf("Expected no retransmits, got %d", stats.Retransmits)
+	}
+}
+
+func TestRetransmitGivesUp(t *testing.T) {
+	testCases := []struct {
+		rt       Retransmission
+		expected []time.Duration
+	}{
+		{Retransmission{Timeout: 10 * time.Millisecond, Retries: 2}, []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}},
+		{Retransmission{Timeout: 10 * time.Millisecond, Retries: 3, MaxTimeout: 30 * time.Millisecond}, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 30 * time.Millisecond}},
+	}
+
+	for i, tc := range testCases {
+		sender, peer := loopbackPair(t)
+		stats := &TransferStats{}
+		r := newResender(tc.rt, sender, stats)
+		r.sent(CreateAckPacket(7), peer.LocalAddr())
+
+		received := make(chan time.Time, len(tc.expected)+1)
+		go func() {
+			buf := make([]byte, MaxPacketSize)
+			for {
+				n, _, err := peer.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				if n == 4 && binary.BigEndian.Uint16(buf[2:]) == 7 {
+					received <- time.Now()
+				}
+			}
+		}()
+
+		start := time.Now()
+		_, _, err := r.read(make([]byte, MaxPacketSize))
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("Expected deadline error, got %v (%d)", err, i)
+		}
+		if stats.Retransmits != tc.rt.Retries {
+			t.Errorf("Expected %d retransmits, got %d (%d)", tc.rt.Retries, stats.Retransmits, i)
+		}
+		var waited time.Duration
+		for j, wait := range tc.expected {
+			waited += wait
+			at := <-received
+			if at.Sub(start) < waited {
+				t.Errorf("Resend %d came after %v, expected at least %v (%d)", j, at.Sub(start), waited, i)
+			}
+		}
+		sender.Close()
+		peer.Close()
+	}
+}
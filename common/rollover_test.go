@@ -0,0 +1,71 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoopOptionsNext(t *testing.T) {
+	testCases := []struct {
+		rollover uint16
+		tid      uint16
+		expected uint16
+	}{
+		{rollover: 0, tid: 1, expected: 2},
+		{rollover: 0, tid: 65535, expected: 0},
+		{rollover: 1, tid: 65535, expected: 1},
+		{rollover: 1, tid: 0, expected: 1},
+	}
+
+	for i, tc := range testCases {
+		if got := (LoopOptions{Rollover: tc.rollover}).next(tc.tid); got != tc.expected {
+			t.Errorf("Expected %d, got %d (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestReadFileLoopRollover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Sends over 65536 blocks")
+	}
+	for _, rollover := range []uint16{0, 1} {
+		sender, peer := loopbackPair(t)
+		deadline := time.Now().Add(30 * time.Second)
+		sender.SetDeadline(deadline)
+		peer.SetDeadline(deadline)
+
+		// One byte blocks keep this quick, the last one past the wrap is
+		// empty
+		const blocks = 65540
+		data := bytes.Repeat([]byte{'x'}, blocks-1)
+		errs := make(chan error, 1)
+		go func() {
+			_, err := ReadFileLoopOptions(bytes.NewReader(data), sender, peer.LocalAddr(), 1, LoopOptions{Rollover: rollover})
+			errs <- err
+		}()
+
+		var got []uint16
+		buf := make([]byte, MaxPacketSize)
+		for i := 0; i < blocks; i++ {
+			n, from, err := peer.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			block := binary.BigEndian.Uint16(buf[2:n])
+			if i >= 65533 {
+				got = append(got, block)
+			}
+			peer.WriteTo(CreateAckPacket(block), from)
+		}
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+		expected := []uint16{65534, 65535, rollover, rollover + 1, rollover + 2, rollover + 3, rollover + 4}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("Expected blocks %v around the wrap, got %v", expected, got)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"time"
+)
+
+// TransferStats describes a finished (or aborted) transfer as seen by the
+// side running the transfer loop.
+type TransferStats struct {
+	// Bytes and Blocks are 64-bit so multi-gigabyte transfers don't overflow
+	// on 32-bit platforms.
+	Bytes       int64
+	Blocks      int64
+	Retransmits int
+	// Duplicates counts packets the peer sent more than once.
+	Duplicates int
+	Duration   time.Duration
+	// Options holds the negotiated options, nil if none were negotiated.
+	Options map[string]string
+	// Violations holds the protocol violations seen during the transfer,
+	// including those from hosts other than the peer.
+	Violations ViolationCounts
+}
+
+func (s *TransferStats) addViolation(from net.Addr, v Violation) {
+	if s.Violations == nil {
+		s.Violations = make(ViolationCounts)
+	}
+	s.Violations.Add(from, v)
+}
+
+func (s TransferStats) String() string {
+	out := fmt.Sprintf("%d bytes, %d blocks in %v", s.Bytes, s.Blocks, s.Duration)
+	if s.Retransmits > 0 || s.Duplicates > 0 {
+		out += fmt.Sprintf(" (%d retransmits, %d duplicates)", s.Retransmits, s.Duplicates)
+	}
+	if n := s.Violations.Total(); n > 0 {
+		out += fmt.Sprintf(" (%d protocol violations)", n)
+	}
+	keys := make([]string, 0, len(s.Options))
+	for k := range s.Options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out += fmt.Sprintf(" %s=%s", k, s.Options[k])
+	}
+	return out
+}
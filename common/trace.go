@@ -0,0 +1,125 @@
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// TraceDirection says whether a traced packet was sent or received.
+type TraceDirection string
+
+const (
+	TraceSend TraceDirection = "send"
+	TraceRecv TraceDirection = "recv"
+)
+
+// TraceEvent describes one packet sent or received. Tracers write one event
+// per line as JSON, for example:
+//
+//	{"time":"2016-01-02T15:04:05.000001Z","elapsed_us":1250,"dir":"send","local":"[::]:51234","peer":"10.0.0.7:2070","op":"DATA","block":3,"size":516}
+type TraceEvent struct {
+	Time time.Time `json:"time"`
+	// Elapsed is the time since the traced conn was opened, in
+	// microseconds.
+	Elapsed int64          `json:"elapsed_us"`
+	Dir     TraceDirection `json:"dir"`
+	Local   string         `json:"local,omitempty"`
+	Peer    string         `json:"peer,omitempty"`
+	Op      string         `json:"op,omitempty"`
+	// Block is set for DATA and ACK packets.
+	Block *uint16 `json:"block,omitempty"`
+	// Code is set for ERROR packets.
+	Code *ErrorCode `json:"code,omitempty"`
+	Size int        `json:"size"`
+	// Err is set when reading or writing the packet failed, for example on
+	// a timeout.
+	Err string `json:"err,omitempty"`
+}
+
+// A Tracer writes a TraceEvent for every packet passing through the conns it
+// wraps to an io.Writer as newline delimited JSON, so transfers can be
+// analysed without a packet capture. It is safe for concurrent use, and a
+// nil *Tracer traces nothing.
+type Tracer struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewTracer returns a Tracer writing events to w.
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{enc: json.NewEncoder(w)}
+}
+
+// Conn returns conn wrapped so that every packet read or written is traced.
+func (t *Tracer) Conn(conn net.PacketConn) net.PacketConn {
+	if t == nil {
+		return conn
+	}
+	return &traceConn{PacketConn: conn, tracer: t, start: time.Now()}
+}
+
+// Record traces a single packet that didn't pass through a traced conn.
+func (t *Tracer) Record(dir TraceDirection, local, peer net.Addr, packet []byte, err error) {
+	if t == nil {
+		return
+	}
+	t.record(time.Now(), dir, local, peer, packet, err)
+}
+
+func (t *Tracer) record(start time.Time, dir TraceDirection, local, peer net.Addr, packet []byte, err error) {
+	now := time.Now()
+	e := TraceEvent{
+		Time:    now.UTC(),
+		Elapsed: now.Sub(start).Microseconds(),
+		Dir:     dir,
+		Size:    len(packet),
+	}
+	if local != nil {
+		e.Local = local.String()
+	}
+	if peer != nil {
+		e.Peer = peer.String()
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+	if op, err := GetOpCode(packet); err == nil {
+		e.Op = op.String()
+		if len(packet) >= 4 {
+			n := binary.BigEndian.Uint16(packet[2:])
+			switch op {
+			case OpDATA, OpACK:
+				e.Block = &n
+			case OpERROR:
+				code := ErrorCode(n)
+				e.Code = &code
+			}
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.enc.Encode(e)
+}
+
+type traceConn struct {
+	net.PacketConn
+	tracer *Tracer
+	start  time.Time
+}
+
+func (c *traceConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	c.tracer.record(c.start, TraceRecv, c.LocalAddr(), addr, b[:n], err)
+	return n, addr, err
+}
+
+func (c *traceConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	c.tracer.record(c.start, TraceSend, c.LocalAddr(), addr, b, err)
+	return n, err
+}
@@ -0,0 +1,74 @@
+package common
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestTracer(t *testing.T) {
+	sender, receiver := loopbackPair(t)
+
+	var buf bytes.Buffer
+	tracer := NewTracer(&buf)
+	traced := tracer.Conn(sender)
+
+	packets := [][]byte{
+		createDataPacket(3, []byte("hello")),
+		CreateAckPacket(0),
+		CreateErrorPacket(ErrFileNotFound, "File not found"),
+	}
+	for _, p := range packets {
+		if _, err := traced.WriteTo(p, receiver.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := receiver.WriteTo(CreateAckPacket(3), sender.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := traced.ReadFrom(make([]byte, MaxPacketSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	block := func(n uint16) *uint16 { return &n }
+	code := func(c ErrorCode) *ErrorCode { return &c }
+	expected := []TraceEvent{
+		{Dir: TraceSend, Op: "DATA", Block: block(3), Size: 9},
+		{Dir: TraceSend, Op: "ACK", Block: block(0), Size: 4},
+		{Dir: TraceSend, Op: "ERROR", Code: code(ErrFileNotFound), Size: 19},
+		{Dir: TraceRecv, Op: "ACK", Block: block(3), Size: 4},
+	}
+
+	scanner := bufio.NewScanner(&buf)
+	i := 0
+	for ; scanner.Scan(); i++ {
+		var e TraceEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("Invalid event %q: %v", scanner.Text(), err)
+		}
+		if i >= len(expected) {
+			continue
+		}
+		if e.Time.IsZero() || e.Local != sender.LocalAddr().String() || e.Peer != receiver.LocalAddr().String() {
+			t.Errorf("Unexpected time or addresses: %+v (%d)", e, i)
+		}
+		e.Time, e.Elapsed, e.Local, e.Peer = expected[i].Time, 0, "", ""
+		if !reflect.DeepEqual(e, expected[i]) {
+			t.Errorf("Expected %+v, got %+v (%d)", expected[i], e, i)
+		}
+	}
+	if i != len(expected) {
+		t.Errorf("Expected %d events, got %d", len(expected), i)
+	}
+}
+
+func TestNilTracer(t *testing.T) {
+	sender, _ := loopbackPair(t)
+	var tracer *Tracer
+	if tracer.Conn(sender) != sender {
+		t.Error("Expected a nil tracer to leave the conn alone")
+	}
+	tracer.Record(TraceRecv, nil, nil, nil, nil)
+}
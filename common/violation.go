@@ -0,0 +1,108 @@
+package common
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Violation classifies a packet that broke the protocol.
+type Violation int
+
+const (
+	// ViolationWrongTID is a packet from an address other than the transfer peer.
+	ViolationWrongTID Violation = iota
+	// ViolationBadOpcode is an unknown opcode, or one not valid at that point
+	// of the transfer.
+	ViolationBadOpcode
+	// ViolationShortPacket is a packet too small to hold its header.
+	ViolationShortPacket
+	// ViolationBadBlock is a block number that is neither the expected block
+	// nor a duplicate of the previous one.
+	ViolationBadBlock
+	// ViolationMalformed is a packet whose body could not be parsed.
+	ViolationMalformed
+)
+
+var violationNames = map[Violation]string{
+	ViolationWrongTID:    "wrong_tid",
+	ViolationBadOpcode:   "bad_opcode",
+	ViolationShortPacket: "short_packet",
+	ViolationBadBlock:    "bad_block",
+	ViolationMalformed:   "malformed",
+}
+
+func (v Violation) String() string {
+	return violationNames[v]
+}
+
+// ViolationCounts tallies protocol violations by the host that sent the
+// offending packet and by kind.
+type ViolationCounts map[string]map[Violation]int
+
+// Add records a violation from addr.
+func (c ViolationCounts) Add(addr net.Addr, v Violation) {
+	host := HostOf(addr)
+	if c[host] == nil {
+		c[host] = make(map[Violation]int)
+	}
+	c[host][v]++
+}
+
+// Merge adds all counts in other to c.
+func (c ViolationCounts) Merge(other ViolationCounts) {
+	for host, kinds := range other {
+		if c[host] == nil {
+			c[host] = make(map[Violation]int)
+		}
+		for v, n := range kinds {
+			c[host][v] += n
+		}
+	}
+}
+
+// Total returns the number of violations recorded.
+func (c ViolationCounts) Total() int {
+	total := 0
+	for _, kinds := range c {
+		for _, n := range kinds {
+			total += n
+		}
+	}
+	return total
+}
+
+func (c ViolationCounts) String() string {
+	hosts := make([]string, 0, len(c))
+	for host := range c {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	var parts []string
+	for _, host := range hosts {
+		for v := ViolationWrongTID; v <= ViolationMalformed; v++ {
+			if n := c[host][v]; n > 0 {
+				parts = append(parts, fmt.Sprintf("%s %v=%d", host, v, n))
+			}
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// HostOf returns the host part of addr, used to key per peer accounting.
+func HostOf(addr net.Addr) string {
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		return udpAddr.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+func sameAddr(a, b net.Addr) bool {
+	return a.String() == b.String()
+}
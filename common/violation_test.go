@@ -0,0 +1,81 @@
+package common
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestViolationCounts(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 2000}
+
+	counts := ViolationCounts{}
+	counts.Add(a, ViolationWrongTID)
+	counts.Add(&net.UDPAddr{IP: a.IP, Port: 1001}, ViolationWrongTID)
+	counts.Add(b, ViolationBadBlock)
+
+	other := ViolationCounts{}
+	other.Add(b, ViolationShortPacket)
+	counts.Merge(other)
+
+	if counts["10.0.0.1"][ViolationWrongTID] != 2 {
+		t.Errorf("Expected violations from one host to be grouped, got %v", counts)
+	}
+	if counts.Total() != 4 {
+		t.Errorf("Expected 4 violations, got %d", counts.Total())
+	}
+	expected := "10.0.0.1 wrong_tid=2, 10.0.0.2 short_packet=1, 10.0.0.2 bad_block=1"
+	if counts.String() != expected {
+		t.Errorf("Expected %q, got %q", expected, counts.String())
+	}
+}
+
+func TestWriteFileLoopRejectsStranger(t *testing.T) {
+	receiver, peer := loopbackPair(t)
+	stranger, _ := loopbackPair(t)
+
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		peer.WriteTo(createDataPacket(1, make([]byte, BlockSize)), receiver.LocalAddr())
+		peer.ReadFrom(buf)
+
+		stranger.WriteTo(createDataPacket(2, []byte("evil")), receiver.LocalAddr())
+		n, _, _ := stranger.ReadFrom(buf)
+		if e, err := ParseErrorPacket(buf[:n]); err != nil || e.Code != ErrUnknownTransferID {
+			t.Errorf("Expected stranger to receive ERROR 5, got %v", buf[:n])
+		}
+
+		peer.WriteTo(createDataPacket(2, []byte("good")), receiver.LocalAddr())
+		peer.ReadFrom(buf)
+	}()
+
+	var w bytes.Buffer
+	stats, err := WriteFileLoop(&w, receiver, peer.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasSuffix(w.Bytes(), []byte("good")) {
+		t.Error("Expected the peer's block to be written, not the stranger's")
+	}
+	if stats.Violations["127.0.0.1"][ViolationWrongTID] != 1 {
+		t.Errorf("Expected a wrong TID violation, got %v", stats.Violations)
+	}
+}
+
+func TestWriteFileLoopBadBlock(t *testing.T) {
+	receiver, peer := loopbackPair(t)
+
+	go func() {
+		peer.WriteTo(createDataPacket(7, []byte("skip")), receiver.LocalAddr())
+	}()
+
+	var w bytes.Buffer
+	stats, err := WriteFileLoop(&w, receiver, peer.LocalAddr())
+	if err == nil {
+		t.Fatal("Expected an error for an out of sequence block")
+	}
+	if stats.Violations["127.0.0.1"][ViolationBadBlock] != 1 {
+		t.Errorf("Expected a bad block violation, got %v", stats.Violations)
+	}
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sort"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// Transfer outcomes recorded in the access log.
+const (
+	outcomeOK      = "ok"
+	outcomeAborted = "aborted"
+	outcomeFailed  = "failed"
+	// outcomeRejected is an upload refused by an UploadValidator.
+	outcomeRejected = "rejected"
+)
+
+// transferOutcome classifies how a transfer ended. Once it has started a
+// peer abort arrives as a *common.Error, anything else is a local failure.
+func transferOutcome(started bool, err error) string {
+	if err == nil {
+		return outcomeOK
+	}
+	if errors.Is(err, errUploadRejected) {
+		return outcomeRejected
+	}
+	if _, ok := err.(*common.Error); ok && started {
+		return outcomeAborted
+	}
+	return outcomeFailed
+}
+
+// logAccess writes the access log record for a finished transfer. started
+// says whether the file was opened, so err came from the transfer itself.
+func (s *Server) logAccess(req *Request, stats common.TransferStats, started bool, err error) {
+	if s.AccessLog == nil {
+		return
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", req.ID),
+		slog.String("client", req.RemoteAddr.String()),
+		slog.String("op", req.OpCode.String()),
+		slog.String("file", req.Filename),
+		slog.String("mode", req.Mode),
+		slog.Int64("bytes", stats.Bytes),
+		slog.Int64("blocks", stats.Blocks),
+		slog.Duration("duration", stats.Duration),
+		slog.Int("retransmits", stats.Retransmits),
+		slog.String("outcome", transferOutcome(started, err)),
+	}
+	if name := s.clientHostname(req.RemoteAddr); name != "" {
+		attrs = append(attrs, slog.String("client_name", name))
+	}
+	if len(stats.Options) > 0 {
+		keys := make([]string, 0, len(stats.Options))
+		for k := range stats.Options {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		options := make([]any, 0, len(keys))
+		for _, k := range keys {
+			options = append(options, slog.String(k, stats.Options[k]))
+		}
+		attrs = append(attrs, slog.Group("options", options...))
+	}
+	if err != nil {
+		attrs = append(attrs, slog.String("err", err.Error()))
+	}
+	if md := req.Metadata.All(); len(md) > 0 {
+		attrs = append(attrs, metadataGroup(md))
+	}
+
+	s.AccessLog.LogAttrs(context.Background(), slog.LevelInfo, "transfer", attrs...)
+}
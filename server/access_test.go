@@ -0,0 +1,103 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// syncBuffer is a bytes.Buffer safe to write from transfer goroutines.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records waits for n JSON log records to be written and returns them.
+func (b *syncBuffer) records(t *testing.T, n int) []map[string]any {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		b.mu.Lock()
+		var records []map[string]any
+		scanner := bufio.NewScanner(bytes.NewReader(b.buf.Bytes()))
+		for scanner.Scan() {
+			var r map[string]any
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				t.Fatalf("Invalid record %q: %v", scanner.Text(), err)
+			}
+			records = append(records, r)
+		}
+		b.mu.Unlock()
+		if len(records) >= n {
+			return records
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d records, got %d", n, len(records))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf syncBuffer
+	s := &Server{AccessLog: slog.New(slog.NewJSONHandler(&buf, nil))}
+	addr, _ := startServer(t, s)
+
+	if _, err := getFile(t, addr, "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	getFile(t, addr, "missing")
+	if err := putFile(t, addr, "upload", make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		op      string
+		file    string
+		bytes   float64
+		outcome string
+	}{
+		{op: "RRQ", file: "kernel", bytes: 1000, outcome: outcomeOK},
+		{op: "RRQ", file: "missing", bytes: 0, outcome: outcomeFailed},
+		{op: "WRQ", file: "upload", bytes: 600, outcome: outcomeOK},
+	}
+	// Records are written as transfers finish, which may not be in order
+	byFile := map[string]map[string]any{}
+	for _, r := range buf.records(t, len(testCases)) {
+		byFile[r["file"].(string)] = r
+	}
+	ids := map[any]bool{}
+	for i, tc := range testCases {
+		r := byFile[tc.file]
+		if id, _ := r["request_id"].(string); len(id) != 8 || ids[id] {
+			t.Errorf("Expected a unique request ID, got %v (%d)", r["request_id"], i)
+		}
+		ids[r["request_id"]] = true
+		if r["msg"] != "transfer" || r["op"] != tc.op || r["file"] != tc.file || r["mode"] != "octet" || r["bytes"] != tc.bytes || r["outcome"] != tc.outcome {
+			t.Errorf("Unexpected record %v (%d)", r, i)
+		}
+		if r["client"] == nil || r["duration"] == nil || r["retransmits"] == nil {
+			t.Errorf("Missing fields in %v (%d)", r, i)
+		}
+	}
+	if byFile["missing"]["err"] == nil {
+		t.Errorf("Expected failed transfer to include the error, got %v", byFile["missing"])
+	}
+}
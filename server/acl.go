@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+)
+
+// allowedSource reports whether requests from addr may be served under the
+// Allow and Deny lists.
+func (s *Server) allowedSource(addr net.Addr) bool {
+	if len(s.Allow) == 0 && len(s.Deny) == 0 {
+		return true
+	}
+	ip, ok := addrIP(addr)
+	if !ok {
+		return false
+	}
+	for _, p := range s.Deny {
+		if p.Contains(ip) {
+			return false
+		}
+	}
+	if len(s.Allow) == 0 {
+		return true
+	}
+	for _, p := range s.Allow {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// addrIP returns the IP of a UDP address, with IPv4-mapped IPv6 addresses
+// unmapped so they match IPv4 prefixes.
+func addrIP(addr net.Addr) (netip.Addr, bool) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	ip, ok := netip.AddrFromSlice(udpAddr.IP)
+	return ip.Unmap(), ok
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestAllowedSource(t *testing.T) {
+	prefixes := func(s ...string) []netip.Prefix {
+		var p []netip.Prefix
+		for _, cidr := range s {
+			p = append(p, netip.MustParsePrefix(cidr))
+		}
+		return p
+	}
+	addr := func(ip string) net.Addr {
+		return &net.UDPAddr{IP: net.ParseIP(ip), Port: 2000}
+	}
+
+	testCases := []struct {
+		allow   []netip.Prefix
+		deny    []netip.Prefix
+		addr    net.Addr
+		allowed bool
+	}{
+		// No rules
+		{addr: addr("192.0.2.1"), allowed: true},
+		// Allow list only
+		{allow: prefixes("10.20.0.0/16"), addr: addr("10.20.3.4"), allowed: true},
+		{allow: prefixes("10.20.0.0/16"), addr: addr("10.21.3.4"), allowed: false},
+		{allow: prefixes("10.20.0.0/16"), addr: addr("::ffff:10.20.3.4"), allowed: true},
+		{allow: prefixes("10.20.0.0/16", "2001:db8::/32"), addr: addr("2001:db8::1"), allowed: true},
+		// Deny list only
+		{deny: prefixes("10.20.9.0/24"), addr: addr("10.20.9.9"), allowed: false},
+		{deny: prefixes("10.20.9.0/24"), addr: addr("10.20.3.4"), allowed: true},
+		// Deny wins
+		{allow: prefixes("10.20.0.0/16"), deny: prefixes("10.20.9.0/24"), addr: addr("10.20.9.9"), allowed: false},
+		{allow: prefixes("10.20.0.0/16"), deny: prefixes("10.20.9.0/24"), addr: addr("10.20.3.4"), allowed: true},
+		// Anything that isn't UDP can't be checked
+		{allow: prefixes("10.20.0.0/16"), addr: mockAddr{}, allowed: false},
+	}
+
+	for i, tc := range testCases {
+		s := &Server{Allow: tc.allow, Deny: tc.deny}
+		if got := s.allowedSource(tc.addr); got != tc.allowed {
+			t.Errorf("Expected allowed = %v for %v (%d)", tc.allowed, tc.addr, i)
+		}
+	}
+}
+
+func TestHandleHandshakeDenied(t *testing.T) {
+	packet := common.RequestPacket{OpCode: common.OpRRQ, Filename: "f", Mode: common.ModeOctet}
+	deny := []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}
+
+	for i, drop := range []bool{false, true} {
+		conn := &mockPacketConn{data: bytes.NewBuffer(packet.ToBytes()), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}}
+		s := &Server{Deny: deny, DropDenied: drop}
+		if err := s.handleHandshake(conn); err == nil {
+			t.Fatalf("Expected request to be denied (%d)", i)
+		}
+		if drop {
+			if conn.data.Len() != 0 {
+				t.Errorf("Expected no reply, got %s (%d)", common.DumpPacket(conn.data.Bytes()), i)
+			}
+			continue
+		}
+		e, err := common.ParseErrorPacket(conn.data.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != common.ErrAccessViolation {
+			t.Errorf("Unexpected error sent: %v (%d)", e, i)
+		}
+	}
+}
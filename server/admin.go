@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// A transfer is an active transfer, tracked so it can be listed and
+// canceled.
+type transfer struct {
+	id      uint64
+	req     *Request
+	started time.Time
+	// conn is the transfer's socket, closing it cancels the transfer.
+	conn  net.PacketConn
+	bytes atomic.Int64
+}
+
+// TransferInfo describes an active transfer.
+type TransferInfo struct {
+	ID uint64 `json:"id"`
+	// RequestID is the ID of the transfer's request, as logged.
+	RequestID string `json:"request_id"`
+	Client    string `json:"client"`
+	Op        string `json:"op"`
+	File      string `json:"file"`
+	// Bytes is the file data sent or received so far.
+	Bytes int64 `json:"bytes"`
+	// Rate is the average bytes per second since the transfer started.
+	Rate    float64   `json:"rate"`
+	Started time.Time `json:"started"`
+	// Metadata is what the request filters attached to the transfer.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Transfers returns the active transfers, oldest first.
+func (s *Server) Transfers() []TransferInfo {
+	now := time.Now()
+	s.mu.Lock()
+	infos := make([]TransferInfo, 0, len(s.transfers))
+	for _, t := range s.transfers {
+		info := TransferInfo{
+			ID:        t.id,
+			RequestID: t.req.ID,
+			Client:    t.req.RemoteAddr.String(),
+			Op:        t.req.OpCode.String(),
+			File:      t.req.Filename,
+			Bytes:     t.bytes.Load(),
+			Started:   t.started,
+		}
+		if md := t.req.Metadata.All(); len(md) > 0 {
+			info.Metadata = md
+		}
+		if elapsed := now.Sub(t.started).Seconds(); elapsed > 0 {
+			info.Rate = float64(info.Bytes) / elapsed
+		}
+		infos = append(infos, info)
+	}
+	s.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ID < infos[j].ID })
+	return infos
+}
+
+// errTransferCancelled is the cause of the context of a transfer cancelled
+// through CancelTransfer.
+var errTransferCancelled = errors.New("Transfer cancelled")
+
+// CancelTransfer cancels the context and closes the socket of the active
+// transfer with the given ID, returning false if there is no such transfer.
+func (s *Server) CancelTransfer(id uint64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.transfers {
+		if t.id == id {
+			t.req.end(errTransferCancelled)
+			t.conn.Close()
+			return true
+		}
+	}
+	return false
+}
+
+// progressConn counts the file data passing through a transfer's socket.
+// Retransmitted blocks are only counted once.
+type progressConn struct {
+	net.PacketConn
+	t         *transfer
+	lastBlock uint16
+}
+
+func (c *progressConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil && addr.String() == c.t.req.RemoteAddr.String() {
+		c.count(b[:n])
+	}
+	return n, addr, err
+}
+
+func (c *progressConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil {
+		c.count(b)
+	}
+	return n, err
+}
+
+func (c *progressConn) count(packet []byte) {
+	if op, _ := common.GetOpCode(packet); op != common.OpDATA || len(packet) < 4 {
+		return
+	}
+	block := binary.BigEndian.Uint16(packet[2:])
+	if block == c.lastBlock {
+		return
+	}
+	c.lastBlock = block
+	c.t.bytes.Add(int64(len(packet) - 4))
+}
+
+// AdminHandler returns an HTTP handler for inspecting and controlling the
+// server. Every request must carry the header "Authorization: Bearer
+// <token>". It serves:
+//
+//	GET    /transfers       list the active transfers as JSON
+//	DELETE /transfers/{id}  cancel a transfer
+//	POST   /drain           stop accepting requests, as Shutdown does, and
+//	                        let active transfers finish
+//	GET    /vars            the server's counters as JSON, see Vars
+func (s *Server) AdminHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if token == "" || !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch id, isTransfer := strings.CutPrefix(r.URL.Path, "/transfers/"); {
+		case r.URL.Path == "/transfers":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.Transfers())
+		case isTransfer:
+			if r.Method != http.MethodDelete {
+				methodNotAllowed(w, http.MethodDelete)
+				return
+			}
+			s.adminCancel(w, id)
+		case r.URL.Path == "/drain":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, http.MethodPost)
+				return
+			}
+			s.logger().Info("Draining by admin request", "transfers", s.activeTransfers())
+			go s.Shutdown(context.Background())
+			w.WriteHeader(http.StatusAccepted)
+		case r.URL.Path == "/vars":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			io.WriteString(w, s.Vars().String())
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+func (s *Server) adminCancel(w http.ResponseWriter, idText string) {
+	id, err := strconv.ParseUint(idText, 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid transfer ID", http.StatusBadRequest)
+		return
+	}
+	if !s.CancelTransfer(id) {
+		http.Error(w, "No such transfer", http.StatusNotFound)
+		return
+	}
+	s.logger().Info("Transfer canceled by admin", "id", id)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+}
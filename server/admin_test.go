@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func adminRequest(t *testing.T, h http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminHandler(t *testing.T) {
+	s := &Server{
+		ReadHandler: ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+			return io.NopCloser(strings.NewReader(strings.Repeat("k", 2000))), 2000, nil
+		}),
+		Filters: []RequestFilter{func(req *Request) error {
+			req.Metadata.Set("asset", "rack4")
+			return nil
+		}},
+	}
+	addr, done := startServer(t, s)
+	h := s.AdminHandler("secret")
+
+	// Read the first block and never acknowledge it, so the transfer stays
+	// active
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{method: "GET", path: "/transfers", status: http.StatusUnauthorized},
+		{method: "GET", path: "/transfers", token: "wrong", status: http.StatusUnauthorized},
+		{method: "GET", path: "/transfers", token: "secret", status: http.StatusOK},
+		{method: "POST", path: "/transfers", token: "secret", status: http.StatusMethodNotAllowed},
+		{method: "GET", path: "/other", token: "secret", status: http.StatusNotFound},
+		{method: "GET", path: "/vars", token: "secret", status: http.StatusOK},
+		{method: "POST", path: "/vars", token: "secret", status: http.StatusMethodNotAllowed},
+		{method: "DELETE", path: "/transfers/abc", token: "secret", status: http.StatusBadRequest},
+		{method: "DELETE", path: "/transfers/99", token: "secret", status: http.StatusNotFound},
+	}
+	for i, tc := range testCases {
+		if w := adminRequest(t, h, tc.method, tc.path, tc.token); w.Code != tc.status {
+			t.Errorf("Expected status %d, got %d (%d)", tc.status, w.Code, i)
+		}
+	}
+
+	var transfers []TransferInfo
+	w := adminRequest(t, h, "GET", "/transfers", "secret")
+	if err := json.Unmarshal(w.Body.Bytes(), &transfers); err != nil {
+		t.Fatal(err)
+	}
+	if len(transfers) != 1 {
+		t.Fatalf("Expected 1 transfer, got %v", transfers)
+	}
+	if tr := transfers[0]; tr.Op != "RRQ" || tr.File != "kernel" || tr.Bytes != common.BlockSize || tr.Client != conn.LocalAddr().String() || tr.Metadata["asset"] != "rack4" {
+		t.Errorf("Unexpected transfer %+v", tr)
+	}
+
+	s.violations.record(conn.LocalAddr(), common.ViolationWrongTID)
+	var vars struct {
+		Violations map[string]map[string]int `json:"violations"`
+	}
+	w = adminRequest(t, h, "GET", "/vars", "secret")
+	if err := json.Unmarshal(w.Body.Bytes(), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if n := vars.Violations["127.0.0.1"]["wrong_tid"]; n != 1 {
+		t.Errorf("Expected the violation in /vars, got %v", vars.Violations)
+	}
+
+	w = adminRequest(t, h, "DELETE", "/transfers/"+strconv.FormatUint(transfers[0].ID, 10), "secret")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Expected status %d, got %d", http.StatusNoContent, w.Code)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for s.activeTransfers() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Transfer still active after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if w := adminRequest(t, h, "POST", "/drain", "secret"); w.Code != http.StatusAccepted {
+		t.Fatalf("Expected status %d, got %d", http.StatusAccepted, w.Code)
+	}
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Server still serving after drain")
+	}
+}
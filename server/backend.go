@@ -0,0 +1,240 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// A Backend stores the files a server reads and writes. Dir is the disk
+// backend; other storage plugs in by implementing Backend and setting
+// Server.Backend, or serving it with a BackendHandler. Names are the
+// requested filenames without any leading slash.
+type Backend interface {
+	// Open opens name for reading, returning its size or -1 if that isn't
+	// known.
+	Open(name string) (io.ReadCloser, int64, error)
+	// Create opens name for writing, replacing any existing file. The
+	// upload is complete once the writer is closed.
+	Create(name string) (io.WriteCloser, error)
+	// Stat describes name, returning an error matching fs.ErrNotExist if
+	// there is no such file.
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// A RemoveBackend is a Backend that can delete files. Failed uploads to it
+// are removed unless their writer has its own Abort method.
+type RemoveBackend interface {
+	Backend
+	Remove(name string) error
+}
+
+// A ContextBackend is a Backend whose reads may block, such as on the
+// network, and can be cancelled. BackendHandler opens files from it with
+// the request's context, see Request.Context, which RequestFromContext
+// turns back into the request.
+type ContextBackend interface {
+	Backend
+	OpenContext(ctx context.Context, name string) (io.ReadCloser, int64, error)
+}
+
+// openContext opens name from b, with ctx if b takes one.
+func openContext(ctx context.Context, b Backend, name string) (io.ReadCloser, int64, error) {
+	if cb, ok := b.(ContextBackend); ok {
+		return cb.OpenContext(ctx, name)
+	}
+	return b.Open(name)
+}
+
+// BackendHandler serves reads and writes from a Backend.
+type BackendHandler struct {
+	Backend Backend
+	// Overwrite decides what happens to existing files. Unlike UploadDir
+	// the check is separate from creating the file, so two uploads racing
+	// for the same name may both succeed.
+	Overwrite OverwritePolicy
+}
+
+func (h BackendHandler) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	return openContext(req.Context(), h.Backend, strings.TrimPrefix(req.Filename, "/"))
+}
+
+func (h BackendHandler) ServeWrite(req *Request) (io.WriteCloser, error) {
+	name, err := h.uploadName(strings.TrimPrefix(req.Filename, "/"))
+	if err != nil {
+		return nil, err
+	}
+	w, err := h.Backend.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := w.(aborter); ok {
+		return w, nil
+	}
+	if rb, ok := h.Backend.(RemoveBackend); ok {
+		return &removingWriter{WriteCloser: w, backend: rb, name: name}, nil
+	}
+	return w, nil
+}
+
+// uploadName returns the name to store an upload of name under according
+// to the overwrite policy.
+func (h BackendHandler) uploadName(name string) (string, error) {
+	if h.Overwrite == OverwriteAllow {
+		return name, nil
+	}
+	candidate := name
+	for i := 1; i <= maxVersions; i++ {
+		_, err := h.Backend.Stat(candidate)
+		if errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if h.Overwrite == OverwriteReject {
+			return "", errFileExists
+		}
+		candidate = name + "." + strconv.Itoa(i)
+	}
+	return "", errFileExists
+}
+
+// removingWriter discards a failed upload by removing it from the backend.
+type removingWriter struct {
+	io.WriteCloser
+	backend RemoveBackend
+	name    string
+}
+
+func (w *removingWriter) Abort() error {
+	w.WriteCloser.Close()
+	return w.backend.Remove(w.name)
+}
+
+func (d Dir) Open(name string) (io.ReadCloser, int64, error) {
+	return d.open(name, true)
+}
+
+func (d Dir) open(name string, followLinks bool) (io.ReadCloser, int64, error) {
+	p, err := d.resolve(name, followLinks)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+// glob returns the regular files in d matching pattern, a path.Match
+// pattern with / separated names relative to d. If followLinks is false,
+// files reached through a symlink are left out.
+func (d Dir) glob(pattern string, followLinks bool) ([]string, error) {
+	root := string(d)
+	if root == "" {
+		root = "."
+	}
+	matches, err := fs.Glob(os.DirFS(root), pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid pattern %q: %v", pattern, err)
+	}
+	files := matches[:0]
+	for _, name := range matches {
+		p, err := d.resolve(name, followLinks)
+		if err != nil {
+			continue
+		}
+		if info, err := os.Stat(p); err == nil && info.Mode().IsRegular() {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+func (d Dir) Create(name string) (io.WriteCloser, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return createFile(p)
+}
+
+// createFile returns a writer to a temporary file beside p that is renamed
+// to p once closed, so an existing file is only replaced by a whole upload.
+func createFile(p string) (io.WriteCloser, error) {
+	f, err := createTemp(filepath.Dir(p), "."+filepath.Base(p)+".")
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{File: f, w: bufio.NewWriter(f), final: p}, nil
+}
+
+func (d Dir) Stat(name string) (fs.FileInfo, error) {
+	p, err := d.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (d Dir) Remove(name string) error {
+	p, err := d.path(name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+func (d NoSymlinksDir) Open(name string) (io.ReadCloser, int64, error) {
+	return Dir(d).open(name, false)
+}
+
+func (d NoSymlinksDir) Create(name string) (io.WriteCloser, error) {
+	p, err := Dir(d).resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return createFile(p)
+}
+
+func (d NoSymlinksDir) Stat(name string) (fs.FileInfo, error) {
+	p, err := Dir(d).resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	return os.Stat(p)
+}
+
+func (d NoSymlinksDir) Remove(name string) error {
+	p, err := Dir(d).resolve(name, false)
+	if err != nil {
+		return err
+	}
+	return os.Remove(p)
+}
+
+// diskDir returns the directory b serves from and whether it follows
+// symlinks, if b is a Dir or NoSymlinksDir.
+func diskDir(b Backend) (d Dir, followLinks bool, ok bool) {
+	switch b := b.(type) {
+	case Dir:
+		return b, true, true
+	case NoSymlinksDir:
+		return Dir(b), false, true
+	}
+	return "", false, false
+}
@@ -0,0 +1,261 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+var _ RemoveBackend = Dir("")
+
+// mapBackend is a Backend keeping files in a map.
+type mapBackend struct {
+	mu    sync.Mutex
+	files map[string]string
+}
+
+func (b *mapBackend) Open(name string) (io.ReadCloser, int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.files[name]
+	if !ok {
+		return nil, 0, fs.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader([]byte(data))), int64(len(data)), nil
+}
+
+func (b *mapBackend) Create(name string) (io.WriteCloser, error) {
+	return &mapWriter{b: b, name: name}, nil
+}
+
+func (b *mapBackend) Stat(name string) (fs.FileInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.files[name]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	return fstest.MapFS{name: {Data: []byte(data)}}.Stat(name)
+}
+
+func (b *mapBackend) Remove(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.files, name)
+	return nil
+}
+
+func (b *mapBackend) names() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var names []string
+	for name := range b.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mapWriter stores its file as soon as it is created, so an abandoned
+// upload leaves a partial file unless removed.
+type mapWriter struct {
+	b    *mapBackend
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *mapWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	w.b.mu.Lock()
+	defer w.b.mu.Unlock()
+	w.b.files[w.name] = w.buf.String()
+	return len(p), nil
+}
+
+func (w *mapWriter) Close() error {
+	return nil
+}
+
+func TestBackendHandler(t *testing.T) {
+	testCases := []struct {
+		policy   OverwritePolicy
+		err      error
+		expected []string
+	}{
+		{policy: OverwriteAllow, expected: []string{"config"}},
+		{policy: OverwriteReject, err: errFileExists, expected: []string{"config"}},
+		{policy: OverwriteVersion, expected: []string{"config", "config.1"}},
+	}
+
+	for i, tc := range testCases {
+		b := &mapBackend{files: map[string]string{"config": "old"}}
+		h := BackendHandler{Backend: b, Overwrite: tc.policy}
+		w, err := h.ServeWrite(&Request{Filename: "/config"})
+		if err != tc.err {
+			t.Errorf("Expected %v, got %v (%d)", tc.err, err, i)
+			continue
+		}
+		if err == nil {
+			io.WriteString(w, "new")
+			w.Close()
+		}
+		if got := b.names(); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestServerBackend(t *testing.T) {
+	b := &mapBackend{files: map[string]string{"kernel": "vmlinuz"}}
+	s := &Server{Backend: b}
+	addr, _ := startServer(t, s)
+
+	got, err := getFile(t, addr, "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "vmlinuz" {
+		t.Errorf("Expected %q, got %q", "vmlinuz", got)
+	}
+	_, err = getFile(t, addr, "missing")
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrFileNotFound {
+		t.Errorf("Expected File not found, got %v", err)
+	}
+	if err := putFile(t, addr, "upload", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Abandon an upload after its first block, which should remove it
+	conn := sendRequest(t, addr, common.OpWRQ, "partial")
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := append([]byte{0, byte(common.OpDATA), 0, 1}, bytes.Repeat([]byte("p"), common.BlockSize)...)
+	if _, err := conn.WriteTo(data, from); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if err := common.SendError(common.ErrDiskFull, "Giving up", conn, from); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"kernel", "upload"}
+	deadline := time.Now().Add(2 * time.Second)
+	for !reflect.DeepEqual(b.names(), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v, got %v", expected, b.names())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServerDirBackend(t *testing.T) {
+	testCases := []struct {
+		backend func(root string) Backend
+	}{
+		{backend: func(root string) Backend { return Dir(root) }},
+		{backend: func(root string) Backend { return Dir(root).NoSymlinks() }},
+		{backend: func(root string) Backend { return NewCachedBackend(Dir(root), 1<<20) }},
+	}
+
+	for i, tc := range testCases {
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, "config"), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		addr, _ := startServer(t, &Server{Backend: tc.backend(root)})
+		if err := putFile(t, addr, "config", []byte("new config")); err != nil {
+			t.Errorf("Error uploading: %v (%d)", err, i)
+			continue
+		}
+
+		// The server may still be closing the file
+		var got []byte
+		for deadline := time.Now().Add(2 * time.Second); ; {
+			var err error
+			got, err = getFile(t, addr, "config")
+			if err == nil && string(got) == "new config" || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if string(got) != "new config" {
+			t.Errorf("Expected %q back, got %q (%d)", "new config", got, i)
+		}
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 1 {
+			t.Errorf("Expected only config in the directory, got %v (%d)", entries, i)
+		}
+	}
+}
+
+// blockingBackend is a ContextBackend whose reads wait for their context to
+// end, sending the request and then the cause.
+type blockingBackend struct {
+	mapBackend
+	requests chan *Request
+	causes   chan error
+}
+
+func (b *blockingBackend) OpenContext(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	req, _ := RequestFromContext(ctx)
+	b.requests <- req
+	<-ctx.Done()
+	b.causes <- context.Cause(ctx)
+	return nil, 0, context.Cause(ctx)
+}
+
+func TestContextBackendCancelled(t *testing.T) {
+	testCases := []struct {
+		cancel   func(s *Server, id uint64)
+		expected error
+	}{
+		{cancel: func(s *Server, id uint64) { s.CancelTransfer(id) }, expected: errTransferCancelled},
+		{cancel: func(s *Server, id uint64) { s.Close() }, expected: ErrServerClosed},
+	}
+
+	for i, tc := range testCases {
+		b := &blockingBackend{requests: make(chan *Request, 1), causes: make(chan error, 1)}
+		s := &Server{Backend: b}
+		addr, _ := startServer(t, s)
+		sendRequest(t, addr, common.OpRRQ, "kernel")
+
+		var req *Request
+		select {
+		case req = <-b.requests:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Backend wasn't opened (%d)", i)
+		}
+		transfers := s.Transfers()
+		if len(transfers) != 1 || req == nil || transfers[0].RequestID != req.ID {
+			t.Fatalf("Expected the transfer of request %v, got %v (%d)", req, transfers, i)
+		}
+		tc.cancel(s, transfers[0].ID)
+		select {
+		case cause := <-b.causes:
+			if cause != tc.expected {
+				t.Errorf("Expected %v, got %v (%d)", tc.expected, cause, i)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("Backend read wasn't cancelled (%d)", i)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// pacerBurst is how much traffic, in time at the full rate, a pacer lets
+// through at once after being idle.
+const pacerBurst = 100 * time.Millisecond
+
+// A pacer limits the bytes per second sent through it. It is safe for
+// concurrent use, so one pacer can be shared by many transfers, in which
+// case those of a higher priority are served first.
+type pacer struct {
+	mu     sync.Mutex
+	bucket *tokenBucket
+	// waiting counts the senders of each priority waiting for their
+	// reservation.
+	waiting [numPriorities]int
+}
+
+func newPacer(bytesPerSecond int64) *pacer {
+	burst := int(float64(bytesPerSecond) * pacerBurst.Seconds())
+	if burst < common.MaxPacketSize {
+		burst = common.MaxPacketSize
+	}
+	return &pacer{bucket: newTokenBucket(float64(bytesPerSecond), burst, time.Now())}
+}
+
+// setRate changes the pacer's rate to bytesPerSecond, as when a server
+// with a new configuration takes over from the one that made it.
+func (p *pacer) setRate(bytesPerSecond int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.bucket.rate == float64(bytesPerSecond) {
+		return
+	}
+	next := newPacer(bytesPerSecond).bucket
+	p.bucket.refill(time.Now())
+	p.bucket.rate, p.bucket.burst = next.rate, next.burst
+	p.bucket.tokens = min(p.bucket.tokens, p.bucket.burst)
+}
+
+// reserve takes n bytes from the pacer for a sender of priority prio,
+// returning how long to wait before sending them. Reservations queue up, so
+// concurrent senders share the rate. While senders of a higher priority are
+// waiting nothing is reserved, and reserve returns false along with how
+// long to hold back before trying again.
+func (p *pacer) reserve(n int, prio Priority, now time.Time) (time.Duration, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	b := p.bucket
+	b.refill(now)
+	for i := prio.index() + 1; i < numPriorities; i++ {
+		if p.waiting[i] > 0 {
+			return time.Duration(float64(n) / b.rate * float64(time.Second)), false
+		}
+	}
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0, true
+	}
+	p.waiting[prio.index()]++
+	return time.Duration(-b.tokens / b.rate * float64(time.Second)), true
+}
+
+// wait blocks until n bytes may be sent by a sender of priority prio.
+func (p *pacer) wait(n int, prio Priority) {
+	for {
+		d, ok := p.reserve(n, prio, time.Now())
+		if !ok {
+			time.Sleep(d)
+			continue
+		}
+		if d > 0 {
+			time.Sleep(d)
+			p.mu.Lock()
+			p.waiting[prio.index()]--
+			p.mu.Unlock()
+		}
+		return
+	}
+}
+
+// pacedConn paces the DATA packets written to it through each of its
+// pacers, at the transfer's priority.
+type pacedConn struct {
+	net.PacketConn
+	pacers   []*pacer
+	priority Priority
+}
+
+func (c *pacedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if op, err := common.GetOpCode(b); err == nil && op == common.OpDATA {
+		for _, p := range c.pacers {
+			p.wait(len(b), c.priority)
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// sharedPacer is a per-client pacer, kept while the client has transfers.
+type sharedPacer struct {
+	*pacer
+	refs int
+}
+
+// bandwidthPacers are the pacers shared by transfers, for MaxBandwidth and
+// MaxClientBandwidth.
+type bandwidthPacers struct {
+	mu      sync.Mutex
+	global  *pacer
+	clients map[string]*sharedPacer
+	// limits is the server whose rates apply, the latest to take over.
+	limits *Server
+}
+
+// takeOver applies s's rates to the pacers, those in use included.
+func (bp *bandwidthPacers) takeOver(s *Server) {
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	bp.limits = s
+	if bp.global != nil && s.MaxBandwidth > 0 {
+		bp.global.setRate(s.MaxBandwidth)
+	}
+	if s.MaxClientBandwidth > 0 {
+		for _, p := range bp.clients {
+			p.setRate(s.MaxClientBandwidth)
+		}
+	}
+}
+
+// transferPacers returns the pacers a new transfer's DATA packets must go
+// through, and a function to call once the transfer is over.
+func (s *Server) transferPacers(req *Request) (pacers []*pacer, release func()) {
+	release = func() {}
+	if s.MaxTransferBandwidth > 0 {
+		pacers = append(pacers, newPacer(s.MaxTransferBandwidth))
+	}
+
+	bp := &s.shared().pacers
+	bp.mu.Lock()
+	defer bp.mu.Unlock()
+	// A server draining after another took over uses the new rates
+	limits := bp.limits
+	if limits == nil {
+		limits = s
+	}
+	if limits.MaxClientBandwidth > 0 {
+		host := common.HostOf(req.RemoteAddr)
+		if bp.clients == nil {
+			bp.clients = make(map[string]*sharedPacer)
+		}
+		p := bp.clients[host]
+		if p == nil {
+			p = &sharedPacer{pacer: newPacer(limits.MaxClientBandwidth)}
+			bp.clients[host] = p
+		}
+		p.refs++
+		pacers = append(pacers, p.pacer)
+		release = func() {
+			bp.mu.Lock()
+			defer bp.mu.Unlock()
+			if p.refs--; p.refs == 0 {
+				delete(bp.clients, host)
+			}
+		}
+	}
+	if limits.MaxBandwidth > 0 {
+		if bp.global == nil {
+			bp.global = newPacer(limits.MaxBandwidth)
+		}
+		pacers = append(pacers, bp.global)
+	}
+	return pacers, release
+}
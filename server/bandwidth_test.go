@@ -0,0 +1,123 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPacerReserve(t *testing.T) {
+	p := newPacer(10000)
+	start := p.bucket.last
+
+	testCases := []struct {
+		n        int
+		after    time.Duration
+		expected time.Duration
+	}{
+		// The burst, never less than one maximum size packet, goes straight
+		// out
+		{n: 516, expected: 0},
+		// Then senders queue behind each other
+		{n: 516, expected: 800 * time.Microsecond},
+		{n: 516, expected: 52400 * time.Microsecond},
+		// Time passing pays off the debt
+		{n: 516, after: time.Second, expected: 0},
+	}
+
+	for i, tc := range testCases {
+		got, _ := p.reserve(tc.n, PriorityNormal, start.Add(tc.after))
+		if got.Round(time.Microsecond) != tc.expected {
+			t.Errorf("Expected to wait %v, got %v (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestPacerPriority(t *testing.T) {
+	p := newPacer(10000)
+	now := p.bucket.last
+
+	// A high priority sender has to wait, so lower ones hold back
+	if d, ok := p.reserve(2000, PriorityHigh, now); !ok || d == 0 {
+		t.Fatalf("Expected the high priority sender to wait, got %v, %v", d, ok)
+	}
+	testCases := []struct {
+		priority Priority
+		reserved bool
+	}{
+		{priority: PriorityLow, reserved: false},
+		{priority: PriorityNormal, reserved: false},
+		{priority: PriorityHigh, reserved: true},
+	}
+	for i, tc := range testCases {
+		if _, ok := p.reserve(100, tc.priority, now); ok != tc.reserved {
+			t.Errorf("Expected reserved %v, got %v (%d)", tc.reserved, ok, i)
+		}
+	}
+
+	// Once the high priority senders have sent, the rest take their turn
+	p.waiting[PriorityHigh.index()] = 0
+	if _, ok := p.reserve(100, PriorityLow, now); !ok {
+		t.Error("Expected the low priority sender to reserve")
+	}
+}
+
+func TestMaxBandwidth(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	data := make([]byte, 4500)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{MaxBandwidth: 10000}
+	addr, _ := startServer(t, s)
+
+	start := time.Now()
+	got, err := getFile(t, addr, "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(data) {
+		t.Errorf("Expected %d bytes, got %d", len(data), len(got))
+	}
+	// About 4.6KB at 10KB/s, less the burst
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected transfer to be paced, took %v", elapsed)
+	}
+}
+
+func TestTransferPacers(t *testing.T) {
+	s := &Server{MaxBandwidth: 1e6, MaxClientBandwidth: 1e5, MaxTransferBandwidth: 1e4}
+	reqFrom := func(ip string, port int) *Request {
+		return &Request{RemoteAddr: &net.UDPAddr{IP: net.ParseIP(ip), Port: port}}
+	}
+
+	a1, releaseA1 := s.transferPacers(reqFrom("10.0.0.1", 1000))
+	a2, releaseA2 := s.transferPacers(reqFrom("10.0.0.1", 2000))
+	b, releaseB := s.transferPacers(reqFrom("10.0.0.2", 1000))
+	if len(a1) != 3 || len(a2) != 3 || len(b) != 3 {
+		t.Fatalf("Expected transfer, client and global pacers, got %d, %d, %d", len(a1), len(a2), len(b))
+	}
+	if a1[0] == a2[0] {
+		t.Error("Expected each transfer to have its own pacer")
+	}
+	if a1[1] != a2[1] || a1[1] == b[1] {
+		t.Error("Expected transfers to share a pacer per client")
+	}
+	if a1[2] != b[2] {
+		t.Error("Expected all transfers to share the global pacer")
+	}
+
+	releaseA1()
+	releaseB()
+	if len(s.shared().pacers.clients) != 1 {
+		t.Errorf("Expected only the active client's pacer to be kept, have %d", len(s.shared().pacers.clients))
+	}
+	releaseA2()
+	if len(s.shared().pacers.clients) != 0 {
+		t.Errorf("Expected client pacers to be released, have %d", len(s.shared().pacers.clients))
+	}
+}
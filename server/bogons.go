@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net"
+	"net/netip"
+)
+
+// bogonPrefixes are the ranges that shouldn't appear as the source of
+// traffic from the internet: private, shared, loopback, link local,
+// documentation and reserved space.
+var bogonPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.0.2.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("198.51.100.0/24"),
+	netip.MustParsePrefix("203.0.113.0/24"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/8"),
+	netip.MustParsePrefix("100::/64"),
+	netip.MustParsePrefix("2001:db8::/32"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("fec0::/10"),
+}
+
+// bogusSource returns why requests from addr must be dropped without a
+// reply, or "" if they may be served. Broadcast, multicast and unspecified
+// addresses can't send requests of their own, so packets claiming them are
+// spoofed, and answering would make the server a reflector. So are bogons
+// when DropBogons is set.
+func (s *Server) bogusSource(addr net.Addr) string {
+	ip, ok := addrIP(addr)
+	if !ok {
+		return ""
+	}
+	switch {
+	case ip.IsUnspecified():
+		return "unspecified address"
+	case ip.IsMulticast():
+		return "multicast address"
+	case ip == netip.AddrFrom4([4]byte{255, 255, 255, 255}):
+		return "broadcast address"
+	case addr.(*net.UDPAddr).Port == 0:
+		return "port zero"
+	}
+	if s.DropBogons {
+		for _, p := range bogonPrefixes {
+			if p.Contains(ip) {
+				return "bogon"
+			}
+		}
+	}
+	return ""
+}
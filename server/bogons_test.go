@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestBogusSource(t *testing.T) {
+	testCases := []struct {
+		addr       string
+		dropBogons bool
+		bogus      bool
+	}{
+		{addr: "192.168.1.10:2000"},
+		{addr: "0.0.0.0:2000", bogus: true},
+		{addr: "255.255.255.255:68", bogus: true},
+		{addr: "224.0.0.1:2000", bogus: true},
+		{addr: "239.255.255.250:1900", bogus: true},
+		{addr: "[::]:2000", bogus: true},
+		{addr: "[ff02::1]:2000", bogus: true},
+		{addr: "[::ffff:224.0.0.1]:2000", bogus: true},
+		{addr: "8.8.8.8:0", bogus: true},
+		{addr: "192.168.1.10:2000", dropBogons: true, bogus: true},
+		{addr: "127.0.0.1:2000", dropBogons: true, bogus: true},
+		{addr: "[fe80::1]:2000", dropBogons: true, bogus: true},
+		{addr: "203.0.113.5:2000", dropBogons: true, bogus: true},
+		{addr: "8.8.8.8:2000", dropBogons: true},
+		{addr: "[2606:4700::1111]:2000", dropBogons: true},
+	}
+
+	for i, tc := range testCases {
+		addr, err := net.ResolveUDPAddr("udp", tc.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{DropBogons: tc.dropBogons}
+		if reason := s.bogusSource(addr); (reason != "") != tc.bogus {
+			t.Errorf("Expected bogus %v for %s, got %q (%d)", tc.bogus, tc.addr, reason, i)
+		}
+	}
+}
+
+func TestHandleHandshakeBroadcastSource(t *testing.T) {
+	// An unknown mode would otherwise be answered from the listener
+	packet := common.RequestPacket{OpCode: common.OpRRQ, Filename: "f", Mode: "binary"}
+	conn := &mockPacketConn{data: bytes.NewBuffer(packet.ToBytes()), addr: &net.UDPAddr{IP: net.IPv4bcast, Port: 68}}
+	s := &Server{}
+	if err := s.handleHandshake(conn); err != nil {
+		t.Errorf("Expected the request to be dropped quietly, got %v", err)
+	}
+	if conn.data.Len() != 0 {
+		t.Errorf("Expected no reply, got %s", common.DumpPacket(conn.data.Bytes()))
+	}
+}
@@ -0,0 +1,406 @@
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CachedBackend wraps a slow Backend, such as S3Backend, with a size bounded
+// LRU cache of file contents, so many clients netbooting the same kernel at
+// once only read it from the backend once. Concurrent misses for the same
+// file share a single load. Files bigger than the cache are streamed
+// straight from the backend. Writes and removals go to the backend and
+// invalidate the cached copy.
+//
+// Stats reports hits and misses, and can be published with expvar:
+//
+//	expvar.Publish("tftp_cache", expvar.Func(func() any { return c.Stats() }))
+type CachedBackend struct {
+	Backend Backend
+	// MaxSize is the most bytes of file content cached.
+	MaxSize int64
+	// TTL, if non-zero, is how long a cached file is served before it is
+	// read from the backend again.
+	TTL time.Duration
+
+	mu      sync.Mutex
+	lru     *list.List // of *cacheEntry, most recently used first
+	entries map[string]*list.Element
+	loading map[string]*cacheLoad
+	stats   CacheStats
+	// preloaded are the files loaded by Preload, reloaded by Watch when
+	// they change.
+	preloaded map[string]bool
+}
+
+var errTooBigToCache = errors.New("File is bigger than the cache")
+
+// CacheStats counts a CachedBackend's activity.
+type CacheStats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+	// Files and Bytes describe what is cached now.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+type cacheEntry struct {
+	name   string
+	data   []byte
+	loaded time.Time
+}
+
+// cacheLoad is a read from the backend that other requests for the same file
+// wait on. data is nil if the file couldn't be cached. A load is stale if the
+// file changed while it was being read, and what it read isn't cached.
+type cacheLoad struct {
+	done  chan struct{}
+	data  []byte
+	stale bool
+}
+
+// NewCachedBackend returns b wrapped in a cache of up to maxSize bytes.
+func NewCachedBackend(b Backend, maxSize int64) *CachedBackend {
+	return &CachedBackend{Backend: b, MaxSize: maxSize}
+}
+
+// Stats returns the cache's counters.
+func (c *CachedBackend) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *CachedBackend) Open(name string) (io.ReadCloser, int64, error) {
+	return c.OpenContext(context.Background(), name)
+}
+
+// OpenContext is Open passing ctx on to the backend. A read waiting on
+// another request's load of the same file gives up once ctx is done.
+func (c *CachedBackend) OpenContext(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	c.mu.Lock()
+	if data, ok := c.lookup(name); ok {
+		c.stats.Hits++
+		c.mu.Unlock()
+		return cachedReader(data)
+	}
+	if load, ok := c.loading[name]; ok {
+		c.mu.Unlock()
+		select {
+		case <-load.done:
+		case <-ctx.Done():
+			return nil, 0, context.Cause(ctx)
+		}
+		c.mu.Lock()
+		if load.data != nil {
+			c.stats.Hits++
+			c.mu.Unlock()
+			return cachedReader(load.data)
+		}
+		c.stats.Misses++
+		c.mu.Unlock()
+		return openContext(ctx, c.Backend, name)
+	}
+	c.stats.Misses++
+	load := &cacheLoad{done: make(chan struct{})}
+	if c.loading == nil {
+		c.loading = make(map[string]*cacheLoad)
+	}
+	c.loading[name] = load
+	c.mu.Unlock()
+
+	r, size, err := c.load(ctx, name, load)
+	close(load.done)
+	return r, size, err
+}
+
+// load reads name from the backend, caching it if it fits.
+func (c *CachedBackend) load(ctx context.Context, name string, load *cacheLoad) (io.ReadCloser, int64, error) {
+	defer func() {
+		c.mu.Lock()
+		if c.loading[name] == load {
+			delete(c.loading, name)
+		}
+		if load.data != nil && !load.stale {
+			c.add(name, load.data)
+		}
+		c.mu.Unlock()
+	}()
+
+	r, size, err := openContext(ctx, c.Backend, name)
+	if err != nil || size > c.MaxSize {
+		return r, size, err
+	}
+	// Read one byte past the limit to spot files of unknown size that are
+	// too big
+	data, err := io.ReadAll(io.LimitReader(r, c.MaxSize+1))
+	if err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+	if int64(len(data)) > c.MaxSize {
+		return readCloser{io.MultiReader(bytes.NewReader(data), r), r}, size, nil
+	}
+	r.Close()
+	load.data = data
+	return cachedReader(data)
+}
+
+// Preload reads the files named by patterns into the cache ahead of the
+// first requests for them, such as at startup before a scheduled mass
+// reboot, returning how many were loaded. When the backend is a Dir or
+// NoSymlinksDir, patterns may be path.Match globs, such as "images/*.img". It fails if a
+// file can't be read, a pattern matches nothing, or the files don't all fit
+// in the cache.
+func (c *CachedBackend) Preload(patterns ...string) (int, error) {
+	var names []string
+	for _, pattern := range patterns {
+		pattern = strings.TrimPrefix(pattern, "/")
+		matches := []string{pattern}
+		if d, followLinks, ok := diskDir(c.Backend); ok {
+			var err error
+			if matches, err = d.glob(pattern, followLinks); err != nil {
+				return 0, err
+			}
+			if len(matches) == 0 {
+				return 0, fmt.Errorf("No files match %q", pattern)
+			}
+		}
+		names = append(names, matches...)
+	}
+
+	var total int64
+	for _, name := range names {
+		data, err := c.readAll(name)
+		if err != nil {
+			return 0, fmt.Errorf("Error preloading %s: %v", name, err)
+		}
+		if total += int64(len(data)); total > c.MaxSize {
+			return 0, fmt.Errorf("Can't preload %s, the files add up to more than the cache holds", name)
+		}
+		c.mu.Lock()
+		c.add(name, data)
+		if c.preloaded == nil {
+			c.preloaded = make(map[string]bool)
+		}
+		c.preloaded[name] = true
+		c.mu.Unlock()
+	}
+	return len(names), nil
+}
+
+// Watch keeps the cache of a Dir or NoSymlinksDir in step with the files on
+// disk, so a new kernel is served as soon as it is in place rather than once
+// the old one expires. Cached copies of files that change are dropped, and
+// preloaded files read again. Watching is only supported on Linux, where it
+// uses inotify. Close the returned Closer to stop.
+func (c *CachedBackend) Watch() (io.Closer, error) {
+	d, _, ok := diskDir(c.Backend)
+	if !ok {
+		return nil, errors.New("Only a Dir backend can be watched")
+	}
+	root := string(d)
+	if root == "" {
+		root = "."
+	}
+	return watchDir(root, c.changed)
+}
+
+// changed drops the cached copies of name, or of everything below it if it
+// is a directory, reloading those that were preloaded. Loads of them under
+// way are left to finish without being cached. An empty name means anything
+// may have changed.
+func (c *CachedBackend) changed(name string) {
+	under := func(key string) bool {
+		clean := path.Clean(key)
+		return name == "" || clean == name || strings.HasPrefix(clean, name+"/")
+	}
+	var reload []string
+	c.mu.Lock()
+	for key, e := range c.entries {
+		if under(key) {
+			c.remove(e)
+		}
+	}
+	for key := range c.loading {
+		if under(key) {
+			c.abandonLoad(key)
+		}
+	}
+	for key := range c.preloaded {
+		if under(key) {
+			reload = append(reload, key)
+		}
+	}
+	c.mu.Unlock()
+
+	for _, key := range reload {
+		// A file that is gone, or no longer fits, is left to be loaded
+		// on demand
+		data, err := c.readAll(key)
+		if err != nil {
+			continue
+		}
+		c.mu.Lock()
+		c.add(key, data)
+		c.mu.Unlock()
+	}
+}
+
+// readAll reads the whole of name from the backend, if it fits in the
+// cache.
+func (c *CachedBackend) readAll(name string) ([]byte, error) {
+	r, size, err := c.Backend.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if size > c.MaxSize {
+		return nil, errTooBigToCache
+	}
+	data, err := io.ReadAll(io.LimitReader(r, c.MaxSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > c.MaxSize {
+		return nil, errTooBigToCache
+	}
+	return data, nil
+}
+
+// lookup returns the cached content of name, marking it recently used.
+// c.mu must be held.
+func (c *CachedBackend) lookup(name string) ([]byte, bool) {
+	e, ok := c.entries[name]
+	if !ok {
+		return nil, false
+	}
+	entry := e.Value.(*cacheEntry)
+	if c.TTL > 0 && time.Since(entry.loaded) > c.TTL {
+		c.remove(e)
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return entry.data, true
+}
+
+// add caches data as the content of name, evicting the least recently used
+// files to make room. c.mu must be held.
+func (c *CachedBackend) add(name string, data []byte) {
+	if e, ok := c.entries[name]; ok {
+		c.remove(e)
+	}
+	if c.lru == nil {
+		c.lru = list.New()
+		c.entries = make(map[string]*list.Element)
+	}
+	for c.stats.Bytes+int64(len(data)) > c.MaxSize {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+	c.entries[name] = c.lru.PushFront(&cacheEntry{name: name, data: data, loaded: time.Now()})
+	c.stats.Files++
+	c.stats.Bytes += int64(len(data))
+}
+
+// remove drops e from the cache. c.mu must be held.
+func (c *CachedBackend) remove(e *list.Element) {
+	entry := c.lru.Remove(e).(*cacheEntry)
+	delete(c.entries, entry.name)
+	c.stats.Files--
+	c.stats.Bytes -= int64(len(entry.data))
+}
+
+// abandonLoad marks the load of name under way stale, so the content it
+// read isn't cached, and lets later requests start a fresh one. c.mu must
+// be held.
+func (c *CachedBackend) abandonLoad(name string) {
+	if load, ok := c.loading[name]; ok {
+		load.stale = true
+		delete(c.loading, name)
+	}
+}
+
+// invalidate drops any cached copy of name, and any load of it under way.
+func (c *CachedBackend) invalidate(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[name]; ok {
+		c.remove(e)
+	}
+	c.abandonLoad(name)
+}
+
+func (c *CachedBackend) Stat(name string) (fs.FileInfo, error) {
+	return c.Backend.Stat(name)
+}
+
+// Create invalidates any cached copy of name once the upload is closed.
+func (c *CachedBackend) Create(name string) (io.WriteCloser, error) {
+	w, err := c.Backend.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return &invalidatingWriter{WriteCloser: w, c: c, name: name}, nil
+}
+
+// Remove removes name from the backend, which must be a RemoveBackend.
+func (c *CachedBackend) Remove(name string) error {
+	defer c.invalidate(name)
+	rb, ok := c.Backend.(RemoveBackend)
+	if !ok {
+		return errReadOnlyBackend
+	}
+	return rb.Remove(name)
+}
+
+type invalidatingWriter struct {
+	io.WriteCloser
+	c    *CachedBackend
+	name string
+}
+
+func (w *invalidatingWriter) Close() error {
+	defer w.c.invalidate(w.name)
+	return w.WriteCloser.Close()
+}
+
+// Abort passes an abort on to the backend's writer if it supports it, and
+// otherwise removes the partial upload from the backend.
+func (w *invalidatingWriter) Abort() error {
+	if a, ok := w.WriteCloser.(aborter); ok {
+		return a.Abort()
+	}
+	w.WriteCloser.Close()
+	return w.c.Remove(w.name)
+}
+
+// KeepPartial passes on to the backend's writer if it can keep partial
+// uploads, and otherwise aborts.
+func (w *invalidatingWriter) KeepPartial() (string, error) {
+	if k, ok := w.WriteCloser.(partialKeeper); ok {
+		defer w.c.invalidate(w.name)
+		return k.KeepPartial()
+	}
+	return "", w.Abort()
+}
+
+func cachedReader(data []byte) (io.ReadCloser, int64, error) {
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// readCloser pairs a Reader with the Closer of the stream it reads.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingBackend counts the files opened on a MemoryBackend, optionally
+// delaying each open.
+type countingBackend struct {
+	*MemoryBackend
+	opens atomic.Int64
+	delay time.Duration
+}
+
+func (b *countingBackend) Open(name string) (io.ReadCloser, int64, error) {
+	b.opens.Add(1)
+	time.Sleep(b.delay)
+	return b.MemoryBackend.Open(name)
+}
+
+func readCached(t *testing.T, c *CachedBackend, name string) string {
+	r, _, err := c.Open(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, _ := io.ReadAll(r)
+	return string(data)
+}
+
+func TestCachedBackend(t *testing.T) {
+	b := &countingBackend{MemoryBackend: &MemoryBackend{}}
+	b.Store("a", []byte("aaaa"))
+	b.Store("b", []byte("bbbb"))
+	b.Store("c", []byte("cccc"))
+	b.Store("big", bytes.Repeat([]byte("x"), 20))
+	c := NewCachedBackend(b, 10)
+
+	testCases := []struct {
+		name  string
+		opens int64
+	}{
+		{name: "a", opens: 1},
+		{name: "a", opens: 1},
+		{name: "b", opens: 2},
+		// Evicts a, the least recently used
+		{name: "c", opens: 3},
+		{name: "b", opens: 3},
+		{name: "a", opens: 4},
+		// Too big to cache
+		{name: "big", opens: 5},
+		{name: "big", opens: 6},
+	}
+	for i, tc := range testCases {
+		expected, _, _ := b.MemoryBackend.Open(tc.name)
+		data, _ := io.ReadAll(expected)
+		if got := readCached(t, c, tc.name); got != string(data) {
+			t.Errorf("Expected %q, got %q (%d)", data, got, i)
+		}
+		if got := b.opens.Load(); got != tc.opens {
+			t.Errorf("Expected %d opens, got %d (%d)", tc.opens, got, i)
+		}
+	}
+
+	expected := CacheStats{Hits: 2, Misses: 6, Evictions: 2, Files: 2, Bytes: 8}
+	if got := c.Stats(); got != expected {
+		t.Errorf("Expected %+v, got %+v", expected, got)
+	}
+
+	// Uploads replace the cached copy
+	w, err := c.Create("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "new")
+	w.Close()
+	if got := readCached(t, c, "a"); got != "new" {
+		t.Errorf("Expected %q after upload, got %q", "new", got)
+	}
+}
+
+func TestCachedBackendConcurrentMisses(t *testing.T) {
+	b := &countingBackend{MemoryBackend: &MemoryBackend{}, delay: 50 * time.Millisecond}
+	b.Store("kernel", []byte(strings.Repeat("k", 1000)))
+	c := NewCachedBackend(b, 1<<20)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if got := readCached(t, c, "kernel"); len(got) != 1000 {
+				t.Errorf("Expected 1000 bytes, got %d", len(got))
+			}
+		}()
+	}
+	wg.Wait()
+	if got := b.opens.Load(); got != 1 {
+		t.Errorf("Expected the backend to be read once, got %d", got)
+	}
+}
+
+// gatedBackend holds each open of a MemoryBackend, having read the file,
+// until release is closed.
+type gatedBackend struct {
+	*MemoryBackend
+	opened  chan struct{}
+	release chan struct{}
+}
+
+func (b *gatedBackend) Open(name string) (io.ReadCloser, int64, error) {
+	r, size, err := b.MemoryBackend.Open(name)
+	select {
+	case b.opened <- struct{}{}:
+	default:
+	}
+	<-b.release
+	return r, size, err
+}
+
+func TestCachedBackendChangedDuringLoad(t *testing.T) {
+	b := &gatedBackend{MemoryBackend: &MemoryBackend{}, opened: make(chan struct{}, 1), release: make(chan struct{})}
+	b.Store("kernel", []byte("v1"))
+	c := NewCachedBackend(b, 100)
+
+	done := make(chan string)
+	go func() { done <- readCached(t, c, "kernel") }()
+	<-b.opened
+	b.Store("kernel", []byte("v2"))
+	c.changed("kernel")
+	close(b.release)
+
+	if got := <-done; got != "v1" {
+		t.Errorf("Expected the load under way to return %q, got %q", "v1", got)
+	}
+	if got := readCached(t, c, "kernel"); got != "v2" {
+		t.Errorf("Expected the stale load not to be cached, got %q", got)
+	}
+}
+
+func TestCachedBackendTTL(t *testing.T) {
+	b := &countingBackend{MemoryBackend: &MemoryBackend{}}
+	b.Store("kernel", []byte("v1"))
+	c := &CachedBackend{Backend: b, MaxSize: 100, TTL: 20 * time.Millisecond}
+
+	readCached(t, c, "kernel")
+	b.Store("kernel", []byte("v2"))
+	if got := readCached(t, c, "kernel"); got != "v1" {
+		t.Errorf("Expected the cached copy, got %q", got)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if got := readCached(t, c, "kernel"); got != "v2" {
+		t.Errorf("Expected a fresh copy after the TTL, got %q", got)
+	}
+}
+
+func TestCachedBackendPreload(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"kernel":         "kkkk",
+		"images/a.img":   "aaaa",
+		"images/b.img":   "bbbb",
+		"images/big.img": strings.Repeat("x", 20),
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		patterns []string
+		files    int
+		fail     bool
+	}{
+		{patterns: []string{"kernel"}, files: 1},
+		{patterns: []string{"/kernel", "images/[ab].img"}, files: 3},
+		{patterns: []string{"images/*.iso"}, fail: true},
+		{patterns: []string{"missing"}, fail: true},
+		{patterns: []string{"images/big.img"}, fail: true},
+		{patterns: []string{"images/*"}, fail: true},
+		{patterns: []string{"images/["}, fail: true},
+	}
+	for i, tc := range testCases {
+		c := NewCachedBackend(Dir(dir), 16)
+		files, err := c.Preload(tc.patterns...)
+		if tc.fail {
+			if err == nil {
+				t.Errorf("Expected preloading %v to fail (%d)", tc.patterns, i)
+			}
+			continue
+		}
+		if err != nil || files != tc.files {
+			t.Errorf("Expected %d files, got %d, %v (%d)", tc.files, files, err, i)
+		}
+		if stats := c.Stats(); stats.Files != tc.files || stats.Misses != 0 {
+			t.Errorf("Expected %d files cached without misses, got %+v (%d)", tc.files, stats, i)
+		}
+	}
+
+	// Preloaded files are served without touching the backend
+	b := &countingBackend{MemoryBackend: &MemoryBackend{}}
+	b.Store("kernel", []byte("kkkk"))
+	c := NewCachedBackend(b, 16)
+	if _, err := c.Preload("kernel"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCached(t, c, "kernel"); got != "kkkk" || b.opens.Load() != 1 {
+		t.Errorf("Expected kernel from the cache after 1 open, got %q after %d", got, b.opens.Load())
+	}
+}
@@ -0,0 +1,132 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxChecksums is how many digests Checksums remembers before forgetting
+// some to make room.
+const maxChecksums = 4096
+
+// checksumAlgorithms are the companion file suffixes Checksums answers, with
+// the hash each is computed with.
+var checksumAlgorithms = map[string]func() hash.Hash{
+	".sha256": sha256.New,
+	".md5":    md5.New,
+}
+
+// Checksums serves name.sha256 and name.md5 when only name exists, computing
+// the digest on the fly in the format sha256sum and md5sum write, so there
+// is no need to pre-generate companion files for every image. Companion
+// files that do exist are served as they are. Use its Middleware with a
+// server:
+//
+//	sums := &server.Checksums{}
+//	s.Middleware = append(s.Middleware, sums.Middleware)
+//
+// Digests of files on disk are remembered until the file's size or
+// modification time changes. Those of other content are computed afresh
+// for every request.
+type Checksums struct {
+	mu      sync.Mutex
+	digests map[string]checksumEntry
+}
+
+// checksumEntry is a digest along with the state of the file it was
+// computed from.
+type checksumEntry struct {
+	size    int64
+	modTime time.Time
+	digest  string
+}
+
+// Middleware serves generated checksums in place of missing companion
+// files.
+func (c *Checksums) Middleware(next Handler) Handler {
+	return CombineHandlers(ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+		r, size, err := next.ServeRead(req)
+		ext := path.Ext(req.Filename)
+		newHash, ok := checksumAlgorithms[strings.ToLower(ext)]
+		if !ok || !os.IsNotExist(err) {
+			return r, size, err
+		}
+		target := *req
+		target.Filename = strings.TrimSuffix(req.Filename, ext)
+		if target.Filename == "" || strings.HasSuffix(target.Filename, "/") {
+			return r, size, err
+		}
+		return c.serve(next, &target, ext, newHash)
+	}), next)
+}
+
+// serve returns the checksum of req's file, computed with newHash.
+func (c *Checksums) serve(next Handler, req *Request, ext string, newHash func() hash.Hash) (io.ReadCloser, int64, error) {
+	r, _, err := next.ServeRead(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer r.Close()
+
+	key := ext + ":" + path.Clean("/"+req.Filename)
+	var info os.FileInfo
+	if f, ok := r.(interface{ Stat() (os.FileInfo, error) }); ok {
+		info, _ = f.Stat()
+	}
+	digest, ok := c.lookup(key, info)
+	if !ok {
+		h := newHash()
+		if _, err := io.Copy(h, r); err != nil {
+			return nil, 0, err
+		}
+		digest = hex.EncodeToString(h.Sum(nil))
+		if info != nil {
+			c.remember(key, info, digest)
+		}
+	}
+	content := fmt.Sprintf("%s  %s\n", digest, path.Base(req.Filename))
+	return io.NopCloser(strings.NewReader(content)), int64(len(content)), nil
+}
+
+// lookup returns the remembered digest for key if it was computed from the
+// file as described by info.
+func (c *Checksums) lookup(key string, info os.FileInfo) (string, bool) {
+	if info == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.digests[key]
+	if !ok || e.size != info.Size() || !e.modTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	return e.digest, true
+}
+
+func (c *Checksums) remember(key string, info os.FileInfo, digest string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.digests == nil {
+		c.digests = make(map[string]checksumEntry)
+	}
+	if len(c.digests) >= maxChecksums {
+		// Forget an arbitrary tenth, they are cheap enough to recompute
+		n := maxChecksums / 10
+		for k := range c.digests {
+			delete(c.digests, k)
+			if n--; n == 0 {
+				break
+			}
+		}
+	}
+	c.digests[key] = checksumEntry{size: info.Size(), modTime: info.ModTime(), digest: digest}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestChecksums(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{
+		"images/disk.img":      "hello\n",
+		"images/kernel":        "kernel",
+		"images/kernel.sha256": "pregenerated\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sums := &Checksums{}
+	s := &Server{Root: dir, Middleware: []Middleware{sums.Middleware}}
+	addr, _ := startServer(t, s)
+
+	testCases := []struct {
+		filename string
+		expected string
+	}{
+		{filename: "images/disk.img.sha256", expected: "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  disk.img\n"},
+		{filename: "images/disk.img.md5", expected: "b1946ac92492d2347c6235b4d2611184  disk.img\n"},
+		{filename: "images/disk.img.MD5", expected: "b1946ac92492d2347c6235b4d2611184  disk.img\n"},
+		{filename: "images/kernel.sha256", expected: "pregenerated\n"},
+		{filename: "images/disk.img", expected: "hello\n"},
+		{filename: "images/missing.sha256"},
+		{filename: "images/disk.img.sha1"},
+	}
+	for i, tc := range testCases {
+		got, err := getFile(t, addr, tc.filename)
+		if tc.expected == "" {
+			if e, ok := err.(*common.Error); !ok || e.Code != common.ErrFileNotFound {
+				t.Errorf("Expected File not found, got %v (%d)", err, i)
+			}
+			continue
+		}
+		if err != nil || string(got) != tc.expected {
+			t.Errorf("Expected %q, got %q, %v (%d)", tc.expected, got, err, i)
+		}
+	}
+
+	// A file changed in place is hashed again rather than served from the
+	// cache
+	path := filepath.Join(dir, "images/disk.img")
+	if err := os.WriteFile(path, []byte("HELLO\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	expected := "0084467710d2fc9d8a306e14efbe6d0f  disk.img\n"
+	if got, err := getFile(t, addr, "images/disk.img.md5"); err != nil || string(got) != expected {
+		t.Errorf("Expected %q, got %q, %v", expected, got, err)
+	}
+}
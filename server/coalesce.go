@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"path"
+	"sync"
+)
+
+// coalescedReads shares one read of a file between the downloads of it that
+// overlap, so a boot storm of clients fetching the same image reads it from
+// disk once and holds a single copy in memory. Unlike CachedBackend nothing
+// is kept once the last of those downloads ends, so there is no staleness
+// to manage beyond that.
+type coalescedReads struct {
+	handler ReadHandler
+	// maxSize is the largest file shared, bigger ones are read per
+	// transfer as usual.
+	maxSize int64
+
+	mu    sync.Mutex
+	files map[string]*sharedRead
+}
+
+// sharedRead is the content of a file read for the downloads holding a
+// reference to it. data is nil until done is closed, and stays nil if the
+// file couldn't be shared.
+type sharedRead struct {
+	done chan struct{}
+	data []byte
+	refs int
+}
+
+func (c *coalescedReads) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	key := path.Clean("/" + req.Filename)
+	c.mu.Lock()
+	if sr, ok := c.files[key]; ok {
+		sr.refs++
+		c.mu.Unlock()
+		select {
+		case <-sr.done:
+		case <-req.Context().Done():
+			c.release(key, sr)
+			return nil, 0, context.Cause(req.Context())
+		}
+		if sr.data != nil {
+			return c.reader(key, sr), int64(len(sr.data)), nil
+		}
+		c.release(key, sr)
+		return c.handler.ServeRead(req)
+	}
+	sr := &sharedRead{done: make(chan struct{}), refs: 1}
+	if c.files == nil {
+		c.files = make(map[string]*sharedRead)
+	}
+	c.files[key] = sr
+	c.mu.Unlock()
+	defer close(sr.done)
+
+	r, size, err := c.handler.ServeRead(req)
+	if err != nil || size > c.maxSize {
+		c.release(key, sr)
+		return r, size, err
+	}
+	// Read one byte past the limit to spot files of unknown size that are
+	// too big
+	data, err := io.ReadAll(io.LimitReader(r, c.maxSize+1))
+	if err != nil {
+		r.Close()
+		c.release(key, sr)
+		return nil, 0, err
+	}
+	if int64(len(data)) > c.maxSize {
+		c.release(key, sr)
+		return readCloser{io.MultiReader(bytes.NewReader(data), r), r}, size, nil
+	}
+	r.Close()
+	sr.data = data
+	return c.reader(key, sr), int64(len(data)), nil
+}
+
+// release drops a reference to sr, forgetting it once there are none left.
+func (c *coalescedReads) release(key string, sr *sharedRead) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sr.refs--
+	if sr.refs == 0 && c.files[key] == sr {
+		delete(c.files, key)
+	}
+}
+
+// sharedReader reads a download's copy of shared content, releasing its
+// reference when closed.
+type sharedReader struct {
+	*bytes.Reader
+	release func()
+	once    sync.Once
+}
+
+func (c *coalescedReads) reader(key string, sr *sharedRead) *sharedReader {
+	return &sharedReader{
+		Reader:  bytes.NewReader(sr.data),
+		release: func() { c.release(key, sr) },
+	}
+}
+
+func (r *sharedReader) Close() error {
+	r.once.Do(r.release)
+	return nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCoalescedReads(t *testing.T) {
+	var opens atomic.Int32
+	handler := ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+		opens.Add(1)
+		switch path.Clean(req.Filename) {
+		case "kernel":
+			return io.NopCloser(strings.NewReader("vmlinuz")), 7, nil
+		case "initrd":
+			return io.NopCloser(strings.NewReader("a big initrd")), -1, nil
+		}
+		return nil, 0, os.ErrNotExist
+	})
+
+	testCases := []struct {
+		filename string
+		readers  int
+		opens    int32
+		content  string
+		err      error
+	}{
+		{filename: "kernel", readers: 3, opens: 1, content: "vmlinuz"},
+		// Too big to share, found out while reading
+		{filename: "initrd", readers: 2, opens: 2, content: "a big initrd"},
+		{filename: "missing", readers: 2, opens: 2, err: os.ErrNotExist},
+	}
+
+	for i, tc := range testCases {
+		c := &coalescedReads{handler: handler, maxSize: 8}
+		opens.Store(0)
+		var readers []io.ReadCloser
+		for j := 0; j < tc.readers; j++ {
+			// The path is cleaned, so these are all the same file
+			r, _, err := c.ServeRead(&Request{Filename: strings.Repeat("./", j) + tc.filename})
+			if err != tc.err {
+				t.Errorf("Expected %v, got %v (%d)", tc.err, err, i)
+			}
+			if r != nil {
+				readers = append(readers, r)
+			}
+		}
+		for _, r := range readers {
+			got, err := io.ReadAll(r)
+			if err != nil || string(got) != tc.content {
+				t.Errorf("Expected %q, got %q, %v (%d)", tc.content, got, err, i)
+			}
+			r.Close()
+		}
+		if got := opens.Load(); got != tc.opens {
+			t.Errorf("Expected %d opens, got %d (%d)", tc.opens, got, i)
+		}
+		if len(c.files) != 0 {
+			t.Errorf("Expected nothing held once every reader is closed, got %v (%d)", c.files, i)
+		}
+
+		// Once the downloads are over the file is read afresh
+		opens.Store(0)
+		if r, _, err := c.ServeRead(&Request{Filename: tc.filename}); err == nil {
+			r.Close()
+		}
+		if got := opens.Load(); got != 1 {
+			t.Errorf("Expected a later download to open the file again, got %d opens (%d)", got, i)
+		}
+	}
+}
+
+func TestServerCoalesceReads(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("k", 2000)
+	if err := os.WriteFile(dir+"/kernel", []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := startServer(t, &Server{Root: dir, CoalesceReads: 1 << 20})
+	for i := 0; i < 2; i++ {
+		got, err := getFile(t, addr, "kernel")
+		if err != nil || string(got) != content {
+			t.Errorf("Unexpected download: %d bytes, %v (%d)", len(got), err, i)
+		}
+	}
+}
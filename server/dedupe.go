@@ -0,0 +1,59 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// defaultDuplicateWindow is used when Server.DuplicateWindow is zero.
+const defaultDuplicateWindow = 5 * time.Second
+
+// requestKey identifies a request for spotting retransmissions of it.
+type requestKey struct {
+	client   string
+	op       common.OpCode
+	filename string
+}
+
+// recentRequests tracks the requests being served, so a client
+// retransmitting its request before the first DATA or ACK arrives doesn't
+// start a second transfer competing with the first.
+type recentRequests struct {
+	mu       sync.Mutex
+	requests map[requestKey]time.Time
+}
+
+// start records the request key, returning false if the same request is
+// already being served and was accepted less than window ago.
+func (r *recentRequests) start(key requestKey, window time.Duration, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if accepted, ok := r.requests[key]; ok && now.Sub(accepted) < window {
+		return false
+	}
+	if r.requests == nil {
+		r.requests = make(map[requestKey]time.Time)
+	}
+	r.requests[key] = now
+	return true
+}
+
+// done forgets the request key once its transfer has finished, so the client
+// may ask again.
+func (r *recentRequests) done(key requestKey, accepted time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	// A later request with the same key may have replaced this one
+	if r.requests[key] == accepted {
+		delete(r.requests, key)
+	}
+}
+
+func (s *Server) duplicateWindow() time.Duration {
+	if s.DuplicateWindow == 0 {
+		return defaultDuplicateWindow
+	}
+	return s.DuplicateWindow
+}
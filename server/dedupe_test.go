@@ -0,0 +1,79 @@
+package server
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestRecentRequests(t *testing.T) {
+	var r recentRequests
+	key := requestKey{client: "10.0.0.1:1024", op: common.OpRRQ, filename: "kernel"}
+	other := requestKey{client: "10.0.0.1:1025", op: common.OpRRQ, filename: "kernel"}
+	now := time.Now()
+
+	testCases := []struct {
+		key      requestKey
+		at       time.Time
+		expected bool
+	}{
+		{key: key, at: now, expected: true},
+		{key: key, at: now.Add(time.Second), expected: false},
+		{key: other, at: now.Add(time.Second), expected: true},
+		// A transfer still running after the window no longer blocks retries
+		{key: key, at: now.Add(5 * time.Second), expected: true},
+	}
+	for i, tc := range testCases {
+		if got := r.start(tc.key, 5*time.Second, tc.at); got != tc.expected {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, got, i)
+		}
+	}
+
+	// Only the latest request with a key forgets it
+	r.done(key, now)
+	if r.start(key, 5*time.Second, now.Add(6*time.Second)) {
+		t.Error("Expected the replacing request to still be tracked")
+	}
+	r.done(key, now.Add(5*time.Second))
+	if !r.start(key, 5*time.Second, now.Add(6*time.Second)) {
+		t.Error("Expected a request to be served again once its transfer finished")
+	}
+}
+
+// countingHandler counts read requests, serving content to each.
+type countingHandler struct {
+	content string
+	reads   atomic.Int32
+}
+
+func (h *countingHandler) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	h.reads.Add(1)
+	return io.NopCloser(strings.NewReader(h.content)), int64(len(h.content)), nil
+}
+
+func TestRetransmittedRequestIgnored(t *testing.T) {
+	h := &countingHandler{content: strings.Repeat("x", 2000)}
+	s := &Server{ReadHandler: h}
+	addr, _ := startServer(t, s)
+
+	// The client gives up waiting for the first DATA and asks again
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	req := common.RequestPacket{OpCode: common.OpRRQ, Filename: "kernel", Mode: common.ModeOctet}
+	if _, err := conn.WriteTo(req.ToBytes(), addr); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	// Give the retransmission time to be handled
+	time.Sleep(100 * time.Millisecond)
+	if got := h.reads.Load(); got != 1 {
+		t.Errorf("Expected 1 transfer, got %d", got)
+	}
+}
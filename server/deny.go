@@ -0,0 +1,53 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// deniedFile reports whether name is refused by DenyFiles or, unless
+// AllowHidden is set, by being a hidden file or in a hidden directory.
+func (s *Server) deniedFile(name string) (bool, string) {
+	var segments []string
+	for _, segment := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment != "." {
+			segments = append(segments, segment)
+		}
+	}
+
+	if !s.AllowHidden {
+		for _, segment := range segments {
+			if strings.HasPrefix(segment, ".") {
+				return true, "hidden file"
+			}
+		}
+	}
+	for _, pattern := range s.DenyFiles {
+		if strings.Contains(pattern, "/") {
+			// Matched against the path and the directories leading to it
+			for i := range segments {
+				if ok, _ := path.Match(pattern, strings.Join(segments[:i+1], "/")); ok {
+					return true, pattern
+				}
+			}
+			continue
+		}
+		for _, segment := range segments {
+			if ok, _ := path.Match(pattern, segment); ok {
+				return true, pattern
+			}
+		}
+	}
+	return false, ""
+}
+
+// checkDenyFiles reports the first malformed pattern in DenyFiles.
+func (s *Server) checkDenyFiles() error {
+	for _, pattern := range s.DenyFiles {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid deny pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestDeniedFile(t *testing.T) {
+	testCases := []struct {
+		name        string
+		denyFiles   []string
+		allowHidden bool
+		denied      bool
+	}{
+		{name: "pxelinux.0", denied: false},
+		{name: ".htpasswd", denied: true},
+		{name: "images/.git/config", denied: true},
+		{name: `boot\.secret`, denied: true},
+		{name: "./pxelinux.0", denied: false},
+		{name: ".htpasswd", allowHidden: true, denied: false},
+		{name: "certs/server.key", denyFiles: []string{"*.key"}, denied: true},
+		{name: "certs/server.crt", denyFiles: []string{"*.key"}, denied: false},
+		{name: "secrets/token", denyFiles: []string{"secrets/*"}, denied: true},
+		{name: "secrets/deep/token", denyFiles: []string{"secrets/*"}, denied: true},
+		{name: `secrets\token`, denyFiles: []string{"secrets/*"}, denied: true},
+		{name: "images/secrets/token", denyFiles: []string{"secrets/*"}, denied: false},
+		{name: "images/secrets/token", denyFiles: []string{"secrets"}, denied: true},
+		{name: "images/x86/vmlinuz", denyFiles: []string{"images/arm/*", "*.key"}, denied: false},
+	}
+
+	for i, tc := range testCases {
+		s := &Server{DenyFiles: tc.denyFiles, AllowHidden: tc.allowHidden}
+		if denied, _ := s.deniedFile(tc.name); denied != tc.denied {
+			t.Errorf("Expected %q denied = %v, got %v (%d)", tc.name, tc.denied, denied, i)
+		}
+	}
+}
+
+func TestHandleHandshakeDeniedFile(t *testing.T) {
+	packet := common.RequestPacket{OpCode: common.OpRRQ, Filename: "certs/server.key", Mode: common.ModeOctet}
+	conn := &mockPacketConn{data: bytes.NewBuffer(packet.ToBytes()), addr: mockAddr{}}
+	s := &Server{DenyFiles: []string{"*.key"}}
+	if err := s.handleHandshake(conn); err == nil {
+		t.Fatal("Expected the request to be denied")
+	}
+
+	e, err := common.ParseErrorPacket(conn.data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != common.ErrAccessViolation {
+		t.Errorf("Unexpected error sent: %v", e)
+	}
+
+	if err := (&Server{DenyFiles: []string{"[a-"}}).checkDenyFiles(); err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// setDSCP marks the packets sent from conn with the DSCP value dscp.
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	// The DSCP is the top six bits of the TOS or traffic class byte
+	tos := dscp << 2
+	v4 := true
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		v4 = false
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if v4 {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+			return
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS, tos)
+		// Dual-stack sockets send IPv4 packets too, where supported
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS, tos)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("Error setting DSCP: %v", sockErr)
+	}
+	return nil
+}
@@ -0,0 +1,12 @@
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+var errDSCPUnsupported = errors.New("DSCP marking isn't supported on Windows")
+
+func setDSCP(conn *net.UDPConn, dscp int) error {
+	return errDSCPUnsupported
+}
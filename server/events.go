@@ -0,0 +1,130 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventRequest is a well formed RRQ or WRQ received, before it is
+	// checked against the server's rules.
+	EventRequest EventType = iota
+	// EventTransferStart is a transfer whose file has been opened.
+	EventTransferStart
+	// EventRetransmit is a packet of a transfer sent again.
+	EventRetransmit
+	// EventTransferEnd is a transfer finished, successfully or not.
+	EventTransferEnd
+	// EventError is a request refused, or a packet on the request port
+	// that couldn't be handled.
+	EventError
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventRequest:
+		return "request"
+	case EventTransferStart:
+		return "transfer_start"
+	case EventRetransmit:
+		return "retransmit"
+	case EventTransferEnd:
+		return "transfer_end"
+	case EventError:
+		return "error"
+	}
+	return "unknown"
+}
+
+// An Event is something that happened in the server, as delivered by
+// Subscribe.
+type Event struct {
+	Type   EventType
+	Time   time.Time
+	Client net.Addr
+
+	// Op and Filename are as requested, and unset for an EventError
+	// about a packet that wasn't a valid request.
+	Op       common.OpCode
+	Filename string
+	// Request is the transfer's request, with its metadata, for the
+	// transfer events.
+	Request *Request
+
+	// Block is the number of the DATA or ACK packet resent for
+	// EventRetransmit, 0 for an option acknowledgement.
+	Block uint16
+	// Outcome and Stats are set for EventTransferEnd, as for the
+	// OnTransferEnd hook. Err is why a transfer didn't succeed, or for
+	// EventError what was wrong.
+	Outcome string
+	Stats   common.TransferStats
+	Err     error
+}
+
+// eventSubscribers are the channels events are delivered to.
+type eventSubscribers struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// Subscribe returns a channel of the server's events, with room for size of
+// them, and a function that stops delivery and closes the channel. Events
+// are never waited on: those arriving while the channel is full are dropped
+// rather than holding up transfers, so subscribers should keep reading.
+func (s *Server) Subscribe(size int) (<-chan Event, func()) {
+	c := make(chan Event, size)
+	s.events.mu.Lock()
+	if s.events.subs == nil {
+		s.events.subs = make(map[chan Event]struct{})
+	}
+	s.events.subs[c] = struct{}{}
+	s.events.mu.Unlock()
+
+	var once sync.Once
+	return c, func() {
+		once.Do(func() {
+			s.events.mu.Lock()
+			delete(s.events.subs, c)
+			s.events.mu.Unlock()
+			close(c)
+		})
+	}
+}
+
+// publish delivers e to the subscribers with room for it.
+func (s *Server) publish(e Event) {
+	s.events.mu.Lock()
+	defer s.events.mu.Unlock()
+	if len(s.events.subs) == 0 {
+		return
+	}
+	e.Time = time.Now()
+	if e.Request != nil {
+		e.Client = e.Request.RemoteAddr
+		e.Op = e.Request.OpCode
+		e.Filename = e.Request.Filename
+	}
+	for c := range s.events.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+// publishRetransmit publishes the resend of packet by req's transfer.
+func (s *Server) publishRetransmit(req *Request, packet []byte) {
+	e := Event{Type: EventRetransmit, Request: req}
+	if op, err := common.GetOpCode(packet); err == nil && (op == common.OpDATA || op == common.OpACK) && len(packet) >= 4 {
+		e.Block = binary.BigEndian.Uint16(packet[2:4])
+	}
+	s.publish(e)
+}
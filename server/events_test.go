@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestSubscribe(t *testing.T) {
+	backend := &MemoryBackend{}
+	backend.Store("kernel", make([]byte, 100))
+	s := &Server{Backend: backend, RetransmitTimeout: 50 * time.Millisecond, Retries: 3}
+	addr, _ := startServer(t, s)
+	events, unsubscribe := s.Subscribe(20)
+	defer unsubscribe()
+
+	testCases := []struct {
+		send     func()
+		expected []EventType
+		filename string
+		block    uint16
+	}{
+		{
+			send:     func() { getFile(t, addr, "kernel") },
+			expected: []EventType{EventRequest, EventTransferStart, EventTransferEnd},
+			filename: "kernel",
+		},
+		{
+			send:     func() { getFile(t, addr, "missing") },
+			expected: []EventType{EventRequest, EventTransferEnd},
+			filename: "missing",
+		},
+		{
+			// Let the only block be resent before acknowledging it
+			send: func() {
+				conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+				buf := make([]byte, common.MaxPacketSize)
+				conn.ReadFrom(buf)
+				_, from, _ := conn.ReadFrom(buf)
+				conn.WriteTo(common.CreateAckPacket(1), from)
+			},
+			expected: []EventType{EventRequest, EventTransferStart, EventRetransmit, EventTransferEnd},
+			filename: "kernel",
+			block:    1,
+		},
+		{
+			send: func() {
+				conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer conn.Close()
+				conn.WriteTo([]byte{0, 9}, addr)
+			},
+			expected: []EventType{EventError},
+		},
+	}
+
+	for i, tc := range testCases {
+		tc.send()
+		var got []EventType
+		for range tc.expected {
+			select {
+			case e := <-events:
+				got = append(got, e.Type)
+				if e.Client == nil || e.Filename != tc.filename || e.Time.IsZero() {
+					t.Errorf("Unexpected %v event %+v (%d)", e.Type, e, i)
+				}
+				if e.Type == EventRetransmit && e.Block != tc.block {
+					t.Errorf("Expected block %d to be resent, got %d (%d)", tc.block, e.Block, i)
+				}
+				if e.Type == EventTransferEnd && (e.Outcome == outcomeOK) != (e.Err == nil) {
+					t.Errorf("Unexpected outcome %s, %v (%d)", e.Outcome, e.Err, i)
+				}
+			case <-time.After(2 * time.Second):
+			}
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, got, i)
+		}
+	}
+
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Error("Expected the channel to be closed")
+	}
+	getFile(t, addr, "kernel")
+}
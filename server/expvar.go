@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/binary"
+	"expvar"
+	"net"
+	"strconv"
+	"sync"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// serverVars holds the counters published by Server.Vars.
+type serverVars struct {
+	m             *expvar.Map
+	transfers     *expvar.Int
+	bytesSent     *expvar.Int
+	bytesReceived *expvar.Int
+	// malformed counts the malformed packets received on the request port.
+	malformed *expvar.Int
+	// errors counts the ERROR packets sent, keyed by error code.
+	errors *expvar.Map
+	// files counts downloads by file when FileMetrics is set, see
+	// countFile.
+	files     *expvar.Map
+	filesMu   sync.Mutex
+	fileNames int
+}
+
+// Vars returns the server's counters as an expvar.Map, so embedders already
+// running an HTTP server can publish them under /debug/vars:
+//
+//	expvar.Publish("tftp", s.Vars())
+//
+// The map holds active_transfers, transfers (the total started),
+// bytes_sent, bytes_received, malformed, the malformed packets received on
+// the request port, errors, the ERROR packets sent by code, and
+// violations, the protocol violations counted by host and kind as returned
+// by Violations. With FileMetrics set, files holds the requests and bytes
+// sent for each file.
+func (s *Server) Vars() *expvar.Map {
+	s.varsOnce.Do(func() {
+		v := &s.vars
+		v.transfers = new(expvar.Int)
+		v.bytesSent = new(expvar.Int)
+		v.bytesReceived = new(expvar.Int)
+		v.malformed = new(expvar.Int)
+		v.errors = new(expvar.Map).Init()
+
+		v.m = new(expvar.Map).Init()
+		v.m.Set("active_transfers", expvar.Func(func() any { return s.activeTransfers() }))
+		v.m.Set("transfers", v.transfers)
+		v.m.Set("bytes_sent", v.bytesSent)
+		v.m.Set("bytes_received", v.bytesReceived)
+		v.m.Set("malformed", v.malformed)
+		v.m.Set("errors", v.errors)
+		v.m.Set("violations", expvar.Func(func() any { return s.violations.byName() }))
+		if s.FileMetrics {
+			v.files = new(expvar.Map).Init()
+			v.m.Set("files", v.files)
+		}
+	})
+	return s.vars.m
+}
+
+// countBytes adds the bytes moved by a finished transfer to the counters.
+func (s *Server) countBytes(op common.OpCode, stats common.TransferStats) {
+	s.Vars()
+	switch op {
+	case common.OpRRQ:
+		s.vars.bytesSent.Add(stats.Bytes)
+	case common.OpWRQ:
+		s.vars.bytesReceived.Add(stats.Bytes)
+	}
+}
+
+// countingConn counts the ERROR packets written through it by code.
+type countingConn struct {
+	net.PacketConn
+	s *Server
+}
+
+func (s *Server) countingConn(conn net.PacketConn) net.PacketConn {
+	s.Vars()
+	return &countingConn{PacketConn: conn, s: s}
+}
+
+func (c *countingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	n, err := c.PacketConn.WriteTo(b, addr)
+	if err == nil && len(b) >= 4 {
+		if op, _ := common.GetOpCode(b); op == common.OpERROR {
+			code := binary.BigEndian.Uint16(b[2:])
+			c.s.vars.errors.Add(strconv.Itoa(int(code)), 1)
+			c.s.StatsD.error(code)
+		}
+	}
+	return n, err
+}
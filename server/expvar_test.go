@@ -0,0 +1,153 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestVars(t *testing.T) {
+	s := &Server{
+		ReadHandler: ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+			if req.Filename != "kernel" {
+				return nil, 0, os.ErrNotExist
+			}
+			return io.NopCloser(strings.NewReader(strings.Repeat("k", 1000))), 1000, nil
+		}),
+		WriteHandler: WriteHandlerFunc(func(req *Request) (io.WriteCloser, error) {
+			return &memoryUpload{closed: make(chan string, 1)}, nil
+		}),
+	}
+	addr, _ := startServer(t, s)
+
+	if _, err := getFile(t, addr, "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	getFile(t, addr, "missing")
+	getFile(t, addr, "missing")
+	if err := putFile(t, addr, "upload", make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]any{
+		"active_transfers": float64(0),
+		"transfers":        float64(4),
+		"bytes_sent":       float64(1000),
+		"bytes_received":   float64(600),
+		"malformed":        float64(0),
+		"errors":           map[string]any{"1": float64(2)},
+		"violations":       map[string]any{},
+	}
+	waitForVars(t, s, expected)
+}
+
+// waitForVars waits for the server's counters to match expected, as they are
+// updated after the reply reaches the client.
+func waitForVars(t *testing.T, s *Server, expected map[string]any) {
+	var got map[string]any
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if err := json.Unmarshal([]byte(s.Vars().String()), &got); err != nil {
+			t.Fatal(err)
+		}
+		if reflect.DeepEqual(got, expected) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestVarsHandshakeErrors(t *testing.T) {
+	s := &Server{}
+	addr, _ := startServer(t, s)
+
+	conn := sendRequest(t, addr, common.OpRRQ, "../etc/passwd")
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo([]byte{0, 9, 'x'}, addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	waitForVars(t, s, map[string]any{
+		"active_transfers": float64(0),
+		"transfers":        float64(0),
+		"bytes_sent":       float64(0),
+		"bytes_received":   float64(0),
+		"malformed":        float64(1),
+		"errors":           map[string]any{"2": float64(1), "4": float64(1)},
+		"violations":       map[string]any{"127.0.0.1": map[string]any{"bad_opcode": float64(1)}},
+	})
+}
+
+func TestFileMetrics(t *testing.T) {
+	s := &Server{
+		ReadHandler: ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+			if req.Filename == "missing" {
+				return nil, 0, os.ErrNotExist
+			}
+			return io.NopCloser(strings.NewReader("image")), 5, nil
+		}),
+		FileMetrics:        true,
+		FileMetricPatterns: []string{"pxelinux.cfg/*"},
+	}
+	addr, _ := startServer(t, s)
+
+	for _, name := range []string{"kernel", "kernel", "initrd", "pxelinux.cfg/default", "pxelinux.cfg/01-88-99-aa-bb-cc-dd", "missing"} {
+		getFile(t, addr, name)
+	}
+	waitForVars(t, s, map[string]any{
+		"active_transfers": float64(0),
+		"transfers":        float64(6),
+		"bytes_sent":       float64(25),
+		"bytes_received":   float64(0),
+		"malformed":        float64(0),
+		"errors":           map[string]any{"1": float64(1)},
+		"violations":       map[string]any{},
+		"files": map[string]any{
+			"kernel":         map[string]any{"requests": float64(2), "bytes": float64(10)},
+			"initrd":         map[string]any{"requests": float64(1), "bytes": float64(5)},
+			"pxelinux.cfg/*": map[string]any{"requests": float64(2), "bytes": float64(10)},
+		},
+	})
+}
+
+func TestFileMetricsBounded(t *testing.T) {
+	s := &Server{FileMetrics: true}
+	for i := 0; i < maxFileMetrics+2; i++ {
+		s.countFile(strconv.Itoa(i), common.TransferStats{Bytes: 1})
+	}
+	s.countFile("0", common.TransferStats{Bytes: 1})
+
+	testCases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "0", expected: `{"bytes": 2, "requests": 2}`},
+		{name: strconv.Itoa(maxFileMetrics - 1), expected: `{"bytes": 1, "requests": 1}`},
+		{name: strconv.Itoa(maxFileMetrics), expected: "<nil>"},
+		{name: otherFiles, expected: `{"bytes": 2, "requests": 2}`},
+	}
+	for i, tc := range testCases {
+		got := "<nil>"
+		if v := s.vars.files.Get(tc.name); v != nil {
+			got = v.String()
+		}
+		if got != tc.expected {
+			t.Errorf("Expected %s, got %s (%d)", tc.expected, got, i)
+		}
+	}
+}
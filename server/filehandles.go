@@ -0,0 +1,150 @@
+package server
+
+import (
+	"container/list"
+	"io"
+	"os"
+	"sync"
+)
+
+// fileHandles keeps the most recently served files of a Dir open, saving an
+// open and close per download when the same image is fetched over and over.
+// Each download reads its own section of the shared handle. A handle is
+// checked against the file on disk before it is reused, and a replaced or
+// modified file is opened afresh.
+type fileHandles struct {
+	dir         Dir
+	followLinks bool
+	// max is how many files are kept open once their downloads end.
+	max int
+
+	mu     sync.Mutex
+	files  map[string]*list.Element
+	lru    *list.List // of *openFile, most recently used first
+	closed bool
+}
+
+// openFile is a handle shared by the downloads holding a reference to it.
+// Once evicted it is closed as soon as the last of them ends.
+type openFile struct {
+	path    string
+	f       *os.File
+	info    os.FileInfo
+	refs    int
+	evicted bool
+}
+
+func (h *fileHandles) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	p, err := h.dir.resolve(req.Filename, h.followLinks)
+	if err != nil {
+		return nil, 0, err
+	}
+	// Stat the path, not the handle, to see whether the file has been
+	// replaced since it was opened
+	info, err := os.Stat(p)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	h.mu.Lock()
+	if e, ok := h.files[p]; ok {
+		of := e.Value.(*openFile)
+		if os.SameFile(of.info, info) && of.info.Size() == info.Size() && of.info.ModTime().Equal(info.ModTime()) {
+			of.refs++
+			h.lru.MoveToFront(e)
+			h.mu.Unlock()
+			return h.reader(of), of.info.Size(), nil
+		}
+		h.evict(e)
+	}
+	h.mu.Unlock()
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	if info, err = f.Stat(); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	of := &openFile{path: p, f: f, info: info, refs: 1}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		// Not worth keeping, serve it like an uncached read
+		of.evicted = true
+		return h.reader(of), info.Size(), nil
+	}
+	if e, ok := h.files[p]; ok {
+		h.evict(e)
+	}
+	if h.files == nil {
+		h.files = make(map[string]*list.Element)
+		h.lru = list.New()
+	}
+	h.files[p] = h.lru.PushFront(of)
+	for h.lru.Len() > h.max {
+		h.evict(h.lru.Back())
+	}
+	return h.reader(of), info.Size(), nil
+}
+
+// reader returns a reader of the whole of of that releases it when closed.
+func (h *fileHandles) reader(of *openFile) io.ReadCloser {
+	var once sync.Once
+	return &fileHandleReader{
+		SectionReader: io.NewSectionReader(of.f, 0, of.info.Size()),
+		info:          of.info,
+		release:       func() { once.Do(func() { h.release(of) }) },
+	}
+}
+
+// evict drops e from the cache, closing its file if no download is using it.
+// h.mu must be held.
+func (h *fileHandles) evict(e *list.Element) {
+	of := h.lru.Remove(e).(*openFile)
+	delete(h.files, of.path)
+	of.evicted = true
+	if of.refs == 0 {
+		of.f.Close()
+	}
+}
+
+func (h *fileHandles) release(of *openFile) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	of.refs--
+	if of.evicted && of.refs == 0 {
+		of.f.Close()
+	}
+}
+
+// close closes the files kept open, those still being downloaded once their
+// downloads end, and stops any more being kept.
+func (h *fileHandles) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for h.lru != nil && h.lru.Len() > 0 {
+		h.evict(h.lru.Back())
+	}
+}
+
+// fileHandleReader is a download's view of a shared file handle. Stat
+// returns the file's details as they were when it was opened, so callers
+// such as Checksums can tell whether it has changed.
+type fileHandleReader struct {
+	*io.SectionReader
+	info    os.FileInfo
+	release func()
+}
+
+func (r *fileHandleReader) Stat() (os.FileInfo, error) {
+	return r.info, nil
+}
+
+func (r *fileHandleReader) Close() error {
+	r.release()
+	return nil
+}
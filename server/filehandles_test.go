@@ -0,0 +1,115 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileHandles(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{"a": "kernel a", "b": "kernel b", "c": "kernel c"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &fileHandles{dir: Dir(root), followLinks: true, max: 2}
+
+	read := func(name string) (io.ReadCloser, string) {
+		t.Helper()
+		r, size, err := h.ServeRead(&Request{Filename: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			t.Fatal(err)
+		}
+		return r, string(data)
+	}
+	handle := func(name string) *os.File {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if e, ok := h.files[filepath.Join(root, name)]; ok {
+			return e.Value.(*openFile).f
+		}
+		return nil
+	}
+
+	// Overlapping downloads share the handle, each with its own offset
+	r1, got1 := read("a")
+	r2, got2 := read("a")
+	if got1 != "kernel a" || got2 != "kernel a" {
+		t.Errorf("Expected %q twice, got %q and %q", "kernel a", got1, got2)
+	}
+	fa := handle("a")
+	r1.Close()
+	r2.Close()
+	r3, _ := read("a")
+	r3.Close()
+	if handle("a") != fa {
+		t.Error("Expected a to be served from the same handle")
+	}
+
+	// A modified file is opened afresh, the old handle closed
+	future := time.Now().Add(time.Hour)
+	if err := os.WriteFile(filepath.Join(root, "a"), []byte("kernel a2"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(filepath.Join(root, "a"), future, future)
+	r4, got := read("a")
+	if got != "kernel a2" {
+		t.Errorf("Expected %q, got %q", "kernel a2", got)
+	}
+	if _, err := fa.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected the stale handle to be closed, got %v", err)
+	}
+
+	// Evicting a handle still being read leaves it open until it's released
+	fa = handle("a")
+	rb, _ := read("b")
+	rb.Close()
+	rc, _ := read("c")
+	rc.Close()
+	if handle("a") != nil {
+		t.Error("Expected a to be evicted")
+	}
+	if _, err := fa.Stat(); err != nil {
+		t.Errorf("Expected a to stay open while being read, got %v", err)
+	}
+	r4.Close()
+	if _, err := fa.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected a to be closed once released, got %v", err)
+	}
+
+	fb := handle("b")
+	h.close()
+	if _, err := fb.Stat(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Expected b to be closed, got %v", err)
+	}
+}
+
+func TestServerOpenFiles(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "pxelinux.0"), []byte("pxe"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Root: root, OpenFiles: 4}
+	addr, _ := startServer(t, s)
+	for i := 0; i < 3; i++ {
+		if got, err := getFile(t, addr, "pxelinux.0"); err != nil || string(got) != "pxe" {
+			t.Errorf("Expected %q, got %q, %v (%d)", "pxe", got, err, i)
+		}
+	}
+	s.mu.Lock()
+	h := s.openFiles
+	s.mu.Unlock()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.files) != 1 {
+		t.Errorf("Expected pxelinux.0 to be kept open, got %d files", len(h.files))
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"path"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+const (
+	// maxFileMetrics is how many names FileMetrics counts separately.
+	maxFileMetrics = 1000
+	// otherFiles is the name files are counted under once there are
+	// maxFileMetrics.
+	otherFiles = "other"
+)
+
+// checkFileMetricPatterns reports the first malformed pattern in
+// FileMetricPatterns.
+func (s *Server) checkFileMetricPatterns() error {
+	for _, pattern := range s.FileMetricPatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("Invalid file metric pattern %q: %v", pattern, err)
+		}
+	}
+	return nil
+}
+
+// fileMetricName returns the name a download of filename is counted under,
+// the first of FileMetricPatterns it matches or else the file's own name.
+func (s *Server) fileMetricName(filename string) string {
+	name := path.Clean("/" + filename)[1:]
+	for _, pattern := range s.FileMetricPatterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return pattern
+		}
+	}
+	return name
+}
+
+// countFile adds a finished download of filename to the file counters.
+func (s *Server) countFile(filename string, stats common.TransferStats) {
+	if !s.FileMetrics {
+		return
+	}
+	s.Vars()
+	v := &s.vars
+	name := s.fileMetricName(filename)
+
+	v.filesMu.Lock()
+	counters, ok := v.files.Get(name).(*expvar.Map)
+	if !ok {
+		if v.fileNames >= maxFileMetrics {
+			name = otherFiles
+			counters, ok = v.files.Get(name).(*expvar.Map)
+		}
+		if !ok {
+			counters = new(expvar.Map).Init()
+			counters.Add("requests", 0)
+			counters.Add("bytes", 0)
+			v.files.Set(name, counters)
+			if name != otherFiles {
+				v.fileNames++
+			}
+		}
+	}
+	v.filesMu.Unlock()
+	counters.Add("requests", 1)
+	counters.Add("bytes", stats.Bytes)
+}
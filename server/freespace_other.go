@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package server
+
+import "errors"
+
+// freeSpace can't tell the free space on this platform.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
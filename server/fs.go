@@ -0,0 +1,48 @@
+package server
+
+import (
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// FS returns a ReadHandler serving files from fsys, for example an embed.FS
+// so a single binary can carry its boot files:
+//
+//	//go:embed boot
+//	var boot embed.FS
+//
+//	sub, _ := fs.Sub(boot, "boot")
+//	s := &server.Server{ReadHandler: server.FS(sub)}
+//
+// Requested names are cleaned of any leading slash. Directories are reported
+// as File not found.
+func FS(fsys fs.FS) ReadHandler {
+	return fsHandler{fsys}
+}
+
+type fsHandler struct {
+	fsys fs.FS
+}
+
+func (h fsHandler) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	name := strings.TrimPrefix(req.Filename, "/")
+	if !fs.ValidPath(name) {
+		return nil, 0, errOutsideRoot
+	}
+	f, err := h.fsys.Open(path.Clean(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, 0, fs.ErrNotExist
+	}
+	return f, info.Size(), nil
+}
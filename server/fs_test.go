@@ -0,0 +1,47 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"testing/fstest"
+)
+
+func TestFS(t *testing.T) {
+	h := FS(fstest.MapFS{
+		"pxelinux.0":           {Data: []byte("loader")},
+		"pxelinux.cfg/default": {Data: []byte("menu")},
+	})
+
+	testCases := []struct {
+		filename string
+		expected string
+		err      error
+	}{
+		{filename: "pxelinux.0", expected: "loader"},
+		{filename: "/pxelinux.cfg/default", expected: "menu"},
+		{filename: "pxelinux.cfg", err: os.ErrNotExist},
+		{filename: "missing", err: os.ErrNotExist},
+		{filename: "pxelinux.cfg/../pxelinux.0", err: errOutsideRoot},
+	}
+
+	for i, tc := range testCases {
+		r, size, err := h.ServeRead(&Request{Filename: tc.filename})
+		if tc.err != nil {
+			if !errors.Is(err, tc.err) {
+				t.Errorf("Expected %v, got %v (%d)", tc.err, err, i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		got, _ := io.ReadAll(r)
+		r.Close()
+		if string(got) != tc.expected || size != int64(len(tc.expected)) {
+			t.Errorf("Expected %q, got %q of size %d (%d)", tc.expected, got, size, i)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// A ReadHandler provides the content of files requested with an RRQ. It
+// returns the content along with its size, or -1 if the size isn't known up
+// front. Returning a *common.Error sends that code and message to the
+// client, os.ErrNotExist is reported as File not found, anything else as
+// Not defined with the error's text.
+type ReadHandler interface {
+	ServeRead(req *Request) (r io.ReadCloser, size int64, err error)
+}
+
+// The ReadHandlerFunc type is an adapter to allow the use of ordinary
+// functions as read handlers.
+type ReadHandlerFunc func(req *Request) (io.ReadCloser, int64, error)
+
+func (f ReadHandlerFunc) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	return f(req)
+}
+
+// A ContentFunc synthesizes the content of a file at request time, for
+// example an iPXE script or a kickstart file tailored to req.RemoteAddr,
+// returning it with its size or -1 if that isn't known. It is a ReadHandler;
+// if the reader returned is also an io.Closer it is closed once the
+// transfer ends.
+type ContentFunc func(req *Request) (io.Reader, int64, error)
+
+func (f ContentFunc) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	r, size, err := f(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	if rc, ok := r.(io.ReadCloser); ok {
+		return rc, size, nil
+	}
+	return io.NopCloser(r), size, nil
+}
+
+// A WriteHandler stores the content of files uploaded with a WRQ. Errors are
+// reported to the client as for ReadHandler.
+//
+// Close is called once the whole file has been received. If the transfer
+// fails part way and the writer has an Abort() error method, Abort is called
+// instead so the partial upload can be discarded.
+type WriteHandler interface {
+	ServeWrite(req *Request) (io.WriteCloser, error)
+}
+
+// The WriteHandlerFunc type is an adapter to allow the use of ordinary
+// functions as write handlers.
+type WriteHandlerFunc func(req *Request) (io.WriteCloser, error)
+
+func (f WriteHandlerFunc) ServeWrite(req *Request) (io.WriteCloser, error) {
+	return f(req)
+}
+
+// aborter is implemented by writers that can discard a partial upload.
+type aborter interface {
+	Abort() error
+}
+
+// partialKeeper is implemented by writers that can set a partial upload
+// aside instead, returning where it was kept.
+type partialKeeper interface {
+	KeepPartial() (string, error)
+}
+
+// Dir serves and stores files in a directory on disk, relative to the
+// working directory if empty. It is the default read and write handler, and
+// the disk Backend.
+// Requests for paths resolving outside the directory, whether through ..
+// or a symlink, are refused with an access violation. Symlinks to files
+// and directories inside it are followed.
+type Dir string
+
+var (
+	errOutsideRoot = &common.Error{Code: common.ErrAccessViolation, Message: "Access violation"}
+	errSymlink     = &common.Error{Code: common.ErrAccessViolation, Message: "Access violation"}
+)
+
+// path returns where name lives on disk, checking it stays inside d.
+func (d Dir) path(name string) (string, error) {
+	return d.resolve(name, true)
+}
+
+// resolve returns where name lives on disk, checking it stays inside d even
+// once any symlinks are followed. If followLinks is false, paths through a
+// symlink are refused wherever it points. Elements of the path that don't
+// exist yet, as for an upload, aren't checked.
+func (d Dir) resolve(name string, followLinks bool) (string, error) {
+	root := string(d)
+	if root == "" {
+		root = "."
+	}
+	p := filepath.Join(root, filepath.FromSlash(name))
+	if !within(root, p) {
+		return "", errOutsideRoot
+	}
+	rel, _ := filepath.Rel(root, p)
+	if rel == "." {
+		return p, nil
+	}
+
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	current := root
+	for _, elem := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, elem)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if !followLinks {
+			return "", errSymlink
+		}
+		// A dangling link fails here rather than letting an upload
+		// create its target, wherever that is
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return "", err
+		}
+		if !within(realRoot, target) {
+			return "", errOutsideRoot
+		}
+	}
+	return p, nil
+}
+
+// within reports whether path is dir or inside it.
+func within(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (d Dir) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	return d.Open(req.Filename)
+}
+
+// NoSymlinks returns d refusing paths through a symlink, even one pointing
+// inside d.
+func (d Dir) NoSymlinks() NoSymlinksDir {
+	return NoSymlinksDir(d)
+}
+
+// NoSymlinksDir is a Dir that refuses paths through a symlink, even one
+// pointing inside it, as a read handler and a Backend.
+type NoSymlinksDir Dir
+
+func (d NoSymlinksDir) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	return d.Open(req.Filename)
+}
+
+// ServeWrite stores the upload, replacing any existing file. Use UploadDir
+// for more control.
+func (d Dir) ServeWrite(req *Request) (io.WriteCloser, error) {
+	return UploadDir{Dir: d}.ServeWrite(req)
+}
+
+// fileWriter buffers writes to an upload, syncing it to disk once complete.
+type fileWriter struct {
+	*os.File
+	w *bufio.Writer
+	// preallocated is set when disk was reserved for the announced size,
+	// which is given back if less arrives.
+	preallocated bool
+	// final is the name File is renamed to once complete, replacing any
+	// file there. reserved is set if final was created empty to reserve it,
+	// and is removed along with File if the upload is abandoned.
+	final    string
+	reserved bool
+	// resumed is set when File is the partial file of an earlier attempt.
+	resumed bool
+}
+
+func (f *fileWriter) Write(p []byte) (int, error) {
+	return f.w.Write(p)
+}
+
+// Flush writes any buffered data to the file.
+func (f *fileWriter) Flush() error {
+	return f.w.Flush()
+}
+
+func (f *fileWriter) Close() error {
+	err := f.w.Flush()
+	if f.preallocated && err == nil {
+		err = f.trim()
+	}
+	if err == nil {
+		err = f.File.Sync()
+	}
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.final)
+	}
+	if err != nil && !f.resumed {
+		f.remove()
+	}
+	return err
+}
+
+// trim releases any preallocated space past the end of the data written.
+func (f *fileWriter) trim() error {
+	end, err := f.File.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	return f.File.Truncate(end)
+}
+
+// KeepPartial closes an upload that was abandoned part way and renames it
+// to its final name with partialSuffix.
+func (f *fileWriter) KeepPartial() (string, error) {
+	err := f.w.Flush()
+	if f.preallocated && err == nil {
+		err = f.trim()
+	}
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		f.remove()
+		return "", err
+	}
+	if f.resumed {
+		// Resumed uploads are written to the partial file already
+		return f.Name(), nil
+	}
+	name := f.final + partialSuffix
+	if err := os.Rename(f.Name(), name); err != nil {
+		f.remove()
+		return "", err
+	}
+	if f.reserved {
+		os.Remove(f.final)
+	}
+	return name, nil
+}
+
+// Abort closes and deletes an upload that was abandoned part way, leaving
+// any file it would have replaced.
+func (f *fileWriter) Abort() error {
+	f.File.Close()
+	return f.remove()
+}
+
+// remove deletes the file being written, and the name reserved for it.
+func (f *fileWriter) remove() error {
+	err := os.Remove(f.Name())
+	if f.reserved {
+		os.Remove(f.final)
+	}
+	return err
+}
+
+// errorPacket returns the code and message to send a client for err. File
+// system errors are reported without the path, which would reveal the
+// server's layout.
+func errorPacket(err error) (common.ErrorCode, string) {
+	if e, ok := err.(*common.Error); ok {
+		return e.Code, e.Message
+	}
+	if os.IsNotExist(err) {
+		return common.ErrFileNotFound, "File not found"
+	}
+	if os.IsPermission(err) {
+		return common.ErrAccessViolation, "Access violation"
+	}
+	if common.IsDiskFull(err) {
+		return common.ErrDiskFull, "Disk full or allocation exceeded"
+	}
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return common.ErrNotDefined, pathErr.Err.Error()
+	}
+	return common.ErrNotDefined, err.Error()
+}
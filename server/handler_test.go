@@ -0,0 +1,362 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// putFile uploads data as filename to the server at addr.
+func putFile(t *testing.T, addr net.Addr, filename string, data []byte) error {
+	conn := sendRequest(t, addr, common.OpWRQ, filename)
+	buf := make([]byte, common.MaxPacketSize)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		return err
+	}
+	if _, err := common.ParseAckPacket(buf[:n]); err != nil {
+		if e, perr := common.ParseErrorPacket(buf[:n]); perr == nil {
+			return e
+		}
+		return err
+	}
+	_, err = common.ReadFileLoop(bytes.NewReader(data), conn, from, common.BlockSize)
+	return err
+}
+
+type memoryUpload struct {
+	bytes.Buffer
+	closed  chan string
+	aborted chan string
+}
+
+func (m *memoryUpload) Close() error {
+	m.closed <- m.String()
+	return nil
+}
+
+func (m *memoryUpload) Abort() error {
+	m.aborted <- m.String()
+	return nil
+}
+
+func TestReadHandler(t *testing.T) {
+	s := &Server{
+		ReadHandler: ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+			switch req.Filename {
+			case "hello":
+				body := "hello " + common.HostOf(req.RemoteAddr)
+				return io.NopCloser(strings.NewReader(body)), int64(len(body)), nil
+			case "secret":
+				return nil, 0, &common.Error{Code: common.ErrAccessViolation, Message: "Go away"}
+			}
+			return nil, 0, io.ErrUnexpectedEOF
+		}),
+	}
+	addr, _ := startServer(t, s)
+
+	testCases := []struct {
+		filename string
+		expected []byte
+		err      error
+	}{
+		{filename: "hello", expected: []byte("hello 127.0.0.1")},
+		{filename: "secret", err: &common.Error{Code: common.ErrAccessViolation, Message: "Go away"}},
+		{filename: "other", err: &common.Error{Code: common.ErrNotDefined, Message: io.ErrUnexpectedEOF.Error()}},
+	}
+
+	for i, tc := range testCases {
+		got, err := getFile(t, addr, tc.filename)
+		if !reflect.DeepEqual(err, tc.err) {
+			t.Errorf("Expected error %v, got %v (%d)", tc.err, err, i)
+			continue
+		}
+		if err == nil && !bytes.Equal(got, tc.expected) {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestWriteHandler(t *testing.T) {
+	upload := &memoryUpload{closed: make(chan string, 1), aborted: make(chan string, 1)}
+	s := &Server{
+		WriteHandler: WriteHandlerFunc(func(req *Request) (io.WriteCloser, error) {
+			if req.Filename == "readonly" {
+				return nil, &common.Error{Code: common.ErrAccessViolation, Message: "Read only"}
+			}
+			return upload, nil
+		}),
+	}
+	addr, _ := startServer(t, s)
+
+	err := putFile(t, addr, "readonly", []byte("x"))
+	expected := &common.Error{Code: common.ErrAccessViolation, Message: "Read only"}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expected %v, got %v", expected, err)
+	}
+
+	data := bytes.Repeat([]byte("config"), 200)
+	if err := putFile(t, addr, "config", data); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-upload.closed:
+		if got != string(data) {
+			t.Error("Uploaded data does not match")
+		}
+	case <-upload.aborted:
+		t.Error("Expected upload to be closed, not aborted")
+	case <-time.After(2 * time.Second):
+		t.Error("Upload was never closed")
+	}
+}
+
+func TestWriteHandlerAbort(t *testing.T) {
+	upload := &memoryUpload{closed: make(chan string, 1), aborted: make(chan string, 1)}
+	s := &Server{
+		WriteHandler: WriteHandlerFunc(func(req *Request) (io.WriteCloser, error) {
+			return upload, nil
+		}),
+	}
+	addr, _ := startServer(t, s)
+
+	conn := sendRequest(t, addr, common.OpWRQ, "config")
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := common.SendError(common.ErrDiskFull, "Giving up", conn, from); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-upload.aborted:
+	case <-upload.closed:
+		t.Error("Expected upload to be aborted, not closed")
+	case <-time.After(2 * time.Second):
+		t.Error("Upload was never aborted")
+	}
+}
+
+// waitForFile waits for an upload to appear at path with the expected
+// content. Uploads are closed after the final ACK is sent, so tests may see
+// the transfer finish slightly before the file does.
+func waitForFile(t *testing.T, path, expected string) {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		data, err := os.ReadFile(path)
+		if err == nil && string(data) == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %q in %s, got %q, %v", expected, path, data, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDirConfinement(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "kernel"), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(filepath.Dir(root), "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		filename string
+		err      error
+	}{
+		{filename: "kernel"},
+		{filename: "sub/../kernel"},
+		{filename: "../secret", err: errOutsideRoot},
+		{filename: "sub/../../secret", err: errOutsideRoot},
+		{filename: "..", err: errOutsideRoot},
+	}
+
+	for i, tc := range testCases {
+		r, _, err := Dir(root).ServeRead(&Request{Filename: tc.filename})
+		if err != tc.err {
+			t.Errorf("Expected %v, got %v (%d)", tc.err, err, i)
+		}
+		if r != nil {
+			r.Close()
+		}
+		if tc.err != nil {
+			if _, err := Dir(root).ServeWrite(&Request{Filename: tc.filename}); err != tc.err {
+				t.Errorf("Expected %v writing, got %v (%d)", tc.err, err, i)
+			}
+		}
+	}
+}
+
+func TestDirSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "images", "kernel"), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"kernel":   "images/kernel",
+		"current":  "images",
+		"secret":   filepath.Join(outside, "secret"),
+		"escape":   "../" + filepath.Base(outside),
+		"dangling": filepath.Join(outside, "missing"),
+	}
+	for name, target := range links {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Skipf("Can't create symlinks: %v", err)
+		}
+	}
+
+	testCases := []struct {
+		filename   string
+		err        error
+		noLinksErr error
+	}{
+		{filename: "images/kernel"},
+		{filename: "kernel", noLinksErr: errSymlink},
+		{filename: "current/kernel", noLinksErr: errSymlink},
+		{filename: "secret", err: errOutsideRoot, noLinksErr: errSymlink},
+		{filename: "escape/secret", err: errOutsideRoot, noLinksErr: errSymlink},
+	}
+
+	for i, tc := range testCases {
+		r, _, err := Dir(root).ServeRead(&Request{Filename: tc.filename})
+		if err != tc.err {
+			t.Errorf("Expected %v, got %v (%d)", tc.err, err, i)
+		}
+		if r != nil {
+			r.Close()
+		}
+		r, _, err = Dir(root).NoSymlinks().ServeRead(&Request{Filename: tc.filename})
+		if err != tc.noLinksErr {
+			t.Errorf("Expected %v without symlinks, got %v (%d)", tc.noLinksErr, err, i)
+		}
+		if r != nil {
+			r.Close()
+		}
+		// As a Backend, such as behind a cache
+		r, _, err = NewCachedBackend(Dir(root).NoSymlinks(), 1<<20).Open(tc.filename)
+		if err != tc.noLinksErr {
+			t.Errorf("Expected %v from the cache without symlinks, got %v (%d)", tc.noLinksErr, err, i)
+		}
+		if r != nil {
+			r.Close()
+		}
+		if tc.err != nil {
+			if _, err := Dir(root).ServeWrite(&Request{Filename: tc.filename}); err != tc.err {
+				t.Errorf("Expected %v writing, got %v (%d)", tc.err, err, i)
+			}
+		}
+		if tc.noLinksErr != nil {
+			u := UploadDir{Dir: Dir(root), NoSymlinks: true}
+			if _, err := u.ServeWrite(&Request{Filename: tc.filename}); err != tc.noLinksErr {
+				t.Errorf("Expected %v writing without symlinks, got %v (%d)", tc.noLinksErr, err, i)
+			}
+		}
+	}
+
+	// Uploads don't create the target of a dangling link
+	if _, err := Dir(root).ServeWrite(&Request{Filename: "dangling"}); err == nil {
+		t.Error("Expected an error uploading through a dangling link")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "missing")); !os.IsNotExist(err) {
+		t.Errorf("Expected no file outside the root, got %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(outside, "secret")); string(data) != "secret" {
+		t.Errorf("Expected the file outside the root to be untouched, got %q", data)
+	}
+}
+
+func TestServerRoot(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "kernel"), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(t.TempDir())
+
+	s := &Server{Root: root}
+	addr, _ := startServer(t, s)
+
+	got, err := getFile(t, addr, "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "boot" {
+		t.Errorf("Expected boot, got %q", got)
+	}
+	if err := putFile(t, addr, "upload", []byte("data")); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, filepath.Join(root, "upload"), "data")
+	_, err = getFile(t, addr, "../kernel")
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected an access violation, got %v", err)
+	}
+}
+
+func TestUploadOnly(t *testing.T) {
+	root, uploads := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "kernel"), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Root: root, UploadRoot: uploads, UploadOnly: true}
+	addr, _ := startServer(t, s)
+
+	_, err := getFile(t, addr, "kernel")
+	if !reflect.DeepEqual(err, errUploadOnly) {
+		t.Errorf("Expected %v, got %v", errUploadOnly, err)
+	}
+	if err := putFile(t, addr, "crash.dump", []byte("dump")); err != nil {
+		t.Fatal(err)
+	}
+	waitForFile(t, filepath.Join(uploads, "crash.dump"), "dump")
+	if _, err := os.Stat(filepath.Join(root, "crash.dump")); !os.IsNotExist(err) {
+		t.Errorf("Expected upload to skip the root, got %v", err)
+	}
+}
+
+func TestErrorPacket(t *testing.T) {
+	pathErr := func(err error) error {
+		return &os.PathError{Op: "open", Path: "/srv/tftp/secret/kernel", Err: err}
+	}
+	testCases := []struct {
+		err     error
+		code    common.ErrorCode
+		message string
+	}{
+		{err: &common.Error{Code: common.ErrFileExists, Message: "Exists"}, code: common.ErrFileExists, message: "Exists"},
+		{err: pathErr(syscall.ENOENT), code: common.ErrFileNotFound, message: "File not found"},
+		{err: pathErr(syscall.EACCES), code: common.ErrAccessViolation, message: "Access violation"},
+		{err: pathErr(syscall.EPERM), code: common.ErrAccessViolation, message: "Access violation"},
+		{err: pathErr(syscall.ENOSPC), code: common.ErrDiskFull, message: "Disk full or allocation exceeded"},
+		{err: pathErr(syscall.EISDIR), code: common.ErrNotDefined, message: syscall.EISDIR.Error()},
+		{err: io.ErrUnexpectedEOF, code: common.ErrNotDefined, message: io.ErrUnexpectedEOF.Error()},
+	}
+
+	for i, tc := range testCases {
+		code, message := errorPacket(tc.err)
+		if code != tc.code || message != tc.message {
+			t.Errorf("Expected %d %q, got %d %q (%d)", tc.code, tc.message, code, message, i)
+		}
+	}
+}
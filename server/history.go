@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// A HistoryRecord describes a finished transfer in the history the server
+// writes to Server.History.
+type HistoryRecord struct {
+	// Time is when the transfer finished.
+	Time        time.Time     `json:"time"`
+	RequestID   string        `json:"request_id"`
+	Client      string        `json:"client"`
+	Op          string        `json:"op"`
+	File        string        `json:"file"`
+	Mode        string        `json:"mode"`
+	Bytes       int64         `json:"bytes"`
+	Duration    time.Duration `json:"duration"`
+	Retransmits int           `json:"retransmits"`
+	Outcome     string        `json:"outcome"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// recordHistory appends the history record of a finished transfer.
+func (s *Server) recordHistory(req *Request, stats common.TransferStats, started bool, err error) {
+	if s.History == nil {
+		return
+	}
+	r := HistoryRecord{
+		Time:        time.Now().UTC(),
+		RequestID:   req.ID,
+		Client:      req.RemoteAddr.String(),
+		Op:          req.OpCode.String(),
+		File:        req.Filename,
+		Mode:        req.Mode,
+		Bytes:       stats.Bytes,
+		Duration:    stats.Duration,
+		Retransmits: stats.Retransmits,
+		Outcome:     transferOutcome(started, err),
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	line, jsonErr := json.Marshal(r)
+	if jsonErr != nil {
+		s.logger().Error("Error encoding history record", "err", jsonErr)
+		return
+	}
+	line = append(line, '\n')
+
+	// One write per record keeps lines whole in a file opened for appending
+	s.historyMu.Lock()
+	defer s.historyMu.Unlock()
+	if _, err := s.History.Write(line); err != nil {
+		s.logger().Error("Error writing history", "err", err)
+	}
+}
+
+// A HistoryQuery selects records from a transfer history. Empty fields
+// match everything.
+type HistoryQuery struct {
+	// Client is a client IP, or IP and port.
+	Client string
+	File   string
+	// Op is RRQ or WRQ.
+	Op      string
+	Outcome string
+	// Since and Until bound when the transfer finished.
+	Since time.Time
+	Until time.Time
+}
+
+// Match reports whether r is selected by q.
+func (q HistoryQuery) Match(r HistoryRecord) bool {
+	if q.Client != "" && q.Client != r.Client {
+		host, _, err := net.SplitHostPort(r.Client)
+		if err != nil || host != q.Client {
+			return false
+		}
+	}
+	if q.File != "" && q.File != r.File {
+		return false
+	}
+	if q.Op != "" && q.Op != r.Op {
+		return false
+	}
+	if q.Outcome != "" && q.Outcome != r.Outcome {
+		return false
+	}
+	if !q.Since.IsZero() && r.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && r.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// ReadHistory calls fn, in order, with each record of the history in r
+// matching q. A record cut short at the end, as by a crash while it was
+// written, is ignored.
+func ReadHistory(r io.Reader, q HistoryQuery, fn func(HistoryRecord) error) error {
+	reader := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var record HistoryRecord
+		if err := json.Unmarshal(text, &record); err != nil {
+			return fmt.Errorf("Line %d: %v", line, err)
+		}
+		if !q.Match(record) {
+			continue
+		}
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), make([]byte, 1000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf syncBuffer
+	s := &Server{History: &buf}
+	addr, _ := startServer(t, s)
+
+	if _, err := getFile(t, addr, "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	getFile(t, addr, "missing")
+	if err := putFile(t, addr, "upload", make([]byte, 600)); err != nil {
+		t.Fatal(err)
+	}
+	buf.records(t, 3)
+
+	var records []HistoryRecord
+	buf.mu.Lock()
+	err := ReadHistory(strings.NewReader(buf.buf.String()), HistoryQuery{}, func(r HistoryRecord) error {
+		records = append(records, r)
+		return nil
+	})
+	buf.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byFile := map[string]HistoryRecord{}
+	for _, r := range records {
+		byFile[r.File] = r
+	}
+	testCases := []struct {
+		op      string
+		file    string
+		bytes   int64
+		outcome string
+	}{
+		{op: "RRQ", file: "kernel", bytes: 1000, outcome: outcomeOK},
+		{op: "RRQ", file: "missing", bytes: 0, outcome: outcomeFailed},
+		{op: "WRQ", file: "upload", bytes: 600, outcome: outcomeOK},
+	}
+	for i, tc := range testCases {
+		r := byFile[tc.file]
+		if r.Op != tc.op || r.Bytes != tc.bytes || r.Outcome != tc.outcome || r.Mode != "octet" {
+			t.Errorf("Unexpected record %+v (%d)", r, i)
+		}
+		if !strings.HasPrefix(r.Client, "127.0.0.1:") || r.Time.IsZero() {
+			t.Errorf("Missing fields in %+v (%d)", r, i)
+		}
+	}
+	if byFile["missing"].Error == "" {
+		t.Errorf("Expected failed transfer to include the error, got %+v", byFile["missing"])
+	}
+}
+
+func TestReadHistory(t *testing.T) {
+	history := `{"time":"2024-01-01T10:00:00Z","client":"10.1.2.3:1000","op":"RRQ","file":"kernel","outcome":"ok"}
+{"time":"2024-01-01T11:00:00Z","client":"10.1.2.4:1000","op":"RRQ","file":"kernel","outcome":"failed"}
+{"time":"2024-01-01T12:00:00Z","client":"10.1.2.3:1001","op":"WRQ","file":"switch.cfg","outcome":"ok"}
+{"time":"2024-01-01T13:00:00Z","client":"10.1.2.3:10`
+
+	testCases := []struct {
+		query    HistoryQuery
+		expected []string
+	}{
+		{query: HistoryQuery{}, expected: []string{"10:00", "11:00", "12:00"}},
+		{query: HistoryQuery{Client: "10.1.2.3"}, expected: []string{"10:00", "12:00"}},
+		{query: HistoryQuery{Client: "10.1.2.3:1001"}, expected: []string{"12:00"}},
+		{query: HistoryQuery{Client: "10.1.2.30"}},
+		{query: HistoryQuery{File: "kernel"}, expected: []string{"10:00", "11:00"}},
+		{query: HistoryQuery{Op: "WRQ"}, expected: []string{"12:00"}},
+		{query: HistoryQuery{Outcome: "failed"}, expected: []string{"11:00"}},
+		{
+			query:    HistoryQuery{Since: time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC), Until: time.Date(2024, 1, 1, 11, 30, 0, 0, time.UTC)},
+			expected: []string{"11:00"},
+		},
+	}
+
+	for i, tc := range testCases {
+		var got []string
+		err := ReadHistory(strings.NewReader(history), tc.query, func(r HistoryRecord) error {
+			got = append(got, r.Time.Format("15:04"))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, got, i)
+		}
+	}
+
+	if err := ReadHistory(strings.NewReader("not json\n"), HistoryQuery{}, func(HistoryRecord) error { return nil }); err == nil {
+		t.Error("Expected an error for a corrupt history")
+	}
+}
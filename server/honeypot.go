@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// errHoneypot is the refusal sent by a honeypot unless
+// Server.HoneypotError says otherwise.
+var errHoneypot = &common.Error{Code: common.ErrFileNotFound, Message: "File not found"}
+
+// honeypot logs req in full and refuses it, see Server.Honeypot.
+func (s *Server) honeypot(conn net.PacketConn, req *Request) {
+	logger := s.requestLogger(req).With("mode", req.Mode, "options", req.Options)
+	if req.LocalAddr != nil {
+		logger = logger.With("local", req.LocalAddr.String())
+	}
+	logger.Warn("Honeypot request")
+	refusal := s.HoneypotError
+	if refusal == nil {
+		refusal = errHoneypot
+	}
+	common.SendError(refusal.Code, refusal.Message, conn, req.RemoteAddr)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestHoneypot(t *testing.T) {
+	handler := ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+		t.Errorf("Honeypot served %s", req.Filename)
+		return nil, 0, io.EOF
+	})
+	testCases := []struct {
+		refusal  *common.Error
+		expected *common.Error
+	}{
+		{expected: errHoneypot},
+		{
+			refusal:  &common.Error{Code: common.ErrAccessViolation, Message: "Go away"},
+			expected: &common.Error{Code: common.ErrAccessViolation, Message: "Go away"},
+		},
+	}
+
+	for i, tc := range testCases {
+		var buf syncBuffer
+		s := &Server{ReadHandler: handler, Honeypot: true, HoneypotError: tc.refusal, Logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+		addr, _ := startServer(t, s)
+
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		req := common.RequestPacket{OpCode: common.OpRRQ, Filename: "pxelinux.0", Mode: "netascii", Options: map[string]string{"tsize": "0", "blksize": "1428"}}
+		if _, err := conn.WriteTo(req.ToBytes(), addr); err != nil {
+			t.Fatal(err)
+		}
+		packet := make([]byte, common.MaxPacketSize)
+		n, _, err := conn.ReadFrom(packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := common.ParseErrorPacket(packet[:n])
+		if err != nil || !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %v, got %v, %v (%d)", tc.expected, got, err, i)
+		}
+
+		var logged map[string]any
+		for _, r := range buf.records(t, 2) {
+			if r["msg"] == "Honeypot request" {
+				logged = r
+			}
+		}
+		expected := map[string]any{"file": "pxelinux.0", "op": "RRQ", "mode": "netascii", "client": conn.LocalAddr().String()}
+		for k, v := range expected {
+			if logged[k] != v {
+				t.Errorf("Expected %s %v, got %v (%d)", k, v, logged[k], i)
+			}
+		}
+		if options := map[string]any{"tsize": "0", "blksize": "1428"}; !reflect.DeepEqual(logged["options"], options) {
+			t.Errorf("Expected options %v, got %v (%d)", options, logged["options"], i)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// A TransferEvent describes a transfer to the Server's OnTransferStart and
+// OnTransferEnd hooks.
+type TransferEvent struct {
+	// Request is the transfer's request, with its metadata.
+	Request  *Request
+	Client   net.Addr
+	Filename string
+	// Op is RRQ for downloads and WRQ for uploads.
+	Op common.OpCode
+
+	// The rest are only set for OnTransferEnd. Started says whether the
+	// file was opened, so data may have moved. Outcome is ok, aborted
+	// (by the peer), failed or rejected (by an UploadValidator), as in the
+	// access log, and Err is why the transfer didn't succeed.
+	Started bool
+	Outcome string
+	Err     error
+	Stats   common.TransferStats
+}
+
+// transferStarted calls the OnTransferStart hook once req's file is open,
+// and publishes the event to subscribers.
+func (s *Server) transferStarted(req *Request) {
+	s.publish(Event{Type: EventTransferStart, Request: req})
+	if s.OnTransferStart == nil {
+		return
+	}
+	s.OnTransferStart(TransferEvent{
+		Request:  req,
+		Client:   req.RemoteAddr,
+		Filename: req.Filename,
+		Op:       req.OpCode,
+	})
+}
+
+// transferEnded calls the OnTransferEnd hook for a finished transfer, and
+// publishes the event to subscribers.
+func (s *Server) transferEnded(req *Request, stats common.TransferStats, started bool, err error) {
+	s.publish(Event{
+		Type:    EventTransferEnd,
+		Request: req,
+		Outcome: transferOutcome(started, err),
+		Stats:   stats,
+		Err:     err,
+	})
+	if s.OnTransferEnd == nil {
+		return
+	}
+	s.OnTransferEnd(TransferEvent{
+		Request:  req,
+		Client:   req.RemoteAddr,
+		Filename: req.Filename,
+		Op:       req.OpCode,
+		Started:  started,
+		Outcome:  transferOutcome(started, err),
+		Err:      err,
+		Stats:    stats,
+	})
+}
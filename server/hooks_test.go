@@ -0,0 +1,74 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestTransferHooks(t *testing.T) {
+	backend := &MemoryBackend{}
+	backend.Store("kernel", make([]byte, 1000))
+	starts := make(chan TransferEvent, 10)
+	ends := make(chan TransferEvent, 10)
+	s := &Server{
+		Backend:         backend,
+		OnTransferStart: func(e TransferEvent) { starts <- e },
+		OnTransferEnd:   func(e TransferEvent) { ends <- e },
+	}
+	addr, _ := startServer(t, s)
+
+	testCases := []struct {
+		op       common.OpCode
+		filename string
+		started  bool
+		outcome  string
+		bytes    int64
+	}{
+		{op: common.OpRRQ, filename: "kernel", started: true, outcome: outcomeOK, bytes: 1000},
+		{op: common.OpRRQ, filename: "missing", outcome: outcomeFailed},
+		{op: common.OpWRQ, filename: "upload", started: true, outcome: outcomeOK, bytes: 600},
+	}
+
+	for i, tc := range testCases {
+		if tc.op == common.OpRRQ {
+			getFile(t, addr, tc.filename)
+		} else if err := putFile(t, addr, tc.filename, make([]byte, 600)); err != nil {
+			t.Fatal(err)
+		}
+
+		var end TransferEvent
+		select {
+		case end = <-ends:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected OnTransferEnd (%d)", i)
+		}
+		if end.Op != tc.op || end.Filename != tc.filename || end.Started != tc.started || end.Outcome != tc.outcome || end.Stats.Bytes != tc.bytes {
+			t.Errorf("Unexpected end event %+v (%d)", end, i)
+		}
+		if end.Client == nil || end.Request == nil || end.Request.Filename != tc.filename {
+			t.Errorf("Expected the client and request in %+v (%d)", end, i)
+		}
+		if (end.Err == nil) != (tc.outcome == outcomeOK) {
+			t.Errorf("Unexpected error %v (%d)", end.Err, i)
+		}
+		if !tc.started && !os.IsNotExist(end.Err) {
+			t.Errorf("Expected the file not to be found, got %v (%d)", end.Err, i)
+		}
+
+		select {
+		case start := <-starts:
+			if !tc.started {
+				t.Errorf("Unexpected start event %+v (%d)", start, i)
+			} else if start.Op != tc.op || start.Filename != tc.filename || start.Outcome != "" {
+				t.Errorf("Unexpected start event %+v (%d)", start, i)
+			}
+		default:
+			if tc.started {
+				t.Errorf("Expected OnTransferStart (%d)", i)
+			}
+		}
+	}
+}
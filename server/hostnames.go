@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultHostnameTimeout bounds a reverse lookup when
+	// Server.HostnameTimeout isn't set.
+	defaultHostnameTimeout = 500 * time.Millisecond
+	// hostnameTTL is how long an answer, or the lack of one, is cached.
+	hostnameTTL = 10 * time.Minute
+	// maxHostnames is how many answers are cached before some are
+	// forgotten to make room.
+	maxHostnames = 4096
+)
+
+// hostnameCache caches the names of client addresses.
+type hostnameCache struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]hostnameEntry
+	// lookup does the reverse lookups, net.DefaultResolver.LookupAddr if
+	// nil.
+	lookup func(ctx context.Context, addr string) ([]string, error)
+}
+
+type hostnameEntry struct {
+	name    string
+	expires time.Time
+}
+
+// clientHostname returns the name of addr's host, or "" if it has none,
+// couldn't be found in time, or ResolveHostnames isn't set.
+func (s *Server) clientHostname(addr net.Addr) string {
+	if !s.ResolveHostnames {
+		return ""
+	}
+	ip, ok := addrIP(addr)
+	if !ok {
+		return ""
+	}
+	timeout := s.HostnameTimeout
+	if timeout <= 0 {
+		timeout = defaultHostnameTimeout
+	}
+	return s.hostnames.name(ip, timeout, time.Now())
+}
+
+func (c *hostnameCache) name(ip netip.Addr, timeout time.Duration, now time.Time) string {
+	c.mu.Lock()
+	e, ok := c.entries[ip]
+	lookup := c.lookup
+	c.mu.Unlock()
+	if ok && now.Before(e.expires) {
+		return e.name
+	}
+
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupAddr
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var name string
+	if names, err := lookup(ctx, ip.String()); err == nil && len(names) > 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[netip.Addr]hostnameEntry)
+	}
+	if len(c.entries) >= maxHostnames {
+		for k, e := range c.entries {
+			if !now.Before(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+	}
+	if len(c.entries) >= maxHostnames {
+		// Still full of fresh answers, forget an arbitrary tenth
+		n := maxHostnames / 10
+		for k := range c.entries {
+			delete(c.entries, k)
+			if n--; n == 0 {
+				break
+			}
+		}
+	}
+	c.entries[ip] = hostnameEntry{name: name, expires: now.Add(hostnameTTL)}
+	return name
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestHostnameCache(t *testing.T) {
+	lookups := 0
+	c := &hostnameCache{lookup: func(ctx context.Context, addr string) ([]string, error) {
+		lookups++
+		switch addr {
+		case "10.0.0.7":
+			return []string{"pxe-07.lab.example.com.", "alias.example.com."}, nil
+		case "10.0.0.8":
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return nil, errors.New("no such host")
+	}}
+	now := time.Now()
+
+	testCases := []struct {
+		ip       string
+		now      time.Time
+		expected string
+		lookups  int
+	}{
+		{ip: "10.0.0.7", now: now, expected: "pxe-07.lab.example.com", lookups: 1},
+		{ip: "10.0.0.7", now: now.Add(time.Minute), expected: "pxe-07.lab.example.com", lookups: 1},
+		{ip: "10.0.0.9", now: now, lookups: 2},
+		{ip: "10.0.0.9", now: now.Add(time.Minute), lookups: 2},
+		{ip: "10.0.0.8", now: now, lookups: 3},
+		{ip: "10.0.0.7", now: now.Add(hostnameTTL), expected: "pxe-07.lab.example.com", lookups: 4},
+	}
+	for i, tc := range testCases {
+		got := c.name(netip.MustParseAddr(tc.ip), 10*time.Millisecond, tc.now)
+		if got != tc.expected || lookups != tc.lookups {
+			t.Errorf("Expected %q after %d lookups, got %q after %d (%d)", tc.expected, tc.lookups, got, lookups, i)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// transferSlots hands out the MaxConcurrentTransfers slots. A freed slot
+// goes to the longest waiting request of the highest priority.
+type transferSlots struct {
+	mu      sync.Mutex
+	used    int
+	waiting [numPriorities][]chan struct{}
+}
+
+// acquireTransfer reserves one of MaxConcurrentTransfers for a new transfer
+// of priority prio, waiting up to TransferQueueTimeout for one to free up.
+// It reports whether a slot was reserved; releaseTransfer must then be
+// called once the transfer is over.
+func (s *Server) acquireTransfer(prio Priority) bool {
+	reserved, wait := s.reserveTransfer(prio)
+	if wait != nil {
+		return wait()
+	}
+	return reserved
+}
+
+// reserveTransfer is acquireTransfer without the waiting. If no slot is
+// free but requests may wait for one, the request takes its place in the
+// queue and wait is returned, which blocks until a slot is handed over or
+// TransferQueueTimeout passes, reporting which. Otherwise wait is nil and
+// reserved reports whether a slot was reserved.
+func (s *Server) reserveTransfer(prio Priority) (reserved bool, wait func() bool) {
+	if s.MaxConcurrentTransfers <= 0 {
+		return true, nil
+	}
+	q := &s.shared().slots
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.used < s.MaxConcurrentTransfers {
+		q.used++
+		return true, nil
+	}
+	if s.TransferQueueTimeout <= 0 {
+		return false, nil
+	}
+	granted := make(chan struct{})
+	q.waiting[prio.index()] = append(q.waiting[prio.index()], granted)
+
+	return false, func() bool {
+		timer := time.NewTimer(s.TransferQueueTimeout)
+		defer timer.Stop()
+		select {
+		case <-granted:
+			return true
+		case <-timer.C:
+		}
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		waiting := q.waiting[prio.index()]
+		for i, c := range waiting {
+			if c == granted {
+				q.waiting[prio.index()] = append(waiting[:i], waiting[i+1:]...)
+				return false
+			}
+		}
+		// The slot was handed over as the timer fired
+		return true
+	}
+}
+
+// releaseTransfer frees a slot, handing it straight to a waiting request if
+// there is one.
+func (s *Server) releaseTransfer() {
+	if s.MaxConcurrentTransfers <= 0 {
+		return
+	}
+	q := &s.shared().slots
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := len(q.waiting) - 1; i >= 0; i-- {
+		if waiting := q.waiting[i]; len(waiting) > 0 {
+			close(waiting[0])
+			q.waiting[i] = waiting[1:]
+			return
+		}
+	}
+	q.used--
+}
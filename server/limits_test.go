@@ -0,0 +1,279 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestMaxConcurrentTransfers(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{MaxConcurrentTransfers: 1}
+	addr, _ := startServer(t, s)
+
+	// Hold the only slot by never acknowledging the first block
+	held := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := held.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = getFile(t, addr, "kernel")
+	if e, ok := err.(*common.Error); !ok || e.Message != "Server busy, try again later" {
+		t.Fatalf("Expected the server to be busy, got %v", err)
+	}
+
+	// Once the first transfer finishes the slot is free again
+	if _, err := held.WriteTo(common.CreateAckPacket(1), from); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		got, err := getFile(t, addr, "kernel")
+		if err == nil {
+			if !bytes.Equal(got, []byte("boot")) {
+				t.Errorf("Expected boot, got %q", got)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Slot was never released: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestTransferQueueTimeout(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), []byte("boot"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{MaxConcurrentTransfers: 1, TransferQueueTimeout: time.Second}
+	addr, _ := startServer(t, s)
+
+	held := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := held.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The queued request is served as soon as the first transfer finishes
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		held.WriteTo(common.CreateAckPacket(1), from)
+	}()
+	got, err := getFile(t, addr, "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("boot")) {
+		t.Errorf("Expected boot, got %q", got)
+	}
+}
+
+func TestTransferSlotPriority(t *testing.T) {
+	s := &Server{MaxConcurrentTransfers: 1, TransferQueueTimeout: 2 * time.Second}
+	if !s.acquireTransfer(PriorityNormal) {
+		t.Fatal("Expected a free slot")
+	}
+
+	// Queue a low, a normal and a high priority request, in that order
+	order := make(chan Priority, 3)
+	queued := 0
+	for _, prio := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		go func() {
+			if s.acquireTransfer(prio) {
+				order <- prio
+			}
+		}()
+		queued++
+		waitForQueued(t, s, queued)
+	}
+
+	var got []Priority
+	for range 3 {
+		s.releaseTransfer()
+		got = append(got, <-order)
+	}
+	expected := []Priority{PriorityHigh, PriorityNormal, PriorityLow}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected slots handed out %v, got %v", expected, got)
+	}
+}
+
+// waitForQueued waits for n requests to be waiting for a transfer slot.
+func waitForQueued(t *testing.T, s *Server, n int) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		slots := &s.shared().slots
+		slots.mu.Lock()
+		queued := 0
+		for _, waiting := range slots.waiting {
+			queued += len(waiting)
+		}
+		slots.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d waiting requests, got %d", n, queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// holdSlot starts a download of filename and leaves it waiting for the ACK
+// of its first block, returning a function that sends it.
+func holdSlot(t *testing.T, addr net.Addr, filename string) func() {
+	conn := sendRequest(t, addr, common.OpRRQ, filename)
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return func() { conn.WriteTo(common.CreateAckPacket(1), from) }
+}
+
+func TestTransferQueueFreesWorkers(t *testing.T) {
+	s := &Server{
+		ReadHandler:            namedHandler("boot"),
+		HandshakeWorkers:       1,
+		MaxConcurrentTransfers: 1,
+		TransferQueueTimeout:   5 * time.Second,
+	}
+	addr, _ := startServer(t, s)
+
+	release := holdSlot(t, addr, "kernel")
+	queued := sendRequest(t, addr, common.OpRRQ, "kernel")
+	waitForQueued(t, s, 1)
+
+	// The only worker is free to answer other requests meanwhile
+	refused := sendRequest(t, addr, common.OpRRQ, "../etc/passwd")
+	refused.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, common.MaxPacketSize)
+	n, _, err := refused.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Expected a reply while a request waits for a slot: %v", err)
+	}
+	if e, err := common.ParseErrorPacket(buf[:n]); err != nil || e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected an access violation, got %s", common.DumpPacket(buf[:n]))
+	}
+
+	release()
+	if _, _, err := queued.ReadFrom(buf); err != nil {
+		t.Errorf("Expected the queued request to be served: %v", err)
+	}
+}
+
+func TestTransferQueuePriorityWithFewWorkers(t *testing.T) {
+	s := &Server{
+		ReadHandler:            namedHandler("boot"),
+		HandshakeWorkers:       1,
+		MaxConcurrentTransfers: 1,
+		TransferQueueTimeout:   5 * time.Second,
+		Priorities: []PriorityRule{
+			{Pattern: "low.img", Priority: PriorityLow},
+			{Pattern: "high.img", Priority: PriorityHigh},
+		},
+	}
+	addr, _ := startServer(t, s)
+
+	release := holdSlot(t, addr, "kernel")
+	// More requests wait than there are workers
+	low := sendRequest(t, addr, common.OpRRQ, "low.img")
+	waitForQueued(t, s, 1)
+	high := sendRequest(t, addr, common.OpRRQ, "high.img")
+	waitForQueued(t, s, 2)
+
+	release()
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := high.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Expected the high priority request to get the slot: %v", err)
+	}
+	low.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := low.ReadFrom(buf); err == nil {
+		t.Error("Expected the low priority request to wait for the high one")
+	}
+
+	high.WriteTo(common.CreateAckPacket(1), from)
+	low.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := low.ReadFrom(buf); err != nil {
+		t.Errorf("Expected the low priority request to be served next: %v", err)
+	}
+}
+
+func TestTakeOver(t *testing.T) {
+	old := &Server{
+		ReadHandler:            namedHandler("boot"),
+		MaxConcurrentTransfers: 1,
+		MaxBandwidth:           1e6,
+		MaxClientBandwidth:     1e5,
+	}
+	oldAddr, _ := startServer(t, old)
+	release := holdSlot(t, oldAddr, "kernel")
+	unlock, err := old.lockUpload(&Request{Filename: "config.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{
+		ReadHandler:            namedHandler("boot"),
+		MaxConcurrentTransfers: 1,
+		TransferQueueTimeout:   5 * time.Second,
+		MaxBandwidth:           2e6,
+		MaxClientBandwidth:     2e5,
+	}
+	s.TakeOver(old)
+	addr, _ := startServer(t, s)
+
+	// The old server's transfer still holds the only slot
+	queued := sendRequest(t, addr, common.OpRRQ, "kernel")
+	waitForQueued(t, s, 1)
+	release()
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := queued.ReadFrom(buf); err != nil {
+		t.Errorf("Expected the slot to be handed over once the old transfer ended: %v", err)
+	}
+
+	if _, err := s.lockUpload(&Request{Filename: "/config.txt"}); err != errUploadInProgress {
+		t.Errorf("Expected the old server's upload to keep the file locked, got %v", err)
+	}
+	unlock()
+	if _, err := s.lockUpload(&Request{Filename: "config.txt"}); err != nil {
+		t.Errorf("Expected the file to be free once the old upload ended, got %v", err)
+	}
+
+	// Transfers of both servers share the bandwidth, at the new rates
+	req := &Request{RemoteAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}}
+	oldPacers, releaseOld := old.transferPacers(req)
+	defer releaseOld()
+	pacers, releaseNew := s.transferPacers(req)
+	defer releaseNew()
+	if len(oldPacers) != 2 || len(pacers) != 2 {
+		t.Fatalf("Expected client and global pacers, got %d and %d", len(oldPacers), len(pacers))
+	}
+	for i, expected := range []float64{2e5, 2e6} {
+		if pacers[i] != oldPacers[i] {
+			t.Errorf("Expected the servers to share pacers (%d)", i)
+		}
+		if rate := pacers[i].bucket.rate; rate != expected {
+			t.Errorf("Expected the new rate %v, got %v (%d)", expected, rate, i)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// errProtocolViolation wraps the errors for malformed packets on the request
+// port.
+var errProtocolViolation = errors.New("Protocol violation")
+
+// Logging of protocol violations on the request port is limited to this
+// rate, so a scanner can't fill the disk.
+const (
+	violationLogRate  = 1
+	violationLogBurst = 10
+)
+
+// logLimiter limits how often a kind of log line is written, counting the
+// ones suppressed.
+type logLimiter struct {
+	mu         sync.Mutex
+	bucket     *tokenBucket
+	suppressed int
+}
+
+// allow reports whether a line may be written, and if so how many were
+// suppressed since the last one.
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.bucket == nil {
+		l.bucket = newTokenBucket(violationLogRate, violationLogBurst, now)
+	}
+	if !l.bucket.allow(now) {
+		l.suppressed++
+		return false, 0
+	}
+	suppressed := l.suppressed
+	l.suppressed = 0
+	return true, suppressed
+}
+
+// logRequestError logs why a request wasn't served, protocol violations at a
+// limited rate.
+func (s *Server) logRequestError(err error) {
+	if !errors.Is(err, errProtocolViolation) {
+		s.logger().Warn("Request not served", "err", err)
+		return
+	}
+	ok, suppressed := s.violationLog.allow(time.Now())
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		s.logger().Warn("Request not served", "err", err, "suppressed", suppressed)
+		return
+	}
+	s.logger().Warn("Request not served", "err", err)
+}
+
+// malformed counts a malformed packet on the request port and answers it
+// with an illegal operation ERROR, unless it is an ERROR itself.
+func (s *Server) malformed(conn net.PacketConn, addr net.Addr, packet []byte, message string) {
+	s.Vars()
+	s.vars.malformed.Add(1)
+	s.StatsD.malformed()
+	if op, err := common.GetOpCode(packet); err == nil && op == common.OpERROR {
+		return
+	}
+	common.SendError(common.ErrIllegalOperation, message, conn, addr)
+}
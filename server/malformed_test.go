@@ -0,0 +1,25 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLogLimiter(t *testing.T) {
+	var l logLimiter
+	now := time.Now()
+	for i := 0; i < violationLogBurst; i++ {
+		if ok, _ := l.allow(now); !ok {
+			t.Fatalf("Expected the burst to be logged (%d)", i)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.allow(now); ok {
+			t.Fatalf("Expected lines beyond the burst to be suppressed (%d)", i)
+		}
+	}
+	ok, suppressed := l.allow(now.Add(time.Second))
+	if !ok || suppressed != 5 {
+		t.Errorf("Expected a line reporting 5 suppressed, got %v, %d", ok, suppressed)
+	}
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var errMemoryFull = fmt.Errorf("Memory backend full: %w", syscall.ENOSPC)
+
+// MemoryBackend is a Backend keeping files in memory, useful in tests and
+// for serving a small set of hot boot files from RAM. It is safe for
+// concurrent use. The zero value is an empty backend with no size limit.
+type MemoryBackend struct {
+	// MaxSize, if non-zero, caps the total bytes stored. Uploads that would
+	// exceed it fail with Disk full.
+	MaxSize int64
+
+	mu    sync.RWMutex
+	files map[string]*memoryFile
+	size  int64
+}
+
+type memoryFile struct {
+	data    []byte
+	modTime time.Time
+}
+
+// Store sets the content of name, replacing any existing file.
+func (m *MemoryBackend) Store(name string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.store(name, bytes.Clone(data))
+}
+
+// store sets the content of name, taking ownership of data. m.mu must be
+// held.
+func (m *MemoryBackend) store(name string, data []byte) error {
+	var existing int64
+	if f, ok := m.files[name]; ok {
+		existing = int64(len(f.data))
+	}
+	if !m.fits(int64(len(data)) - existing) {
+		return errMemoryFull
+	}
+	if m.files == nil {
+		m.files = make(map[string]*memoryFile)
+	}
+	m.files[name] = &memoryFile{data: data, modTime: time.Now()}
+	m.size += int64(len(data)) - existing
+	return nil
+}
+
+// fits reports whether n more bytes can be stored. m.mu must be held.
+func (m *MemoryBackend) fits(n int64) bool {
+	return m.MaxSize == 0 || m.size+n <= m.MaxSize
+}
+
+// Size returns the total bytes stored.
+func (m *MemoryBackend) Size() int64 {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.size
+}
+
+func (m *MemoryBackend) Open(name string) (io.ReadCloser, int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[name]
+	if !ok {
+		return nil, 0, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	// Stored data is never modified, so readers can share it
+	return io.NopCloser(bytes.NewReader(f.data)), int64(len(f.data)), nil
+}
+
+// Create returns a writer buffering the upload in memory. The file appears
+// once the writer is closed.
+func (m *MemoryBackend) Create(name string) (io.WriteCloser, error) {
+	return &memoryWriter{m: m, name: name}, nil
+}
+
+func (m *MemoryBackend) Stat(name string) (fs.FileInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	f, ok := m.files[name]
+	if !ok {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return memoryFileInfo{name: path.Base(name), size: int64(len(f.data)), modTime: f.modTime}, nil
+}
+
+func (m *MemoryBackend) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, ok := m.files[name]
+	if !ok {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrNotExist}
+	}
+	delete(m.files, name)
+	m.size -= int64(len(f.data))
+	return nil
+}
+
+type memoryWriter struct {
+	m    *MemoryBackend
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *memoryWriter) Write(p []byte) (int, error) {
+	// Fail early rather than buffering an upload that can never be stored
+	w.m.mu.RLock()
+	fits := w.m.fits(int64(w.buf.Len() + len(p)))
+	w.m.mu.RUnlock()
+	if !fits {
+		return 0, errMemoryFull
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memoryWriter) Close() error {
+	w.m.mu.Lock()
+	defer w.m.mu.Unlock()
+	return w.m.store(w.name, w.buf.Bytes())
+}
+
+// Abort discards the upload.
+func (w *memoryWriter) Abort() error {
+	w.buf.Reset()
+	return nil
+}
+
+type memoryFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+func (i memoryFileInfo) Name() string       { return i.name }
+func (i memoryFileInfo) Size() int64        { return i.size }
+func (i memoryFileInfo) Mode() fs.FileMode  { return 0444 }
+func (i memoryFileInfo) ModTime() time.Time { return i.modTime }
+func (i memoryFileInfo) IsDir() bool        { return false }
+func (i memoryFileInfo) Sys() any           { return nil }
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+var _ RemoveBackend = &MemoryBackend{}
+
+func TestMemoryBackend(t *testing.T) {
+	m := &MemoryBackend{MaxSize: 10}
+	if err := m.Store("kernel", []byte("vmlinuz")); err != nil {
+		t.Fatal(err)
+	}
+
+	r, size, err := m.Open("kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(r)
+	if string(got) != "vmlinuz" || size != 7 {
+		t.Errorf("Expected %q of size 7, got %q of size %d", "vmlinuz", got, size)
+	}
+	info, err := m.Stat("kernel")
+	if err != nil || info.Size() != 7 || info.Name() != "kernel" {
+		t.Errorf("Unexpected stat %v, %v", info, err)
+	}
+	if _, _, err := m.Open("missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected not found, got %v", err)
+	}
+
+	steps := []struct {
+		run  func() error
+		err  error
+		size int64
+	}{
+		{run: func() error { return upload(m, "small", "abc") }, size: 10},
+		{run: func() error { return upload(m, "big", "a") }, err: errMemoryFull, size: 10},
+		{run: func() error { return m.Remove("small") }, size: 7},
+		// Replacing a file only needs room for the difference
+		{run: func() error { return m.Store("kernel", []byte("vmlinuz.2")) }, size: 9},
+	}
+	for i, step := range steps {
+		if err := step.run(); err != step.err {
+			t.Errorf("Expected %v, got %v (%d)", step.err, err, i)
+		}
+		if got := m.Size(); got != step.size {
+			t.Errorf("Expected size %d, got %d (%d)", step.size, got, i)
+		}
+	}
+}
+
+func upload(m *MemoryBackend, name, data string) error {
+	w, _ := m.Create(name)
+	if _, err := io.WriteString(w, data); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+func TestMemoryBackendFull(t *testing.T) {
+	s := &Server{Backend: &MemoryBackend{MaxSize: 1000}}
+	addr, _ := startServer(t, s)
+
+	err := putFile(t, addr, "big", bytes.Repeat([]byte("x"), 2000))
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrDiskFull {
+		t.Errorf("Expected Disk full, got %v", err)
+	}
+}
@@ -0,0 +1,52 @@
+package server
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// hiddenErrorMessage is sent in place of the text of unexpected errors when
+// Server.HideErrorDetails is set.
+const hiddenErrorMessage = "Internal error"
+
+// clientError returns the code and message to send a client for err,
+// hiding the text of errors that weren't meant for clients if the server is
+// configured to.
+func (s *Server) clientError(err error) (common.ErrorCode, string) {
+	code, message := errorPacket(err)
+	if _, ok := err.(*common.Error); !ok && s.HideErrorDetails && code == common.ErrNotDefined {
+		message = hiddenErrorMessage
+	}
+	return code, message
+}
+
+// errorMessageConn replaces the text of the ERROR packets written through
+// it with the server's message for their code.
+type errorMessageConn struct {
+	net.PacketConn
+	messages map[common.ErrorCode]string
+}
+
+func (s *Server) errorMessageConn(conn net.PacketConn) net.PacketConn {
+	if len(s.ErrorMessages) == 0 {
+		return conn
+	}
+	return &errorMessageConn{PacketConn: conn, messages: s.ErrorMessages}
+}
+
+func (c *errorMessageConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if op, _ := common.GetOpCode(b); op != common.OpERROR || len(b) < 4 {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	code := common.ErrorCode(binary.BigEndian.Uint16(b[2:]))
+	message, ok := c.messages[code]
+	if !ok {
+		return c.PacketConn.WriteTo(b, addr)
+	}
+	if _, err := c.PacketConn.WriteTo(common.CreateErrorPacket(code, message), addr); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
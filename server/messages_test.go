@@ -0,0 +1,63 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestErrorMessages(t *testing.T) {
+	handler := ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+		switch req.Filename {
+		case "broken":
+			return nil, 0, errors.New("open /srv/tftp/broken: input/output error")
+		case "secret":
+			return nil, 0, &common.Error{Code: common.ErrAccessViolation, Message: "Go away"}
+		case "custom":
+			return nil, 0, &common.Error{Code: common.ErrNotDefined, Message: "Try again tomorrow"}
+		}
+		return nil, 0, os.ErrNotExist
+	})
+
+	testCases := []struct {
+		messages map[common.ErrorCode]string
+		hide     bool
+		filename string
+		expected *common.Error
+	}{
+		{filename: "missing", expected: &common.Error{Code: common.ErrFileNotFound, Message: "File not found"}},
+		{filename: "broken", expected: &common.Error{Code: common.ErrNotDefined, Message: "open /srv/tftp/broken: input/output error"}},
+		{
+			messages: map[common.ErrorCode]string{common.ErrFileNotFound: "No such image, ask IT"},
+			filename: "missing",
+			expected: &common.Error{Code: common.ErrFileNotFound, Message: "No such image, ask IT"},
+		},
+		{
+			messages: map[common.ErrorCode]string{common.ErrFileNotFound: "No such image, ask IT"},
+			filename: "secret",
+			expected: &common.Error{Code: common.ErrAccessViolation, Message: "Go away"},
+		},
+		{hide: true, filename: "broken", expected: &common.Error{Code: common.ErrNotDefined, Message: hiddenErrorMessage}},
+		{hide: true, filename: "custom", expected: &common.Error{Code: common.ErrNotDefined, Message: "Try again tomorrow"}},
+		{hide: true, filename: "missing", expected: &common.Error{Code: common.ErrFileNotFound, Message: "File not found"}},
+		{
+			messages: map[common.ErrorCode]string{common.ErrNotDefined: "Server error"},
+			hide:     true,
+			filename: "broken",
+			expected: &common.Error{Code: common.ErrNotDefined, Message: "Server error"},
+		},
+	}
+
+	for i, tc := range testCases {
+		s := &Server{ReadHandler: handler, ErrorMessages: tc.messages, HideErrorDetails: tc.hide}
+		addr, _ := startServer(t, s)
+		_, err := getFile(t, addr, tc.filename)
+		if !reflect.DeepEqual(err, tc.expected) {
+			t.Errorf("Expected %#v, got %#v (%d)", tc.expected, err, i)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"io"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+var errUploadOnly = &common.Error{Code: common.ErrAccessViolation, Message: "Server only accepts uploads"}
+
+// Middleware wraps a Handler to add behaviour such as logging,
+// authorisation, rate limiting or metrics around every read and write.
+type Middleware func(Handler) Handler
+
+// Chain wraps h with each of middleware in turn. The first middleware is the
+// outermost, so it sees each request first.
+func Chain(h Handler, middleware ...Middleware) Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// CombineHandlers returns a Handler serving reads with r and writes with w.
+// Middleware that only cares about one direction can use it to pass the
+// other straight through, for example:
+//
+//	func readOnly(next server.Handler) server.Handler {
+//		return server.CombineHandlers(next, server.WriteHandlerFunc(deny))
+//	}
+func CombineHandlers(r ReadHandler, w WriteHandler) Handler {
+	return handlerPair{r, w}
+}
+
+type handlerPair struct {
+	ReadHandler
+	WriteHandler
+}
+
+// rootHandler returns the server's read and write handlers wrapped in its
+// middleware, built once on first use.
+func (s *Server) rootHandler() Handler {
+	s.rootOnce.Do(func() {
+		var r ReadHandler
+		var w WriteHandler
+		if s.Backend != nil {
+			h := BackendHandler{Backend: s.Backend, Overwrite: s.Overwrite}
+			r, w = h, h
+		} else {
+			uploadRoot := s.UploadRoot
+			if uploadRoot == "" {
+				uploadRoot = s.Root
+			}
+			r = Dir(s.Root)
+			if s.NoSymlinks {
+				r = Dir(s.Root).NoSymlinks()
+			}
+			if s.OpenFiles > 0 {
+				h := &fileHandles{dir: Dir(s.Root), followLinks: !s.NoSymlinks, max: s.OpenFiles}
+				s.mu.Lock()
+				s.openFiles = h
+				s.mu.Unlock()
+				r = h
+			}
+			w = UploadDir{
+				Dir:          Dir(uploadRoot),
+				Overwrite:    s.Overwrite,
+				CreateDirs:   s.CreateDirs,
+				Perm:         s.UploadPerm,
+				Owner:        s.UploadOwner,
+				NoSymlinks:   s.NoSymlinks,
+				MinFreeSpace: s.MinFreeSpace,
+			}
+		}
+		if s.CoalesceReads > 0 {
+			r = &coalescedReads{handler: r, maxSize: s.CoalesceReads}
+		}
+		if s.ReadHandler != nil {
+			r = s.ReadHandler
+		}
+		if s.UploadOnly {
+			r = ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+				return nil, 0, errUploadOnly
+			})
+		}
+		if s.WriteHandler != nil {
+			w = s.WriteHandler
+		}
+		s.root = Chain(CombineHandlers(r, w), s.Middleware...)
+	})
+	return s.root
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// callLog records the order middleware runs in.
+type callLog struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (l *callLog) add(name string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.calls = append(l.calls, name)
+}
+
+func (l *callLog) get() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.calls...)
+}
+
+// recordingMiddleware notes its name in calls each time a read passes
+// through it.
+func recordingMiddleware(name string, calls *callLog) Middleware {
+	return func(next Handler) Handler {
+		read := ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+			calls.add(name)
+			return next.ServeRead(req)
+		})
+		return CombineHandlers(read, next)
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var calls callLog
+	deny := Middleware(func(next Handler) Handler {
+		write := WriteHandlerFunc(func(req *Request) (io.WriteCloser, error) {
+			return nil, &common.Error{Code: common.ErrAccessViolation, Message: "Read only"}
+		})
+		return CombineHandlers(next, write)
+	})
+	s := &Server{
+		ReadHandler: namedHandler("content"),
+		Middleware: []Middleware{
+			recordingMiddleware("first", &calls),
+			recordingMiddleware("second", &calls),
+			deny,
+		},
+	}
+	addr, _ := startServer(t, s)
+
+	got, err := getFile(t, addr, "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("content")) {
+		t.Errorf("Expected content, got %q", got)
+	}
+	if expected := []string{"first", "second"}; !reflect.DeepEqual(calls.get(), expected) {
+		t.Errorf("Expected middleware to run in order %v, got %v", expected, calls.get())
+	}
+
+	err = putFile(t, addr, "kernel", []byte("x"))
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected an access violation, got %v", err)
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
 	"bytes"
@@ -9,9 +9,11 @@ import (
 
 type mockHandler struct {
 	replyChan chan struct{}
+	lastReq   *Request
 }
 
-func (m *mockHandler) serve(remoteAddr net.Addr, filename string) {
+func (m *mockHandler) serve(conn net.PacketConn, req *Request) {
+	m.lastReq = req
 	m.replyChan <- struct{}{}
 }
 
@@ -48,7 +50,7 @@ func (m *mockPacketConn) Close() error {
 }
 
 func (m *mockPacketConn) LocalAddr() net.Addr {
-	return m.addr
+	return mockAddr{}
 }
 
 func (m *mockPacketConn) SetDeadline(t time.Time) error {
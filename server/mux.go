@@ -0,0 +1,168 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+var errWriteNotAllowed = &common.Error{Code: common.ErrAccessViolation, Message: "Writing this file is not allowed"}
+
+// A Handler serves both reads and writes.
+type Handler interface {
+	ReadHandler
+	WriteHandler
+}
+
+// ServeMux routes requests to handlers by filename, much like
+// http.ServeMux. It is both a ReadHandler and a WriteHandler, so a server
+// routing every request uses the same mux for both:
+//
+//	mux := server.NewServeMux()
+//	mux.HandleRead("pxelinux.cfg/*", configs)
+//	mux.HandleReadFunc("boot.ipxe", bootScript)
+//	mux.Handle("/", server.Dir("/srv/tftp"))
+//	s := &server.Server{ReadHandler: mux, WriteHandler: mux}
+//
+// Patterns are matched against the requested filename, ignoring any leading
+// slash on either:
+//
+//   - a pattern ending in a slash matches every file beneath it, with "/"
+//     matching all files
+//   - a pattern containing *, ? or [ is a glob, see path.Match
+//   - anything else matches that file only
+//
+// An exact match wins over a glob, which wins over a prefix. Among globs or
+// prefixes the longest pattern wins.
+type ServeMux struct {
+	mu     sync.RWMutex
+	reads  []muxEntry
+	writes []muxEntry
+}
+
+type muxKind int
+
+const (
+	muxPrefix muxKind = iota
+	muxGlob
+	muxExact
+)
+
+// muxEntry is a registered pattern, with either read or write set.
+type muxEntry struct {
+	pattern string
+	kind    muxKind
+	read    ReadHandler
+	write   WriteHandler
+}
+
+// NewServeMux allocates and returns a new ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{}
+}
+
+// Handle registers h for both reads and writes of files matching pattern.
+func (m *ServeMux) Handle(pattern string, h Handler) {
+	m.HandleRead(pattern, h)
+	m.HandleWrite(pattern, h)
+}
+
+// HandleRead registers h for reads of files matching pattern. It panics if
+// the pattern is invalid or already registered for reads.
+func (m *ServeMux) HandleRead(pattern string, h ReadHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.reads = addMuxEntry(m.reads, muxEntry{pattern: pattern, read: h})
+}
+
+// HandleReadFunc registers f to generate the content of files matching
+// pattern when they are read, see ContentFunc.
+func (m *ServeMux) HandleReadFunc(pattern string, f func(req *Request) (io.Reader, int64, error)) {
+	m.HandleRead(pattern, ContentFunc(f))
+}
+
+// HandleWrite registers h for writes of files matching pattern. It panics if
+// the pattern is invalid or already registered for writes.
+func (m *ServeMux) HandleWrite(pattern string, h WriteHandler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.writes = addMuxEntry(m.writes, muxEntry{pattern: pattern, write: h})
+}
+
+func addMuxEntry(entries []muxEntry, e muxEntry) []muxEntry {
+	pattern := e.pattern
+	if pattern == "" {
+		panic("tftp: invalid pattern")
+	}
+	e.pattern = strings.TrimPrefix(pattern, "/")
+	e.kind = muxExact
+	switch {
+	case strings.HasSuffix(pattern, "/"):
+		e.kind = muxPrefix
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(e.pattern, ""); err != nil {
+			panic(fmt.Sprintf("tftp: invalid pattern %q: %v", pattern, err))
+		}
+		e.kind = muxGlob
+	}
+	for _, existing := range entries {
+		if existing.pattern == e.pattern && existing.kind == e.kind {
+			panic(fmt.Sprintf("tftp: multiple registrations for %s", pattern))
+		}
+	}
+	return append(entries, e)
+}
+
+// match returns the entry with the best pattern matching name, or nil.
+func match(entries []muxEntry, name string) *muxEntry {
+	name = strings.TrimPrefix(name, "/")
+	var best *muxEntry
+	for i := range entries {
+		e := &entries[i]
+		var ok bool
+		switch e.kind {
+		case muxExact:
+			ok = e.pattern == name
+		case muxGlob:
+			ok, _ = path.Match(e.pattern, name)
+		case muxPrefix:
+			ok = strings.HasPrefix(name, e.pattern)
+		}
+		if !ok {
+			continue
+		}
+		if best == nil || e.kind > best.kind || (e.kind == best.kind && len(e.pattern) > len(best.pattern)) {
+			best = e
+		}
+	}
+	return best
+}
+
+// ServeRead dispatches the request to the read handler whose pattern best
+// matches the filename, reporting File not found if there is none.
+func (m *ServeMux) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	m.mu.RLock()
+	e := match(m.reads, req.Filename)
+	m.mu.RUnlock()
+	if e == nil {
+		return nil, 0, os.ErrNotExist
+	}
+	return e.read.ServeRead(req)
+}
+
+// ServeWrite dispatches the request to the write handler whose pattern best
+// matches the filename, reporting an access violation if there is none.
+func (m *ServeMux) ServeWrite(req *Request) (io.WriteCloser, error) {
+	m.mu.RLock()
+	e := match(m.writes, req.Filename)
+	m.mu.RUnlock()
+	if e == nil {
+		return nil, errWriteNotAllowed
+	}
+	return e.write.ServeWrite(req)
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"io"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// namedHandler serves its own name as the content of every file.
+type namedHandler string
+
+func (h namedHandler) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	return io.NopCloser(strings.NewReader(string(h))), int64(len(h)), nil
+}
+
+func (h namedHandler) ServeWrite(req *Request) (io.WriteCloser, error) {
+	return nil, &common.Error{Code: common.ErrNotDefined, Message: string(h)}
+}
+
+func TestServeMux(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleRead("pxelinux.cfg/*", namedHandler("configs"))
+	mux.HandleRead("pxelinux.cfg/default", namedHandler("default"))
+	mux.HandleRead("/images/", namedHandler("images"))
+	mux.HandleRead("images/x86/", namedHandler("x86"))
+	mux.HandleRead("images/*.efi", namedHandler("efi"))
+	mux.Handle("uploads/", namedHandler("uploads"))
+
+	testCases := []struct {
+		filename string
+		expected string
+	}{
+		{filename: "pxelinux.cfg/01-aa-bb", expected: "configs"},
+		{filename: "/pxelinux.cfg/01-aa-bb", expected: "configs"},
+		{filename: "pxelinux.cfg/default", expected: "default"},
+		{filename: "images/vmlinuz", expected: "images"},
+		{filename: "images/x86/vmlinuz", expected: "x86"},
+		{filename: "images/grub.efi", expected: "efi"},
+		{filename: "uploads/log", expected: "uploads"},
+		{filename: "pxelinux.cfg/a/b", expected: ""},
+		{filename: "kernel", expected: ""},
+	}
+
+	for i, tc := range testCases {
+		r, _, err := mux.ServeRead(&Request{Filename: tc.filename})
+		if tc.expected == "" {
+			if !os.IsNotExist(err) {
+				t.Errorf("Expected not found, got %v (%d)", err, i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		got, _ := io.ReadAll(r)
+		if string(got) != tc.expected {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestServeMuxReadFunc(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleReadFunc("hosts/*.ks", func(req *Request) (io.Reader, int64, error) {
+		body := "network --hostname=" + strings.TrimSuffix(path.Base(req.Filename), ".ks") + " --ip=" + common.HostOf(req.RemoteAddr)
+		return strings.NewReader(body), int64(len(body)), nil
+	})
+	mux.HandleReadFunc("broken", func(req *Request) (io.Reader, int64, error) {
+		return nil, 0, os.ErrPermission
+	})
+	s := &Server{ReadHandler: mux}
+	addr, _ := startServer(t, s)
+
+	got, err := getFile(t, addr, "hosts/node1.ks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "network --hostname=node1 --ip=127.0.0.1"; string(got) != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+	_, err = getFile(t, addr, "broken")
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected an access violation, got %v", err)
+	}
+}
+
+func TestServeMuxWrites(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleRead("/", namedHandler("everything"))
+	mux.Handle("uploads/", namedHandler("uploads"))
+
+	_, err := mux.ServeWrite(&Request{Filename: "uploads/log"})
+	if e, ok := err.(*common.Error); !ok || e.Message != "uploads" {
+		t.Errorf("Expected the uploads handler, got %v", err)
+	}
+	_, err = mux.ServeWrite(&Request{Filename: "kernel"})
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected an access violation, got %v", err)
+	}
+}
+
+func TestServeMuxInvalidPattern(t *testing.T) {
+	for i, pattern := range []string{"", "[", "a/"} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected a panic for %q (%d)", pattern, i)
+				}
+			}()
+			mux := NewServeMux()
+			mux.HandleRead("a/", namedHandler("a"))
+			mux.HandleRead(pattern, namedHandler("b"))
+		}()
+	}
+}
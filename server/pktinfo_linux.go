@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+const (
+	pktInfoSupported  = true
+	pktInfoBufferSize = 128
+)
+
+// enablePktInfo asks the kernel to report the local address every packet
+// received on conn was sent to, so transfers to requests arriving on a
+// wildcard listener can answer from the address the client contacted.
+func enablePktInfo(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_PKTINFO, 1)
+		// IPv6 sockets report IPv4 packets with IP_PKTINFO too, but IPv4
+		// sockets can't set IPV6_RECVPKTINFO
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, syscall.IPV6_RECVPKTINFO, 1); err == nil {
+			sockErr = nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("Error setting IP_PKTINFO: %v", sockErr)
+	}
+	return nil
+}
+
+// parsePktInfo extracts the local address from the control messages of a
+// packet read from a socket set up by enablePktInfo, without a port. For
+// IPv4 that is the address the kernel would answer from, which is the
+// interface's own address for broadcasts. IPv6 multicast destinations can't
+// be answered from, so aren't reported.
+func parsePktInfo(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing control messages: %v", err)
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_PKTINFO:
+			// struct in_pktinfo
+			if len(m.Data) < 12 {
+				return nil, fmt.Errorf("Packet info too short")
+			}
+			// The kernel's choice of source is the client's own address
+			// for packets over loopback, where the destination will do
+			ip := net.IP(append([]byte(nil), m.Data[8:12]...))
+			if !ip.IsLoopback() {
+				ip = net.IP(append([]byte(nil), m.Data[4:8]...))
+			}
+			return &net.UDPAddr{IP: ip}, nil
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == syscall.IPV6_PKTINFO:
+			// struct in6_pktinfo
+			if len(m.Data) < 20 {
+				return nil, fmt.Errorf("Packet info too short")
+			}
+			ip := net.IP(append([]byte(nil), m.Data[:16]...))
+			if ip.IsMulticast() {
+				return nil, fmt.Errorf("Packet sent to multicast address %v", ip)
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				return &net.UDPAddr{IP: ip4}, nil
+			}
+			addr := &net.UDPAddr{IP: ip}
+			if ip.IsLinkLocalUnicast() {
+				// Link-local addresses can't be bound without their zone
+				index := int(binary.NativeEndian.Uint32(m.Data[16:20]))
+				addr.Zone = strconv.Itoa(index)
+				if ifi, err := net.InterfaceByIndex(index); err == nil {
+					addr.Zone = ifi.Name
+				}
+			}
+			return addr, nil
+		}
+	}
+	return nil, fmt.Errorf("No packet info in control messages")
+}
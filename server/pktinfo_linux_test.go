@@ -0,0 +1,83 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestReadRequestPktInfo(t *testing.T) {
+	testCases := []struct {
+		network  string
+		listen   string
+		dest     net.IP
+		expected string
+	}{
+		{network: "udp4", listen: "0.0.0.0:0", dest: net.IPv4(127, 0, 0, 1), expected: "127.0.0.1"},
+		{network: "udp4", listen: "0.0.0.0:0", dest: net.IPv4(127, 0, 0, 2), expected: "127.0.0.2"},
+		// Dual stack listeners report IPv4 destinations unmapped
+		{network: "udp", listen: "[::]:0", dest: net.IPv4(127, 0, 0, 2), expected: "127.0.0.2"},
+		{network: "udp6", listen: "[::]:0", dest: net.IPv6loopback, expected: "::1"},
+	}
+
+	for i, tc := range testCases {
+		conn, err := net.ListenPacket(tc.network, tc.listen)
+		if err != nil {
+			t.Skipf("Can't listen on %s: %v", tc.listen, err)
+		}
+		defer conn.Close()
+		wildcard, ok := wildcardListener(conn)
+		if !ok {
+			t.Fatalf("Expected %v to be a wildcard listener (%d)", conn.LocalAddr(), i)
+		}
+		if err := enablePktInfo(wildcard); err != nil {
+			t.Fatal(err)
+		}
+
+		client, err := net.ListenPacket("udp", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		if _, err := client.WriteTo(sampleRRQ(), &net.UDPAddr{IP: tc.dest, Port: port}); err != nil {
+			t.Fatal(err)
+		}
+
+		s := &Server{}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		packet := make([]byte, 512)
+		_, _, localAddr, err := s.readRequest(conn, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := (&net.UDPAddr{IP: net.ParseIP(tc.expected), Port: port}).String()
+		if localAddr == nil || localAddr.String() != expected {
+			t.Errorf("Expected destination %v, got %v (%d)", expected, localAddr, i)
+		}
+	}
+}
+
+func TestTransferAnswersFromDestination(t *testing.T) {
+	conn, err := net.ListenPacket("udp4", "0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{ReadHandler: namedHandler("kernel"), Logger: slog.New(slog.DiscardHandler)}
+	go s.Serve(conn)
+	t.Cleanup(func() { s.Close() })
+
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: conn.LocalAddr().(*net.UDPAddr).Port}
+	client := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip := from.(*net.UDPAddr).IP; !ip.Equal(addr.IP) {
+		t.Errorf("Expected reply from %v, got %v", addr.IP, ip)
+	}
+}
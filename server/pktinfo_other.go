@@ -0,0 +1,23 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+const (
+	pktInfoSupported  = false
+	pktInfoBufferSize = 0
+)
+
+var errPktInfoUnsupported = errors.New("Packet info is only supported on Linux")
+
+func enablePktInfo(conn *net.UDPConn) error {
+	return errPktInfoUnsupported
+}
+
+func parsePktInfo(oob []byte) (*net.UDPAddr, error) {
+	return nil, errPktInfoUnsupported
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// fallocKeepSize allocates without changing the file's size, so a short
+// upload doesn't leave zeros at the end.
+const fallocKeepSize = 0x1
+
+// preallocate reserves size bytes of disk for f, reporting whether it could.
+// File systems that can't preallocate are skipped rather than failing the
+// upload.
+func preallocate(f *os.File, size int64) (bool, error) {
+	err := syscall.Fallocate(int(f.Fd()), fallocKeepSize, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,66 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestUploadPreallocates(t *testing.T) {
+	root := t.TempDir()
+	u := UploadDir{Dir: Dir(root)}
+
+	// Less arrives than was announced, the rest is given back
+	req := &Request{OpCode: common.OpWRQ, Filename: "config.txt", Options: map[string]string{"tsize": "1048576"}}
+	w, err := u.ServeWrite(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !w.(*fileWriter).preallocated {
+		t.Skip("File system can't preallocate")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Stat(w.(*fileWriter).Name(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks*512 < 1048576 {
+		t.Errorf("Expected 1048576 bytes reserved, got %d", st.Blocks*512)
+	}
+	w.Write([]byte("hostname sw1"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(root, "config.txt"))
+	if err != nil || info.Size() != int64(len("hostname sw1")) {
+		t.Errorf("Unexpected upload: %v, %v", info, err)
+	}
+	if err := syscall.Stat(filepath.Join(root, "config.txt"), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Blocks*512 >= 1048576 {
+		t.Errorf("Expected reserved space to be released, %d bytes still allocated", st.Blocks*512)
+	}
+
+	// More than the disk can hold fails before any data is sent
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(root, &fs); err != nil {
+		t.Fatal(err)
+	}
+	free := int64(fs.Bavail) * int64(fs.Bsize)
+	req = &Request{OpCode: common.OpWRQ, Filename: "huge.img", Options: map[string]string{"tsize": strconv.FormatInt(free+1<<30, 10)}}
+	_, err = u.ServeWrite(req)
+	if errors.Is(err, syscall.EFBIG) {
+		t.Skip("Disk has more space than a file can use")
+	}
+	if code, _ := errorPacket(err); code != common.ErrDiskFull {
+		t.Errorf("Expected disk full, got %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("Expected refused upload to be removed, got %v", entries)
+	}
+}
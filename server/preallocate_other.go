@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import "os"
+
+// preallocate does nothing outside Linux, where the files are left to grow
+// as the upload arrives.
+func preallocate(f *os.File, size int64) (bool, error) {
+	return false, nil
+}
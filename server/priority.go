@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"path"
+)
+
+// A Priority ranks transfers competing for a transfer slot or for
+// bandwidth, see Server.Priorities.
+type Priority int
+
+const (
+	PriorityLow Priority = iota - 1
+	PriorityNormal
+	PriorityHigh
+
+	numPriorities = 3
+)
+
+var priorityNames = map[Priority]string{
+	PriorityLow:    "low",
+	PriorityNormal: "normal",
+	PriorityHigh:   "high",
+}
+
+func (p Priority) String() string {
+	if name, ok := priorityNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Priority(%d)", int(p))
+}
+
+// ParsePriority returns the priority named by s, one of low, normal or high.
+func ParsePriority(s string) (Priority, error) {
+	for p, name := range priorityNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown priority %q", s)
+}
+
+// index returns p's position in per priority arrays, lowest first.
+func (p Priority) index() int {
+	return int(p - PriorityLow)
+}
+
+// A PriorityRule gives the files matching Pattern, a path.Match pattern such
+// as "images/*.iso", a priority.
+type PriorityRule struct {
+	Pattern  string
+	Priority Priority
+}
+
+// checkPriorities reports the first malformed rule in Priorities.
+func (s *Server) checkPriorities() error {
+	for _, rule := range s.Priorities {
+		if _, err := path.Match(rule.Pattern, ""); err != nil {
+			return fmt.Errorf("Invalid priority pattern %q: %v", rule.Pattern, err)
+		}
+		if _, ok := priorityNames[rule.Priority]; !ok {
+			return fmt.Errorf("Invalid priority %v for %q", rule.Priority, rule.Pattern)
+		}
+	}
+	return nil
+}
+
+// priority returns the priority of a transfer of filename, that of the
+// first of Priorities it matches.
+func (s *Server) priority(filename string) Priority {
+	name := path.Clean("/" + filename)[1:]
+	for _, rule := range s.Priorities {
+		if ok, _ := path.Match(rule.Pattern, name); ok {
+			return rule.Priority
+		}
+	}
+	return PriorityNormal
+}
@@ -0,0 +1,38 @@
+package server
+
+import "testing"
+
+func TestPriority(t *testing.T) {
+	s := &Server{Priorities: []PriorityRule{
+		{Pattern: "vmlinuz*", Priority: PriorityHigh},
+		{Pattern: "initrd.img", Priority: PriorityHigh},
+		{Pattern: "wallpapers/*", Priority: PriorityLow},
+	}}
+	testCases := []struct {
+		filename string
+		expected Priority
+	}{
+		{filename: "vmlinuz-6.1", expected: PriorityHigh},
+		{filename: "/initrd.img", expected: PriorityHigh},
+		{filename: "wallpapers/beach.png", expected: PriorityLow},
+		{filename: "wallpapers/2024/beach.png", expected: PriorityNormal},
+		{filename: "pxelinux.0", expected: PriorityNormal},
+	}
+	for i, tc := range testCases {
+		if got := s.priority(tc.filename); got != tc.expected {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, got, i)
+		}
+	}
+
+	for _, p := range []Priority{PriorityLow, PriorityNormal, PriorityHigh} {
+		if got, err := ParsePriority(p.String()); err != nil || got != p {
+			t.Errorf("Expected %v, got %v, %v", p, got, err)
+		}
+	}
+	if _, err := ParsePriority("urgent"); err == nil {
+		t.Error("Expected an unknown priority to fail")
+	}
+	if err := (&Server{Priorities: []PriorityRule{{Pattern: "[", Priority: PriorityHigh}}}).checkPriorities(); err == nil {
+		t.Error("Expected a malformed pattern to fail")
+	}
+}
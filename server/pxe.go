@@ -0,0 +1,158 @@
+package server
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// pxeClientTTL is how long a client's MAC is remembered after its
+	// pxelinux.cfg lookup.
+	pxeClientTTL = 10 * time.Minute
+	// maxPXEClients is how many clients are remembered before expired ones
+	// are swept away.
+	maxPXEClients = 1024
+)
+
+// PXELinux recognises the config lookups pxelinux makes while booting: one
+// for the machine's UUID, then pxelinux.cfg/01-<MAC>, then its IP in hex
+// with ever fewer digits (C0A80102, C0A8010, ... C), and finally default.
+//
+// Its Filter adds the MAC and IP found in those names to the request's
+// Metadata, and remembers the MAC so later requests from the same client,
+// for its kernel and initrd, are logged with it too. Its Middleware can cut
+// the hex IP fallbacks short. Use both with a server:
+//
+//	pxe := &server.PXELinux{Fallback: "pxelinux.cfg/default"}
+//	s.Filters = append(s.Filters, pxe.Filter)
+//	s.Middleware = append(s.Middleware, pxe.Middleware)
+type PXELinux struct {
+	// Fallback, if set, is served in place of a missing hex IP config, so
+	// a client isn't refused up to nine more times before pxelinux asks for
+	// default. Configs for shorter IP prefixes, such as a subnet's, are
+	// never asked for.
+	Fallback string
+
+	mu      sync.Mutex
+	clients map[netip.Addr]pxeClient
+}
+
+type pxeClient struct {
+	mac  string
+	seen time.Time
+}
+
+// Filter annotates req with the MAC and IP found in its filename, or the
+// client's MAC if it has been seen before. It never rejects a request.
+func (p *PXELinux) Filter(req *Request) error {
+	ip, haveIP := addrIP(req.RemoteAddr)
+	if mac, ok := pxelinuxMAC(req.Filename); ok {
+		req.Metadata.Set("mac", mac.String())
+		if haveIP {
+			p.remember(ip, mac.String())
+		}
+	} else if haveIP {
+		if mac, ok := p.lookup(ip); ok {
+			req.Metadata.Set("mac", mac)
+		}
+	}
+	if hex, ok := pxelinuxHexIP(req.Filename); ok && len(hex) == 8 {
+		n, _ := strconv.ParseUint(hex, 16, 32)
+		req.Metadata.Set("pxe_ip", netip.AddrFrom4([4]byte{byte(n >> 24), byte(n >> 16), byte(n >> 8), byte(n)}).String())
+	}
+	return nil
+}
+
+// Middleware serves Fallback in place of missing hex IP configs.
+func (p *PXELinux) Middleware(next Handler) Handler {
+	if p.Fallback == "" {
+		return next
+	}
+	return CombineHandlers(ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+		r, size, err := next.ServeRead(req)
+		if _, ok := pxelinuxHexIP(req.Filename); ok && os.IsNotExist(err) {
+			fallback := *req
+			fallback.Filename = p.Fallback
+			return next.ServeRead(&fallback)
+		}
+		return r, size, err
+	}), next)
+}
+
+func (p *PXELinux) remember(ip netip.Addr, mac string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if p.clients == nil {
+		p.clients = make(map[netip.Addr]pxeClient)
+	}
+	if len(p.clients) >= maxPXEClients {
+		for k, c := range p.clients {
+			if now.Sub(c.seen) > pxeClientTTL {
+				delete(p.clients, k)
+			}
+		}
+	}
+	p.clients[ip] = pxeClient{mac: mac, seen: now}
+}
+
+func (p *PXELinux) lookup(ip netip.Addr) (string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	c, ok := p.clients[ip]
+	if !ok || time.Since(c.seen) > pxeClientTTL {
+		return "", false
+	}
+	return c.mac, true
+}
+
+// pxelinuxConfig returns the base name of a file in a pxelinux.cfg
+// directory.
+func pxelinuxConfig(name string) (string, bool) {
+	dir, base := path.Split(strings.TrimPrefix(name, "/"))
+	if path.Base(dir) != "pxelinux.cfg" {
+		return "", false
+	}
+	return base, true
+}
+
+// pxelinuxMAC returns the MAC address in a pxelinux style per-host config
+// filename such as pxelinux.cfg/01-88-99-aa-bb-cc-dd, where 01 is the ARP
+// hardware type for Ethernet.
+func pxelinuxMAC(name string) (net.HardwareAddr, bool) {
+	base, ok := pxelinuxConfig(name)
+	if !ok {
+		return nil, false
+	}
+	hex, ok := strings.CutPrefix(base, "01-")
+	if !ok || len(hex) != 17 {
+		return nil, false
+	}
+	mac, err := net.ParseMAC(hex)
+	if err != nil {
+		return nil, false
+	}
+	return mac, true
+}
+
+// pxelinuxHexIP returns the hex digits of a pxelinux config named for all
+// or a prefix of an IPv4 address, such as pxelinux.cfg/C0A801.
+func pxelinuxHexIP(name string) (string, bool) {
+	base, ok := pxelinuxConfig(name)
+	if !ok || len(base) == 0 || len(base) > 8 {
+		return "", false
+	}
+	for _, c := range base {
+		if !('0' <= c && c <= '9' || 'A' <= c && c <= 'F') {
+			return "", false
+		}
+	}
+	return base, true
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestPXELinuxNames(t *testing.T) {
+	testCases := []struct {
+		filename string
+		mac      string
+		hexIP    string
+	}{
+		{filename: "pxelinux.cfg/01-88-99-aa-bb-cc-dd", mac: "88:99:aa:bb:cc:dd"},
+		{filename: "/boot/pxelinux.cfg/01-88-99-AA-BB-CC-DD", mac: "88:99:aa:bb:cc:dd"},
+		{filename: "pxelinux.cfg/C0A80102", hexIP: "C0A80102"},
+		{filename: "pxelinux.cfg/C0A8", hexIP: "C0A8"},
+		{filename: "pxelinux.cfg/default"},
+		{filename: "pxelinux.cfg/c0a80102"},
+		{filename: "pxelinux.cfg/C0A801020"},
+		{filename: "01-88-99-aa-bb-cc-dd"},
+		{filename: "other/C0A80102"},
+	}
+	for i, tc := range testCases {
+		mac, _ := pxelinuxMAC(tc.filename)
+		hexIP, _ := pxelinuxHexIP(tc.filename)
+		if mac.String() != tc.mac || hexIP != tc.hexIP {
+			t.Errorf("Expected %q and %q, got %q and %q (%d)", tc.mac, tc.hexIP, mac, hexIP, i)
+		}
+	}
+}
+
+func TestPXELinux(t *testing.T) {
+	var buf syncBuffer
+	pxe := &PXELinux{Fallback: "pxelinux.cfg/default"}
+	files := &MemoryBackend{}
+	files.Store("pxelinux.cfg/default", []byte("default"))
+	files.Store("vmlinuz", []byte("kernel"))
+	s := &Server{
+		Backend:    files,
+		Filters:    []RequestFilter{pxe.Filter},
+		Middleware: []Middleware{pxe.Middleware},
+		AccessLog:  slog.New(slog.NewJSONHandler(&buf, nil)),
+	}
+	addr, _ := startServer(t, s)
+
+	testCases := []struct {
+		filename string
+		expected string
+		meta     map[string]any
+	}{
+		{filename: "pxelinux.cfg/01-88-99-aa-bb-cc-dd", meta: map[string]any{"mac": "88:99:aa:bb:cc:dd"}},
+		{filename: "pxelinux.cfg/7F000001", expected: "default", meta: map[string]any{"mac": "88:99:aa:bb:cc:dd", "pxe_ip": "127.0.0.1"}},
+		{filename: "vmlinuz", expected: "kernel", meta: map[string]any{"mac": "88:99:aa:bb:cc:dd"}},
+	}
+	for i, tc := range testCases {
+		got, err := getFile(t, addr, tc.filename)
+		if tc.expected == "" {
+			if e, ok := err.(*common.Error); !ok || e.Code != common.ErrFileNotFound {
+				t.Errorf("Expected File not found, got %v (%d)", err, i)
+			}
+			continue
+		}
+		if err != nil || string(got) != tc.expected {
+			t.Errorf("Expected %q, got %q, %v (%d)", tc.expected, got, err, i)
+		}
+	}
+
+	byFile := map[string]map[string]any{}
+	for _, r := range buf.records(t, len(testCases)) {
+		byFile[r["file"].(string)] = r
+	}
+	for i, tc := range testCases {
+		if got := byFile[tc.filename]["meta"]; !reflect.DeepEqual(got, tc.meta) {
+			t.Errorf("Expected metadata %v, got %v (%d)", tc.meta, got, i)
+		}
+	}
+}
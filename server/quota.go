@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// defaultQuotaWindow is used when Server.ClientQuotaWindow is zero.
+const defaultQuotaWindow = time.Hour
+
+// quotaSlots is how many parts a quota window is split into. Usage is
+// forgotten a slot at a time as the window slides past it.
+const quotaSlots = 60
+
+// maxIdleClients is how many clients' usage is kept before those with none
+// left in the window are swept away.
+const maxIdleClients = 1024
+
+// quotaUsage is the bytes transferred with one client IP during the slots
+// starting at each time, oldest first.
+type quotaUsage struct {
+	starts []time.Time
+	bytes  []int64
+}
+
+// forget drops the slots that ended before since.
+func (u *quotaUsage) forget(since time.Time, slot time.Duration) {
+	i := 0
+	for i < len(u.starts) && !u.starts[i].Add(slot).After(since) {
+		i++
+	}
+	u.starts = u.starts[i:]
+	u.bytes = u.bytes[i:]
+}
+
+func (u *quotaUsage) total() int64 {
+	var total int64
+	for _, b := range u.bytes {
+		total += b
+	}
+	return total
+}
+
+// clientQuotas tracks the bytes each client IP has transferred over a
+// sliding window.
+type clientQuotas struct {
+	mu      sync.Mutex
+	clients map[string]*quotaUsage
+}
+
+// add records n bytes transferred with host at now.
+func (q *clientQuotas) add(host string, n int64, window time.Duration, now time.Time) {
+	if n <= 0 {
+		return
+	}
+	slot := window / quotaSlots
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.clients[host]
+	if u == nil {
+		if q.clients == nil {
+			q.clients = make(map[string]*quotaUsage)
+		}
+		if len(q.clients) >= maxIdleClients {
+			for h, other := range q.clients {
+				if other.forget(now.Add(-window), slot); len(other.starts) == 0 {
+					delete(q.clients, h)
+				}
+			}
+		}
+		u = &quotaUsage{}
+		q.clients[host] = u
+	}
+	start := now.Truncate(slot)
+	if last := len(u.starts) - 1; last >= 0 && u.starts[last].Equal(start) {
+		u.bytes[last] += n
+		return
+	}
+	u.starts = append(u.starts, start)
+	u.bytes = append(u.bytes, n)
+}
+
+// used returns the bytes transferred with host in the window ending at now.
+func (q *clientQuotas) used(host string, window time.Duration, now time.Time) int64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	u := q.clients[host]
+	if u == nil {
+		return 0
+	}
+	u.forget(now.Add(-window), window/quotaSlots)
+	if len(u.starts) == 0 {
+		delete(q.clients, host)
+		return 0
+	}
+	return u.total()
+}
+
+func (s *Server) quotaWindow() time.Duration {
+	if s.ClientQuotaWindow <= 0 {
+		return defaultQuotaWindow
+	}
+	return s.ClientQuotaWindow
+}
+
+// overQuota reports whether the client at addr has used up its quota,
+// counting transfers that have finished within the window and those still
+// running.
+func (s *Server) overQuota(addr net.Addr) bool {
+	if s.ClientQuota <= 0 {
+		return false
+	}
+	host := common.HostOf(addr)
+	used := s.shared().quotas.used(host, s.quotaWindow(), time.Now())
+	s.mu.Lock()
+	for _, t := range s.transfers {
+		if common.HostOf(t.req.RemoteAddr) == host {
+			used += t.bytes.Load()
+		}
+	}
+	s.mu.Unlock()
+	return used >= s.ClientQuota
+}
+
+// chargeQuota counts a finished transfer's bytes against its client's quota.
+func (s *Server) chargeQuota(t *transfer) {
+	if s.ClientQuota <= 0 {
+		return
+	}
+	s.shared().quotas.add(common.HostOf(t.req.RemoteAddr), t.bytes.Load(), s.quotaWindow(), time.Now())
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestClientQuotas(t *testing.T) {
+	var q clientQuotas
+	window := time.Hour
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	q.add("10.0.0.1", 100, window, start)
+	q.add("10.0.0.1", 50, window, start.Add(30*time.Second))
+	q.add("10.0.0.1", 25, window, start.Add(30*time.Minute))
+	q.add("10.0.0.2", 1000, window, start)
+
+	testCases := []struct {
+		host     string
+		at       time.Duration
+		expected int64
+	}{
+		{host: "10.0.0.1", at: time.Minute, expected: 175},
+		{host: "10.0.0.2", at: time.Minute, expected: 1000},
+		{host: "10.0.0.3", at: time.Minute, expected: 0},
+		{host: "10.0.0.1", at: 59 * time.Minute, expected: 175},
+		{host: "10.0.0.1", at: time.Hour + time.Minute, expected: 25},
+		{host: "10.0.0.1", at: 2 * time.Hour, expected: 0},
+	}
+
+	for i, tc := range testCases {
+		if used := q.used(tc.host, window, start.Add(tc.at)); used != tc.expected {
+			t.Errorf("Expected %d bytes, got %d (%d)", tc.expected, used, i)
+		}
+	}
+	if _, ok := q.clients["10.0.0.1"]; ok {
+		t.Error("Expected a client with no usage left to be forgotten")
+	}
+}
+
+func TestClientQuotaRefusesRequests(t *testing.T) {
+	backend := &MemoryBackend{}
+	backend.Store("kernel", make([]byte, 1500))
+	s := &Server{Backend: backend, ClientQuota: 2000}
+	addr, _ := startServer(t, s)
+
+	if _, err := getFile(t, addr, "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	// The first download is charged once it has finished
+	deadline := time.Now().Add(2 * time.Second)
+	for s.shared().quotas.used("127.0.0.1", s.quotaWindow(), time.Now()) < 1500 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the download to be charged to the client")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, err := getFile(t, addr, "kernel"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := getFile(t, addr, "kernel")
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected an access violation once over quota, got %v", err)
+	}
+	if err := putFile(t, addr, "upload", []byte("data")); err == nil {
+		t.Error("Expected uploads to be refused once over quota")
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// tokenBucket allows events at rate per second on average, with bursts of up
+// to burst at once. It is not safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// allow takes a token if one is available.
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.refill(now)
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// full reports whether the bucket would be full at now, meaning it holds
+// no state worth keeping.
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+}
+
+const (
+	// maxIPBuckets is how many per-IP buckets are kept, so a flood of
+	// spoofed sources can't grow them without bound.
+	maxIPBuckets = 1024
+	// bucketSweepInterval is how often, at most, full buckets are swept
+	// away once there are maxIPBuckets.
+	bucketSweepInterval = time.Second
+)
+
+// requestLimiter applies the server's global and per-IP request rates.
+type requestLimiter struct {
+	mu     sync.Mutex
+	global *tokenBucket
+	perIP  map[string]*tokenBucket
+	// swept is when full buckets were last swept away.
+	swept time.Time
+}
+
+// makeRoom frees a place for a new per-IP bucket if there are maxIPBuckets.
+// Full buckets, which hold no state worth keeping, are swept away at most
+// every bucketSweepInterval, so a flood doesn't pay for a sweep per
+// request; when none are, an arbitrary bucket is dropped. l.mu must be
+// held.
+func (l *requestLimiter) makeRoom(now time.Time) {
+	if len(l.perIP) < maxIPBuckets {
+		return
+	}
+	if now.Sub(l.swept) >= bucketSweepInterval {
+		l.swept = now
+		for h, b := range l.perIP {
+			if b.full(now) {
+				delete(l.perIP, h)
+			}
+		}
+	}
+	for h := range l.perIP {
+		if len(l.perIP) < maxIPBuckets {
+			break
+		}
+		delete(l.perIP, h)
+	}
+}
+
+// allowRequest reports whether a new request from addr is within the
+// configured rates.
+func (s *Server) allowRequest(addr net.Addr) bool {
+	if s.RequestRate <= 0 && s.RequestRatePerIP <= 0 {
+		return true
+	}
+	l := &s.limiter
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var ipBucket *tokenBucket
+	if s.RequestRatePerIP > 0 {
+		host := common.HostOf(addr)
+		ipBucket = l.perIP[host]
+		if ipBucket == nil {
+			if l.perIP == nil {
+				l.perIP = make(map[string]*tokenBucket)
+			}
+			l.makeRoom(now)
+			ipBucket = newTokenBucket(s.RequestRatePerIP, s.RequestBurst, now)
+			l.perIP[host] = ipBucket
+		}
+		if !ipBucket.allow(now) {
+			return false
+		}
+	}
+	if s.RequestRate > 0 {
+		if l.global == nil {
+			l.global = newTokenBucket(s.RequestRate, s.RequestBurst, now)
+		}
+		if !l.global.allow(now) {
+			if ipBucket != nil {
+				// Give back the client's token, it wasn't its fault
+				ipBucket.tokens++
+			}
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Now()
+	b := newTokenBucket(2, 3, start)
+
+	testCases := []struct {
+		after   time.Duration
+		allowed bool
+	}{
+		// The burst is available straight away
+		{after: 0, allowed: true},
+		{after: 0, allowed: true},
+		{after: 0, allowed: true},
+		{after: 0, allowed: false},
+		// Then tokens come back at the rate
+		{after: 250 * time.Millisecond, allowed: false},
+		{after: 500 * time.Millisecond, allowed: true},
+		{after: 500 * time.Millisecond, allowed: false},
+		// But never more than the burst
+		{after: 10 * time.Second, allowed: true},
+		{after: 10 * time.Second, allowed: true},
+		{after: 10 * time.Second, allowed: true},
+		{after: 10 * time.Second, allowed: false},
+	}
+
+	for i, tc := range testCases {
+		if got := b.allow(start.Add(tc.after)); got != tc.allowed {
+			t.Errorf("Expected allowed = %v (%d)", tc.allowed, i)
+		}
+	}
+}
+
+func TestAllowRequest(t *testing.T) {
+	a := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	aOtherPort := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 2000}
+	b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1000}
+	c := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 3), Port: 1000}
+
+	// Rates low enough that no tokens come back during the test
+	s := &Server{RequestRate: 0.001, RequestRatePerIP: 0.001, RequestBurst: 2}
+	testCases := []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{addr: a, allowed: true},
+		{addr: aOtherPort, allowed: true},
+		// a has used its burst
+		{addr: a, allowed: false},
+		// as has everyone together, but b keeps its token for later
+		{addr: b, allowed: false},
+		{addr: c, allowed: false},
+	}
+	for i, tc := range testCases {
+		if got := s.allowRequest(tc.addr); got != tc.allowed {
+			t.Errorf("Expected allowed = %v for %v (%d)", tc.allowed, tc.addr, i)
+		}
+	}
+	if tokens := s.limiter.perIP["10.0.0.2"].tokens; tokens != 2 {
+		t.Errorf("Expected b's tokens to be returned, has %v", tokens)
+	}
+}
+
+func TestHandleHandshakeRateLimited(t *testing.T) {
+	packet := common.RequestPacket{OpCode: common.OpRRQ, Filename: "f", Mode: common.ModeOctet}
+	s := &Server{RequestRatePerIP: 0.001, RejectRateLimited: true, handlers: map[common.OpCode]requestHandler{
+		common.OpRRQ: requestHandlerFunc(func(conn net.PacketConn, req *Request) {}),
+	}}
+
+	for i, limited := range []bool{false, true} {
+		conn := &mockPacketConn{data: bytes.NewBuffer(packet.ToBytes()), addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 69}}
+		err := s.handleHandshake(conn)
+		if !limited {
+			if err != nil {
+				t.Errorf("%v (%d)", err, i)
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("Expected request to be rate limited (%d)", i)
+		}
+		e, err := common.ParseErrorPacket(conn.data.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Code != common.ErrNotDefined {
+			t.Errorf("Unexpected error sent: %v", e)
+		}
+	}
+}
+
+func TestRequestLimiterBounded(t *testing.T) {
+	// A flood from spoofed sources, whose buckets never refill in time to
+	// be swept
+	s := &Server{RequestRatePerIP: 0.001}
+	for i := 0; i < 3*maxIPBuckets; i++ {
+		addr := &net.UDPAddr{IP: net.IPv4(10, byte(i>>16), byte(i>>8), byte(i)), Port: 69}
+		if !s.allowRequest(addr) {
+			t.Fatalf("Expected the first request from %v to be allowed", addr)
+		}
+		if n := len(s.limiter.perIP); n > maxIPBuckets {
+			t.Fatalf("Expected at most %d buckets, got %d", maxIPBuckets, n)
+		}
+	}
+
+	// Full buckets are swept away, but only every bucketSweepInterval
+	now := time.Now()
+	l := &requestLimiter{perIP: make(map[string]*tokenBucket), swept: now}
+	fill := func() (used int) {
+		for i := 0; len(l.perIP) < maxIPBuckets; i++ {
+			b := newTokenBucket(0.001, 1, now)
+			if i%2 == 0 {
+				b.tokens = 0
+			}
+			l.perIP[strconv.Itoa(len(l.perIP))+"/"+strconv.Itoa(i)] = b
+		}
+		for _, b := range l.perIP {
+			if !b.full(now) {
+				used++
+			}
+		}
+		return used
+	}
+	fill()
+	l.makeRoom(now.Add(time.Millisecond))
+	if got := len(l.perIP); got != maxIPBuckets-1 {
+		t.Errorf("Expected one bucket dropped between sweeps, got %d", got)
+	}
+	used := fill()
+	l.makeRoom(now.Add(bucketSweepInterval))
+	if got := len(l.perIP); got != used {
+		t.Errorf("Expected the %d buckets in use to be kept, got %d", used, got)
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strings"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// maxRemapRestarts bounds how often the s flag may restart the rules for one
+// request, so a bad rule set can't loop forever.
+const maxRemapRestarts = 20
+
+var errRemapAbort = &common.Error{Code: common.ErrAccessViolation, Message: "Access violation"}
+
+// A RemapRule rewrites requested filenames, in the style of tftpd-hpa's
+// remap rules. Rules are usually parsed from a file, see ParseRemapRules.
+type RemapRule struct {
+	Pattern *regexp.Regexp
+	// Replacement replaces the match when Rewrite is set. \0 to \9 are the
+	// whole match and its subexpressions, \i the client's IP, \x the
+	// client's IPv4 address in hex and \\ a backslash.
+	Replacement string
+
+	Rewrite   bool // r: replace the match with Replacement
+	Global    bool // g: replace every match, not just the first
+	Lower     bool // l: lower case the whole filename
+	End       bool // e: stop processing rules
+	Restart   bool // s: start again from the first rule
+	Abort     bool // a: refuse the request
+	Invert    bool // ~: the rule applies when the pattern doesn't match
+	ReadOnly  bool // G: only apply to reads
+	WriteOnly bool // P: only apply to writes
+}
+
+// ParseRemapRules reads remap rules, one per line, in the tftpd-hpa format:
+//
+//	flags regex [replacement]
+//
+// Blank lines and lines starting with # are ignored. The flags are those of
+// RemapRule plus i for a case insensitive match; "-" means no flags. For
+// example, to serve DOS style paths from upper case firmware:
+//
+//	rg  \\  /
+//	l   .
+func ParseRemapRules(r io.Reader) ([]RemapRule, error) {
+	var rules []RemapRule
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("Remap rule on line %d has too many fields", line)
+		}
+		rule, err := parseRemapRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid remap rule on line %d: %v", line, err)
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading remap rules: %v", err)
+	}
+	return rules, nil
+}
+
+func parseRemapRule(fields []string) (RemapRule, error) {
+	var rule RemapRule
+	if len(fields) < 2 {
+		return rule, fmt.Errorf("missing regex")
+	}
+	pattern := fields[1]
+	for _, flag := range fields[0] {
+		switch flag {
+		case '-':
+		case 'r':
+			rule.Rewrite = true
+		case 'g':
+			rule.Global = true
+		case 'i':
+			pattern = "(?i)" + pattern
+		case 'l':
+			rule.Lower = true
+		case 'e':
+			rule.End = true
+		case 's':
+			rule.Restart = true
+		case 'a':
+			rule.Abort = true
+		case '~':
+			rule.Invert = true
+		case 'G':
+			rule.ReadOnly = true
+		case 'P':
+			rule.WriteOnly = true
+		default:
+			return rule, fmt.Errorf("unknown flag %q", flag)
+		}
+	}
+	if rule.Rewrite {
+		if len(fields) < 3 {
+			return rule, fmt.Errorf("missing replacement")
+		}
+		rule.Replacement = fields[2]
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return rule, err
+	}
+	rule.Pattern = re
+	return rule, nil
+}
+
+// remap rewrites a requested filename with the server's remap rules.
+func (s *Server) remap(op common.OpCode, name string, client net.Addr) (string, error) {
+	restarts := 0
+	for i := 0; i < len(s.Remap); i++ {
+		rule := &s.Remap[i]
+		if rule.ReadOnly && op != common.OpRRQ || rule.WriteOnly && op != common.OpWRQ {
+			continue
+		}
+		matched := rule.Pattern.MatchString(name)
+		if matched == rule.Invert {
+			continue
+		}
+		if rule.Rewrite && matched {
+			name = rule.rewrite(name, client)
+		}
+		if rule.Lower {
+			name = strings.ToLower(name)
+		}
+		if rule.Abort {
+			return "", errRemapAbort
+		}
+		if rule.End {
+			break
+		}
+		if rule.Restart {
+			restarts++
+			if restarts > maxRemapRestarts {
+				return "", fmt.Errorf("Remap rules restarted more than %d times", maxRemapRestarts)
+			}
+			i = -1
+		}
+	}
+	return name, nil
+}
+
+// rewrite replaces the first match of the rule's pattern in name, or every
+// match if the rule is global.
+func (rule *RemapRule) rewrite(name string, client net.Addr) string {
+	var b strings.Builder
+	last := 0
+	for _, m := range rule.Pattern.FindAllStringSubmatchIndex(name, -1) {
+		b.WriteString(name[last:m[0]])
+		b.WriteString(expandRemap(rule.Replacement, name, m, client))
+		last = m[1]
+		if !rule.Global {
+			break
+		}
+	}
+	b.WriteString(name[last:])
+	return b.String()
+}
+
+// expandRemap expands the escapes in a replacement for the match m of name.
+func expandRemap(replacement, name string, m []int, client net.Addr) string {
+	var b strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		if c != '\\' || i == len(replacement)-1 {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch c = replacement[i]; {
+		case '0' <= c && c <= '9':
+			if n := int(c-'0') * 2; n+1 < len(m) && m[n] >= 0 {
+				b.WriteString(name[m[n]:m[n+1]])
+			}
+		case c == 'i':
+			b.WriteString(common.HostOf(client))
+		case c == 'x':
+			if ip, ok := addrIP(client); ok && ip.Is4() {
+				a := ip.As4()
+				fmt.Fprintf(&b, "%02X%02X%02X%02X", a[0], a[1], a[2], a[3])
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
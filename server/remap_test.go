@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestRemap(t *testing.T) {
+	rules, err := ParseRemapRules(strings.NewReader(`
+# DOS style paths from legacy firmware
+rg   \\                /
+ri   ^PXELINUX\.0$     pxelinux.0
+a    ^secret/
+rP   ^(.*)$            uploads/\i/\1
+re   ^hosts/host$      hosts/\x.cfg
+r    ^hosts/           never/
+l    ^BOOT/
+~a   ^[a-z0-9./_-]+$
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Remap: rules}
+	client := &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 2000}
+
+	testCases := []struct {
+		op       common.OpCode
+		filename string
+		expected string
+		err      error
+	}{
+		{op: common.OpRRQ, filename: `BOOT\X86\KERNEL`, expected: "boot/x86/kernel"},
+		{op: common.OpRRQ, filename: "PXELinux.0", expected: "pxelinux.0"},
+		{op: common.OpRRQ, filename: "secret/key", err: errRemapAbort},
+		{op: common.OpWRQ, filename: "log.txt", expected: "uploads/10.1.2.3/log.txt"},
+		{op: common.OpRRQ, filename: "hosts/host", expected: "hosts/0A010203.cfg"},
+		{op: common.OpRRQ, filename: "Mixed", err: errRemapAbort},
+	}
+	for i, tc := range testCases {
+		got, err := s.remap(tc.op, tc.filename, client)
+		if err != tc.err {
+			t.Errorf("Expected %v, got %v (%d)", tc.err, err, i)
+			continue
+		}
+		if err == nil && got != tc.expected {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestRemapRestartLimit(t *testing.T) {
+	rules, err := ParseRemapRules(strings.NewReader("s ^loop$"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Remap: rules}
+	if _, err := s.remap(common.OpRRQ, "loop", nil); err == nil {
+		t.Error("Expected endless restarts to be refused")
+	}
+}
+
+func TestRemapBeforeFilenameCheck(t *testing.T) {
+	rules, err := ParseRemapRules(strings.NewReader(`rg \\ /
+r ^/ ./
+r ^evil$ ../secret`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Remap: rules, ReadHandler: namedHandler("kernel")}
+	addr, _ := startServer(t, s)
+
+	if got, err := getFile(t, addr, `\BOOT\KERNEL`); err != nil || string(got) != "kernel" {
+		t.Errorf("Expected the DOS style path to be served, got %q, %v", got, err)
+	}
+}
+
+func TestParseRemapRulesErrors(t *testing.T) {
+	for i, rules := range []string{"r ^a$", "x ^a$ b", "r ( b", "r", "r a b c"} {
+		if _, err := ParseRemapRules(strings.NewReader(rules)); err == nil {
+			t.Errorf("Expected an error for %q (%d)", rules, i)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// Request is a parsed RRQ or WRQ along with everything learned about it while
+// it is being served.
+type Request struct {
+	// ID identifies the request in every log line, hook and record of its
+	// transfer, so those of concurrent transfers can be told apart. It is
+	// random, so also distinguishes transfers across restarts.
+	ID       string
+	OpCode   common.OpCode
+	Filename string
+	Mode     string
+	// Options holds the options the client appended to the request (RFC
+	// 2347), keyed by lower case name. The server doesn't acknowledge them.
+	Options    map[string]string
+	RemoteAddr net.Addr
+	// LocalAddr is the address the client sent the request to, when known.
+	// Behind a transparent proxy this is the original destination.
+	LocalAddr net.Addr
+	// Metadata is attached by request filters and carried through to every
+	// log line and hook for the transfer.
+	Metadata *Metadata
+
+	// priority ranks the transfer against others for a slot or bandwidth
+	priority Priority
+
+	// ctx is cancelled with a cause when the transfer ends or is cut short
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+
+	// resumeFrom is the offset the client asked to resume an upload from,
+	// if the server allows it. A handler able to resume sets resumedAt to
+	// where it will carry on from.
+	resumeFrom int64
+	resumedAt  int64
+}
+
+func newRequest(packet *common.RequestPacket, remoteAddr net.Addr) *Request {
+	return &Request{
+		ID:         newRequestID(),
+		OpCode:     packet.OpCode,
+		Filename:   packet.Filename,
+		Mode:       packet.Mode,
+		Options:    packet.Options,
+		RemoteAddr: remoteAddr,
+		Metadata:   &Metadata{},
+	}
+}
+
+// newRequestID returns a short random request ID.
+func newRequestID() string {
+	var b [4]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestContextKey is the context key for the Request a context belongs
+// to.
+type requestContextKey struct{}
+
+// Context returns the request's context. It is cancelled once the transfer
+// ends, including when it is cancelled through the admin API or cut short
+// by Close or Shutdown, and has a deadline if Server.MaxTransferDuration is
+// set. Handlers and backends pass it on to calls that may block, such as
+// fetches from remote storage. context.Cause tells why it ended.
+func (r *Request) Context() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// RequestFromContext returns the Request a context was made for, giving
+// code handed only the context, such as a ContextBackend, the client's
+// address and the request ID.
+func RequestFromContext(ctx context.Context) (*Request, bool) {
+	r, ok := ctx.Value(requestContextKey{}).(*Request)
+	return r, ok
+}
+
+// startContext gives req its context, from the handshake on.
+func (s *Server) startContext(req *Request) {
+	ctx, cancel := context.WithCancelCause(context.WithValue(context.Background(), requestContextKey{}, req))
+	req.ctx, req.cancel = ctx, cancel
+	if s.MaxTransferDuration > 0 {
+		var stop context.CancelFunc
+		req.ctx, stop = context.WithTimeoutCause(ctx, s.MaxTransferDuration, errTransferTooLong)
+		req.cancel = func(cause error) {
+			cancel(cause)
+			stop()
+		}
+	}
+}
+
+// end cancels req's context with cause, or context.Canceled if nil.
+func (r *Request) end(cause error) {
+	if r.cancel != nil {
+		r.cancel(cause)
+	}
+}
+
+// TransferSize returns the size of an upload as announced by the client's
+// tsize option (RFC 2349), if it sent one. In a download request tsize asks
+// for the file's size instead, so it is never reported for those.
+func (r *Request) TransferSize() (int64, bool) {
+	v, ok := r.Options["tsize"]
+	if !ok || r.OpCode != common.OpWRQ {
+		return 0, false
+	}
+	size, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || size < 0 {
+		return 0, false
+	}
+	return size, true
+}
+
+// resumeOption is the nonstandard option a client sends with a WRQ to carry
+// on from a byte offset into an upload kept from an earlier attempt.
+const resumeOption = "offset"
+
+// resumeOffset returns the offset requested with resumeOption, if any.
+func (r *Request) resumeOffset() (int64, bool) {
+	v, ok := r.Options[resumeOption]
+	if !ok || r.OpCode != common.OpWRQ {
+		return 0, false
+	}
+	offset, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || offset <= 0 {
+		return 0, false
+	}
+	return offset, true
+}
+
+// rolloverOption is sent by some PXE ROMs to choose whether the block
+// counter wraps to 0 or 1 after block 65535.
+const rolloverOption = "rollover"
+
+// rollover returns the block number req asked to follow 65535, if it asked
+// for one the server supports.
+func (r *Request) rollover() (uint16, bool) {
+	switch r.Options[rolloverOption] {
+	case "0":
+		return 0, true
+	case "1":
+		return 1, true
+	}
+	return 0, false
+}
+
+// timeoutOption asks for a retransmission timeout in seconds (RFC 2349),
+// and the nonstandard utimeout option of tftpd-hpa for one in microseconds.
+const (
+	timeoutOption  = "timeout"
+	utimeoutOption = "utimeout"
+)
+
+// retransmitTimeout returns the retransmission timeout req asked for, along
+// with the option it asked with: utimeout if it sent a valid one, otherwise
+// timeout. The ranges accepted are those of tftpd-hpa.
+func (r *Request) retransmitTimeout() (time.Duration, string, bool) {
+	if v, err := strconv.ParseInt(r.Options[utimeoutOption], 10, 64); err == nil && v >= 10000 && v <= 255000000 {
+		return time.Duration(v) * time.Microsecond, utimeoutOption, true
+	}
+	if v, err := strconv.ParseInt(r.Options[timeoutOption], 10, 64); err == nil && v >= 1 && v <= 255 {
+		return time.Duration(v) * time.Second, timeoutOption, true
+	}
+	return 0, "", false
+}
+
+// Metadata is a set of key/value pairs describing a transfer, such as a
+// resolved hostname or an asset tag. It is safe for concurrent use.
+type Metadata struct {
+	mu     sync.RWMutex
+	values map[string]string
+}
+
+// Set stores value under key, replacing any previous value.
+func (m *Metadata) Set(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.values == nil {
+		m.values = make(map[string]string)
+	}
+	m.values[key] = value
+}
+
+// Get returns the value stored under key, if any.
+func (m *Metadata) Get(key string) (string, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	value, ok := m.values[key]
+	return value, ok
+}
+
+// All returns a copy of every key/value pair.
+func (m *Metadata) All() map[string]string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	values := make(map[string]string, len(m.values))
+	for k, v := range m.values {
+		values[k] = v
+	}
+	return values
+}
+
+// String renders the metadata as space separated key=value pairs sorted by
+// key, or the empty string if there is none.
+func (m *Metadata) String() string {
+	values := m.All()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%s=%q", k, values[k])
+	}
+	return strings.Join(parts, " ")
+}
+
+// A RequestFilter runs before a request is handed to its handler. It may
+// annotate the request's Metadata, or reject it by returning an error. A
+// *common.Error is sent to the client as is, anything else as ERROR 0.
+type RequestFilter func(req *Request) error
+
+func (s *Server) runFilters(req *Request) error {
+	for _, filter := range s.Filters {
+		if err := filter(req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logSuffix returns the ID and metadata formatted for the end of a log line.
+func (r *Request) logSuffix() string {
+	if md := r.Metadata.String(); md != "" {
+		return " [request_id=" + r.ID + " " + md + "]"
+	}
+	return " [request_id=" + r.ID + "]"
+}
+
+// logger returns the server's logger.
+func (s *Server) logger() *slog.Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+	return slog.Default()
+}
+
+// requestLogger returns a logger adding the request's ID, client, the
+// client's name if resolved, file, opcode and metadata to every record.
+func (s *Server) requestLogger(r *Request) *slog.Logger {
+	logger := s.logger().With(
+		"request_id", r.ID,
+		"client", r.RemoteAddr.String(),
+		"file", r.Filename,
+		"op", r.OpCode.String(),
+	)
+	if name := s.clientHostname(r.RemoteAddr); name != "" {
+		logger = logger.With("client_name", name)
+	}
+	if md := r.Metadata.All(); len(md) > 0 {
+		logger = logger.With(metadataGroup(md))
+	}
+	return logger
+}
+
+// metadataGroup returns metadata as a "meta" log group, sorted by key.
+func metadataGroup(md map[string]string) slog.Attr {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	attrs := make([]any, 0, len(keys))
+	for _, k := range keys {
+		attrs = append(attrs, slog.String(k, md[k]))
+	}
+	return slog.Group("meta", attrs...)
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestMetadata(t *testing.T) {
+	md := &Metadata{}
+	if md.String() != "" {
+		t.Errorf("Expected empty metadata to render as empty string, got %q", md.String())
+	}
+
+	md.Set("host", "node1.example.com")
+	md.Set("asset", "A-100")
+	md.Set("asset", "A-101")
+
+	if v, ok := md.Get("asset"); !ok || v != "A-101" {
+		t.Errorf("Expected asset A-101, got %q", v)
+	}
+	if _, ok := md.Get("missing"); ok {
+		t.Error("Didn't expect missing key to be found")
+	}
+	expected := `asset="A-101" host="node1.example.com"`
+	if md.String() != expected {
+		t.Errorf("Expected %s, got %s", expected, md.String())
+	}
+}
+
+func TestTransferSize(t *testing.T) {
+	testCases := []struct {
+		op       common.OpCode
+		options  map[string]string
+		expected int64
+		ok       bool
+	}{
+		{op: common.OpWRQ, options: nil},
+		{op: common.OpWRQ, options: map[string]string{"tsize": "1048576"}, expected: 1048576, ok: true},
+		{op: common.OpWRQ, options: map[string]string{"tsize": "0"}, expected: 0, ok: true},
+		{op: common.OpWRQ, options: map[string]string{"tsize": "-1"}},
+		{op: common.OpWRQ, options: map[string]string{"tsize": "big"}},
+		{op: common.OpRRQ, options: map[string]string{"tsize": "0"}},
+	}
+
+	for i, tc := range testCases {
+		req := &Request{OpCode: tc.op, Options: tc.options}
+		size, ok := req.TransferSize()
+		if size != tc.expected || ok != tc.ok {
+			t.Errorf("Expected %d, %v, got %d, %v (%d)", tc.expected, tc.ok, size, ok, i)
+		}
+	}
+}
+
+func TestRetransmitTimeoutOptions(t *testing.T) {
+	testCases := []struct {
+		options  map[string]string
+		expected time.Duration
+		option   string
+		ok       bool
+	}{
+		{options: nil},
+		{options: map[string]string{"timeout": "3"}, expected: 3 * time.Second, option: "timeout", ok: true},
+		{options: map[string]string{"timeout": "0"}},
+		{options: map[string]string{"timeout": "256"}},
+		{options: map[string]string{"utimeout": "50000"}, expected: 50 * time.Millisecond, option: "utimeout", ok: true},
+		{options: map[string]string{"utimeout": "50000", "timeout": "3"}, expected: 50 * time.Millisecond, option: "utimeout", ok: true},
+		// An invalid utimeout falls back to timeout
+		{options: map[string]string{"utimeout": "5", "timeout": "3"}, expected: 3 * time.Second, option: "timeout", ok: true},
+		{options: map[string]string{"utimeout": "fast"}},
+	}
+
+	for i, tc := range testCases {
+		req := &Request{OpCode: common.OpRRQ, Options: tc.options}
+		timeout, option, ok := req.retransmitTimeout()
+		if timeout != tc.expected || option != tc.option || ok != tc.ok {
+			t.Errorf("Expected %v, %q, %v, got %v, %q, %v (%d)", tc.expected, tc.option, tc.ok, timeout, option, ok, i)
+		}
+	}
+}
+
+func TestRequestFilters(t *testing.T) {
+	replyChan := make(chan struct{})
+	handler := &mockHandler{replyChan: replyChan}
+	s := &Server{
+		handlers: map[common.OpCode]requestHandler{common.OpRRQ: handler},
+	}
+
+	s.Filters = []RequestFilter{
+		func(req *Request) error {
+			req.Metadata.Set("asset", "A-100")
+			return nil
+		},
+		func(req *Request) error {
+			if req.Filename == "secret" {
+				return &common.Error{Code: common.ErrAccessViolation, Message: "Denied"}
+			}
+			return nil
+		},
+	}
+
+	conn := &mockPacketConn{data: bytes.NewBuffer(sampleRRQ()), addr: mockAddr{}}
+	if err := s.handleHandshake(conn); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-replyChan:
+	case <-time.After(time.Second):
+		t.Fatal("Handler not called")
+	}
+	if v, _ := handler.lastReq.Metadata.Get("asset"); v != "A-100" {
+		t.Errorf("Expected metadata to reach the handler, got %q", v)
+	}
+
+	rejected := common.RequestPacket{OpCode: common.OpRRQ, Filename: "secret", Mode: "octet"}
+	conn = &mockPacketConn{data: bytes.NewBuffer(rejected.ToBytes()), addr: mockAddr{}}
+	if err := s.handleHandshake(conn); err == nil {
+		t.Fatal("Expected request to be rejected")
+	}
+	e, err := common.ParseErrorPacket(conn.data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected ERROR %d to be sent, got %v", common.ErrAccessViolation, e)
+	}
+
+	s.Filters = []RequestFilter{
+		func(req *Request) error { return fmt.Errorf("Lookup failed") },
+	}
+	conn = &mockPacketConn{data: bytes.NewBuffer(sampleRRQ()), addr: mockAddr{}}
+	s.handleHandshake(conn)
+	if e, _ := common.ParseErrorPacket(conn.data.Bytes()); e == nil || e.Code != common.ErrNotDefined {
+		t.Errorf("Expected plain errors to be sent as ERROR 0, got %v", e)
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Server{Logger: slog.New(slog.NewTextHandler(&buf, nil))}
+	r := &Request{
+		ID:         "1f2e3d4c",
+		OpCode:     common.OpRRQ,
+		Filename:   "pxelinux.0",
+		RemoteAddr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 2070},
+		Metadata:   &Metadata{},
+	}
+	r.Metadata.Set("rack", "r12")
+	r.Metadata.Set("asset", "A-1")
+
+	s.requestLogger(r).Info("Handling RRQ")
+	expected := `msg="Handling RRQ" request_id=1f2e3d4c client=10.0.0.7:2070 file=pxelinux.0 op=RRQ meta.asset=A-1 meta.rack=r12`
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("Expected log to contain %s, got %s", expected, buf.String())
+	}
+}
+
+func TestRequestContext(t *testing.T) {
+	contexts := make(chan context.Context, 1)
+	handler := ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+		ctx := req.Context()
+		if got, ok := RequestFromContext(ctx); !ok || got != req {
+			t.Errorf("Expected the request from its context, got %v", got)
+		}
+		if ctx.Err() != nil {
+			t.Errorf("Expected a live context, got %v", ctx.Err())
+		}
+		contexts <- ctx
+		return io.NopCloser(strings.NewReader("kernel")), 6, nil
+	})
+	s := &Server{ReadHandler: handler, MaxTransferDuration: time.Minute}
+	addr, _ := startServer(t, s)
+
+	if _, err := getFile(t, addr, "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	ctx := <-contexts
+	if deadline, ok := ctx.Deadline(); !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("Expected a deadline within a minute, got %v", deadline)
+	}
+	select {
+	case <-ctx.Done():
+		if cause := context.Cause(ctx); cause != context.Canceled {
+			t.Errorf("Expected %v, got %v", context.Canceled, cause)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Context wasn't cancelled once the transfer ended")
+	}
+}
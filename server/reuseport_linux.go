@@ -0,0 +1,26 @@
+package server
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// Not defined by package syscall
+const soReusePort = 0xf
+
+// reusePortControl sets SO_REUSEPORT on a socket before it is bound, so
+// several sockets can share an address with the kernel spreading incoming
+// packets across them.
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("Error setting SO_REUSEPORT: %v", sockErr)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestListenAndServeReusePort(t *testing.T) {
+	s := &Server{Addr: "127.0.0.1:0", ReusePort: 4, ReadHandler: namedHandler("shared")}
+	done := make(chan error, 1)
+	go func() { done <- s.ListenAndServe() }()
+
+	var addrs []net.Addr
+	for deadline := time.Now().Add(2 * time.Second); len(addrs) < 4; {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected 4 listeners, got %d", len(addrs))
+		}
+		time.Sleep(10 * time.Millisecond)
+		addrs = addrs[:0]
+		s.mu.Lock()
+		for conn := range s.listeners {
+			addrs = append(addrs, conn.LocalAddr())
+		}
+		s.mu.Unlock()
+	}
+	for i, addr := range addrs {
+		if addr.String() != addrs[0].String() {
+			t.Errorf("Expected every listener on %v, got %v (%d)", addrs[0], addr, i)
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		got, err := getFile(t, addrs[0], "kernel")
+		if err != nil {
+			t.Fatalf("%v (%d)", err, i)
+		}
+		if string(got) != "shared" {
+			t.Errorf("Expected %q, got %q (%d)", "shared", got, i)
+		}
+	}
+
+	s.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ListenAndServe didn't return after Close")
+	}
+}
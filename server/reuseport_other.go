@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errReusePortUnsupported = errors.New("Multiple listeners are only supported on Linux")
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	return errReusePortUnsupported
+}
@@ -0,0 +1,198 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// emptyPayloadHash is the SHA-256 of an empty request body.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+var errReadOnlyBackend = &common.Error{Code: common.ErrAccessViolation, Message: "Uploads are not supported"}
+
+// S3Backend is a read only Backend serving objects from an S3 compatible
+// bucket, so boot files can live in object storage. Objects are addressed
+// path style, <Endpoint>/<Bucket>/<Prefix><name>, which S3 compatible
+// stores such as MinIO also accept. Requests are signed with AWS Signature
+// Version 4 when AccessKey is set and anonymous otherwise.
+type S3Backend struct {
+	// Endpoint is the base URL of the store, for example
+	// https://s3.eu-west-1.amazonaws.com.
+	Endpoint string
+	Bucket   string
+	// Prefix is prepended to every requested name, for example "tftp/".
+	Prefix string
+	// Region is used when signing requests, us-east-1 if empty.
+	Region string
+
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	// Client makes the requests, http.DefaultClient if nil.
+	Client *http.Client
+}
+
+func (b *S3Backend) Open(name string) (io.ReadCloser, int64, error) {
+	return b.OpenContext(context.Background(), name)
+}
+
+// OpenContext fetches name with a request that is abandoned, along with
+// reading its body, once ctx is done.
+func (b *S3Backend) OpenContext(ctx context.Context, name string) (io.ReadCloser, int64, error) {
+	resp, err := b.do(ctx, http.MethodGet, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	return resp.Body, resp.ContentLength, nil
+}
+
+func (b *S3Backend) Stat(name string) (fs.FileInfo, error) {
+	resp, err := b.do(context.Background(), http.MethodHead, name)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return memoryFileInfo{name: path.Base(name), size: resp.ContentLength, modTime: modTime}, nil
+}
+
+// Create always fails, the backend is read only.
+func (b *S3Backend) Create(name string) (io.WriteCloser, error) {
+	return nil, errReadOnlyBackend
+}
+
+// do sends a signed request for the object holding name, returning the
+// response if it succeeded.
+func (b *S3Backend) do(ctx context.Context, method, name string) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(b.Endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 endpoint: %v", err)
+	}
+	u.Path += "/" + b.Bucket + "/" + b.Prefix + name
+	// Send the path escaped exactly as it is signed
+	u.RawPath = s3EscapePath(u.Path)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if b.AccessKey != "" {
+		b.sign(req, time.Now())
+	}
+
+	client := b.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	resp.Body.Close()
+	op := "open"
+	if method == http.MethodHead {
+		op = "stat"
+	}
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	case http.StatusForbidden:
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return nil, fmt.Errorf("Unexpected S3 response for %s: %s", name, resp.Status)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, which
+// must have no body. Every header already set on req is signed.
+func (b *S3Backend) sign(req *http.Request, now time.Time) {
+	region := b.Region
+	if region == "" {
+		region = "us-east-1"
+	}
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+	if b.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", b.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		emptyPayloadHash,
+	}, "\n")
+
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hexSHA256(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+b.SecretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		b.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3EscapePath escapes every byte of p except unreserved characters and
+// slashes, as Signature Version 4 requires.
+func s3EscapePath(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "%%%02X", c)
+	}
+	return b.String()
+}
+
+func hexSHA256(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
@@ -1,187 +1,1552 @@
-package main
+// Package server implements a TFTP server (RFC 1350) that can be embedded in
+// other programs. See cmd/tftpd for a standalone daemon.
+package server
 
 import (
 	"bufio"
-	"flag"
+	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
 	"net"
+	"net/netip"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ryanslade/tftp/common"
 )
 
-// Flags
-var (
-	port int
-)
+// ErrServerClosed is returned by Serve and ListenAndServe after a call to
+// Shutdown or Close.
+var ErrServerClosed = errors.New("tftp: Server closed")
+
+// A Server defines parameters for running a TFTP server. The zero value is a
+// valid configuration serving the working directory on port 69.
+type Server struct {
+	// Addr is the UDP address to listen on, ":69" if empty.
+	Addr string
+
+	// ReadTimeout is how long a transfer waits for each packet from the
+	// peer before it is abandoned. Zero means wait forever.
+	ReadTimeout time.Duration
+	// WriteTimeout bounds sending each packet of a transfer. Zero means no
+	// timeout.
+	WriteTimeout time.Duration
+	// IdleTimeout abandons a transfer when nothing has been received from
+	// its peer for this long. Unlike ReadTimeout, packets from anyone else
+	// don't count as activity. Zero means no idle timeout.
+	IdleTimeout time.Duration
+	// MaxTransferDuration is the longest a transfer may run, however
+	// steadily it progresses, before the peer is sent an ERROR and it is
+	// abandoned, so a pathologically slow client can't hold on to a socket
+	// and an open file for hours. Zero means no limit.
+	MaxTransferDuration time.Duration
+
+	// RetransmitTimeout, if non-zero, is how long a transfer waits for the
+	// peer's reply before sending its last DATA or ACK again, up to Retries
+	// times before giving up. The wait doubles with every resend of the
+	// same packet, up to MaxBlockTimeout. Slow serial-backed clients want
+	// long waits, datacenter netboots short ones. Without it transfers
+	// never resend, waiting as long as ReadTimeout allows. Clients may ask
+	// for a wait of their own with the timeout option (RFC 2349), in
+	// seconds, or the finer grained utimeout, in microseconds, as
+	// tftpd-hpa supports; Retries defaults to defaultRetries for them.
+	RetransmitTimeout time.Duration
+	Retries           int
+	MaxBlockTimeout   time.Duration
+
+	// Root is the directory files are served from and uploaded to when
+	// ReadHandler or WriteHandler aren't set, the working directory if
+	// empty. Requests can't reach files outside it, even through a
+	// symlink.
+	Root string
+
+	// UploadRoot is the directory uploads are stored in when WriteHandler
+	// isn't set, Root if empty.
+	UploadRoot string
+	// UploadOnly makes the server a drop box, accepting uploads but
+	// refusing every read request with an access violation.
+	UploadOnly bool
+	// Honeypot serves nothing, for spotting rogue PXE clients and scanners
+	// on networks that shouldn't see TFTP at all. Every request passing
+	// the address rules is logged in full, with its mode and options, and
+	// refused with HoneypotError, File not found if nil.
+	Honeypot      bool
+	HoneypotError *common.Error
+	// Overwrite decides what happens when an upload names an existing
+	// file, when WriteHandler isn't set.
+	Overwrite OverwritePolicy
+	// CreateDirs creates missing parent directories of uploads, when
+	// WriteHandler isn't set.
+	CreateDirs bool
+	// UploadPerm and UploadOwner, if set, are the mode and owner given to
+	// uploaded files when WriteHandler isn't set. See UploadDir.
+	UploadPerm  os.FileMode
+	UploadOwner *FileOwner
+	// MinFreeSpace, if non-zero, refuses uploads to UploadRoot with Disk
+	// full while its file system has fewer bytes than this free, counting
+	// the size announced with tsize. See UploadDir.
+	MinFreeSpace int64
+	// NoSymlinks refuses requests for paths through a symlink under Root or
+	// UploadRoot, even one pointing inside them, with an access violation.
+	NoSymlinks bool
+	// KeepPartialUploads keeps what arrived of a failed upload to disk
+	// under its name with a .partial suffix, rather than deleting it.
+	// Uploads to other handlers are discarded either way.
+	KeepPartialUploads bool
+	// ResumableUploads lets a client carry on with an interrupted upload
+	// to disk by sending a WRQ with the nonstandard option "offset", the
+	// number of bytes it believes arrived. If a partial file of the upload
+	// was kept the server truncates it to at most that offset and answers
+	// with an OACK of the offset it continues from, after which the first
+	// DATA block holds the byte at that offset. Otherwise the option is
+	// ignored and the upload starts afresh. Partial files are kept as if
+	// KeepPartialUploads were set. Uploads aren't resumed when there are
+	// UploadValidators, which must see the whole file.
+	ResumableUploads bool
+
+	// ConcurrentUploads decides what happens to an upload of a file another
+	// client is still uploading, by default refusing it.
+	ConcurrentUploads UploadConflictPolicy
+
+	// OctetOnly refuses netascii and mail mode requests with an illegal
+	// operation error, for deployments only serving binary images.
+	OctetOnly bool
+
+	// DenyFiles are path.Match patterns of files that are never read or
+	// written, such as "*.key" or "secrets/*". A pattern without a slash is
+	// matched against each element of the requested path, one with a slash
+	// against the path and each directory leading to it. Hidden files and
+	// directories, whose names start with a dot, are refused too unless
+	// AllowHidden is set. Requests for them get an access violation.
+	DenyFiles   []string
+	AllowHidden bool
+
+	// Backend, if set, stores files in place of Root and UploadRoot. Only
+	// Overwrite of the upload options applies to it.
+	Backend Backend
+
+	// CoalesceReads, if non-zero, is the size of the largest file read
+	// from Root or Backend once for all the downloads of it that overlap,
+	// rather than once per transfer. The content is held in memory until
+	// the last of them ends. It can't be combined with a custom
+	// ReadHandler, whose content may differ between clients.
+	CoalesceReads int64
+
+	// OpenFiles, if non-zero, is how many of the files most recently
+	// downloaded from Root are kept open, saving an open and close per
+	// download of popular images. A file that changes on disk is opened
+	// afresh. It can't be combined with Backend or a custom ReadHandler,
+	// which don't read from Root.
+	OpenFiles int
+
+	// ReadHandler provides the content of read requests and WriteHandler
+	// stores uploads. They default to serving Backend, or Root and
+	// UploadRoot, see Dir.
+	ReadHandler  ReadHandler
+	WriteHandler WriteHandler
+
+	// Middleware wraps the read and write handlers, in order, with the
+	// first seeing each request first. It must not be changed once the
+	// server has started.
+	Middleware []Middleware
+
+	// MaxConcurrentTransfers caps how many transfers are served at once,
+	// zero meaning no limit. Requests beyond the cap wait up to
+	// TransferQueueTimeout for a transfer to finish, and are refused with
+	// an ERROR if none does.
+	MaxConcurrentTransfers int
+	TransferQueueTimeout   time.Duration
+
+	// Priorities rank transfers by the first rule whose pattern their
+	// file matches, PriorityNormal if none does. When requests are
+	// waiting for one of MaxConcurrentTransfers, a freed slot goes to the
+	// highest priority, and while MaxBandwidth or MaxClientBandwidth is
+	// the limit, lower priority transfers hold back for higher ones.
+	Priorities []PriorityRule
+
+	// Allow and Deny restrict which client addresses are served. A request
+	// is refused if its source is in Deny, or if Allow is set and its source
+	// isn't in it. Refused requests are answered with an access violation,
+	// or dropped without a reply if DropDenied is set.
+	Allow      []netip.Prefix
+	Deny       []netip.Prefix
+	DropDenied bool
+	// DropBogons drops requests from bogons too: private, loopback, link
+	// local, documentation and reserved addresses. Only set it on servers
+	// whose clients reach them across the internet. Requests from
+	// broadcast, multicast and unspecified addresses are always dropped.
+	DropBogons bool
+
+	// RequestRate limits how many requests per second are accepted from
+	// all clients together, and RequestRatePerIP from each client IP, with
+	// bursts of up to RequestBurst. Zero means no limit. Excess requests
+	// are dropped, or refused with an ERROR if RejectRateLimited is set.
+	RequestRate       float64
+	RequestRatePerIP  float64
+	RequestBurst      int
+	RejectRateLimited bool
+
+	// MaxBandwidth caps the bytes per second of DATA sent by all transfers
+	// together, MaxClientBandwidth by all transfers to one client IP, and
+	// MaxTransferBandwidth by each transfer. Zero means no limit.
+	MaxBandwidth         int64
+	MaxClientBandwidth   int64
+	MaxTransferBandwidth int64
+
+	// ClientQuota, if non-zero, caps the bytes of file data sent to and
+	// received from each client IP over the last ClientQuotaWindow, one
+	// hour if zero. Requests from clients over their quota are refused
+	// with an access violation, containing devices stuck downloading the
+	// same image in a reboot loop.
+	ClientQuota       int64
+	ClientQuotaWindow time.Duration
+
+	// ErrorMessages replaces the text of the ERROR packets sent to clients
+	// by error code, since some boot ROMs show it to their users. Codes
+	// not in the map keep the server's text.
+	ErrorMessages map[common.ErrorCode]string
+	// HideErrorDetails sends "Internal error" in place of the text of
+	// unexpected errors, such as those from the file system, handlers or
+	// filters, which may describe the server's internals. A *common.Error
+	// is still sent as it is.
+	HideErrorDetails bool
+
+	// Logger receives the server's logs, slog.Default() if nil. Set it to
+	// slog.New(slog.DiscardHandler) to silence the server, or give it a
+	// slog.Handler passing records on to another logging package.
+	Logger *slog.Logger
+	// AccessLog, if set, receives one record per finished transfer, with
+	// the client, file, bytes, duration, retransmits and outcome.
+	AccessLog *slog.Logger
+	// ResolveHostnames adds the client's name, looked up by reverse DNS,
+	// to the log lines and access log records of its transfers as
+	// client_name. A lookup waits at most HostnameTimeout, 500ms if zero,
+	// and its answer, or lack of one, is cached for a while, so slow DNS
+	// holds up few transfers.
+	ResolveHostnames bool
+	HostnameTimeout  time.Duration
+	// History, if set, receives a HistoryRecord of every finished transfer
+	// as a line of JSON, for keeping a record that outlives log rotation.
+	// See ReadHistory.
+	History io.Writer
+
+	// Remap rewrites requested filenames before they are checked and
+	// handled, see ParseRemapRules.
+	Remap []RemapRule
+
+	// Filters are run in order on every request before it is handed to its
+	// handler.
+	Filters []RequestFilter
+
+	// Transparent is set when requests reach the server through a TPROXY
+	// redirect. The original destination of each request is then read from
+	// the socket's control messages, and transfers reply from that address.
+	// Only supported on Linux, and requires CAP_NET_ADMIN.
+	Transparent bool
+
+	// SinglePort serves transfers from the listener's own port rather than
+	// a fresh socket each, for clients behind NAT or firewalls that only
+	// let UDP port 69 through. Packets from a client with a transfer
+	// running are passed to that transfer. It can't be combined with
+	// Transparent.
+	SinglePort bool
+
+	// DSCP, if non-zero, is the Differentiated Services code point, 0 to
+	// 63, marking every packet the server sends so the network can
+	// classify and shape TFTP traffic. Not supported on Windows.
+	DSCP int
+
+	// DuplicateWindow is how long retransmissions of a request, the same
+	// file asked for from the same client address, are ignored while its
+	// transfer runs rather than starting a competing one. Zero means 5
+	// seconds and a negative value turns the check off.
+	DuplicateWindow time.Duration
+
+	// HandshakeWorkers is how many goroutines per listener check and parse
+	// requests, GOMAXPROCS if zero. Requests arriving while all of them are
+	// busy and their queue is full are dropped. Requests waiting for one of
+	// MaxConcurrentTransfers don't hold up a worker.
+	HandshakeWorkers int
+
+	// ReadBuffer and WriteBuffer, if non-zero, set the size in bytes of the
+	// kernel's receive and send buffers of the listeners and transfer
+	// sockets. A larger receive buffer stops requests being dropped during
+	// boot storms. The kernel may cap them, see net.core.rmem_max on Linux.
+	ReadBuffer  int
+	WriteBuffer int
+
+	// ReusePort, if greater than one, makes ListenAndServe open this many
+	// sockets on Addr with SO_REUSEPORT, each read by its own loop, so the
+	// kernel spreads bursts of requests across cores. Only supported on
+	// Linux.
+	ReusePort int
+
+	// SummaryInterval, if non-zero, logs a summary line this often: the
+	// transfers completed and failed, bytes sent and received, the most
+	// transfers active at once and the requests refused or dropped since
+	// the previous line. It gives deployments without metrics trends from
+	// their logs alone.
+	SummaryInterval time.Duration
+
+	// Tracer, if set, receives an event for every packet the server sends
+	// or receives.
+	Tracer *common.Tracer
+
+	// StatsD, if set, receives counters and timings for every transfer.
+	StatsD *StatsD
+
+	// FileMetrics adds counters of the downloads of each file and the
+	// bytes they sent to Vars, under files, showing which files are in
+	// use. Files matching one of FileMetricPatterns, path.Match patterns
+	// such as "images/*.iso", are counted together under the pattern. Once
+	// maxFileMetrics names are counted the rest are counted as "other", so
+	// clients asking for made up names can't grow the counters without
+	// bound.
+	FileMetrics        bool
+	FileMetricPatterns []string
+
+	// Webhooks are notified when transfers start and finish.
+	Webhooks []*Webhook
+
+	// OnTransferStart, if set, is called once the file of each transfer
+	// has been opened, and OnTransferEnd when every transfer finishes,
+	// including those whose file couldn't be opened. They are called from
+	// the transfer's goroutine, so must be safe for concurrent use and
+	// shouldn't block.
+	OnTransferStart func(TransferEvent)
+	OnTransferEnd   func(TransferEvent)
+
+	// UploadValidators inspect every completed upload, in order, before
+	// it is handed to the write handler. Uploads are held in a temporary
+	// file until then. If one rejects an upload it is discarded, the
+	// client is sent an access violation in place of the final ACK, or the
+	// validator's error if it is a *common.Error, and the access log
+	// records the outcome as rejected. Clients wait for the validators, so
+	// they should be quick.
+	UploadValidators []UploadValidator
+
+	// handlers overrides the built in RRQ/WRQ handlers, used by tests.
+	handlers map[common.OpCode]requestHandler
+
+	rootOnce  sync.Once
+	root      Handler
+	openFiles *fileHandles
+
+	varsOnce sync.Once
+	vars     serverVars
+
+	inShutdown     atomic.Bool
+	nextTransferID atomic.Uint64
+	violations     violationRegistry
+	limiter        requestLimiter
+	stateOnce      sync.Once
+	state          *sharedState
+	hostnames      hostnameCache
+	violationLog   logLimiter
+	historyMu      sync.Mutex
+	summary        summary
+	events         eventSubscribers
+
+	mu        sync.Mutex
+	listeners map[net.PacketConn]*portMux
+	// startTime is when the first listener started serving
+	startTime time.Time
+	transfers map[net.PacketConn]*transfer
+	active    sync.WaitGroup
+}
+
+// sharedState is what a server hands over to the one taking over from it,
+// see TakeOver.
+type sharedState struct {
+	slots   transferSlots
+	quotas  clientQuotas
+	uploads uploadLocks
+	recent  recentRequests
+	pacers  bandwidthPacers
+}
+
+// shared returns the server's state, possibly shared with the server it took
+// over from.
+func (s *Server) shared() *sharedState {
+	s.stateOnce.Do(func() {
+		if s.state == nil {
+			s.state = &sharedState{}
+		}
+	})
+	return s.state
+}
+
+// TakeOver makes s carry on where old leaves off, such as when a changed
+// configuration is applied by replacing old while its transfers drain. The
+// two share the MaxConcurrentTransfers slots, client quotas, upload locks,
+// duplicate requests seen and the MaxBandwidth and MaxClientBandwidth
+// pacers, now at s's rates, so old's transfers still count against s's
+// limits. It must be called before s serves any request.
+func (s *Server) TakeOver(old *Server) {
+	s.state = old.shared()
+	s.state.pacers.takeOver(s)
+}
 
 type requestHandler interface {
-	serve(remoteAddr net.Addr, filename string)
+	serve(conn net.PacketConn, req *Request)
 }
 
-type requestHandlerFunc func(remoteAddr net.Addr, filename string)
+type requestHandlerFunc func(conn net.PacketConn, req *Request)
 
-func (r requestHandlerFunc) serve(remoteAddr net.Addr, filename string) {
-	r(remoteAddr, filename)
+func (r requestHandlerFunc) serve(conn net.PacketConn, req *Request) {
+	r(conn, req)
 }
 
-var handlerMapping = map[common.OpCode]requestHandler{
-	common.OpRRQ: requestHandlerFunc(handleReadRequest),
-	common.OpWRQ: requestHandlerFunc(handleWriteRequest),
+func (s *Server) handler(op common.OpCode) (requestHandler, bool) {
+	if s.handlers != nil {
+		h, ok := s.handlers[op]
+		return h, ok
+	}
+	switch op {
+	case common.OpRRQ:
+		return requestHandlerFunc(s.handleReadRequest), true
+	case common.OpWRQ:
+		return requestHandlerFunc(s.handleWriteRequest), true
+	}
+	return nil, false
 }
 
 func acceptedMode(mode string) bool {
-	switch strings.ToLower(mode) {
-	case "netascii", "octet", "mail":
-		return true
+	return common.ValidMode(mode)
+}
+
+// checkFilename rejects requested names that try to leave the served tree:
+// absolute paths, drive letters and ".." segments. Backslashes are treated
+// as separators too, since they are on Windows.
+func checkFilename(name string) error {
+	if strings.HasPrefix(name, "/") || strings.HasPrefix(name, `\`) {
+		return fmt.Errorf("absolute path")
 	}
-	return false
+	if len(name) >= 2 && name[1] == ':' && 'a' <= name[0]|0x20 && name[0]|0x20 <= 'z' {
+		return fmt.Errorf("drive letter")
+	}
+	for _, segment := range strings.FieldsFunc(name, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return fmt.Errorf("parent directory segment")
+		}
+	}
+	return nil
 }
 
-func handleHandshake(conn net.PacketConn) error {
-	packet := make([]byte, common.MaxPacketSize)
+// ListenAndServe listens for requests on the UDP address addr and serves
+// them. It is shorthand for a Server with only Addr set.
+func ListenAndServe(addr string) error {
+	s := &Server{Addr: addr}
+	return s.ListenAndServe()
+}
 
-	n, remoteAddr, err := conn.ReadFrom(packet)
-	if err != nil {
-		return fmt.Errorf("Error reading from connection: %v", err)
+// ListenAndServe listens on s.Addr and calls Serve. It always returns a
+// non-nil error; after Shutdown or Close that is ErrServerClosed.
+func (s *Server) ListenAndServe() error {
+	if s.shuttingDown() {
+		return ErrServerClosed
 	}
-	if n == common.MaxPacketSize {
-		return fmt.Errorf("Packet too big: %d bytes", n)
+	conns, err := s.Listen()
+	if err != nil {
+		return err
 	}
+	return s.ServeListeners(conns)
+}
 
-	log.Printf("Request from %v", remoteAddr)
-	req, err := common.ParseRequestPacket(packet)
+// Listen opens the sockets ListenAndServe serves: one on s.Addr, or
+// ReusePort of them sharing its address. Binding them up front lets a
+// daemon give up the privileges needed for port 69 before ServeListeners.
+func (s *Server) Listen() ([]net.PacketConn, error) {
+	addr := s.Addr
+	if addr == "" {
+		addr = ":69"
+	}
+	lc := net.ListenConfig{Control: s.listenControl}
+	conn, err := lc.ListenPacket(context.Background(), "udp", addr)
 	if err != nil {
-		return fmt.Errorf("Error parsing request packet: %v", err)
+		return nil, fmt.Errorf("Error listening: %v", err)
 	}
 
-	if !acceptedMode(req.Mode) {
-		return fmt.Errorf("Unknown mode: %s", req.Mode)
+	// The rest share the first socket's address, which has the port chosen
+	// by the kernel if Addr's was zero
+	conns := []net.PacketConn{conn}
+	for len(conns) < s.ReusePort {
+		conn, err := lc.ListenPacket(context.Background(), "udp", conns[0].LocalAddr().String())
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, fmt.Errorf("Error listening: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// ServeListeners calls Serve on each of conns, as opened by Listen, and
+// returns once they have all stopped. One failing takes the others down
+// with it. It always returns a non-nil error; after Shutdown or Close that
+// is ErrServerClosed.
+func (s *Server) ServeListeners(conns []net.PacketConn) error {
+	if len(conns) == 1 {
+		return s.Serve(conns[0])
 	}
+	errc := make(chan error, len(conns))
+	for _, c := range conns {
+		go func(c net.PacketConn) { errc <- s.Serve(c) }(c)
+	}
+	err := <-errc
+	for _, c := range conns {
+		c.Close()
+	}
+	for range conns[1:] {
+		<-errc
+	}
+	return err
+}
 
-	handler, ok := handlerMapping[req.OpCode]
+// listenControl prepares the sockets opened by Listen.
+func (s *Server) listenControl(network, address string, c syscall.RawConn) error {
+	if s.Transparent {
+		if err := transparentControl(network, address, c); err != nil {
+			return err
+		}
+	}
+	if s.ReusePort > 1 {
+		return reusePortControl(network, address, c)
+	}
+	return nil
+}
+
+// Serve reads requests from conn, which may be bound by the caller, and
+// serves each transfer in its own goroutine from a fresh socket. Serve closes
+// conn when it returns. It always returns a non-nil error; after Shutdown or
+// Close that is ErrServerClosed.
+func (s *Server) Serve(conn net.PacketConn) error {
+	if !s.trackListener(conn, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(conn, false)
+	defer conn.Close()
+
+	if err := s.prepareListener(conn); err != nil {
+		return err
+	}
+
+	// Requests are handled by a pool of workers so that reading the next
+	// datagram is never held up by a slow one
+	workers := s.HandshakeWorkers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	queue := make(chan *handshake, workers*handshakeQueuePerWorker)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for h := range queue {
+				if err := s.handlePacket(conn, h); err != nil {
+					s.summary.drop()
+					s.logRequestError(err)
+				}
+			}
+		}()
+	}
+	defer wg.Wait()
+	defer close(queue)
+
+	s.logger().Info("Waiting for requests", "addr", conn.LocalAddr().String())
+	for {
+		h, err := s.readHandshake(conn)
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
+			s.logRequestError(err)
+			continue
+		}
+		if h == nil {
+			continue
+		}
+		h.background = true
+		select {
+		case queue <- h:
+		default:
+			// As the kernel would if we hadn't kept up
+			s.summary.drop()
+			s.logger().Debug("Request queue full, dropping request", "client", h.remoteAddr.String())
+		}
+	}
+}
+
+// prepareListener sets up a listener passed to Serve or ServeOne.
+func (s *Server) prepareListener(conn net.PacketConn) error {
+	if err := s.checkConfig(); err != nil {
+		return err
+	}
+	if udpConn, ok := wildcardListener(conn); ok && !s.Transparent && pktInfoSupported {
+		if err := enablePktInfo(udpConn); err != nil {
+			s.logger().Warn("Transfers may answer from a different address than requests were sent to", "addr", conn.LocalAddr().String(), "err", err)
+		}
+	}
+	if !s.Transparent && !s.tunesSockets() {
+		return nil
+	}
+	udpConn, ok := conn.(*net.UDPConn)
 	if !ok {
-		return fmt.Errorf("No handler for OpCode: %d\n", req.OpCode)
+		return fmt.Errorf("Transparent mode and socket options require a *net.UDPConn, got %T", conn)
+	}
+	if err := s.tuneSocket(udpConn); err != nil {
+		return err
+	}
+	if s.Transparent {
+		return enableOrigDst(udpConn)
+	}
+	return nil
+}
+
+// checkConfig returns every problem with the server's fields that stops it
+// serving.
+func (s *Server) checkConfig() error {
+	var errs []error
+	if s.Transparent && s.SinglePort {
+		errs = append(errs, fmt.Errorf("Transparent mode can't be combined with single port mode"))
+	}
+	errs = append(errs, s.checkDenyFiles(), s.checkFileMetricPatterns(), s.checkPriorities())
+	if s.MinFreeSpace > 0 {
+		if _, err := freeSpace("."); errors.Is(err, errors.ErrUnsupported) {
+			errs = append(errs, fmt.Errorf("MinFreeSpace isn't supported on %s", runtime.GOOS))
+		}
+	}
+	if s.DSCP < 0 || s.DSCP > 63 {
+		errs = append(errs, fmt.Errorf("Invalid DSCP %d, must be between 0 and 63", s.DSCP))
+	}
+	if s.CoalesceReads > 0 && s.ReadHandler != nil {
+		errs = append(errs, fmt.Errorf("CoalesceReads can't be combined with a custom ReadHandler"))
+	}
+	if s.OpenFiles > 0 && (s.Backend != nil || s.ReadHandler != nil) {
+		errs = append(errs, fmt.Errorf("OpenFiles only applies to files read from Root, not a Backend or custom ReadHandler"))
+	}
+	return errors.Join(errs...)
+}
+
+// Check reports every problem with the server's configuration found without
+// listening: those Serve would refuse to start with, and a Root or
+// UploadRoot that isn't a directory, which would leave it serving nothing.
+func (s *Server) Check() error {
+	errs := []error{s.checkConfig()}
+	if s.Backend == nil {
+		errs = append(errs, checkDir("Root", s.Root))
+		if s.UploadRoot != "" {
+			errs = append(errs, checkDir("UploadRoot", s.UploadRoot))
+		}
 	}
-	go handler.serve(remoteAddr, req.Filename)
+	return errors.Join(errs...)
+}
 
+// checkDir returns an error naming field unless dir is a directory.
+func checkDir(field, dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	info, err := os.Stat(dir)
+	switch {
+	case os.IsNotExist(err):
+		return fmt.Errorf("%s %s doesn't exist", field, dir)
+	case err != nil:
+		return fmt.Errorf("%s %s: %v", field, dir, err)
+	case !info.IsDir():
+		return fmt.Errorf("%s %s isn't a directory", field, dir)
+	}
 	return nil
 }
 
-func handleReadRequest(remoteAddress net.Addr, filename string) {
-	start := time.Now()
-	log.Println("Handling RRQ for", filename)
+func (s *Server) tunesSockets() bool {
+	return s.DSCP != 0 || s.ReadBuffer != 0 || s.WriteBuffer != 0
+}
 
-	conn, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   net.IPv4zero,
-		Port: 0,
-	})
-	if err != nil {
-		log.Println("Error listening", err)
-		return
+// tuneSocket applies DSCP, ReadBuffer and WriteBuffer to conn.
+func (s *Server) tuneSocket(conn *net.UDPConn) error {
+	if s.DSCP != 0 {
+		if err := setDSCP(conn, s.DSCP); err != nil {
+			return err
+		}
+	}
+	if s.ReadBuffer != 0 {
+		if err := conn.SetReadBuffer(s.ReadBuffer); err != nil {
+			return fmt.Errorf("Error setting receive buffer: %v", err)
+		}
 	}
+	if s.WriteBuffer != 0 {
+		if err := conn.SetWriteBuffer(s.WriteBuffer); err != nil {
+			return fmt.Errorf("Error setting send buffer: %v", err)
+		}
+	}
+	return nil
+}
+
+// ServeOne serves a single request read from conn and returns once its
+// transfer has finished, closing conn. It suits servers started per request
+// by inetd, which hands over its socket with the request waiting to be read.
+// The returned error only reports failures to accept the request; the
+// transfer's outcome is logged.
+func (s *Server) ServeOne(conn net.PacketConn) error {
+	if !s.trackListener(conn, true) {
+		conn.Close()
+		return ErrServerClosed
+	}
+	defer s.trackListener(conn, false)
 	defer conn.Close()
 
-	f, err := os.Open(filename)
-	if err != nil {
-		log.Println(err)
-		if os.IsNotExist(err) {
-			common.SendError(1, "File not found", conn, remoteAddress)
-			return
+	if err := s.prepareListener(conn); err != nil {
+		return err
+	}
+
+	err := s.handleHandshake(conn)
+	if mux := s.listenerMux(conn); mux != nil {
+		// Nothing else reads the listener, which carries the transfer
+		go mux.pump()
+	}
+	s.active.Wait()
+	if err != nil && s.shuttingDown() {
+		return ErrServerClosed
+	}
+	return err
+}
+
+// Shutdown stops accepting requests and lets active transfers drain. If ctx
+// expires before they finish, their sockets are closed and ctx's error is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.inShutdown.Store(true)
+	s.closeListeners()
+
+	if n := s.activeTransfers(); n > 0 {
+		s.logger().Info("Shutting down, waiting for active transfers", "transfers", n)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.active.Wait()
+		close(done)
+	}()
+	defer s.closeOpenFiles()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.logger().Warn("Closing transfers still active at shutdown", "transfers", s.closeTransfers())
+		return ctx.Err()
+	}
+}
+
+// Close immediately closes the listeners and the sockets of all active
+// transfers. For a graceful shutdown use Shutdown.
+func (s *Server) Close() error {
+	s.inShutdown.Store(true)
+	s.closeListeners()
+	s.closeTransfers()
+	s.closeOpenFiles()
+	return nil
+}
+
+// closeOpenFiles closes the files kept open for OpenFiles.
+func (s *Server) closeOpenFiles() {
+	s.mu.Lock()
+	h := s.openFiles
+	s.mu.Unlock()
+	if h != nil {
+		h.close()
+	}
+}
+
+func (s *Server) activeTransfers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.transfers)
+}
+
+// closeTransfers closes the sockets of all active transfers, returning how
+// many there were.
+func (s *Server) closeTransfers() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, t := range s.transfers {
+		t.req.end(ErrServerClosed)
+		conn.Close()
+	}
+	return len(s.transfers)
+}
+
+// Violations returns the protocol violations seen so far, per peer. Past
+// the first 1000 peers the rest are counted together under "other".
+func (s *Server) Violations() common.ViolationCounts {
+	return s.violations.snapshot()
+}
+
+func (s *Server) shuttingDown() bool {
+	return s.inShutdown.Load()
+}
+
+// trackListener adds or removes a listener, returning false if a listener is
+// added after shutdown started.
+func (s *Server) trackListener(conn net.PacketConn, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, conn)
+		return true
+	}
+	if s.shuttingDown() {
+		return false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.PacketConn]*portMux)
+		s.startTime = time.Now()
+		if s.SummaryInterval > 0 {
+			go s.logSummaries(s.SummaryInterval)
 		}
-		common.SendError(0, err.Error(), conn, remoteAddress)
-		return
 	}
-	defer f.Close()
+	var mux *portMux
+	if s.SinglePort {
+		mux = newPortMux(conn)
+	}
+	s.listeners[conn] = mux
+	return true
+}
+
+// listenerMux returns the portMux of a listener, nil unless in single port
+// mode.
+func (s *Server) listenerMux(conn net.PacketConn) *portMux {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.listeners[conn]
+}
 
-	br := bufio.NewReader(f)
-	bytesRead, err := common.ReadFileLoop(br, conn, remoteAddress, common.BlockSize)
+// closeListeners stops the listeners. Those in single port mode carry the
+// packets of their transfers, so they are only closed once those finish.
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn, mux := range s.listeners {
+		if mux != nil {
+			mux.shutdown()
+			continue
+		}
+		conn.Close()
+	}
+}
+
+// startTransfer opens the socket for a transfer and serves it in a new
+// goroutine, tracking it so Shutdown can wait for it. finished is called
+// when the transfer ends.
+func (s *Server) startTransfer(handler requestHandler, req *Request, mux *portMux, finished func()) error {
+	var udpConn net.PacketConn
+	if mux != nil {
+		c, ok := mux.open(req.RemoteAddr)
+		if !ok {
+			return fmt.Errorf("Ignoring duplicate request from %v, its transfer has started", req.RemoteAddr)
+		}
+		udpConn = c
+	} else {
+		var err error
+		udpConn, err = s.listenTransfer(req)
+		if err != nil {
+			return fmt.Errorf("Error listening: %v", err)
+		}
+		if s.tunesSockets() {
+			if err := s.tuneSocket(udpConn.(*net.UDPConn)); err != nil {
+				udpConn.Close()
+				return err
+			}
+		}
+		if c, err := detectUnreachable(udpConn.(*net.UDPConn)); err != nil {
+			s.requestLogger(req).Warn("Transfers to clients that have gone away run until they time out", "err", err)
+		} else {
+			udpConn = c
+		}
+	}
+	t := &transfer{id: s.nextTransferID.Add(1), req: req, started: time.Now()}
+	conn := s.errorMessageConn(s.countingConn(s.Tracer.Conn(&progressConn{PacketConn: udpConn, t: t})))
+	pacers, releasePacers := s.transferPacers(req)
+	if len(pacers) > 0 {
+		conn = &pacedConn{PacketConn: conn, pacers: pacers, priority: req.priority}
+	}
+	if s.ReadTimeout > 0 || s.WriteTimeout > 0 || s.IdleTimeout > 0 || s.MaxTransferDuration > 0 {
+		tc := &timeoutConn{
+			PacketConn: conn,
+			read:       s.ReadTimeout,
+			write:      s.WriteTimeout,
+			idle:       s.IdleTimeout,
+			peer:       req.RemoteAddr,
+			lastActive: time.Now(),
+		}
+		if deadline, ok := req.Context().Deadline(); ok {
+			tc.expires = deadline
+		}
+		conn = tc
+	}
+
+	s.mu.Lock()
+	if s.transfers == nil {
+		s.transfers = make(map[net.PacketConn]*transfer)
+	}
+	t.conn = conn
+	s.transfers[conn] = t
+	s.summary.active(len(s.transfers))
+	s.active.Add(1)
+	s.mu.Unlock()
+	s.vars.transfers.Add(1)
+
+	go func() {
+		defer func() {
+			req.end(nil)
+			// Charged before it stops counting as running, so it can't
+			// slip between the two
+			s.chargeQuota(t)
+			s.mu.Lock()
+			delete(s.transfers, conn)
+			s.mu.Unlock()
+			conn.Close()
+			releasePacers()
+			finished()
+			s.releaseTransfer()
+			s.active.Done()
+		}()
+		handler.serve(conn, req)
+	}()
+	return nil
+}
+
+// listenTransfer opens the socket a transfer is served from. When the
+// request's local address is known, such as the original destination in
+// transparent mode or the destination reported for a wildcard listener, the
+// socket is bound to it so the client sees replies coming from the address
+// it contacted, even on multi-homed hosts. Otherwise it is bound to the
+// wildcard address of the client's family.
+func (s *Server) listenTransfer(req *Request) (net.PacketConn, error) {
+	// Don't use DialUDP here, see https://groups.google.com/forum/#!topic/golang-nuts/Mb3MS9Khito
+	if local, ok := req.LocalAddr.(*net.UDPAddr); ok {
+		var lc net.ListenConfig
+		if s.Transparent {
+			lc.Control = transparentControl
+		}
+		// Keep the zone, link-local addresses can't be bound without it
+		addr := &net.UDPAddr{IP: local.IP, Zone: local.Zone}
+		return lc.ListenPacket(context.Background(), "udp", addr.String())
+	}
+	if ip, ok := addrIP(req.RemoteAddr); ok && ip.Is6() {
+		return net.ListenUDP("udp6", &net.UDPAddr{IP: net.IPv6unspecified})
+	}
+	return net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+}
+
+// wildcardListener returns conn if it is a UDP socket bound to the wildcard
+// address.
+func wildcardListener(conn net.PacketConn) (*net.UDPConn, bool) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return nil, false
+	}
+	ip, ok := addrIP(conn.LocalAddr())
+	return udpConn, ok && ip.IsUnspecified()
+}
+
+// readRequest reads the next packet from the listener, along with the
+// address it was sent to when that is known: the original destination in
+// transparent mode, the listener's address if it is bound to a specific IP,
+// or otherwise the destination reported by the kernel where it can.
+func (s *Server) readRequest(conn net.PacketConn, packet []byte) (n int, remoteAddr, localAddr net.Addr, err error) {
+	if wildcard, ok := wildcardListener(conn); ok && !s.Transparent && pktInfoSupported {
+		return s.readRequestPktInfo(wildcard, packet)
+	}
+	udpConn, ok := conn.(*net.UDPConn)
+	if !s.Transparent || !ok {
+		n, remoteAddr, err = conn.ReadFrom(packet)
+		if ip, ok := addrIP(conn.LocalAddr()); ok && !ip.IsUnspecified() {
+			localAddr = conn.LocalAddr()
+		}
+		return n, remoteAddr, localAddr, err
+	}
+
+	oob := make([]byte, origDstOOBBufferSize)
+	n, oobn, _, from, err := udpConn.ReadMsgUDP(packet, oob)
+	if err != nil {
+		return n, nil, nil, err
+	}
+	origDst, err := parseOrigDst(oob[:oobn])
 	if err != nil {
-		log.Println("Error handling read:", err)
+		s.logger().Warn("No original destination for packet", "client", from.String(), "err", err)
+		return n, from, nil, nil
 	}
-	log.Printf("Done sending %s. %d bytes in %v", filename, bytesRead, time.Since(start))
+	return n, from, origDst, nil
 }
 
-func fileCleanup(f *os.File) {
-	if err := f.Sync(); err != nil {
-		log.Printf("Error syncing %s, %v", f.Name(), err)
+// readRequestPktInfo reads the next packet from a wildcard listener set up
+// by enablePktInfo. If the kernel didn't say where the packet was sent the
+// local address is left unknown.
+func (s *Server) readRequestPktInfo(conn *net.UDPConn, packet []byte) (n int, remoteAddr, localAddr net.Addr, err error) {
+	oob := make([]byte, pktInfoBufferSize)
+	n, oobn, _, from, err := conn.ReadMsgUDP(packet, oob)
+	if err != nil {
+		return n, nil, nil, err
 	}
-	if err := f.Close(); err != nil {
-		log.Printf("Error closing file %s, %v", f.Name(), err)
+	local, err := parsePktInfo(oob[:oobn])
+	if err != nil {
+		s.logger().Debug("No destination for packet", "client", from.String(), "err", err)
+		return n, from, nil, nil
 	}
+	local.Port = conn.LocalAddr().(*net.UDPAddr).Port
+	return n, from, local, nil
 }
 
-func handleWriteRequest(remoteAddress net.Addr, filename string) {
-	log.Println("Handling WRQ")
+var (
+	errPeerTimeout     = errors.New("Timed out waiting for peer")
+	errTransferTooLong = errors.New("Transfer exceeded maximum duration")
+)
 
-	// Don't use DialUDP here, see https://groups.google.com/forum/#!topic/golang-nuts/Mb3MS9Khito
-	conn, err := net.ListenUDP("udp", nil)
+// defaultRetries is how many times a packet is resent when the client asked
+// for a retransmission timeout but Server.Retries isn't set.
+const defaultRetries = 5
+
+func (s *Server) retransmission() common.Retransmission {
+	return common.Retransmission{
+		Timeout:    s.RetransmitTimeout,
+		Retries:    s.Retries,
+		MaxTimeout: s.MaxBlockTimeout,
+	}
+}
+
+// loopOptions returns how req's transfer loop runs, along with the options
+// acknowledged to the client, nil if there are none. The loop's OACK is set
+// if there are.
+func (s *Server) loopOptions(req *Request) (common.LoopOptions, map[string]string) {
+	opts := common.LoopOptions{
+		Retransmission: s.retransmission(),
+		Context:        req.Context(),
+		OnRetransmit:   func(packet []byte) { s.publishRetransmit(req, packet) },
+	}
+	acked := make(map[string]string)
+	if timeout, option, ok := req.retransmitTimeout(); ok {
+		opts.Timeout = timeout
+		if opts.Retries <= 0 {
+			opts.Retries = defaultRetries
+		}
+		acked[option] = req.Options[option]
+	}
+	if rollover, ok := req.rollover(); ok {
+		opts.Rollover = rollover
+		acked[rolloverOption] = strconv.Itoa(int(rollover))
+	}
+	if req.resumedAt > 0 {
+		acked[resumeOption] = strconv.FormatInt(req.resumedAt, 10)
+	}
+	if len(acked) == 0 {
+		return opts, nil
+	}
+	opts.OACK = common.CreateOACKPacket(acked)
+	return opts, acked
+}
+
+// timeoutConn sets a fresh deadline before every read and write. Reads also
+// give up once the peer has been idle for too long. A deadline set by the
+// transfer for retransmitting applies too, but only its own expiry is
+// reported as os.ErrDeadlineExceeded, so running out of ReadTimeout or
+// IdleTimeout ends the transfer rather than causing a resend. Once expires
+// passes the peer is sent an ERROR and the transfer's next read or write
+// fails.
+type timeoutConn struct {
+	net.PacketConn
+	read  time.Duration
+	write time.Duration
+
+	idle       time.Duration
+	peer       net.Addr
+	lastActive time.Time
+
+	// deadline is the read deadline set by the transfer
+	deadline time.Time
+
+	expires time.Time
+	expired bool
+}
+
+func (c *timeoutConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	var deadline time.Time
+	if c.read > 0 {
+		deadline = time.Now().Add(c.read)
+	}
+	if c.idle > 0 {
+		idleDeadline := c.lastActive.Add(c.idle)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+	if !c.expires.IsZero() {
+		if c.expire() {
+			return 0, nil, errTransferTooLong
+		}
+		if deadline.IsZero() || c.expires.Before(deadline) {
+			deadline = c.expires
+		}
+	}
+	own := !deadline.IsZero() && (c.deadline.IsZero() || deadline.Before(c.deadline))
+	if own {
+		c.PacketConn.SetReadDeadline(deadline)
+	} else {
+		c.PacketConn.SetReadDeadline(c.deadline)
+	}
+	n, addr, err := c.PacketConn.ReadFrom(b)
+	if err == nil && addr.String() == c.peer.String() {
+		c.lastActive = time.Now()
+	}
+	if own && errors.Is(err, os.ErrDeadlineExceeded) {
+		if c.expire() {
+			return n, addr, errTransferTooLong
+		}
+		return n, addr, errPeerTimeout
+	}
+	return n, addr, err
+}
+
+// expire reports whether the transfer has run out of time, telling the peer
+// the first time it has.
+func (c *timeoutConn) expire() bool {
+	if c.expires.IsZero() || time.Now().Before(c.expires) {
+		return false
+	}
+	if !c.expired {
+		c.expired = true
+		common.SendError(common.ErrNotDefined, errTransferTooLong.Error(), c, c.peer)
+	}
+	return true
+}
+
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	c.deadline = t
+	return c.PacketConn.SetReadDeadline(t)
+}
+
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	c.deadline = t
+	return c.PacketConn.SetDeadline(t)
+}
+
+func (c *timeoutConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if !c.expired && c.expire() {
+		return 0, errTransferTooLong
+	}
+	if c.write > 0 {
+		c.PacketConn.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+// handshakeQueuePerWorker is how many requests may wait for each handshake
+// worker.
+const handshakeQueuePerWorker = 64
+
+// handshake is a datagram read from a listener, waiting to be handled.
+type handshake struct {
+	packet     []byte
+	n          int
+	remoteAddr net.Addr
+	localAddr  net.Addr
+	// background is set for the requests of Serve's workers, which leave
+	// a request waiting for a transfer slot to a goroutine of its own.
+	background bool
+}
+
+// handleHandshake reads a request from conn and handles it.
+func (s *Server) handleHandshake(conn net.PacketConn) error {
+	h, err := s.readHandshake(conn)
+	if err != nil || h == nil {
+		return err
+	}
+	return s.handlePacket(conn, h)
+}
+
+// readHandshake reads the next datagram from conn. It returns nil if the
+// datagram belongs to a transfer in single port mode, which it is passed to.
+func (s *Server) readHandshake(conn net.PacketConn) (*handshake, error) {
+	h := &handshake{packet: make([]byte, common.MaxPacketSize)}
+	mux := s.listenerMux(conn)
+	var err error
+	h.n, h.remoteAddr, h.localAddr, err = s.readRequest(conn, h.packet)
 	if err != nil {
-		log.Println(err)
-		return
+		return nil, fmt.Errorf("Error reading from connection: %w", err)
+	}
+	if mux != nil {
+		if mux.deliver(h.remoteAddr, h.packet[:h.n]) {
+			return nil, nil
+		}
+		if s.shuttingDown() {
+			// Still reading for the transfers being drained
+			return nil, nil
+		}
+	}
+	return h, nil
+}
+
+// handlePacket checks and parses a request read by readHandshake and starts
+// its transfer.
+func (s *Server) handlePacket(conn net.PacketConn, h *handshake) (err error) {
+	packet, n, remoteAddr, localAddr := h.packet, h.n, h.remoteAddr, h.localAddr
+	defer func() {
+		if err != nil {
+			s.publish(Event{Type: EventError, Client: remoteAddr, Err: err})
+		}
+	}()
+	mux := s.listenerMux(conn)
+	if s.Tracer != nil {
+		local := localAddr
+		if local == nil {
+			local = conn.LocalAddr()
+		}
+		s.Tracer.Record(common.TraceRecv, local, remoteAddr, packet[:n], nil)
+		// Trace any ERROR sent in reply on the listener too
+		conn = s.Tracer.Conn(conn)
+	}
+	conn = s.errorMessageConn(s.countingConn(conn))
+
+	if reason := s.bogusSource(remoteAddr); reason != "" {
+		s.logger().Debug("Dropping request from bogus source", "client", remoteAddr.String(), "reason", reason)
+		return nil
+	}
+	if !s.allowedSource(remoteAddr) {
+		if !s.DropDenied {
+			common.SendError(common.ErrAccessViolation, "Access violation", conn, remoteAddr)
+		}
+		return fmt.Errorf("Request from %v denied by address rules", remoteAddr)
 	}
-	defer conn.Close()
 
-	f, err := os.Create(filename)
+	if n == common.MaxPacketSize {
+		s.violations.record(remoteAddr, common.ViolationMalformed)
+		s.malformed(conn, remoteAddr, packet[:n], "Packet too big")
+		return fmt.Errorf("%w (%v) from %v: packet too big", errProtocolViolation, common.ViolationMalformed, remoteAddr)
+	}
+
+	if localAddr != nil {
+		s.logger().Debug("Request", "client", remoteAddr.String(), "local", localAddr.String())
+	} else {
+		s.logger().Debug("Request", "client", remoteAddr.String())
+	}
+	packet = packet[:n]
+
+	opcode, err := common.GetOpCode(packet)
 	if err != nil {
-		log.Println(err)
-		// TODO: This error should indicate what went wrong
-		common.SendError(0, err.Error(), conn, remoteAddress)
-		return
+		kind := common.ViolationBadOpcode
+		if n < 2 {
+			kind = common.ViolationShortPacket
+		}
+		s.violations.record(remoteAddr, kind)
+		s.malformed(conn, remoteAddr, packet, "Illegal TFTP operation")
+		return fmt.Errorf("%w (%v) from %v: %v: %s", errProtocolViolation, kind, remoteAddr, err, common.DumpPacket(packet))
+	}
+	if opcode != common.OpRRQ && opcode != common.OpWRQ {
+		s.violations.record(remoteAddr, common.ViolationBadOpcode)
+		s.malformed(conn, remoteAddr, packet, "Expected RRQ or WRQ")
+		return fmt.Errorf("%w (%v) from %v: unexpected packet on request port: %s", errProtocolViolation, common.ViolationBadOpcode, remoteAddr, common.DumpPacket(packet))
 	}
-	defer fileCleanup(f)
 
-	bw := bufio.NewWriter(f)
-	defer bw.Flush()
+	if !s.allowRequest(remoteAddr) {
+		if s.RejectRateLimited {
+			common.SendError(common.ErrNotDefined, "Too many requests, try again later", conn, remoteAddr)
+		}
+		return fmt.Errorf("Request from %v rate limited", remoteAddr)
+	}
 
-	tid := uint16(0)
+	req, err := common.ParseRequestPacket(packet)
+	if err != nil {
+		s.violations.record(remoteAddr, common.ViolationMalformed)
+		s.malformed(conn, remoteAddr, packet, "Malformed request")
+		return fmt.Errorf("%w (%v) from %v: %v: %s", errProtocolViolation, common.ViolationMalformed, remoteAddr, err, common.DumpPacket(packet))
+	}
+	s.publish(Event{Type: EventRequest, Client: remoteAddr, Op: req.OpCode, Filename: req.Filename})
 
-	// Acknowledge WRQ
-	ack := common.CreateAckPacket(tid)
-	_, err = conn.WriteTo(ack, remoteAddress)
+	if s.Honeypot {
+		r := newRequest(req, remoteAddr)
+		r.LocalAddr = localAddr
+		s.honeypot(conn, r)
+		return nil
+	}
+
+	if !acceptedMode(req.Mode) {
+		common.SendError(common.ErrIllegalOperation, fmt.Sprintf("Unknown mode %q", req.Mode), conn, remoteAddr)
+		return fmt.Errorf("Unknown mode %q from %v", req.Mode, remoteAddr)
+	}
+	if s.OctetOnly && req.Mode != common.ModeOctet {
+		common.SendError(common.ErrIllegalOperation, fmt.Sprintf("Mode %q not supported, only octet", req.Mode), conn, remoteAddr)
+		return fmt.Errorf("Refused %s mode request from %v, only octet is served", req.Mode, remoteAddr)
+	}
+
+	if len(s.Remap) > 0 {
+		name, err := s.remap(req.OpCode, req.Filename, remoteAddr)
+		if err != nil {
+			code, message := s.clientError(err)
+			common.SendError(code, message, conn, remoteAddr)
+			return fmt.Errorf("Request for %s from %v refused by remap rules: %v", req.Filename, remoteAddr, err)
+		}
+		if name != req.Filename {
+			s.logger().Debug("Remapped filename", "client", remoteAddr.String(), "from", req.Filename, "to", name)
+			req.Filename = name
+		}
+	}
+
+	// The first copy of a retransmitted request is served, the rest dropped
+	forget := func() {}
+	if window := s.duplicateWindow(); window > 0 {
+		key := requestKey{client: remoteAddr.String(), op: req.OpCode, filename: req.Filename}
+		accepted := time.Now()
+		if !s.shared().recent.start(key, window, accepted) {
+			s.logger().Debug("Ignoring retransmitted request", "client", remoteAddr.String(), "file", req.Filename)
+			return nil
+		}
+		forget = func() { s.shared().recent.done(key, accepted) }
+	}
+	started := false
+	defer func() {
+		if !started {
+			forget()
+		}
+	}()
+
+	if err := checkFilename(req.Filename); err != nil {
+		common.SendError(common.ErrAccessViolation, "Access violation", conn, remoteAddr)
+		return fmt.Errorf("Rejected filename %q from %v: %v", req.Filename, remoteAddr, err)
+	}
+	if denied, rule := s.deniedFile(req.Filename); denied {
+		common.SendError(common.ErrAccessViolation, "Access violation", conn, remoteAddr)
+		return fmt.Errorf("Denied filename %q from %v: %s", req.Filename, remoteAddr, rule)
+	}
+	if s.overQuota(remoteAddr) {
+		common.SendError(common.ErrAccessViolation, "Quota exceeded, try again later", conn, remoteAddr)
+		return fmt.Errorf("Request for %s from %v refused, client quota of %d bytes used up", req.Filename, remoteAddr, s.ClientQuota)
+	}
+
+	handler, ok := s.handler(req.OpCode)
+	if !ok {
+		return fmt.Errorf("No handler for OpCode: %d\n", req.OpCode)
+	}
+
+	r := newRequest(req, remoteAddr)
+	r.LocalAddr = localAddr
+	s.startContext(r)
+	defer func() {
+		if !started {
+			r.end(nil)
+		}
+	}()
+	if err := s.runFilters(r); err != nil {
+		code, message := s.clientError(err)
+		common.SendError(code, message, conn, remoteAddr)
+		return fmt.Errorf("Request for %s from %v rejected: %v%s", r.Filename, remoteAddr, err, r.logSuffix())
+	}
+	start := func(reserved bool) error {
+		if !reserved {
+			common.SendError(common.ErrNotDefined, "Server busy, try again later", conn, remoteAddr)
+			return fmt.Errorf("Request for %s from %v refused, %d transfers already active%s", r.Filename, remoteAddr, s.MaxConcurrentTransfers, r.logSuffix())
+		}
+		if err := s.startTransfer(handler, r, mux, forget); err != nil {
+			s.releaseTransfer()
+			return fmt.Errorf("%v%s", err, r.logSuffix())
+		}
+		return nil
+	}
+
+	r.priority = s.priority(r.Filename)
+	reserved, wait := s.reserveTransfer(r.priority)
+	if wait != nil && h.background {
+		// Waiting for a slot mustn't hold up the worker, and the requests
+		// queued behind it, for as long as TransferQueueTimeout
+		started = true
+		go func() {
+			reserved := wait()
+			if reserved && s.shuttingDown() {
+				s.releaseTransfer()
+				reserved = false
+			}
+			if err := start(reserved); err != nil {
+				forget()
+				r.end(nil)
+				s.publish(Event{Type: EventError, Client: remoteAddr, Err: err})
+				s.summary.drop()
+				s.logRequestError(err)
+			}
+		}()
+		return nil
+	}
+	if wait != nil {
+		reserved = wait()
+	}
+	if err := start(reserved); err != nil {
+		return err
+	}
+	started = true
+	return nil
+}
+
+func (s *Server) handleReadRequest(conn net.PacketConn, req *Request) {
+	var stats common.TransferStats
+	var err error
+	started := false
+	defer func() {
+		s.countBytes(req.OpCode, stats)
+		s.summary.transfer(req.OpCode, stats, err)
+		if started {
+			s.countFile(req.Filename, stats)
+		}
+		s.StatsD.transfer(req.OpCode, stats, transferOutcome(started, err))
+		s.logAccess(req, stats, started, err)
+		s.recordHistory(req, stats, started, err)
+		s.notifyEnd(req, stats, err)
+		s.transferEnded(req, stats, started, err)
+	}()
+
+	logger := s.requestLogger(req)
+	logger.Info("Handling RRQ")
+
+	r, _, err := s.rootHandler().ServeRead(req)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("Error opening file", "err", err)
+		code, message := s.clientError(err)
+		common.SendError(code, message, conn, req.RemoteAddr)
 		return
 	}
+	defer r.Close()
+	started = true
+	s.notify(WebhookStart, req, stats, nil)
+	s.transferStarted(req)
 
-	err = common.WriteFileLoop(bw, conn, remoteAddress)
+	opts, acked := s.loopOptions(req)
+	if opts.OACK != nil {
+		if _, err = conn.WriteTo(opts.OACK, req.RemoteAddr); err != nil {
+			logger.Error("Error acknowledging options", "err", err)
+			return
+		}
+	}
+
+	// Content already in memory needn't be buffered again
+	var br io.Reader = r
+	if _, ok := r.(*sharedReader); !ok {
+		br = bufio.NewReader(r)
+	}
+	stats, err = common.ReadFileLoopOptions(br, conn, req.RemoteAddr, common.BlockSize, opts)
+	stats.Options = acked
+	s.recordTransferViolations(logger, stats)
+	if peerErr, ok := err.(*common.Error); ok {
+		logger.Warn("Sending aborted by client", "err", peerErr, "stats", stats)
+		return
+	}
 	if err != nil {
-		log.Println("Error sending file:", err)
+		logger.Error("Error sending file", "err", err, "stats", stats)
+		return
 	}
-	log.Println("Seccesfully received:", filename)
+	logger.Info("Done sending", "stats", stats)
 }
 
-func listenAndServe(port int) {
-	addr, err := net.ResolveUDPAddr("udp", fmt.Sprintf(":%d", port))
+func (s *Server) handleWriteRequest(conn net.PacketConn, req *Request) {
+	var stats common.TransferStats
+	var err error
+	started := false
+	defer func() {
+		s.countBytes(req.OpCode, stats)
+		s.summary.transfer(req.OpCode, stats, err)
+		s.StatsD.transfer(req.OpCode, stats, transferOutcome(started, err))
+		s.logAccess(req, stats, started, err)
+		s.recordHistory(req, stats, started, err)
+		s.notifyEnd(req, stats, err)
+		s.transferEnded(req, stats, started, err)
+	}()
+
+	logger := s.requestLogger(req)
+	logger.Info("Handling WRQ")
+
+	release, err := s.lockUpload(req)
 	if err != nil {
-		log.Println(err)
+		logger.Warn("Refusing concurrent upload", "err", err)
+		code, message := s.clientError(err)
+		common.SendError(code, message, conn, req.RemoteAddr)
 		return
 	}
-	conn, err := net.ListenUDP("udp", addr)
+	// Registered before the writer is closed, so runs after it
+	defer release()
+
+	if offset, ok := req.resumeOffset(); ok && s.ResumableUploads && len(s.UploadValidators) == 0 {
+		req.resumeFrom = offset
+	}
+	w, err := s.rootHandler().ServeWrite(req)
+	if err == nil {
+		w, err = s.validateUploads(req, w)
+	}
 	if err != nil {
-		log.Println(err)
+		logger.Warn("Error creating file", "err", err)
+		code, message := s.clientError(err)
+		common.SendError(code, message, conn, req.RemoteAddr)
 		return
 	}
-	defer conn.Close()
 
-	log.Println("Waiting for requests on port", port)
-	for {
-		err := handleHandshake(conn)
-		if err != nil {
-			log.Println(err)
-			continue
+	started = true
+	s.notify(WebhookStart, req, stats, nil)
+	s.transferStarted(req)
+	aborted := false
+	defer func() {
+		if _, ok := w.(aborter); ok && aborted {
+			s.discardPartial(logger, w)
+			return
 		}
-	}
-}
+		closeErr := w.Close()
+		if errors.Is(closeErr, errUploadRejected) {
+			logger.Warn("Discarded rejected upload", "err", closeErr)
+			err = closeErr
+		} else if closeErr != nil {
+			logger.Error("Error closing file", "err", closeErr)
+			err = closeErr
+		}
+	}()
 
-func init() {
-	flag.IntVar(&port, "port", 69, "Port to listen on")
-}
+	// Acknowledge WRQ
+	opts, acked := s.loopOptions(req)
+	reply := opts.OACK
+	if reply == nil {
+		reply = common.CreateAckPacket(0)
+	}
+	if req.resumedAt > 0 {
+		logger.Info("Resuming upload", "offset", req.resumedAt)
+	}
+	_, err = conn.WriteTo(reply, req.RemoteAddr)
+	if err != nil {
+		logger.Error("Error acknowledging WRQ", "err", err)
+		aborted = true
+		return
+	}
 
-func main() {
-	flag.Parse()
-	listenAndServe(port)
+	stats, err = common.WriteFileLoopOptions(w, conn, req.RemoteAddr, opts)
+	stats.Options = acked
+	s.recordTransferViolations(logger, stats)
+	if peerErr, ok := err.(*common.Error); ok {
+		logger.Warn("Receiving aborted by client", "err", peerErr, "stats", stats)
+		aborted = true
+		return
+	}
+	if err != nil {
+		logger.Error("Error receiving file", "err", err, "stats", stats)
+		// Close discards rejected uploads itself, reporting why
+		aborted = !uploadRejected(w)
+		return
+	}
+	logger.Info("Successfully received", "stats", stats)
 }
@@ -1,20 +1,22 @@
-package main
+package server
 
 import (
 	"bytes"
-	"io/ioutil"
-	"log"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ryanslade/tftp/common"
 )
 
-func init() {
-	log.SetOutput(ioutil.Discard)
-	handlerMapping = map[common.OpCode]requestHandler{}
-}
-
 func TestParseACKPacket(t *testing.T) {
 	testCases := []struct {
 		packet      []byte
@@ -84,7 +86,13 @@ func TestAcceptedMode(t *testing.T) {
 	}
 
 	for _, tc := range testCases {
-		outcome := acceptedMode(tc.mode)
+		// Modes reach acceptedMode normalized by the parser
+		packet := common.RequestPacket{OpCode: common.OpRRQ, Filename: "f", Mode: tc.mode}
+		req, err := common.ParseRequestPacket(packet.ToBytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		outcome := acceptedMode(req.Mode)
 		if outcome != tc.accepted {
 			t.Errorf("Expected mode, '%s' accepted = %v", tc.mode, tc.accepted)
 		}
@@ -119,8 +127,12 @@ func TestHandleHandshake(t *testing.T) {
 	mockWRQHandler := &mockHandler{
 		replyChan: wChan,
 	}
-	handlerMapping[common.OpRRQ] = mockRRQHandler
-	handlerMapping[common.OpWRQ] = mockWRQHandler
+	s := &Server{
+		handlers: map[common.OpCode]requestHandler{
+			common.OpRRQ: mockRRQHandler,
+			common.OpWRQ: mockWRQHandler,
+		},
+	}
 
 	for i, tc := range testCases {
 		conn := &mockPacketConn{
@@ -134,7 +146,7 @@ func TestHandleHandshake(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		err = handleHandshake(conn)
+		err = s.handleHandshake(conn)
 		if err != nil {
 			t.Log(i)
 			t.Fatal(err)
@@ -158,6 +170,179 @@ func TestHandleHandshake(t *testing.T) {
 	}
 }
 
+func TestHandleHandshakeViolations(t *testing.T) {
+	testCases := []struct {
+		packet   []byte
+		expected common.Violation
+		noReply  bool
+	}{
+		{packet: []byte{1}, expected: common.ViolationShortPacket},
+		{packet: []byte{0, 99}, expected: common.ViolationBadOpcode},
+		{packet: []byte{0, 4, 0, 1}, expected: common.ViolationBadOpcode},
+		{packet: []byte{0, 1, 'a', 'b'}, expected: common.ViolationMalformed},
+		{packet: make([]byte, common.MaxPacketSize), expected: common.ViolationMalformed},
+		// ERRORs are never answered
+		{packet: common.CreateErrorPacket(common.ErrNotDefined, "x"), expected: common.ViolationBadOpcode, noReply: true},
+	}
+
+	for i, tc := range testCases {
+		s := &Server{}
+		conn := &mockPacketConn{
+			data: bytes.NewBuffer(tc.packet),
+			addr: mockAddr{},
+		}
+		if err := s.handleHandshake(conn); err == nil {
+			t.Errorf("Expected an error (%d)", i)
+		}
+		counts := s.Violations()
+		if counts[mockAddr{}.String()][tc.expected] != 1 {
+			t.Errorf("Expected %v to be recorded, got %v (%d)", tc.expected, counts, i)
+		}
+		if tc.noReply {
+			if conn.data.Len() != 0 {
+				t.Errorf("Expected no reply, got %s (%d)", common.DumpPacket(conn.data.Bytes()), i)
+			}
+			continue
+		}
+		if e, err := common.ParseErrorPacket(conn.data.Bytes()); err != nil || e.Code != common.ErrIllegalOperation {
+			t.Errorf("Expected an illegal operation ERROR, got %v, %v (%d)", e, err, i)
+		}
+	}
+}
+
+func TestViolationsBounded(t *testing.T) {
+	s := &Server{}
+	addr := func(i int) net.Addr {
+		return &net.UDPAddr{IP: net.IPv4(10, 0, byte(i>>8), byte(i)), Port: 69}
+	}
+	for i := 0; i < maxViolationHosts+2; i++ {
+		s.violations.record(addr(i), common.ViolationBadOpcode)
+	}
+	s.violations.merge(common.ViolationCounts{"10.0.0.0": {common.ViolationBadBlock: 3}})
+
+	counts := s.Violations()
+	if len(counts) != maxViolationHosts+1 {
+		t.Errorf("Expected %d hosts, got %d", maxViolationHosts+1, len(counts))
+	}
+	testCases := []struct {
+		host     string
+		expected map[common.Violation]int
+	}{
+		{host: "10.0.0.0", expected: map[common.Violation]int{common.ViolationBadOpcode: 1, common.ViolationBadBlock: 3}},
+		{host: common.HostOf(addr(maxViolationHosts - 1)), expected: map[common.Violation]int{common.ViolationBadOpcode: 1}},
+		{host: common.HostOf(addr(maxViolationHosts))},
+		{host: otherHosts, expected: map[common.Violation]int{common.ViolationBadOpcode: 2}},
+	}
+	for i, tc := range testCases {
+		if got := counts[tc.host]; !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %v from %s, got %v (%d)", tc.expected, tc.host, got, i)
+		}
+	}
+}
+
+func TestCheckFilename(t *testing.T) {
+	testCases := []struct {
+		filename string
+		accepted bool
+	}{
+		{filename: "pxelinux.0", accepted: true},
+		{filename: "pxelinux.cfg/default", accepted: true},
+		{filename: "boot\\x86\\wdsnbp.com", accepted: true},
+		{filename: "a..b/..c", accepted: true},
+		{filename: "/etc/passwd", accepted: false},
+		{filename: "\\windows\\win.ini", accepted: false},
+		{filename: "C:\\boot.ini", accepted: false},
+		{filename: "c:boot.ini", accepted: false},
+		{filename: "..", accepted: false},
+		{filename: "../etc/passwd", accepted: false},
+		{filename: "images/../../etc/passwd", accepted: false},
+		{filename: "images\\..\\..\\secret", accepted: false},
+		{filename: "images/..", accepted: false},
+	}
+
+	for i, tc := range testCases {
+		err := checkFilename(tc.filename)
+		if (err == nil) != tc.accepted {
+			t.Errorf("Expected %q accepted = %v, got %v (%d)", tc.filename, tc.accepted, err, i)
+		}
+	}
+}
+
+func TestHandleHandshakeTraversal(t *testing.T) {
+	packet := common.RequestPacket{OpCode: common.OpRRQ, Filename: "/etc/passwd", Mode: common.ModeOctet}
+	conn := &mockPacketConn{data: bytes.NewBuffer(packet.ToBytes()), addr: mockAddr{}}
+	s := &Server{}
+	if err := s.handleHandshake(conn); err == nil {
+		t.Fatal("Expected absolute path to be rejected")
+	}
+
+	e, err := common.ParseErrorPacket(conn.data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != common.ErrAccessViolation {
+		t.Errorf("Unexpected error sent: %v", e)
+	}
+}
+
+func TestHandleHandshakeUnknownMode(t *testing.T) {
+	packet := common.RequestPacket{OpCode: common.OpRRQ, Filename: "f", Mode: "Binary"}
+	conn := &mockPacketConn{data: bytes.NewBuffer(packet.ToBytes()), addr: mockAddr{}}
+	s := &Server{}
+	if err := s.handleHandshake(conn); err == nil {
+		t.Fatal("Expected unknown mode to be rejected")
+	}
+
+	e, err := common.ParseErrorPacket(conn.data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Code != common.ErrIllegalOperation || e.Message != `Unknown mode "binary"` {
+		t.Errorf("Unexpected error sent: %v", e)
+	}
+}
+
+func TestHandleHandshakeOctetOnly(t *testing.T) {
+	testCases := []struct {
+		mode     string
+		expected string
+	}{
+		{mode: "octet"},
+		{mode: "OCTET"},
+		{mode: "netascii", expected: `Mode "netascii" not supported, only octet`},
+		{mode: "NetASCII", expected: `Mode "netascii" not supported, only octet`},
+		{mode: "mail", expected: `Mode "mail" not supported, only octet`},
+	}
+
+	for i, tc := range testCases {
+		packet := common.RequestPacket{OpCode: common.OpRRQ, Filename: "f", Mode: tc.mode}
+		conn := &mockPacketConn{data: bytes.NewBuffer(packet.ToBytes()), addr: mockAddr{}}
+		s := &Server{OctetOnly: true, handlers: map[common.OpCode]requestHandler{
+			common.OpRRQ: requestHandlerFunc(func(net.PacketConn, *Request) {}),
+		}}
+		err := s.handleHandshake(conn)
+		s.active.Wait()
+		if tc.expected == "" {
+			if err != nil {
+				t.Errorf("Expected %s to be served, got %v (%d)", tc.mode, err, i)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("Expected %s to be refused (%d)", tc.mode, i)
+			continue
+		}
+		e, err := common.ParseErrorPacket(conn.data.Bytes())
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		if e.Code != common.ErrIllegalOperation || e.Message != tc.expected {
+			t.Errorf("Unexpected error sent: %v (%d)", e, i)
+		}
+	}
+}
+
 func TestGetOpcode(t *testing.T) {
 	testCases := []struct {
 		data           []byte
@@ -211,3 +396,622 @@ func TestGetOpcode(t *testing.T) {
 		}
 	}
 }
+
+// startServer serves s on a loopback socket, returning the address to send
+// requests to and a channel receiving Serve's result. Its logs are discarded
+// unless it has a Logger.
+func startServer(t *testing.T, s *Server) (net.Addr, chan error) {
+	if s.Logger == nil {
+		s.Logger = slog.New(slog.DiscardHandler)
+	}
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.Serve(conn) }()
+	t.Cleanup(func() { s.Close() })
+	return conn.LocalAddr(), done
+}
+
+// sendRequest sends an RRQ or WRQ for filename from a fresh socket.
+func sendRequest(t *testing.T, addr net.Addr, op common.OpCode, filename string) net.PacketConn {
+	local := "127.0.0.1:0"
+	if ip, ok := addrIP(addr); ok && ip.Is6() {
+		local = "[::1]:0"
+	}
+	conn, err := net.ListenPacket("udp", local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	req := common.RequestPacket{OpCode: op, Filename: filename, Mode: common.ModeOctet}
+	if _, err := conn.WriteTo(req.ToBytes(), addr); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// getFile downloads filename from the server at addr.
+func getFile(t *testing.T, addr net.Addr, filename string) ([]byte, error) {
+	conn := sendRequest(t, addr, common.OpRRQ, filename)
+	var buf bytes.Buffer
+	_, err := receiveFile(&buf, conn, addr, filename)
+	return buf.Bytes(), err
+}
+
+// receiveFile writes to w the file conn asked the server at addr for with
+// an RRQ for filename, following the server to its transfer ID.
+func receiveFile(w io.Writer, conn net.PacketConn, addr net.Addr, filename string) (common.TransferStats, error) {
+	rrq := common.RequestPacket{OpCode: common.OpRRQ, Filename: filename, Mode: common.ModeOctet}
+	return common.WriteFileLoopOptions(w, conn, addr, common.LoopOptions{Request: rrq.ToBytes()})
+}
+
+func TestServeIPv6(t *testing.T) {
+	s := &Server{ReadHandler: namedHandler("v6")}
+	bound, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback not available: %v", err)
+	}
+	go s.Serve(bound)
+	t.Cleanup(func() { s.Close() })
+	wildcard, err := net.ListenPacket("udp6", "[::]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(wildcard)
+
+	testCases := []net.Addr{
+		bound.LocalAddr(),
+		// Transfer sockets of a wildcard listener must match the client's family
+		&net.UDPAddr{IP: net.IPv6loopback, Port: wildcard.LocalAddr().(*net.UDPAddr).Port},
+	}
+	for i, addr := range testCases {
+		got, err := getFile(t, addr, "kernel")
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		if string(got) != "v6" {
+			t.Errorf("Expected %q, got %q (%d)", "v6", got, i)
+		}
+	}
+}
+
+func TestServeAndShutdown(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	data := bytes.Repeat([]byte("boot"), 1000)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	addr, done := startServer(t, s)
+
+	got, err := getFile(t, addr, "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("Downloaded data does not match")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed from Serve, got %v", err)
+	}
+	if err := s.ListenAndServe(); err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed from ListenAndServe, got %v", err)
+	}
+}
+
+func TestListenThenServe(t *testing.T) {
+	s := &Server{Addr: "127.0.0.1:0", ReadHandler: namedHandler("bound early"), Logger: slog.New(slog.DiscardHandler)}
+	conns, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 {
+		t.Fatalf("Expected 1 listener, got %d", len(conns))
+	}
+	done := make(chan error, 1)
+	go func() { done <- s.ServeListeners(conns) }()
+
+	got, err := getFile(t, conns[0].LocalAddr(), "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "bound early" {
+		t.Errorf("Expected %q, got %q", "bound early", got)
+	}
+
+	s.Close()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("Expected ErrServerClosed, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeListeners didn't return after Close")
+	}
+}
+
+func TestReadTimeoutAbandonsTransfer(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{ReadTimeout: 50 * time.Millisecond}
+	addr, _ := startServer(t, s)
+
+	// Request the file but never acknowledge it
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Expected transfer to time out before shutdown did, got %v", err)
+	}
+}
+
+func TestIdleTimeoutIgnoresStrangers(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{IdleTimeout: 100 * time.Millisecond}
+	addr, _ := startServer(t, s)
+
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A stranger keeps poking the transfer, which mustn't keep it alive
+	stranger, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				stranger.WriteTo(common.CreateAckPacket(1), from)
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Expected idle transfer to be abandoned before shutdown gave up, got %v", err)
+	}
+}
+
+func TestRetransmitData(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	data := make([]byte, 2000)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var stats common.TransferStats
+	s := &Server{
+		RetransmitTimeout: 20 * time.Millisecond,
+		Retries:           2,
+		OnTransferEnd:     func(e TransferEvent) { stats = e.Stats },
+	}
+	addr, _ := startServer(t, s)
+
+	// Ignore the first DATA packet, which should come again
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	var got bytes.Buffer
+	if _, err := receiveFile(&got, conn, addr, "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Errorf("Received data does not match")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Retransmits != 1 {
+		t.Errorf("Expected 1 retransmit, got %d", stats.Retransmits)
+	}
+}
+
+func TestRetransmitGivesUp(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{RetransmitTimeout: 20 * time.Millisecond, Retries: 2}
+	addr, _ := startServer(t, s)
+
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	for i := 0; i < 3; i++ {
+		if _, _, err := conn.ReadFrom(buf); err != nil {
+			t.Fatalf("Expected DATA %d, got %v", i, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Expected transfer to be abandoned after retries, got %v", err)
+	}
+}
+
+// slowWriter takes delay over every write.
+type slowWriter struct {
+	bytes.Buffer
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(b []byte) (int, error) {
+	time.Sleep(w.delay)
+	return w.Buffer.Write(b)
+}
+
+func TestMaxTransferDuration(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), make([]byte, 20*common.BlockSize), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{ReadTimeout: time.Second, MaxTransferDuration: 200 * time.Millisecond}
+	addr, _ := startServer(t, s)
+
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	w := &slowWriter{delay: 50 * time.Millisecond}
+	_, err := receiveFile(w, conn, addr, "kernel")
+	expected := &common.Error{Code: common.ErrNotDefined, Message: errTransferTooLong.Error()}
+	if !reflect.DeepEqual(err, expected) {
+		t.Errorf("Expected %v, got %v", expected, err)
+	}
+	if w.Len() >= 20*common.BlockSize {
+		t.Errorf("Expected the transfer to be cut short, got all %d bytes", w.Len())
+	}
+}
+
+func TestRolloverOption(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), []byte("vmlinuz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	addr, _ := startServer(t, &Server{})
+
+	testCases := []struct {
+		op       common.OpCode
+		rollover string
+		// acked is the OACK expected, nil for a plain reply
+		acked map[string]string
+	}{
+		{op: common.OpRRQ, rollover: "1", acked: map[string]string{"rollover": "1"}},
+		{op: common.OpRRQ, rollover: "0", acked: map[string]string{"rollover": "0"}},
+		{op: common.OpRRQ, rollover: "2"},
+		{op: common.OpWRQ, rollover: "1", acked: map[string]string{"rollover": "1"}},
+	}
+
+	for i, tc := range testCases {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		req := common.RequestPacket{OpCode: tc.op, Filename: "kernel", Mode: common.ModeOctet, Options: map[string]string{"rollover": tc.rollover}}
+		if _, err := conn.WriteTo(req.ToBytes(), addr); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, common.MaxPacketSize)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		acked, _ := common.ParseOACKPacket(buf[:n])
+		if !reflect.DeepEqual(acked, tc.acked) {
+			t.Errorf("Expected OACK of %v, got %s (%d)", tc.acked, common.DumpPacket(buf[:n]), i)
+			continue
+		}
+		if tc.op != common.OpRRQ || acked == nil {
+			continue
+		}
+		// The first block follows the client's ACK of the OACK
+		conn.WriteTo(common.CreateAckPacket(0), from)
+		n, _, err = conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := common.DumpPacket(buf[:n]); got != "DATA block=1 len=7 data=766d6c696e757a" {
+			t.Errorf("Expected the first block, got %s (%d)", got, i)
+		}
+		conn.WriteTo(common.CreateAckPacket(1), from)
+	}
+}
+
+func TestUtimeoutOption(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), []byte("vmlinuz"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// The server doesn't resend by itself, only at the client's request
+	addr, _ := startServer(t, &Server{})
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	req := common.RequestPacket{OpCode: common.OpRRQ, Filename: "kernel", Mode: common.ModeOctet, Options: map[string]string{"utimeout": "20000"}}
+	if _, err := conn.WriteTo(req.ToBytes(), addr); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, common.MaxPacketSize)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := common.DumpPacket(buf[:n]); got != `OACK "utimeout"="20000"` {
+		t.Fatalf("Expected utimeout to be acknowledged, got %s", got)
+	}
+	conn.WriteTo(common.CreateAckPacket(0), from)
+
+	// Without an ACK the first block comes again after 20ms
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := common.DumpPacket(buf[:n]); got != "DATA block=1 len=7 data=766d6c696e757a" {
+			t.Errorf("Expected the first block, got %s (%d)", got, i)
+		}
+		if i > 0 && time.Since(start) > time.Second {
+			t.Errorf("Expected a resend within the requested timeout, took %v", time.Since(start))
+		}
+	}
+	conn.WriteTo(common.CreateAckPacket(1), from)
+}
+
+func TestCloseAbortsTransfers(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	addr, _ := startServer(t, s)
+
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Expected Close to end active transfers, got %v", err)
+	}
+}
+
+func TestShutdownGracePeriod(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), make([]byte, 2000), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	addr, done := startServer(t, s)
+
+	// Start a transfer that stalls after the first block
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected shutdown to hit its deadline, got %v", err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed from Serve, got %v", err)
+	}
+
+	// The stalled transfer's socket has been closed, so it finishes promptly
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("Expected remaining transfers to be closed, got %v", err)
+	}
+}
+
+func TestShutdownDrainsTransfers(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+	data := bytes.Repeat([]byte("x"), 5000)
+	if err := os.WriteFile(filepath.Join(dir, "kernel"), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{}
+	addr, _ := startServer(t, s)
+
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- s.Shutdown(context.Background()) }()
+
+	// The in-flight download completes even though shutdown has started
+	received := n - 4
+	for block := uint16(1); ; block++ {
+		if _, err := conn.WriteTo(common.CreateAckPacket(block), from); err != nil {
+			t.Fatal(err)
+		}
+		if n < 4+common.BlockSize {
+			break
+		}
+		if n, _, err = conn.ReadFrom(buf); err != nil {
+			t.Fatal(err)
+		}
+		received += n - 4
+	}
+	if received != len(data) {
+		t.Errorf("Expected %d bytes, got %d", len(data), received)
+	}
+
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Shutdown didn't return after the transfer finished")
+	}
+}
+
+func TestServeOne(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{ReadHandler: namedHandler("once")}
+	client := sendRequest(t, conn.LocalAddr(), common.OpRRQ, "kernel")
+
+	done := make(chan error, 1)
+	go func() { done <- s.ServeOne(conn) }()
+	var buf bytes.Buffer
+	if _, err := receiveFile(&buf, client, conn.LocalAddr(), "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "once" {
+		t.Errorf("Expected %q, got %q", "once", buf.String())
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("ServeOne didn't return after the transfer")
+	}
+	if _, _, err := conn.ReadFrom(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected the listener to be closed, got %v", err)
+	}
+}
+
+func TestSlowRequestDoesNotBlockOthers(t *testing.T) {
+	release := make(chan struct{})
+	slow := func(req *Request) error {
+		if req.Filename == "slow" {
+			<-release
+		}
+		return nil
+	}
+	s := &Server{HandshakeWorkers: 2, Filters: []RequestFilter{slow}, ReadHandler: namedHandler("fast")}
+	addr, _ := startServer(t, s)
+	defer close(release)
+
+	sendRequest(t, addr, common.OpRRQ, "slow")
+	got, err := getFile(t, addr, "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "fast" {
+		t.Errorf("Expected %q, got %q", "fast", got)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "kernel")
+	if err := os.WriteFile(file, []byte("kernel"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		s        *Server
+		expected []string
+	}{
+		{s: &Server{Root: root}},
+		{s: &Server{Root: filepath.Join(root, "missing")}, expected: []string{"Root " + filepath.Join(root, "missing") + " doesn't exist"}},
+		{s: &Server{Root: root, UploadRoot: file}, expected: []string{"UploadRoot " + file + " isn't a directory"}},
+		{s: &Server{Root: file, Backend: &mapBackend{}}},
+		{
+			s: &Server{Root: root, DenyFiles: []string{"["}, DSCP: 64},
+			expected: []string{
+				`Invalid deny pattern "[": syntax error in pattern`,
+				"Invalid DSCP 64, must be between 0 and 63",
+			},
+		},
+		{
+			s: &Server{Root: root, ReadHandler: Dir(root), CoalesceReads: 1 << 20, OpenFiles: 4},
+			expected: []string{
+				"CoalesceReads can't be combined with a custom ReadHandler",
+				"OpenFiles only applies to files read from Root, not a Backend or custom ReadHandler",
+			},
+		},
+		{
+			s:        &Server{Backend: &mapBackend{}, CoalesceReads: 1 << 20, OpenFiles: 4},
+			expected: []string{"OpenFiles only applies to files read from Root, not a Backend or custom ReadHandler"},
+		},
+	}
+
+	for i, tc := range testCases {
+		var got []string
+		if err := tc.s.Check(); err != nil {
+			got = strings.Split(err.Error(), "\n")
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package server
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// muxQueueSize is how many packets may wait for a transfer in single port
+// mode before more are dropped, as a full socket buffer would.
+const muxQueueSize = 16
+
+// portMux shares a listener between the transfers served from it in single
+// port mode. Packets read by the listener's loop from a client with a
+// transfer running are handed to that transfer rather than treated as new
+// requests, and transfers reply through the listener.
+type portMux struct {
+	conn net.PacketConn
+
+	mu       sync.Mutex
+	peers    map[string]*muxConn
+	draining bool
+}
+
+func newPortMux(conn net.PacketConn) *portMux {
+	return &portMux{conn: conn, peers: make(map[string]*muxConn)}
+}
+
+// open returns the connection of a transfer with peer, or false if peer
+// already has one, as when a request is retransmitted before its transfer
+// starts.
+func (m *portMux) open(peer net.Addr) (*muxConn, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.peers[peer.String()]; ok {
+		return nil, false
+	}
+	c := &muxConn{
+		mux:      m,
+		peer:     peer,
+		packets:  make(chan []byte, muxQueueSize),
+		closed:   make(chan struct{}),
+		deadline: make(chan struct{}, 1),
+	}
+	m.peers[peer.String()] = c
+	return c, true
+}
+
+// deliver hands packet to the transfer with addr, returning false if there
+// is none. packet must not be reused by the caller.
+func (m *portMux) deliver(addr net.Addr, packet []byte) bool {
+	m.mu.Lock()
+	c, ok := m.peers[addr.String()]
+	m.mu.Unlock()
+	if !ok {
+		return false
+	}
+	// A retransmitted request isn't news to a transfer that has started
+	if op, err := common.GetOpCode(packet); err == nil && (op == common.OpRRQ || op == common.OpWRQ) {
+		return true
+	}
+	select {
+	case c.packets <- packet:
+	default:
+	}
+	return true
+}
+
+// pump delivers packets from clients with a transfer running until the
+// listener is closed, dropping everything else.
+func (m *portMux) pump() {
+	for {
+		packet := make([]byte, common.MaxPacketSize)
+		n, addr, err := m.conn.ReadFrom(packet)
+		if err != nil {
+			return
+		}
+		m.deliver(addr, packet[:n])
+	}
+}
+
+// shutdown stops the listener once the transfers using it have finished.
+func (m *portMux) shutdown() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.draining = true
+	if len(m.peers) == 0 {
+		m.conn.Close()
+	}
+}
+
+func (m *portMux) remove(c *muxConn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.peers[c.peer.String()] == c {
+		delete(m.peers, c.peer.String())
+	}
+	if m.draining && len(m.peers) == 0 {
+		m.conn.Close()
+	}
+}
+
+// muxConn is the connection of a transfer in single port mode. It only
+// receives packets from its peer.
+type muxConn struct {
+	mux       *portMux
+	peer      net.Addr
+	packets   chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	mu           sync.Mutex
+	readDeadline time.Time
+	// deadline wakes a blocked ReadFrom when the read deadline changes
+	deadline chan struct{}
+}
+
+func (c *muxConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+
+		select {
+		case packet := <-c.packets:
+			stopTimer(timer)
+			return copy(b, packet), c.peer, nil
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, nil, net.ErrClosed
+		case <-expired:
+			return 0, nil, os.ErrDeadlineExceeded
+		case <-c.deadline:
+			// Start again with the new deadline
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(t *time.Timer) {
+	if t != nil {
+		t.Stop()
+	}
+}
+
+func (c *muxConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+	return c.mux.conn.WriteTo(b, addr)
+}
+
+func (c *muxConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mux.remove(c)
+	})
+	return nil
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.mux.conn.LocalAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	select {
+	case c.deadline <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetWriteDeadline is a no-op, the listener is shared so writes can't be
+// given a deadline of their own.
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestSinglePort(t *testing.T) {
+	backend := &MemoryBackend{}
+	data := bytes.Repeat([]byte("boot"), 1000)
+	backend.Store("kernel", data)
+	s := &Server{SinglePort: true, Backend: backend}
+	addr, _ := startServer(t, s)
+
+	// Replies come from the listener's port
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != addr.String() {
+		t.Errorf("Expected DATA from %v, got %v", addr, from)
+	}
+	if op, _ := common.GetOpCode(buf[:n]); op != common.OpDATA {
+		t.Errorf("Expected DATA, got %s", common.DumpPacket(buf[:n]))
+	}
+	conn.WriteTo(common.CreateErrorPacket(common.ErrNotDefined, "Done"), from)
+
+	// Concurrent transfers are kept apart
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			got, err := getFile(t, addr, "kernel")
+			if err != nil || !bytes.Equal(got, data) {
+				t.Errorf("Download failed: %v", err)
+			}
+		}()
+		go func(i int) {
+			defer wg.Done()
+			name := string(rune('a' + i))
+			if err := putFile(t, addr, name, bytes.Repeat([]byte(name), 2000)); err != nil {
+				t.Errorf("Upload failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < 4; i++ {
+		name := string(rune('a' + i))
+		r, _, err := backend.Open(name)
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		content, _ := io.ReadAll(r)
+		r.Close()
+		if !bytes.Equal(content, bytes.Repeat([]byte(name), 2000)) {
+			t.Errorf("Upload %s does not match (%d)", name, i)
+		}
+	}
+}
+
+func TestSinglePortShutdownDrains(t *testing.T) {
+	backend := &MemoryBackend{}
+	data := make([]byte, 2000)
+	backend.Store("kernel", data)
+	s := &Server{SinglePort: true, Backend: backend}
+	addr, done := startServer(t, s)
+
+	// Start a transfer, then shut down before acknowledging anything
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	buf := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		shutdown <- s.Shutdown(ctx)
+	}()
+
+	// The listener still carries the transfer to the end
+	for block := uint16(1); ; block++ {
+		if _, err := conn.WriteTo(common.CreateAckPacket(block), addr); err != nil {
+			t.Fatal(err)
+		}
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n < 4+common.BlockSize {
+			conn.WriteTo(common.CreateAckPacket(block+1), addr)
+			break
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected the transfer to drain, got %v", err)
+	}
+	if err := <-done; err != ErrServerClosed {
+		t.Errorf("Expected ErrServerClosed from Serve, got %v", err)
+	}
+}
@@ -0,0 +1,102 @@
+//go:build !windows
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestSetDSCP(t *testing.T) {
+	testCases := []struct {
+		network, addr string
+		level, opt    int
+	}{
+		{network: "udp4", addr: "127.0.0.1:0", level: syscall.IPPROTO_IP, opt: syscall.IP_TOS},
+		{network: "udp6", addr: "[::1]:0", level: syscall.IPPROTO_IPV6, opt: syscall.IPV6_TCLASS},
+	}
+
+	for i, tc := range testCases {
+		conn, err := net.ListenUDP(tc.network, mustResolve(t, tc.network, tc.addr))
+		if err != nil {
+			t.Logf("Skipping %s: %v (%d)", tc.network, err, i)
+			continue
+		}
+		// Expedited Forwarding
+		if err := setDSCP(conn, 46); err != nil {
+			t.Errorf("%v (%d)", err, i)
+		}
+		raw, err := conn.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tos int
+		raw.Control(func(fd uintptr) {
+			tos, err = syscall.GetsockoptInt(int(fd), tc.level, tc.opt)
+		})
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+		} else if tos != 46<<2 {
+			t.Errorf("Expected TOS %#x, got %#x (%d)", 46<<2, tos, i)
+		}
+		conn.Close()
+	}
+}
+
+func mustResolve(t *testing.T, network, addr string) *net.UDPAddr {
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return udpAddr
+}
+
+func TestServeWithDSCP(t *testing.T) {
+	s := &Server{DSCP: 46, ReadHandler: namedHandler("marked")}
+	addr, _ := startServer(t, s)
+	got, err := getFile(t, addr, "kernel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "marked" {
+		t.Errorf("Expected %q, got %q", "marked", got)
+	}
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Server{DSCP: 64}).Serve(conn); err == nil {
+		t.Error("Expected an error for an out of range DSCP")
+	}
+}
+
+func TestSocketBuffers(t *testing.T) {
+	conn, err := net.ListenUDP("udp", mustResolve(t, "udp", "127.0.0.1:0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{ReadBuffer: 64 << 10, WriteBuffer: 32 << 10}
+	if err := s.prepareListener(conn); err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rcvbuf, sndbuf int
+	raw.Control(func(fd uintptr) {
+		rcvbuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		sndbuf, _ = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	// Linux reports double the size asked for, to account for overhead
+	if rcvbuf != 64<<10 && rcvbuf != 128<<10 {
+		t.Errorf("Expected a receive buffer of 64KiB, got %d", rcvbuf)
+	}
+	if sndbuf != 32<<10 && sndbuf != 64<<10 {
+		t.Errorf("Expected a send buffer of 32KiB, got %d", sndbuf)
+	}
+}
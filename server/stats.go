@@ -0,0 +1,53 @@
+package server
+
+import (
+	"expvar"
+	"log/slog"
+	"runtime"
+	"time"
+)
+
+// LogStats logs a snapshot of the server's state: how long it has been
+// serving, its counters, as published by Vars, the goroutine count and then
+// each active transfer with its progress. It suits hosts where the admin
+// API or metrics can't be reached, such as from a SIGUSR1 handler.
+func (s *Server) LogStats() {
+	s.Vars()
+	s.mu.Lock()
+	started := s.startTime
+	s.mu.Unlock()
+	var uptime time.Duration
+	if !started.IsZero() {
+		uptime = time.Since(started).Round(time.Second)
+	}
+
+	var errorCounts []any
+	s.vars.errors.Do(func(kv expvar.KeyValue) {
+		errorCounts = append(errorCounts, slog.String(kv.Key, kv.Value.String()))
+	})
+	transfers := s.Transfers()
+	s.logger().Info("Server stats",
+		"uptime", uptime,
+		"active_transfers", len(transfers),
+		"transfers", s.vars.transfers.Value(),
+		"bytes_sent", s.vars.bytesSent.Value(),
+		"bytes_received", s.vars.bytesReceived.Value(),
+		"malformed", s.vars.malformed.Value(),
+		slog.Group("errors", errorCounts...),
+		"goroutines", runtime.NumGoroutine(),
+	)
+
+	now := time.Now()
+	for _, t := range transfers {
+		s.logger().Info("Active transfer",
+			"id", t.ID,
+			"request_id", t.RequestID,
+			"client", t.Client,
+			"op", t.Op,
+			"file", t.File,
+			"bytes", t.Bytes,
+			"rate", int64(t.Rate),
+			"elapsed", now.Sub(t.Started).Round(time.Millisecond),
+		)
+	}
+}
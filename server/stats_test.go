@@ -0,0 +1,89 @@
+package server
+
+import (
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestLogStats(t *testing.T) {
+	backend := &MemoryBackend{}
+	backend.Store("kernel", make([]byte, 2000))
+	var buf syncBuffer
+	s := &Server{Backend: backend, Logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+	addr, _ := startServer(t, s)
+
+	// Leave a transfer waiting for its first ACK
+	conn := sendRequest(t, addr, common.OpRRQ, "kernel")
+	packet := make([]byte, common.MaxPacketSize)
+	if _, _, err := conn.ReadFrom(packet); err != nil {
+		t.Fatal(err)
+	}
+	s.LogStats()
+
+	var stats, active map[string]any
+	for _, r := range buf.records(t, 2) {
+		switch r["msg"] {
+		case "Server stats":
+			stats = r
+		case "Active transfer":
+			active = r
+		}
+	}
+	if stats == nil || active == nil {
+		t.Fatalf("Expected stats and an active transfer, got %v and %v", stats, active)
+	}
+	if stats["active_transfers"] != float64(1) || stats["transfers"] != float64(1) || stats["goroutines"] == nil || stats["uptime"] == nil {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+	if active["file"] != "kernel" || active["op"] != "RRQ" || active["bytes"] != float64(512) {
+		t.Errorf("Unexpected transfer %v", active)
+	}
+}
+
+func TestSummaryInterval(t *testing.T) {
+	backend := &MemoryBackend{}
+	backend.Store("kernel", make([]byte, 2000))
+	var buf syncBuffer
+	s := &Server{Backend: backend, SummaryInterval: 50 * time.Millisecond, Logger: slog.New(slog.NewJSONHandler(&buf, nil))}
+	addr, _ := startServer(t, s)
+
+	if _, err := getFile(t, addr, "kernel"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := getFile(t, addr, "missing"); err == nil {
+		t.Fatal("Expected missing file to fail")
+	}
+	if _, err := getFile(t, addr, "../etc/passwd"); err == nil {
+		t.Fatal("Expected traversal to be refused")
+	}
+
+	// The counts may be spread over several lines. A transfer may still be
+	// winding down when the next starts, so the peak is checked
+	// separately.
+	expected := map[string]float64{"completed": 1, "failed": 1, "dropped": 1, "bytes_sent": 2000}
+	var peak float64
+	var got map[string]float64
+	for deadline := time.Now().Add(2 * time.Second); !reflect.DeepEqual(got, expected); {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %v, got %v", expected, got)
+		}
+		time.Sleep(10 * time.Millisecond)
+		got = make(map[string]float64)
+		for _, r := range buf.records(t, 0) {
+			if r["msg"] != "Summary" {
+				continue
+			}
+			for k := range expected {
+				got[k] += r[k].(float64)
+			}
+			peak = max(peak, r["peak_transfers"].(float64))
+		}
+	}
+	if peak < 1 || peak > 2 {
+		t.Errorf("Expected a peak of 1 or 2 transfers, got %v", peak)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// A StatsD sends metrics to a StatsD or DogStatsD server over UDP. Metrics
+// are fire and forget, a slow or missing StatsD server never holds up a
+// transfer. It is safe for concurrent use, and a nil *StatsD sends nothing.
+//
+// For every finished transfer it sends the counters transfers.<op>.<outcome>,
+// bytes_sent or bytes_received and retransmits, and the timer
+// transfer_time.<op>. Every ERROR packet sent counts towards errors.<code>,
+// and every malformed packet received on the request port towards malformed.
+type StatsD struct {
+	conn   net.Conn
+	prefix string
+	suffix string
+}
+
+// DialStatsD returns a StatsD sending to the server at addr. Every metric
+// name starts with prefix. If tags are given they are added to every metric
+// in DogStatsD format, for example "env:prod".
+func DialStatsD(addr, prefix string, tags ...string) (*StatsD, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("Error dialing StatsD: %v", err)
+	}
+	s := &StatsD{conn: conn, prefix: prefix}
+	if len(tags) > 0 {
+		s.suffix = "|#" + strings.Join(tags, ",")
+	}
+	return s, nil
+}
+
+// Close closes the connection to the StatsD server.
+func (s *StatsD) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+// transfer sends the metrics for a finished transfer in a single datagram.
+func (s *StatsD) transfer(op common.OpCode, stats common.TransferStats, outcome string) {
+	if s == nil {
+		return
+	}
+	name := strings.ToLower(op.String())
+	var b bytes.Buffer
+	s.appendMetric(&b, "transfers."+name+"."+outcome, 1, "c")
+	switch op {
+	case common.OpRRQ:
+		s.appendMetric(&b, "bytes_sent", stats.Bytes, "c")
+	case common.OpWRQ:
+		s.appendMetric(&b, "bytes_received", stats.Bytes, "c")
+	}
+	s.appendMetric(&b, "retransmits", int64(stats.Retransmits), "c")
+	s.appendMetric(&b, "transfer_time."+name, stats.Duration.Milliseconds(), "ms")
+	s.conn.Write(b.Bytes())
+}
+
+// error counts an ERROR packet sent to a client.
+func (s *StatsD) error(code uint16) {
+	if s == nil {
+		return
+	}
+	var b bytes.Buffer
+	s.appendMetric(&b, "errors."+strconv.Itoa(int(code)), 1, "c")
+	s.conn.Write(b.Bytes())
+}
+
+// malformed counts a malformed packet received on the request port.
+func (s *StatsD) malformed() {
+	if s == nil {
+		return
+	}
+	var b bytes.Buffer
+	s.appendMetric(&b, "malformed", 1, "c")
+	s.conn.Write(b.Bytes())
+}
+
+// appendMetric appends a metric line, <prefix><name>:<value>|<type>[|#tags].
+// Lines after the first are newline separated.
+func (s *StatsD) appendMetric(b *bytes.Buffer, name string, value int64, typ string) {
+	if b.Len() > 0 {
+		b.WriteByte('\n')
+	}
+	fmt.Fprintf(b, "%s%s:%d|%s%s", s.prefix, name, value, typ, s.suffix)
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"io"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// statsdLines reads datagrams from conn until n metric lines have arrived.
+func statsdLines(t *testing.T, conn net.PacketConn, n int) []string {
+	var lines []string
+	buf := make([]byte, 1500)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for len(lines) < n {
+		m, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("Expected %d lines, got %q: %v", n, lines, err)
+		}
+		lines = append(lines, strings.Split(string(buf[:m]), "\n")...)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestStatsD(t *testing.T) {
+	sink, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	testCases := []struct {
+		tags     []string
+		file     string
+		expected []string
+	}{
+		{
+			file: "kernel",
+			expected: []string{
+				"tftp.bytes_sent:1000|c",
+				"tftp.retransmits:0|c",
+				"tftp.transfer_time.rrq:0|ms",
+				"tftp.transfers.rrq.ok:1|c",
+			},
+		},
+		{
+			tags: []string{"env:test", "site:lab"},
+			file: "missing",
+			expected: []string{
+				"tftp.bytes_sent:0|c|#env:test,site:lab",
+				"tftp.errors.1:1|c|#env:test,site:lab",
+				"tftp.retransmits:0|c|#env:test,site:lab",
+				"tftp.transfer_time.rrq:0|ms|#env:test,site:lab",
+				"tftp.transfers.rrq.failed:1|c|#env:test,site:lab",
+			},
+		},
+	}
+
+	for i, tc := range testCases {
+		statsd, err := DialStatsD(sink.LocalAddr().String(), "tftp.", tc.tags...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Server{
+			ReadHandler: ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+				if req.Filename != "kernel" {
+					return nil, 0, os.ErrNotExist
+				}
+				return io.NopCloser(strings.NewReader(strings.Repeat("k", 1000))), 1000, nil
+			}),
+			StatsD: statsd,
+		}
+		addr, _ := startServer(t, s)
+		getFile(t, addr, tc.file)
+
+		got := statsdLines(t, sink, len(tc.expected))
+		// A loopback transfer can take a few milliseconds
+		for j, line := range got {
+			if strings.HasPrefix(line, "tftp.transfer_time.rrq:") {
+				got[j] = "tftp.transfer_time.rrq:0|ms" + line[strings.Index(line, "|ms")+3:]
+			}
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+		statsd.Close()
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// summary counts what happened since the last summary line was logged.
+type summary struct {
+	mu sync.Mutex
+	summaryCounts
+}
+
+type summaryCounts struct {
+	completed     int64
+	failed        int64
+	bytesSent     int64
+	bytesReceived int64
+	// dropped counts requests refused or dropped before their transfer
+	// started.
+	dropped int64
+	// peak is the most transfers active at once.
+	peak int
+}
+
+// transfer counts a finished transfer, err being its outcome.
+func (m *summary) transfer(op common.OpCode, stats common.TransferStats, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err == nil {
+		m.completed++
+	} else {
+		m.failed++
+	}
+	switch op {
+	case common.OpRRQ:
+		m.bytesSent += stats.Bytes
+	case common.OpWRQ:
+		m.bytesReceived += stats.Bytes
+	}
+}
+
+func (m *summary) drop() {
+	m.mu.Lock()
+	m.dropped++
+	m.mu.Unlock()
+}
+
+// active records that n transfers are running.
+func (m *summary) active(n int) {
+	m.mu.Lock()
+	m.peak = max(m.peak, n)
+	m.mu.Unlock()
+}
+
+// take returns the counts and resets them, with the peak starting again
+// from the n transfers running.
+func (m *summary) take(n int) summaryCounts {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	taken := m.summaryCounts
+	m.summaryCounts = summaryCounts{peak: n}
+	return taken
+}
+
+// logSummaries logs a line of the counts every interval until the server
+// shuts down, for deployments without metrics to still see trends.
+func (s *Server) logSummaries(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if s.shuttingDown() {
+			return
+		}
+		m := s.summary.take(s.activeTransfers())
+		s.logger().Info("Summary",
+			"interval", interval,
+			"completed", m.completed,
+			"failed", m.failed,
+			"bytes_sent", m.bytesSent,
+			"bytes_received", m.bytesReceived,
+			"peak_transfers", m.peak,
+			"dropped", m.dropped,
+		)
+	}
+}
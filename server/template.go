@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"text/template"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// TemplateData is what templates rendered by TemplateHandler are executed
+// with.
+type TemplateData struct {
+	// Filename is the requested filename.
+	Filename string
+	// ClientIP is the IP the request came from.
+	ClientIP string
+	// MAC is the client's MAC address, colon separated, when the filename
+	// is a pxelinux style per-host config such as
+	// pxelinux.cfg/01-88-99-aa-bb-cc-dd, and empty otherwise.
+	MAC string
+	// Metadata is the request's metadata, as set by request filters.
+	Metadata map[string]string
+}
+
+// TemplateHandler returns a ReadHandler rendering t for every request, so a
+// single template can replace thousands of near identical per-host files:
+//
+//	t := template.Must(template.ParseFiles("host.cfg.tmpl"))
+//	mux.HandleRead("pxelinux.cfg/01-*", server.TemplateHandler(t))
+//
+// A template error is reported to the client as ERROR 0.
+func TemplateHandler(t *template.Template) ReadHandler {
+	return ContentFunc(func(req *Request) (io.Reader, int64, error) {
+		data := TemplateData{
+			Filename: req.Filename,
+			ClientIP: common.HostOf(req.RemoteAddr),
+			Metadata: req.Metadata.All(),
+		}
+		if mac, ok := pxelinuxMAC(req.Filename); ok {
+			data.MAC = mac.String()
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, data); err != nil {
+			return nil, 0, err
+		}
+		return &buf, int64(buf.Len()), nil
+	})
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestTemplateHandler(t *testing.T) {
+	tmpl := template.Must(template.New("host").Parse(
+		`{{if .MAC}}host {{.MAC}}{{else}}file {{.Filename}}{{end}} ip {{.ClientIP}} site {{.Metadata.site}}{{if eq .Filename "broken"}}{{.Missing}}{{end}}`))
+	s := &Server{
+		ReadHandler: TemplateHandler(tmpl),
+		Filters: []RequestFilter{func(req *Request) error {
+			req.Metadata.Set("site", "lab")
+			return nil
+		}},
+	}
+	addr, _ := startServer(t, s)
+
+	testCases := []struct {
+		filename string
+		expected string
+	}{
+		{filename: "pxelinux.cfg/01-88-99-AA-bb-cc-dd", expected: "host 88:99:aa:bb:cc:dd ip 127.0.0.1 site lab"},
+		{filename: "pxelinux.cfg/default", expected: "file pxelinux.cfg/default ip 127.0.0.1 site lab"},
+		{filename: "pxelinux.cfg/01-88-99", expected: "file pxelinux.cfg/01-88-99 ip 127.0.0.1 site lab"},
+	}
+	for i, tc := range testCases {
+		got, err := getFile(t, addr, tc.filename)
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		if string(got) != tc.expected {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+	}
+
+	_, err := getFile(t, addr, "broken")
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrNotDefined {
+		t.Errorf("Expected ERROR 0 for a failed template, got %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// Not defined by package syscall
+const (
+	ipv6Transparent      = 0x4b
+	ipv6RecvOrigDstAddr  = 0x4a
+	ipv6OrigDstAddr      = 0x4a
+	origDstOOBBufferSize = 128
+)
+
+// transparentControl marks a socket IP_TRANSPARENT before it is bound, which
+// allows binding to, and receiving packets for, non-local addresses. It
+// requires CAP_NET_ADMIN.
+func transparentControl(network, address string, c syscall.RawConn) error {
+	var sockErr error
+	err := c.Control(func(fd uintptr) {
+		level, opt := syscall.SOL_IP, syscall.IP_TRANSPARENT
+		if network == "udp6" {
+			level, opt = syscall.SOL_IPV6, ipv6Transparent
+		}
+		sockErr = syscall.SetsockoptInt(int(fd), level, opt, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("Error setting IP_TRANSPARENT: %v", sockErr)
+	}
+	return nil
+}
+
+// enableOrigDst asks the kernel to report the original destination of every
+// packet received on conn.
+func enableOrigDst(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVORIGDSTADDR, 1)
+		if sockErr != nil {
+			return
+		}
+		// Only possible on IPv6 sockets, IPv4 sockets ignore the failure
+		syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6RecvOrigDstAddr, 1)
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("Error setting IP_RECVORIGDSTADDR: %v", sockErr)
+	}
+	return nil
+}
+
+// parseOrigDst extracts the original destination from the control messages
+// of a packet read from a socket set up by enableOrigDst.
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing control messages: %v", err)
+	}
+	return origDstFromMessages(msgs)
+}
+
+func origDstFromMessages(msgs []syscall.SocketControlMessage) (*net.UDPAddr, error) {
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_IP && m.Header.Type == syscall.IP_ORIGDSTADDR:
+			// struct sockaddr_in
+			if len(m.Data) < 8 {
+				return nil, fmt.Errorf("Original destination too short")
+			}
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[4:8]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		case m.Header.Level == syscall.SOL_IPV6 && m.Header.Type == ipv6OrigDstAddr:
+			// struct sockaddr_in6
+			if len(m.Data) < 24 {
+				return nil, fmt.Errorf("Original destination too short")
+			}
+			return &net.UDPAddr{
+				IP:   net.IP(append([]byte(nil), m.Data[8:24]...)),
+				Port: int(binary.BigEndian.Uint16(m.Data[2:4])),
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("No original destination in control messages")
+}
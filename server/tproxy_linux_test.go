@@ -0,0 +1,91 @@
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestOrigDstFromMessages(t *testing.T) {
+	testCases := []struct {
+		msg         syscall.SocketControlMessage
+		expected    *net.UDPAddr
+		shouldError bool
+	}{
+		{
+			msg: syscall.SocketControlMessage{
+				Header: syscall.Cmsghdr{Level: syscall.SOL_IP, Type: syscall.IP_ORIGDSTADDR},
+				Data:   []byte{2, 0, 0, 69, 10, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0},
+			},
+			expected: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 69},
+		},
+		{
+			msg: syscall.SocketControlMessage{
+				Header: syscall.Cmsghdr{Level: syscall.SOL_IPV6, Type: ipv6OrigDstAddr},
+				Data: append([]byte{10, 0, 0, 69, 0, 0, 0, 0},
+					net.ParseIP("2001:db8::5")...),
+			},
+			expected: &net.UDPAddr{IP: net.ParseIP("2001:db8::5"), Port: 69},
+		},
+		{
+			msg: syscall.SocketControlMessage{
+				Header: syscall.Cmsghdr{Level: syscall.SOL_IP, Type: syscall.IP_PKTINFO},
+				Data:   make([]byte, 12),
+			},
+			shouldError: true,
+		},
+	}
+
+	for i, tc := range testCases {
+		addr, err := origDstFromMessages([]syscall.SocketControlMessage{tc.msg})
+		if tc.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error (%d)", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		if !addr.IP.Equal(tc.expected.IP) || addr.Port != tc.expected.Port {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, addr, i)
+		}
+	}
+}
+
+func TestReadRequestOrigDst(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := enableOrigDst(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if _, err := client.WriteTo(sampleRRQ(), conn.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{Transparent: true}
+	packet := make([]byte, 512)
+	n, remoteAddr, localAddr, err := s.readRequest(conn, packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(sampleRRQ()) {
+		t.Errorf("Expected %d bytes, got %d", len(sampleRRQ()), n)
+	}
+	if remoteAddr.String() != client.LocalAddr().String() {
+		t.Errorf("Expected request from %v, got %v", client.LocalAddr(), remoteAddr)
+	}
+	if localAddr == nil || localAddr.String() != conn.LocalAddr().String() {
+		t.Errorf("Expected original destination %v, got %v", conn.LocalAddr(), localAddr)
+	}
+}
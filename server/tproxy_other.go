@@ -0,0 +1,25 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+const origDstOOBBufferSize = 0
+
+var errTransparentUnsupported = errors.New("Transparent proxying is only supported on Linux")
+
+func transparentControl(network, address string, c syscall.RawConn) error {
+	return errTransparentUnsupported
+}
+
+func enableOrigDst(conn *net.UDPConn) error {
+	return errTransparentUnsupported
+}
+
+func parseOrigDst(oob []byte) (*net.UDPAddr, error) {
+	return nil, errTransparentUnsupported
+}
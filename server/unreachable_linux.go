@@ -0,0 +1,58 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// detectUnreachable has the kernel report ICMP errors for packets sent from
+// conn, a transfer's own socket, which it otherwise only does for connected
+// sockets. Reads then fail as soon as the client is reported unreachable,
+// rather than the transfer running through every retransmit of a client that
+// has gone away.
+func detectUnreachable(conn *net.UDPConn) (net.PacketConn, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_RECVERR, 1)
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil && sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, syscall.IPV6_RECVERR, 1)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("Error setting IP_RECVERR: %v", sockErr)
+	}
+	return unreachableConn{conn}, nil
+}
+
+// unreachableConn fails reads once the peer is reported unreachable. The
+// ICMP errors that don't mean it has gone, such as fragmentation needed,
+// are skipped.
+type unreachableConn struct {
+	net.PacketConn
+}
+
+func (c unreachableConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(b)
+		var errno syscall.Errno
+		if err == nil || !errors.As(err, &errno) {
+			return n, addr, err
+		}
+		switch errno {
+		case syscall.ECONNREFUSED, syscall.EHOSTUNREACH, syscall.ENETUNREACH, syscall.EHOSTDOWN:
+			return n, addr, fmt.Errorf("Client unreachable: %w", err)
+		case syscall.EMSGSIZE, syscall.EPROTO, syscall.ENOPROTOOPT, syscall.EOPNOTSUPP, syscall.EACCES:
+			continue
+		}
+		return n, addr, err
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"bytes"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestTransferClientUnreachable(t *testing.T) {
+	testCases := []string{"127.0.0.1:0", "[::1]:0"}
+
+	for i, listen := range testCases {
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, "kernel"), bytes.Repeat([]byte("k"), 3*common.BlockSize), 0644); err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.ListenPacket("udp", listen)
+		if err != nil {
+			t.Skipf("Can't listen on %s: %v", listen, err)
+		}
+		var buf syncBuffer
+		// Without the ICMP errors the transfer would retransmit for seconds
+		s := &Server{
+			Root:              root,
+			RetransmitTimeout: 100 * time.Millisecond,
+			Retries:           50,
+			Logger:            slog.New(slog.NewJSONHandler(&buf, nil)),
+		}
+		go s.Serve(conn)
+		defer s.Close()
+
+		client := sendRequest(t, conn.LocalAddr(), common.OpRRQ, "kernel")
+		if _, _, err := client.ReadFrom(make([]byte, common.MaxPacketSize)); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+
+		deadline := time.Now().Add(2 * time.Second)
+		for len(s.Transfers()) > 0 && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n := len(s.Transfers()); n > 0 {
+			t.Errorf("Expected the transfer to end once the client was unreachable, %d still active (%d)", n, i)
+		}
+		buf.mu.Lock()
+		logged := buf.buf.String()
+		buf.mu.Unlock()
+		if !strings.Contains(logged, "Client unreachable") {
+			t.Errorf("Expected the unreachable client to be logged, got %s (%d)", logged, i)
+		}
+	}
+}
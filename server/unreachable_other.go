@@ -0,0 +1,12 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// detectUnreachable returns conn unchanged. Windows already fails reads
+// once the client is reported unreachable, and elsewhere the ICMP errors
+// aren't reported for unconnected sockets.
+func detectUnreachable(conn *net.UDPConn) (net.PacketConn, error) {
+	return conn, nil
+}
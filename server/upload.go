@@ -0,0 +1,308 @@
+package server
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// OverwritePolicy decides what happens when an upload names a file that
+// already exists.
+type OverwritePolicy int
+
+const (
+	// OverwriteAllow replaces the existing file.
+	OverwriteAllow OverwritePolicy = iota
+	// OverwriteReject refuses the upload with ERROR 6 (File already exists).
+	OverwriteReject
+	// OverwriteVersion keeps the existing file and stores the upload
+	// alongside it with the first free numeric suffix, name.1, name.2 and
+	// so on.
+	OverwriteVersion
+)
+
+var overwritePolicyNames = map[OverwritePolicy]string{
+	OverwriteAllow:   "allow",
+	OverwriteReject:  "reject",
+	OverwriteVersion: "version",
+}
+
+func (p OverwritePolicy) String() string {
+	if name, ok := overwritePolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("OverwritePolicy(%d)", int(p))
+}
+
+// ParseOverwritePolicy returns the policy named by s, one of allow, reject or
+// version.
+func ParseOverwritePolicy(s string) (OverwritePolicy, error) {
+	for p, name := range overwritePolicyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown overwrite policy %q", s)
+}
+
+// maxVersions bounds the suffixes OverwriteVersion tries before giving up.
+const maxVersions = 1000
+
+var errFileExists = &common.Error{Code: common.ErrFileExists, Message: "File already exists"}
+
+// UploadDir stores uploads in a directory on disk, with control over what
+// happens to existing files. Dir uses an UploadDir with the zero options.
+// Each upload is written to a hidden temporary file beside its final name
+// and only renamed into place once complete, so a failed upload never
+// touches the file it would have replaced.
+type UploadDir struct {
+	// Dir is the directory uploads are stored in, see Dir.
+	Dir Dir
+	// Overwrite decides what happens to existing files.
+	Overwrite OverwritePolicy
+	// CreateDirs creates any missing parent directories of an upload,
+	// rather than failing it.
+	CreateDirs bool
+	// Perm, if non-zero, is the mode uploaded files are given regardless of
+	// the process umask.
+	Perm os.FileMode
+	// Owner, if set, is the owner uploaded files are given.
+	Owner *FileOwner
+	// NoSymlinks refuses uploads to paths through a symlink, even one
+	// pointing inside Dir. Symlinks leading outside Dir are always refused.
+	NoSymlinks bool
+	// MinFreeSpace, if non-zero, refuses uploads with Disk full while the
+	// file system holding Dir has fewer bytes than this available, or would
+	// once the size announced with tsize has arrived, rather than letting
+	// them fail halfway.
+	MinFreeSpace int64
+}
+
+// FileOwner is a user and group to give uploaded files. Either ID may be -1
+// to leave it unchanged, as with os.Chown.
+type FileOwner struct {
+	UID, GID int
+}
+
+func (u UploadDir) ServeWrite(req *Request) (io.WriteCloser, error) {
+	p, err := u.Dir.resolve(req.Filename, !u.NoSymlinks)
+	if err != nil {
+		return nil, err
+	}
+	if u.CreateDirs {
+		// path has already checked p is inside the root, so are its parents
+		if err := os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+			return nil, err
+		}
+	}
+	if u.MinFreeSpace > 0 {
+		if err := u.checkFreeSpace(filepath.Dir(p), req); err != nil {
+			return nil, err
+		}
+	}
+	if req.resumeFrom > 0 {
+		w, err := u.resume(p, req)
+		if w != nil || err != nil {
+			return w, err
+		}
+	}
+	final, reserved, err := u.create(p)
+	if err != nil {
+		return nil, err
+	}
+	// The upload is written to a temporary file beside the final one and
+	// renamed over it once complete, so an existing file is only replaced
+	// by a whole upload
+	f, err := createTemp(filepath.Dir(final), "."+filepath.Base(final)+".")
+	if err != nil {
+		if reserved {
+			os.Remove(final)
+		}
+		return nil, err
+	}
+	w := &fileWriter{File: f, w: bufio.NewWriter(f), final: final, reserved: reserved}
+	if err := u.setAttributes(f); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if size, ok := req.TransferSize(); ok && size > 0 {
+		// Reserve the space up front, so a full disk fails the upload
+		// before any data is sent and the file isn't fragmented
+		w.preallocated, err = preallocate(f, size)
+		if err != nil {
+			w.Abort()
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// checkFreeSpace fails with Disk full if storing req's upload in dir would
+// leave less than MinFreeSpace available.
+func (u UploadDir) checkFreeSpace(dir string, req *Request) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return fmt.Errorf("Error checking free space: %v", err)
+	}
+	need := u.MinFreeSpace
+	if size, ok := req.TransferSize(); ok {
+		need += size
+	}
+	if free < need {
+		return fmt.Errorf("Only %d bytes free for uploads, %d needed: %w", free, need, syscall.ENOSPC)
+	}
+	return nil
+}
+
+// create returns the name an upload to p is stored under according to the
+// overwrite policy. Unless existing files are overwritten the name is
+// reserved by creating it empty, reported by reserved, so a racing upload
+// can't take it too.
+func (u UploadDir) create(p string) (final string, reserved bool, err error) {
+	if u.Overwrite == OverwriteAllow {
+		return p, false, nil
+	}
+	name := p
+	for i := 1; i <= maxVersions; i++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			if err := f.Close(); err != nil {
+				os.Remove(name)
+				return "", false, err
+			}
+			return name, true, nil
+		}
+		if !os.IsExist(err) {
+			return "", false, err
+		}
+		if u.Overwrite == OverwriteReject {
+			break
+		}
+		name = p + "." + strconv.Itoa(i)
+	}
+	return "", false, errFileExists
+}
+
+// createTemp creates a new file in dir named prefix followed by a random
+// suffix. Unlike os.CreateTemp the file is given mode 0666 less the umask,
+// as os.Create does, since it becomes the upload.
+func createTemp(dir, prefix string) (*os.File, error) {
+	for i := 0; i < 100; i++ {
+		var b [4]byte
+		rand.Read(b[:])
+		f, err := os.OpenFile(filepath.Join(dir, prefix+hex.EncodeToString(b[:])), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+	return nil, fmt.Errorf("Error creating temporary file in %s", dir)
+}
+
+// resume carries on with an upload to p from the partial file kept of an
+// earlier attempt, truncated to the offset the client asked for if it is
+// longer. It returns a nil writer if there is nothing to resume.
+func (u UploadDir) resume(p string, req *Request) (io.WriteCloser, error) {
+	partial, err := u.Dir.resolve(req.Filename+partialSuffix, !u.NoSymlinks)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(partial, os.O_WRONLY, 0)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	final, err := u.finalName(p)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	offset := min(req.resumeFrom, info.Size())
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	req.resumedAt = offset
+	return &fileWriter{File: f, w: bufio.NewWriter(f), final: final, resumed: true}, nil
+}
+
+// finalName returns the name a resumed upload to p is stored under once
+// complete, according to the overwrite policy. Unlike create the name
+// isn't reserved, so a racing upload may take it first.
+func (u UploadDir) finalName(p string) (string, error) {
+	if u.Overwrite == OverwriteAllow {
+		return p, nil
+	}
+	name := p
+	for i := 1; i <= maxVersions; i++ {
+		_, err := os.Lstat(name)
+		if os.IsNotExist(err) {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if u.Overwrite == OverwriteReject {
+			return "", errFileExists
+		}
+		name = p + "." + strconv.Itoa(i)
+	}
+	return "", errFileExists
+}
+
+// setAttributes applies the configured mode and owner to a new upload.
+func (u UploadDir) setAttributes(f *os.File) error {
+	if u.Perm != 0 {
+		if err := f.Chmod(u.Perm); err != nil {
+			return err
+		}
+	}
+	if u.Owner != nil {
+		if err := f.Chown(u.Owner.UID, u.Owner.GID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// partialSuffix is appended to the name of failed uploads kept with
+// Server.KeepPartialUploads.
+const partialSuffix = ".partial"
+
+// discardPartial disposes of a failed upload, keeping it aside if the server
+// is configured to and w supports it, and otherwise deleting it.
+func (s *Server) discardPartial(logger *slog.Logger, w io.WriteCloser) {
+	if k, ok := w.(partialKeeper); ok && (s.KeepPartialUploads || s.ResumableUploads) {
+		name, err := k.KeepPartial()
+		if err != nil {
+			logger.Error("Error keeping partial file", "err", err)
+		} else if name != "" {
+			logger.Info("Kept partial file", "path", name)
+		}
+		return
+	}
+	if err := w.(aborter).Abort(); err != nil {
+		logger.Error("Error discarding partial file", "err", err)
+		return
+	}
+	logger.Info("Removed partial file")
+}
@@ -0,0 +1,395 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestOverwritePolicy(t *testing.T) {
+	testCases := []struct {
+		policy   OverwritePolicy
+		err      error
+		expected map[string]string
+	}{
+		{
+			policy:   OverwriteAllow,
+			expected: map[string]string{"kernel": "new"},
+		},
+		{
+			policy:   OverwriteReject,
+			err:      errFileExists,
+			expected: map[string]string{"kernel": "old"},
+		},
+		{
+			policy:   OverwriteVersion,
+			expected: map[string]string{"kernel": "old", "kernel.1": "old.1", "kernel.2": "new"},
+		},
+	}
+
+	for i, tc := range testCases {
+		root := t.TempDir()
+		for _, name := range []string{"kernel", "kernel.1"} {
+			if tc.policy != OverwriteVersion && name != "kernel" {
+				continue
+			}
+			content := "old" + name[len("kernel"):]
+			if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		u := UploadDir{Dir: Dir(root), Overwrite: tc.policy}
+		w, err := u.ServeWrite(&Request{Filename: "kernel"})
+		if err != tc.err {
+			t.Errorf("Expected %v, got %v (%d)", tc.err, err, i)
+			continue
+		}
+		if err == nil {
+			w.Write([]byte("new"))
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for name, expected := range tc.expected {
+			got, err := os.ReadFile(filepath.Join(root, name))
+			if err != nil || string(got) != expected {
+				t.Errorf("Expected %s to contain %q, got %q, %v (%d)", name, expected, got, err, i)
+			}
+		}
+	}
+}
+
+func TestUploadReplacesWholeFile(t *testing.T) {
+	testCases := []struct {
+		policy   OverwritePolicy
+		end      func(w io.WriteCloser) error
+		expected map[string]string
+	}{
+		{
+			policy:   OverwriteAllow,
+			end:      io.WriteCloser.Close,
+			expected: map[string]string{"kernel": "new"},
+		},
+		{
+			policy:   OverwriteAllow,
+			end:      discard,
+			expected: map[string]string{"kernel": "old"},
+		},
+		{
+			policy: OverwriteAllow,
+			end: func(w io.WriteCloser) error {
+				_, err := w.(partialKeeper).KeepPartial()
+				return err
+			},
+			expected: map[string]string{"kernel": "old", "kernel.partial": "new"},
+		},
+		{
+			policy:   OverwriteVersion,
+			end:      discard,
+			expected: map[string]string{"kernel": "old"},
+		},
+	}
+
+	for i, tc := range testCases {
+		root := t.TempDir()
+		if err := os.WriteFile(filepath.Join(root, "kernel"), []byte("old"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		u := UploadDir{Dir: Dir(root), Overwrite: tc.policy}
+		w, err := u.ServeWrite(&Request{Filename: "kernel", Options: map[string]string{"tsize": "3"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("new"))
+		w.(*fileWriter).Flush()
+		// Until the upload ends the existing file is untouched
+		if got, err := os.ReadFile(filepath.Join(root, "kernel")); err != nil || string(got) != "old" {
+			t.Errorf("Expected %q during the upload, got %q, %v (%d)", "old", got, err, i)
+		}
+		if err := tc.end(w); err != nil {
+			t.Errorf("%v (%d)", err, i)
+		}
+
+		got := make(map[string]string)
+		entries, _ := os.ReadDir(root)
+		for _, e := range entries {
+			data, _ := os.ReadFile(filepath.Join(root, e.Name()))
+			got[e.Name()] = string(data)
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestParseOverwritePolicy(t *testing.T) {
+	for _, p := range []OverwritePolicy{OverwriteAllow, OverwriteReject, OverwriteVersion} {
+		got, err := ParseOverwritePolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("Expected %v, got %v, %v", p, got, err)
+		}
+	}
+	if _, err := ParseOverwritePolicy("clobber"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
+
+func TestUploadCreateDirs(t *testing.T) {
+	root := t.TempDir()
+	req := &Request{Filename: "backups/SN1234/config.txt"}
+
+	if _, err := (UploadDir{Dir: Dir(root)}).ServeWrite(req); !os.IsNotExist(err) {
+		t.Errorf("Expected missing directory to fail the upload, got %v", err)
+	}
+
+	w, err := UploadDir{Dir: Dir(root), CreateDirs: true}.ServeWrite(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("hostname sw1"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(filepath.Join(root, "backups", "SN1234", "config.txt"))
+	if err != nil || string(got) != "hostname sw1" {
+		t.Errorf("Unexpected upload: %q, %v", got, err)
+	}
+
+	_, err = UploadDir{Dir: Dir(root), CreateDirs: true}.ServeWrite(&Request{Filename: "../outside/x"})
+	if err != errOutsideRoot {
+		t.Errorf("Expected %v, got %v", errOutsideRoot, err)
+	}
+}
+
+func TestUploadMinFreeSpace(t *testing.T) {
+	root := t.TempDir()
+	if _, err := freeSpace(root); err != nil {
+		t.Skipf("Free space unknown: %v", err)
+	}
+	const huge = 1 << 62
+
+	testCases := []struct {
+		minFree  int64
+		options  map[string]string
+		diskFull bool
+	}{
+		{minFree: 1},
+		{minFree: 1, options: map[string]string{"tsize": "1024"}},
+		{minFree: huge, diskFull: true},
+		{minFree: 1, options: map[string]string{"tsize": strconv.FormatInt(huge, 10)}, diskFull: true},
+	}
+
+	for i, tc := range testCases {
+		name := fmt.Sprintf("upload%d", i)
+		req := &Request{OpCode: common.OpWRQ, Filename: name, Options: tc.options}
+		w, err := UploadDir{Dir: Dir(root), MinFreeSpace: tc.minFree}.ServeWrite(req)
+		if tc.diskFull {
+			if code, _ := errorPacket(err); code != common.ErrDiskFull {
+				t.Errorf("Expected Disk full, got %v (%d)", err, i)
+			}
+			if _, err := os.Stat(filepath.Join(root, name)); !os.IsNotExist(err) {
+				t.Errorf("Expected no file for a refused upload, got %v (%d)", err, i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		w.Close()
+	}
+}
+
+func TestUploadPerm(t *testing.T) {
+	root := t.TempDir()
+	for i, perm := range []os.FileMode{0600, 0644, 0640} {
+		name := fmt.Sprintf("upload%d", i)
+		w, err := UploadDir{Dir: Dir(root), Perm: perm, Owner: &FileOwner{UID: -1, GID: -1}}.ServeWrite(&Request{Filename: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+		info, err := os.Stat(filepath.Join(root, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != perm {
+			t.Errorf("Expected mode %v, got %v (%d)", perm, info.Mode().Perm(), i)
+		}
+	}
+}
+
+func TestPartialUploads(t *testing.T) {
+	testCases := []struct {
+		keep     bool
+		expected []string
+	}{
+		{keep: false, expected: nil},
+		{keep: true, expected: []string{"config.txt.partial"}},
+	}
+
+	for i, tc := range testCases {
+		root := t.TempDir()
+		s := &Server{Root: root, ReadTimeout: 50 * time.Millisecond, KeepPartialUploads: tc.keep}
+		addr, _ := startServer(t, s)
+
+		// Send the first block and then go quiet
+		conn := sendRequest(t, addr, common.OpWRQ, "config.txt")
+		buf := make([]byte, common.MaxPacketSize)
+		_, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := append([]byte{0, byte(common.OpDATA), 0, 1}, bytes.Repeat([]byte("p"), common.BlockSize)...)
+		if _, err := conn.WriteTo(data, from); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		err = s.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := os.ReadDir(root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("Expected %v, got %v (%d)", tc.expected, names, i)
+		}
+		if tc.keep {
+			if got, err := os.ReadFile(filepath.Join(root, "config.txt.partial")); err != nil || len(got) != common.BlockSize {
+				t.Errorf("Expected the first block to be kept, got %d bytes, %v (%d)", len(got), err, i)
+			}
+		}
+	}
+}
+
+func TestResumeUpload(t *testing.T) {
+	testCases := []struct {
+		resumable bool
+		partial   int
+		offset    int
+		resumedAt int
+	}{
+		{resumable: true, partial: 1500, offset: 1024, resumedAt: 1024},
+		{resumable: true, partial: 600, offset: 1024, resumedAt: 600},
+		{resumable: true, partial: -1, offset: 1024, resumedAt: 0},
+		{resumable: false, partial: 1500, offset: 1024, resumedAt: 0},
+	}
+
+	for i, tc := range testCases {
+		root := t.TempDir()
+		if tc.partial >= 0 {
+			if err := os.WriteFile(filepath.Join(root, "fw.bin.partial"), bytes.Repeat([]byte("a"), tc.partial), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		s := &Server{Root: root, ResumableUploads: tc.resumable}
+		addr, _ := startServer(t, s)
+
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		req := common.RequestPacket{
+			OpCode:   common.OpWRQ,
+			Filename: "fw.bin",
+			Mode:     common.ModeOctet,
+			Options:  map[string]string{resumeOption: strconv.Itoa(tc.offset)},
+		}
+		if _, err := conn.WriteTo(req.ToBytes(), addr); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, common.MaxPacketSize)
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resumedAt := 0
+		if options, err := common.ParseOACKPacket(buf[:n]); err == nil {
+			resumedAt, _ = strconv.Atoi(options[resumeOption])
+		} else if _, err := common.ParseAckPacket(buf[:n]); err != nil {
+			t.Fatalf("Expected OACK or ACK, got %s (%d)", common.DumpPacket(buf[:n]), i)
+		}
+		if resumedAt != tc.resumedAt {
+			t.Errorf("Expected to resume at %d, got %d (%d)", tc.resumedAt, resumedAt, i)
+		}
+
+		content := bytes.Repeat([]byte("b"), 2000)
+		if _, err := common.ReadFileLoop(bytes.NewReader(content[resumedAt:]), conn, from, common.BlockSize); err != nil {
+			t.Fatal(err)
+		}
+		expected := append(bytes.Repeat([]byte("a"), resumedAt), content[resumedAt:]...)
+		waitForFile(t, filepath.Join(root, "fw.bin"), string(expected))
+		_, err = os.Stat(filepath.Join(root, "fw.bin.partial"))
+		if tc.resumable && !os.IsNotExist(err) {
+			t.Errorf("Expected partial file to be gone, got %v (%d)", err, i)
+		}
+	}
+}
+
+func TestUploadTransferID(t *testing.T) {
+	upload := &memoryUpload{closed: make(chan string, 1), aborted: make(chan string, 1)}
+	s := &Server{WriteHandler: WriteHandlerFunc(func(req *Request) (io.WriteCloser, error) {
+		return upload, nil
+	})}
+	addr, _ := startServer(t, s)
+
+	conn := sendRequest(t, addr, common.OpWRQ, "config.txt")
+	buf := make([]byte, common.MaxPacketSize)
+	_, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Another port on the client's host can't take the upload over
+	rogue, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rogue.Close()
+	rogue.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := rogue.WriteTo([]byte{0, byte(common.OpDATA), 0, 1, 'e', 'v', 'i', 'l'}, from); err != nil {
+		t.Fatal(err)
+	}
+	n, _, err := rogue.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, err := common.ParseErrorPacket(buf[:n]); err != nil || e.Code != common.ErrUnknownTransferID {
+		t.Errorf("Expected ERROR %d for the other port, got %s", common.ErrUnknownTransferID, common.DumpPacket(buf[:n]))
+	}
+
+	if _, err := conn.WriteTo([]byte{0, byte(common.OpDATA), 0, 1, 'g', 'o', 'o', 'd'}, from); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-upload.closed:
+		if got != "good" {
+			t.Errorf("Expected %q to be stored, got %q", "good", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the upload to complete")
+	}
+}
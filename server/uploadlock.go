@@ -0,0 +1,111 @@
+package server
+
+import (
+	"fmt"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// UploadConflictPolicy decides what happens to an upload of a file another
+// client is still uploading.
+type UploadConflictPolicy int
+
+const (
+	// ConflictReject refuses the later upload with ERROR 6 (File already
+	// exists).
+	ConflictReject UploadConflictPolicy = iota
+	// ConflictWait holds the later upload until the earlier one finishes,
+	// refusing it as ConflictReject does if that takes longer than
+	// uploadWaitTimeout.
+	ConflictWait
+	// ConflictAllow lets both uploads write to the file at once, so their
+	// content may be interleaved.
+	ConflictAllow
+)
+
+var uploadConflictPolicyNames = map[UploadConflictPolicy]string{
+	ConflictReject: "reject",
+	ConflictWait:   "wait",
+	ConflictAllow:  "allow",
+}
+
+func (p UploadConflictPolicy) String() string {
+	if name, ok := uploadConflictPolicyNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("UploadConflictPolicy(%d)", int(p))
+}
+
+// ParseUploadConflictPolicy returns the policy named by s, one of reject,
+// wait or allow.
+func ParseUploadConflictPolicy(s string) (UploadConflictPolicy, error) {
+	for p, name := range uploadConflictPolicyNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("Unknown upload conflict policy %q", s)
+}
+
+// uploadWaitTimeout bounds how long ConflictWait holds an upload. Clients
+// give up on a WRQ that isn't answered after a few retransmits, so there is
+// little point waiting longer.
+const uploadWaitTimeout = 5 * time.Second
+
+var errUploadInProgress = &common.Error{Code: common.ErrFileExists, Message: "File is already being uploaded"}
+
+// uploadLocks tracks the files being uploaded, each with a channel closed
+// once its upload is over.
+type uploadLocks struct {
+	mu    sync.Mutex
+	files map[string]chan struct{}
+}
+
+// lockUpload reserves the file req uploads to according to the server's
+// ConcurrentUploads policy. Files are told apart by their requested name,
+// so uploads to the same name on different virtual hosts also conflict. The
+// returned func releases the file once the upload is over.
+func (s *Server) lockUpload(req *Request) (func(), error) {
+	if s.ConcurrentUploads == ConflictAllow {
+		return func() {}, nil
+	}
+	key := path.Clean("/" + req.Filename)
+	uploads := &s.shared().uploads
+	var timeout <-chan time.Time
+	for {
+		uploads.mu.Lock()
+		done, busy := uploads.files[key]
+		if !busy {
+			if uploads.files == nil {
+				uploads.files = make(map[string]chan struct{})
+			}
+			done = make(chan struct{})
+			uploads.files[key] = done
+			uploads.mu.Unlock()
+			return func() {
+				uploads.mu.Lock()
+				delete(uploads.files, key)
+				uploads.mu.Unlock()
+				close(done)
+			}, nil
+		}
+		uploads.mu.Unlock()
+
+		if s.ConcurrentUploads != ConflictWait {
+			return nil, errUploadInProgress
+		}
+		if timeout == nil {
+			timer := time.NewTimer(uploadWaitTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-done:
+		case <-timeout:
+			return nil, errUploadInProgress
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestConcurrentUploads(t *testing.T) {
+	testCases := []struct {
+		policy UploadConflictPolicy
+		// expected is the reply to the second upload, an ACK or ERROR
+		expected common.OpCode
+		// afterFirst is whether the reply only comes once the first upload
+		// is done
+		afterFirst bool
+	}{
+		{policy: ConflictReject, expected: common.OpERROR},
+		{policy: ConflictWait, expected: common.OpACK, afterFirst: true},
+		{policy: ConflictAllow, expected: common.OpACK},
+	}
+
+	for i, tc := range testCases {
+		s := &Server{Root: t.TempDir(), ConcurrentUploads: tc.policy}
+		addr, _ := startServer(t, s)
+
+		first := sendRequest(t, addr, common.OpWRQ, "config.txt")
+		buf := make([]byte, common.MaxPacketSize)
+		_, from, err := first.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		second := sendRequest(t, addr, common.OpWRQ, "./config.txt")
+		replies := make(chan []byte, 1)
+		go func() {
+			buf := make([]byte, common.MaxPacketSize)
+			n, _, err := second.ReadFrom(buf)
+			if err != nil {
+				close(replies)
+				return
+			}
+			replies <- buf[:n]
+		}()
+
+		var reply []byte
+		if !tc.afterFirst {
+			reply = <-replies
+		} else {
+			select {
+			case reply := <-replies:
+				t.Errorf("Expected no reply while the first upload runs, got %s (%d)", common.DumpPacket(reply), i)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		// Finish the first upload
+		if _, err := first.WriteTo([]byte{0, byte(common.OpDATA), 0, 1}, from); err != nil {
+			t.Fatal(err)
+		}
+		if tc.afterFirst {
+			reply = <-replies
+		}
+		if reply == nil {
+			t.Fatalf("No reply to the second upload (%d)", i)
+		}
+		if op, _ := common.GetOpCode(reply); op != tc.expected {
+			t.Errorf("Expected %v, got %s (%d)", tc.expected, common.DumpPacket(reply), i)
+		}
+		if tc.expected == common.OpERROR {
+			if e, _ := common.ParseErrorPacket(reply); e.Code != common.ErrFileExists {
+				t.Errorf("Expected File already exists, got %v (%d)", e, i)
+			}
+		}
+	}
+}
+
+func TestParseUploadConflictPolicy(t *testing.T) {
+	for _, p := range []UploadConflictPolicy{ConflictReject, ConflictWait, ConflictAllow} {
+		got, err := ParseUploadConflictPolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("Expected %v, got %v, %v", p, got, err)
+		}
+	}
+	if _, err := ParseUploadConflictPolicy("queue"); err == nil {
+		t.Error("Expected an error for an unknown policy")
+	}
+}
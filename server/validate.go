@@ -0,0 +1,198 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// An UploadValidator inspects a completed upload before it is stored. path
+// names a temporary file holding its content, which must not be kept once
+// ValidateUpload returns. Returning an error rejects the upload.
+type UploadValidator interface {
+	ValidateUpload(req *Request, path string) error
+}
+
+// UploadValidatorFunc adapts a function to an UploadValidator.
+type UploadValidatorFunc func(req *Request, path string) error
+
+func (f UploadValidatorFunc) ValidateUpload(req *Request, path string) error {
+	return f(req, path)
+}
+
+// CommandValidator validates uploads with an external command, such as a
+// config linter or virus scanner. The command is run with the path of the
+// upload appended to its arguments, and TFTP_CLIENT and TFTP_FILENAME set
+// in its environment. It accepts the upload by exiting with status zero.
+type CommandValidator struct {
+	// Command is the program and its leading arguments.
+	Command []string
+	// Timeout, if non-zero, kills the command and rejects the upload once
+	// it has run this long.
+	Timeout time.Duration
+}
+
+func (c CommandValidator) ValidateUpload(req *Request, path string) error {
+	if len(c.Command) == 0 {
+		return errors.New("No validator command")
+	}
+	ctx := context.Background()
+	if c.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.Timeout)
+		defer cancel()
+	}
+	args := append(append([]string(nil), c.Command[1:]...), path)
+	cmd := exec.CommandContext(ctx, c.Command[0], args...)
+	cmd.Env = append(os.Environ(),
+		"TFTP_REQUEST_ID="+req.ID,
+		"TFTP_CLIENT="+req.RemoteAddr.String(),
+		"TFTP_FILENAME="+req.Filename,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	// Don't wait for children of a killed command still holding its output
+	cmd.WaitDelay = time.Second
+	if err := cmd.Run(); err != nil {
+		if out := strings.TrimSpace(output.String()); out != "" {
+			return fmt.Errorf("%s: %v: %s", c.Command[0], err, out)
+		}
+		return fmt.Errorf("%s: %v", c.Command[0], err)
+	}
+	return nil
+}
+
+var (
+	errUploadRejected = errors.New("Upload rejected")
+	// errRejectedPacket is sent to the client when a validator's error
+	// isn't a *common.Error of its own.
+	errRejectedPacket = &common.Error{Code: common.ErrAccessViolation, Message: "Upload rejected"}
+)
+
+// validatingWriter holds an upload in a temporary file until it is
+// complete, then passes it to the server's validators. Only uploads they
+// all accept are copied to the handler's writer, others are discarded.
+type validatingWriter struct {
+	dst        io.WriteCloser
+	spool      *os.File
+	w          *bufio.Writer
+	req        *Request
+	validators []UploadValidator
+
+	validated bool
+	// rejected is the validator error refusing the upload
+	rejected error
+}
+
+// validateUploads wraps the handler's writer for req with the server's
+// validators, if there are any.
+func (s *Server) validateUploads(req *Request, dst io.WriteCloser) (io.WriteCloser, error) {
+	if len(s.UploadValidators) == 0 {
+		return dst, nil
+	}
+	spool, err := os.CreateTemp("", "tftp-upload-")
+	if err != nil {
+		discard(dst)
+		return nil, err
+	}
+	return &validatingWriter{
+		dst:        dst,
+		spool:      spool,
+		w:          bufio.NewWriter(spool),
+		req:        req,
+		validators: s.UploadValidators,
+	}, nil
+}
+
+func (v *validatingWriter) Write(p []byte) (int, error) {
+	return v.w.Write(p)
+}
+
+// Flush runs the validators once the last block has arrived, so a rejected
+// upload is refused with an ERROR in place of the final ACK.
+func (v *validatingWriter) Flush() error {
+	if err := v.w.Flush(); err != nil {
+		return err
+	}
+	if err := v.validate(); err != nil {
+		var e *common.Error
+		if errors.As(err, &e) {
+			return e
+		}
+		return errRejectedPacket
+	}
+	return nil
+}
+
+func (v *validatingWriter) validate() error {
+	if v.validated {
+		return v.rejected
+	}
+	v.validated = true
+	for _, validator := range v.validators {
+		if err := validator.ValidateUpload(v.req, v.spool.Name()); err != nil {
+			v.rejected = fmt.Errorf("%w: %w", errUploadRejected, err)
+			break
+		}
+	}
+	return v.rejected
+}
+
+// Close stores the upload if it is accepted, returning an error matching
+// errUploadRejected if it isn't.
+func (v *validatingWriter) Close() error {
+	defer v.removeSpool()
+	if err := v.w.Flush(); err != nil {
+		discard(v.dst)
+		return err
+	}
+	if err := v.validate(); err != nil {
+		discard(v.dst)
+		return err
+	}
+	if _, err := v.spool.Seek(0, io.SeekStart); err != nil {
+		discard(v.dst)
+		return err
+	}
+	if _, err := io.Copy(v.dst, v.spool); err != nil {
+		discard(v.dst)
+		return err
+	}
+	return v.dst.Close()
+}
+
+// Abort discards an upload abandoned part way.
+func (v *validatingWriter) Abort() error {
+	v.removeSpool()
+	return discard(v.dst)
+}
+
+func (v *validatingWriter) removeSpool() {
+	v.spool.Close()
+	os.Remove(v.spool.Name())
+}
+
+// uploadRejected reports whether w is validating an upload that was
+// refused.
+func uploadRejected(w io.WriteCloser) bool {
+	v, ok := w.(*validatingWriter)
+	return ok && v.rejected != nil
+}
+
+// discard abandons an upload to w, removing what was stored if w can.
+func discard(w io.WriteCloser) error {
+	if a, ok := w.(aborter); ok {
+		return a.Abort()
+	}
+	return w.Close()
+}
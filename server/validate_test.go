@@ -0,0 +1,156 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestUploadValidators(t *testing.T) {
+	closed := make(chan string, 1)
+	aborted := make(chan string, 1)
+	var buf syncBuffer
+	var validated []string
+	s := &Server{
+		WriteHandler: WriteHandlerFunc(func(req *Request) (io.WriteCloser, error) {
+			return &memoryUpload{closed: closed, aborted: aborted}, nil
+		}),
+		UploadValidators: []UploadValidator{
+			UploadValidatorFunc(func(req *Request, path string) error {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					return err
+				}
+				validated = append(validated, req.Filename)
+				if bytes.Contains(data, []byte("virus")) {
+					return errors.New("Infected")
+				}
+				return nil
+			}),
+		},
+		AccessLog: slog.New(slog.NewJSONHandler(&buf, nil)),
+	}
+	addr, _ := startServer(t, s)
+
+	good := bytes.Repeat([]byte("config "), 200)
+	if err := putFile(t, addr, "good", good); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-closed:
+		if got != string(good) {
+			t.Errorf("Expected the accepted upload to be stored, got %d bytes", len(got))
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the accepted upload to be stored")
+	}
+
+	bad := append(bytes.Repeat([]byte("config "), 200), "virus"...)
+	err := putFile(t, addr, "bad", bad)
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected an access violation for the rejected upload, got %v", err)
+	}
+	select {
+	case got := <-aborted:
+		if got != "" {
+			t.Errorf("Expected nothing of the rejected upload to be stored, got %q", got)
+		}
+	case <-closed:
+		t.Error("Expected the rejected upload to be discarded")
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected the rejected upload to be discarded")
+	}
+
+	byFile := map[string]map[string]any{}
+	for _, r := range buf.records(t, 2) {
+		byFile[r["file"].(string)] = r
+	}
+	if byFile["good"]["outcome"] != outcomeOK {
+		t.Errorf("Expected %s, got %v", outcomeOK, byFile["good"])
+	}
+	if byFile["bad"]["outcome"] != outcomeRejected || byFile["bad"]["err"] == nil {
+		t.Errorf("Expected %s with the error, got %v", outcomeRejected, byFile["bad"])
+	}
+	if len(validated) != 2 {
+		t.Errorf("Expected each upload to be validated once, got %v", validated)
+	}
+}
+
+func TestUploadValidatorKeepsOriginal(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "startup-config")
+	if err := os.WriteFile(path, []byte("hostname sw1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{
+		Root: root,
+		UploadValidators: []UploadValidator{
+			UploadValidatorFunc(func(req *Request, path string) error {
+				return errors.New("Lint failed")
+			}),
+		},
+	}
+	addr, _ := startServer(t, s)
+
+	err := putFile(t, addr, "startup-config", []byte("hostname"))
+	if e, ok := err.(*common.Error); !ok || e.Code != common.ErrAccessViolation {
+		t.Errorf("Expected an access violation for the rejected upload, got %v", err)
+	}
+	// The rejected upload is discarded after the ERROR is sent
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		entries, _ := os.ReadDir(root)
+		if len(entries) == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("Expected the rejected upload to be removed, got %v", entries)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != "hostname sw1" {
+		t.Errorf("Expected the original to be kept, got %q, %v", got, err)
+	}
+}
+
+func TestCommandValidator(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("No shell to run validators with")
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "upload")
+	if err := os.WriteFile(path, []byte("hostname switch1"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{Filename: "switch1.cfg", RemoteAddr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}}
+
+	testCases := []struct {
+		script  string
+		timeout time.Duration
+		valid   bool
+	}{
+		{script: `grep -q hostname "$1"`, valid: true},
+		{script: `grep -q virus "$1"`},
+		{script: `test "$TFTP_FILENAME" = switch1.cfg && test "$TFTP_CLIENT" = 127.0.0.1:1234`, valid: true},
+		{script: `echo bad config >&2; exit 1`},
+		{script: `sleep 5`, timeout: 50 * time.Millisecond},
+	}
+
+	for i, tc := range testCases {
+		v := CommandValidator{Command: []string{sh, "-c", tc.script, "validator"}, Timeout: tc.timeout}
+		err := v.ValidateUpload(req, path)
+		if (err == nil) != tc.valid {
+			t.Errorf("Expected valid %v, got %v (%d)", tc.valid, err, i)
+		}
+	}
+}
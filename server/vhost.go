@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sync"
+)
+
+// HostMux routes requests to handlers by the local IP they were sent to, so
+// one server listening on several addresses can serve a different tree to
+// each provisioning subnet:
+//
+//	hosts := server.NewHostMux()
+//	hosts.Handle("10.1.0.1", server.Dir("/srv/tftp/lab"))
+//	hosts.Handle("10.2.0.1", server.Dir("/srv/tftp/prod"))
+//	s := &server.Server{ReadHandler: hosts, WriteHandler: hosts}
+//
+// The local IP is known when the server listens on specific addresses, in
+// transparent mode, or on Linux when it listens on the wildcard address.
+type HostMux struct {
+	// Default serves requests whose local IP has no handler of its own, or
+	// isn't known. If nil such reads are reported as File not found and
+	// writes refused.
+	Default Handler
+
+	mu    sync.RWMutex
+	hosts map[netip.Addr]Handler
+}
+
+// NewHostMux allocates and returns a new HostMux.
+func NewHostMux() *HostMux {
+	return &HostMux{}
+}
+
+// Handle registers h for requests sent to ip. It panics if ip is invalid or
+// already registered.
+func (m *HostMux) Handle(ip string, h Handler) {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		panic(fmt.Sprintf("tftp: invalid host IP %q: %v", ip, err))
+	}
+	addr = addr.Unmap()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.hosts[addr]; ok {
+		panic(fmt.Sprintf("tftp: multiple registrations for %s", ip))
+	}
+	if m.hosts == nil {
+		m.hosts = make(map[netip.Addr]Handler)
+	}
+	m.hosts[addr] = h
+}
+
+// handler returns the handler for req, or nil.
+func (m *HostMux) handler(req *Request) Handler {
+	if ip, ok := addrIP(req.LocalAddr); ok {
+		m.mu.RLock()
+		h, ok := m.hosts[ip]
+		m.mu.RUnlock()
+		if ok {
+			return h
+		}
+	}
+	return m.Default
+}
+
+func (m *HostMux) ServeRead(req *Request) (io.ReadCloser, int64, error) {
+	h := m.handler(req)
+	if h == nil {
+		return nil, 0, os.ErrNotExist
+	}
+	return h.ServeRead(req)
+}
+
+func (m *HostMux) ServeWrite(req *Request) (io.WriteCloser, error) {
+	h := m.handler(req)
+	if h == nil {
+		return nil, errWriteNotAllowed
+	}
+	return h.ServeWrite(req)
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net"
+	"testing"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+func TestHostMux(t *testing.T) {
+	hosts := NewHostMux()
+	hosts.Handle("127.0.0.1", namedHandler("lab"))
+	hosts.Handle("127.0.0.2", namedHandler("prod"))
+	s := &Server{ReadHandler: hosts}
+
+	lab, _ := startServer(t, s)
+	conn, err := net.ListenPacket("udp", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Can't listen on a second loopback address: %v", err)
+	}
+	go s.Serve(conn)
+	prod := conn.LocalAddr()
+	wildcard, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(wildcard)
+	other := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: wildcard.LocalAddr().(*net.UDPAddr).Port}
+
+	// The local IP of requests to a wildcard listener is only known where
+	// the kernel reports it
+	wildcardExpected := ""
+	if pktInfoSupported {
+		wildcardExpected = "lab"
+	}
+
+	testCases := []struct {
+		addr     net.Addr
+		expected string
+	}{
+		{addr: lab, expected: "lab"},
+		{addr: prod, expected: "prod"},
+		{addr: other, expected: wildcardExpected},
+	}
+	for i, tc := range testCases {
+		got, err := getFile(t, tc.addr, "kernel")
+		if tc.expected == "" {
+			if e, ok := err.(*common.Error); !ok || e.Code != common.ErrFileNotFound {
+				t.Errorf("Expected File not found, got %v (%d)", err, i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v (%d)", err, i)
+			continue
+		}
+		if string(got) != tc.expected {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+	}
+
+	withDefault := &HostMux{Default: namedHandler("default")}
+	addr, _ := startServer(t, &Server{ReadHandler: withDefault})
+	if got, err := getFile(t, addr, "kernel"); err != nil || string(got) != "default" {
+		t.Errorf("Expected the default handler, got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"log/slog"
+	"net"
+	"sync"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+const (
+	// maxViolationHosts is how many hosts violations are counted for
+	// separately, so a flood of spoofed addresses can't exhaust memory.
+	maxViolationHosts = 1000
+	// otherHosts is the host violations are counted under once there are
+	// maxViolationHosts.
+	otherHosts = "other"
+)
+
+// violationRegistry tallies the protocol violations seen from each peer over
+// the life of the server, whether on the listener or during a transfer.
+type violationRegistry struct {
+	mu     sync.Mutex
+	counts common.ViolationCounts
+}
+
+func (r *violationRegistry) record(from net.Addr, v common.Violation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.add(common.HostOf(from), v, 1)
+}
+
+func (r *violationRegistry) merge(counts common.ViolationCounts) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for host, kinds := range counts {
+		for v, n := range kinds {
+			r.add(host, v, n)
+		}
+	}
+}
+
+// add counts n violations of kind v from host, or from otherHosts once
+// maxViolationHosts have been seen. r.mu must be held.
+func (r *violationRegistry) add(host string, v common.Violation, n int) {
+	if r.counts == nil {
+		r.counts = common.ViolationCounts{}
+	}
+	kinds, ok := r.counts[host]
+	if !ok {
+		if len(r.counts) >= maxViolationHosts {
+			host = otherHosts
+			kinds = r.counts[host]
+		}
+		if kinds == nil {
+			kinds = make(map[common.Violation]int)
+			r.counts[host] = kinds
+		}
+	}
+	kinds[v] += n
+}
+
+// snapshot returns a copy of the counts that is safe to read without locking.
+func (r *violationRegistry) snapshot() common.ViolationCounts {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	counts := common.ViolationCounts{}
+	counts.Merge(r.counts)
+	return counts
+}
+
+// byName returns the counts with the violations named, for publishing as
+// JSON.
+func (r *violationRegistry) byName() map[string]map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	named := make(map[string]map[string]int, len(r.counts))
+	for host, kinds := range r.counts {
+		named[host] = make(map[string]int, len(kinds))
+		for v, n := range kinds {
+			named[host][v.String()] = n
+		}
+	}
+	return named
+}
+
+// recordTransferViolations adds the violations seen during a transfer to the
+// registry and logs them.
+func (s *Server) recordTransferViolations(logger *slog.Logger, stats common.TransferStats) {
+	if len(stats.Violations) == 0 {
+		return
+	}
+	s.violations.merge(stats.Violations)
+	logger.Warn("Protocol violations during transfer", "violations", stats.Violations.String())
+}
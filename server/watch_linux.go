@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// watchMask selects the inotify events meaning a file's content may have
+// changed, or a directory appeared that needs watching too.
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM |
+	syscall.IN_DELETE | syscall.IN_CREATE
+
+// dirWatcher watches every directory under root with inotify, calling
+// changed with the / separated name, relative to root, of each file or
+// directory that is written, replaced, moved or removed. It is called with
+// "" when events were lost, so anything may have changed.
+type dirWatcher struct {
+	root    string
+	f       *os.File
+	changed func(name string)
+
+	mu   sync.Mutex
+	dirs map[int32]string // by watch descriptor
+	done chan struct{}
+}
+
+func watchDir(root string, changed func(name string)) (io.Closer, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	// Non-blocking, so reads go through the poller and Close interrupts
+	// them
+	w := &dirWatcher{
+		root:    root,
+		f:       os.NewFile(uintptr(fd), "inotify"),
+		changed: changed,
+		dirs:    make(map[int32]string),
+		done:    make(chan struct{}),
+	}
+	if err := w.addTree(""); err != nil {
+		w.f.Close()
+		return nil, err
+	}
+	go w.run()
+	return w, nil
+}
+
+// addTree watches dir, relative to root, and every directory below it.
+func (w *dirWatcher) addTree(dir string) error {
+	return filepath.WalkDir(filepath.Join(w.root, filepath.FromSlash(dir)), func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Gone already, its removal is reported as an event
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(w.root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			rel = ""
+		}
+		// Through Control, which keeps Close from releasing the descriptor
+		// meanwhile
+		var wd int
+		rc, err := w.f.SyscallConn()
+		if err != nil {
+			return err
+		}
+		if ctlErr := rc.Control(func(fd uintptr) {
+			wd, err = syscall.InotifyAddWatch(int(fd), p, watchMask)
+		}); ctlErr != nil {
+			return ctlErr
+		}
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+		w.mu.Lock()
+		w.dirs[int32(wd)] = filepath.ToSlash(rel)
+		w.mu.Unlock()
+		return nil
+	})
+}
+
+func (w *dirWatcher) run() {
+	defer close(w.done)
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			return
+		}
+		for b := buf[:n]; len(b) >= syscall.SizeofInotifyEvent; {
+			wd := int32(binary.NativeEndian.Uint32(b[0:]))
+			mask := binary.NativeEndian.Uint32(b[4:])
+			nameLen := int(binary.NativeEndian.Uint32(b[12:]))
+			end := min(syscall.SizeofInotifyEvent+nameLen, len(b))
+			name := string(trimNUL(b[syscall.SizeofInotifyEvent:end]))
+			b = b[end:]
+			w.handle(wd, mask, name)
+		}
+	}
+}
+
+func (w *dirWatcher) handle(wd int32, mask uint32, name string) {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		w.changed("")
+		return
+	}
+	w.mu.Lock()
+	dir, ok := w.dirs[wd]
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+	}
+	w.mu.Unlock()
+	if !ok || name == "" {
+		return
+	}
+	rel := path.Join(dir, name)
+	if mask&syscall.IN_ISDIR != 0 && mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+		// Failing leaves changes below it unseen until they expire
+		w.addTree(rel)
+	}
+	if mask&syscall.IN_CREATE != 0 && mask&syscall.IN_ISDIR == 0 {
+		// Its content arrives with IN_CLOSE_WRITE
+		return
+	}
+	w.changed(rel)
+}
+
+// Close stops watching, waiting for any call to changed to return.
+func (w *dirWatcher) Close() error {
+	err := w.f.Close()
+	<-w.done
+	return err
+}
+
+func trimNUL(b []byte) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	return b
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestWatchDir(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Mkdir(filepath.Join(root, "images"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	changes := make(chan string, 16)
+	w, err := watchDir(root, func(name string) { changes <- name })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	testCases := []struct {
+		change   func() error
+		expected []string
+	}{
+		{change: func() error { return os.WriteFile(filepath.Join(root, "kernel"), []byte("v1"), 0644) }, expected: []string{"kernel"}},
+		{change: func() error { return os.WriteFile(filepath.Join(root, "images/a.img"), []byte("a"), 0644) }, expected: []string{"images/a.img"}},
+		{change: func() error { return os.WriteFile(filepath.Join(root, "kernel.tmp"), []byte("v2"), 0644) }, expected: []string{"kernel.tmp"}},
+		{
+			change:   func() error { return os.Rename(filepath.Join(root, "kernel.tmp"), filepath.Join(root, "kernel")) },
+			expected: []string{"kernel.tmp", "kernel"},
+		},
+		{change: func() error { return os.Remove(filepath.Join(root, "images/a.img")) }, expected: []string{"images/a.img"}},
+		{change: func() error { return os.Mkdir(filepath.Join(root, "new"), 0755) }, expected: []string{"new"}},
+		// Directories appearing are watched too
+		{change: func() error { return os.WriteFile(filepath.Join(root, "new/b.img"), []byte("b"), 0644) }, expected: []string{"new/b.img"}},
+	}
+	for i, tc := range testCases {
+		if err := tc.change(); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for len(got) < len(tc.expected) {
+			select {
+			case name := <-changes:
+				got = append(got, name)
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Expected %q, got %q (%d)", tc.expected, got, i)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("Expected %q, got %q (%d)", tc.expected, got, i)
+		}
+	}
+}
+
+func TestCachedBackendWatch(t *testing.T) {
+	root := t.TempDir()
+	for name, content := range map[string]string{"kernel": "v1", "initrd": "i1"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c := NewCachedBackend(Dir(root), 1024)
+	if _, err := c.Preload("kernel"); err != nil {
+		t.Fatal(err)
+	}
+	if got := readCached(t, c, "initrd"); got != "i1" {
+		t.Fatalf("Expected i1, got %q", got)
+	}
+	w, err := c.Watch()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	for name, content := range map[string]string{"kernel": "v2", "initrd": "i2"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		c.mu.Lock()
+		kernel, kernelOK := c.lookup("kernel")
+		_, initrdOK := c.lookup("initrd")
+		c.mu.Unlock()
+		// The preloaded kernel is read again, initrd left for the next
+		// request
+		if kernelOK && string(kernel) == "v2" && !initrdOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected kernel reloaded and initrd dropped, got %q, %v and %v", kernel, kernelOK, initrdOK)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := readCached(t, c, "initrd"); got != "i2" {
+		t.Errorf("Expected i2, got %q", got)
+	}
+}
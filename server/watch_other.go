@@ -0,0 +1,14 @@
+//go:build !linux
+
+package server
+
+import (
+	"errors"
+	"io"
+)
+
+var errWatchUnsupported = errors.New("Watching for changes is only supported on Linux")
+
+func watchDir(root string, changed func(name string)) (io.Closer, error) {
+	return nil, errWatchUnsupported
+}
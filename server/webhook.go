@@ -0,0 +1,117 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/ryanslade/tftp/common"
+)
+
+// Webhook events.
+const (
+	WebhookStart   = "start"
+	WebhookSuccess = "success"
+	WebhookFailure = "failure"
+)
+
+// webhookTimeout bounds each delivery when the Webhook has no Client.
+const webhookTimeout = 10 * time.Second
+
+var defaultWebhookClient = &http.Client{Timeout: webhookTimeout}
+
+// A Webhook POSTs a WebhookEvent as JSON to URL when a transfer starts,
+// succeeds or fails. Deliveries are made in the background, so may arrive
+// out of order, and are not retried; failures are logged.
+type Webhook struct {
+	URL string
+	// Events lists the events to send, all of them if empty.
+	Events []string
+	// Client makes the requests. If nil a client with a 10 second timeout
+	// is used.
+	Client *http.Client
+}
+
+// WebhookEvent is the body of a webhook request. A transfer starts once the
+// file has been opened, so a request that fails before then only sends a
+// failure event.
+type WebhookEvent struct {
+	Event     string    `json:"event"`
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Client    string    `json:"client"`
+	Op        string    `json:"op"`
+	File      string    `json:"file"`
+	Bytes     int64     `json:"bytes"`
+	// Duration is the length of the transfer in milliseconds.
+	Duration int64  `json:"duration_ms"`
+	Error    string `json:"error,omitempty"`
+	// Metadata is what the request filters attached to the transfer.
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (h *Webhook) wants(event string) bool {
+	return len(h.Events) == 0 || slices.Contains(h.Events, event)
+}
+
+func (h *Webhook) send(e WebhookEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	client := h.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	resp, err := client.Post(h.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected status: %s", resp.Status)
+	}
+	return nil
+}
+
+// notify sends event for req to every webhook that wants it.
+func (s *Server) notify(event string, req *Request, stats common.TransferStats, err error) {
+	e := WebhookEvent{
+		Event:     event,
+		Time:      time.Now().UTC(),
+		RequestID: req.ID,
+		Client:    common.HostOf(req.RemoteAddr),
+		Op:        req.OpCode.String(),
+		File:      req.Filename,
+		Bytes:     stats.Bytes,
+		Duration:  stats.Duration.Milliseconds(),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if md := req.Metadata.All(); len(md) > 0 {
+		e.Metadata = md
+	}
+	for _, h := range s.Webhooks {
+		if !h.wants(event) {
+			continue
+		}
+		go func(h *Webhook) {
+			if err := h.send(e); err != nil {
+				s.requestLogger(req).Warn("Error sending webhook", "url", h.URL, "event", event, "err", err)
+			}
+		}(h)
+	}
+}
+
+// notifyEnd sends the success or failure event for a finished transfer.
+func (s *Server) notifyEnd(req *Request, stats common.TransferStats, err error) {
+	if err != nil {
+		s.notify(WebhookFailure, req, stats, err)
+		return
+	}
+	s.notify(WebhookSuccess, req, stats, nil)
+}
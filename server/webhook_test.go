@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhooks(t *testing.T) {
+	events := make(chan WebhookEvent, 10)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var e WebhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			t.Errorf("Invalid webhook body: %v", err)
+		}
+		events <- e
+	}))
+	defer hook.Close()
+
+	s := &Server{
+		ReadHandler: ReadHandlerFunc(func(req *Request) (io.ReadCloser, int64, error) {
+			if req.Filename != "installer" {
+				return nil, 0, os.ErrNotExist
+			}
+			return io.NopCloser(strings.NewReader(strings.Repeat("i", 1000))), 1000, nil
+		}),
+		Webhooks: []*Webhook{
+			{URL: hook.URL},
+			{URL: hook.URL, Events: []string{WebhookSuccess}},
+		},
+		Filters: []RequestFilter{func(req *Request) error {
+			req.Metadata.Set("asset", "rack4")
+			return nil
+		}},
+	}
+	addr, _ := startServer(t, s)
+
+	if _, err := getFile(t, addr, "installer"); err != nil {
+		t.Fatal(err)
+	}
+	getFile(t, addr, "missing")
+
+	var got []string
+	for len(got) < 4 {
+		select {
+		case e := <-events:
+			if e.Client != "127.0.0.1" || e.Op != "RRQ" || e.Metadata["asset"] != "rack4" {
+				t.Errorf("Unexpected event %+v", e)
+			}
+			if e.Event == WebhookSuccess && e.Bytes != 1000 {
+				t.Errorf("Expected 1000 bytes, got %+v", e)
+			}
+			if e.Event == WebhookFailure && e.Error == "" {
+				t.Errorf("Expected an error, got %+v", e)
+			}
+			got = append(got, e.File+" "+e.Event)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected 4 events, got %q", got)
+		}
+	}
+	sort.Strings(got)
+	expected := []string{"installer start", "installer success", "installer success", "missing failure"}
+	if strings.Join(got, ",") != strings.Join(expected, ",") {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}